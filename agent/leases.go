@@ -0,0 +1,105 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/romana/core/common/client"
+	"github.com/romana/core/common/log/trace"
+
+	log "github.com/romana/rlog"
+	"github.com/vishvananda/netlink"
+)
+
+// How often to renew leases of addresses of endpoints on the host.
+const leaseRenewalInterval = time.Minute
+
+// StartLeaseRenewal periodically renews leases of addresses of endpoints
+// on the host, so that romanad can release addresses left behind by
+// endpoints that are gone. Each agent renews leases on its own host only,
+// and nothing else renews them periodically.
+func StartLeaseRenewal(ctx context.Context, romanaClient *client.Client, hostname string) error {
+	if romanaClient == nil || ctx == nil || hostname == "" {
+		return fmt.Errorf("error client/context or hostname empty")
+	}
+
+	go func() {
+		ticker := time.NewTicker(leaseRenewalInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				renewLeases(romanaClient, hostname)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func renewLeases(romanaClient *client.Client, hostname string) {
+	ips, err := LocalEndpointIPs()
+	if err != nil {
+		// Nothing is reported, as reporting no endpoints
+		// would get their addresses released.
+		log.Errorf("Error listing endpoints to renew address leases: %s", err)
+		return
+	}
+	log.Tracef(trace.Inside, "Renewing address leases of %d endpoint addresses on %s", len(ips), hostname)
+	err = romanaClient.IPAM.RenewLeasesByIP(hostname, ips)
+	if err != nil {
+		log.Errorf("Error renewing address leases on %s: %s", hostname, err)
+	}
+}
+
+// LocalEndpointIPs returns addresses of endpoints on the host, which
+// are the destinations of the routes to them via the host side of
+// their veth interfaces, as set up by the CNI plugin.
+func LocalEndpointIPs() ([]net.IP, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("error listing links: %s", err)
+	}
+
+	var ips []net.IP
+	for _, link := range links {
+		if link.Type() != "veth" {
+			continue
+		}
+		routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("error listing routes via link (%s): %s",
+				link.Attrs().Name, err)
+		}
+		for _, r := range routes {
+			if r.Dst == nil {
+				continue
+			}
+			ones, bits := r.Dst.Mask.Size()
+			if ones == bits {
+				ips = append(ips, r.Dst.IP)
+			}
+		}
+	}
+
+	return ips, nil
+}
@@ -16,14 +16,14 @@ import (
 )
 
 func Run(ctx context.Context, key string, client *client.Client, storage policycache.Interface) (<-chan api.Policy, error) {
-	policies, err := client.Store.GetExt(key, store.GetOptions{Recursive: true})
+	policies, LastIndex, err := client.Store.ListTreeExt(key)
 	if err != nil {
 		return nil, errors.Wrap(err, "controller init fail")
 	}
 
-	for _, val := range policies.GetResponse().Node.Nodes {
+	for _, val := range policies {
 		var policy api.Policy
-		err := json.Unmarshal([]byte(val.Value), &policy)
+		err := json.Unmarshal(val.Value, &policy)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to unmarshal policy")
 		}
@@ -31,8 +31,10 @@ func Run(ctx context.Context, key string, client *client.Client, storage policyc
 		storage.Put(val.Key, policy)
 	}
 
+	// Watch from the index policies were listed at, so that no change
+	// is missed; if the watch is lost, it resumes after the last change.
 	respCh, err := client.Store.WatchExt(
-		key, store.WatcherOptions{Recursive: true, NoList: true}, ctx.Done())
+		key, store.WatcherOptions{Recursive: true, NoList: true, AfterIndex: LastIndex}, ctx.Done())
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to start watching")
 	}
@@ -47,18 +49,15 @@ func Run(ctx context.Context, key string, client *client.Client, storage policyc
 	}
 
 	policyOut := make(chan api.Policy)
-	var LastIndex uint64
 	go func() {
 		var err error
 		for {
 			if err != nil {
-				respCh, err = client.Store.WatchExt(
-					key,
-					store.WatcherOptions{Recursive: true,
-						NoList:     true,
-						AfterIndex: LastIndex,
-					},
-					ctx.Done())
+				var changed []api.Policy
+				respCh, LastIndex, changed, err = reconnect(ctx, key, client, storage, LastIndex)
+				for _, p := range changed {
+					policyOut <- p
+				}
 			}
 			if err != nil {
 				log.Printf("failed to reconnect policy watcher %s", err)
@@ -72,6 +71,7 @@ func Run(ctx context.Context, key string, client *client.Client, storage policyc
 			case resp, ok := <-respCh:
 				if !ok {
 					err = fmt.Errorf("channel closed")
+					continue
 				}
 
 				LastIndex = resp.LastIndex
@@ -96,3 +96,46 @@ func Run(ctx context.Context, key string, client *client.Client, storage policyc
 
 	return policyOut, nil
 }
+
+// reconnect watches policies under the key again, after the index.
+// If changes after it were compacted, they may have been missed, so
+// policies in the storage are replaced with those listed now, and the
+// policies put or deleted are returned, along with the index they
+// were listed at.
+func reconnect(ctx context.Context, key string, c *client.Client, storage policycache.Interface, index uint64) (<-chan *store.KVPairExt, uint64, []api.Policy, error) {
+	respCh, err := c.Store.WatchExt(
+		key, store.WatcherOptions{Recursive: true, NoList: true, AfterIndex: index}, ctx.Done())
+	if err != client.ErrCompacted {
+		return respCh, index, nil, err
+	}
+
+	log.Printf("policy changes after index %d were compacted, listing policies again", index)
+	kvps, listIndex, err := c.Store.ListTreeExt(key)
+	if err != nil {
+		return nil, index, nil, errors.Wrap(err, "failed to list policies")
+	}
+	changed := make([]api.Policy, 0)
+	listed := make(map[string]bool)
+	for _, val := range kvps {
+		var policy api.Policy
+		if err := json.Unmarshal(val.Value, &policy); err != nil {
+			log.Printf("failed to unmarshal policy %s, err=%s", val.Value, err)
+			continue
+		}
+		listed[val.Key] = true
+		storage.Put(val.Key, policy)
+		changed = append(changed, policy)
+	}
+	for _, k := range storage.Keys() {
+		if listed[k] {
+			continue
+		}
+		if policy, ok := storage.Get(k); ok {
+			changed = append(changed, policy)
+		}
+		storage.Delete(k)
+	}
+	respCh, err = c.Store.WatchExt(
+		key, store.WatcherOptions{Recursive: true, NoList: true, AfterIndex: listIndex}, ctx.Done())
+	return respCh, listIndex, changed, err
+}
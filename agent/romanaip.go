@@ -21,11 +21,12 @@ import (
 	"errors"
 	"fmt"
 	"syscall"
+	"time"
 
 	"github.com/romana/core/common/api"
 	"github.com/romana/core/common/client"
 
-	"github.com/docker/libkv/store"
+	libkvStore "github.com/docker/libkv/store"
 	log "github.com/romana/rlog"
 	"github.com/vishvananda/netlink"
 )
@@ -87,7 +88,7 @@ func GetIPs(link netlink.Link) ([]string, error) {
 	return addresses, nil
 }
 
-func linkAddDeleteIP(kvpair *store.KVPairExt, toAdd bool,
+func linkAddDeleteIP(kvpair *libkvStore.KVPairExt, toAdd bool,
 	defaultLink netlink.Link, defaultLinkAddressList []string) error {
 	var value string
 	var IPAddressOnThisNode bool
@@ -138,7 +139,7 @@ func linkAddDeleteIP(kvpair *store.KVPairExt, toAdd bool,
 	return netlink.AddrDel(defaultLink, ipAddress)
 }
 
-func StartRomanaIPSync(ctx context.Context, store *client.Store,
+func StartRomanaIPSync(ctx context.Context, store client.Store,
 	defaultLink netlink.Link) error {
 	var err error
 
@@ -159,23 +160,51 @@ func StartRomanaIPSync(ctx context.Context, store *client.Store,
 	return nil
 }
 
-func romanaIPWatcher(ctx context.Context, store *client.Store,
+func romanaIPWatcher(ctx context.Context, store client.Store,
 	defaultLink netlink.Link, defaultLinkAddressList []string) {
 
-	// TODO: event stream could be broken it store connection is
-	// broken so add support for re-watching the events stream here.
-	events, err := store.WatchTreeExt(client.DefaultEtcdPrefix+client.RomanaIPPrefix,
-		ctx.Done())
-	if err != nil {
-		log.Error("Error watching kvstore romanaIP keys.")
-		return
-	}
-
+	key := client.DefaultEtcdPrefix + client.RomanaIPPrefix
+	var events <-chan *libkvStore.KVPairExt
+	var lastIndex uint64
 	for {
+		if events == nil {
+			// The event stream is broken if the store connection
+			// is, so it is re-established after the last event seen.
+			var err error
+			events, err = store.WatchExt(key,
+				libkvStore.WatcherOptions{Recursive: true, NoList: true, AfterIndex: lastIndex},
+				ctx.Done())
+			if err == client.ErrCompacted {
+				// Changes since were lost, so current romanaIPs
+				// are sent again, as "get" actions.
+				log.Warnf("Changes of kvstore romanaIP keys after index %d were compacted, listing them again", lastIndex)
+				lastIndex = 0
+				events, err = store.WatchExt(key,
+					libkvStore.WatcherOptions{Recursive: true},
+					ctx.Done())
+			}
+			if err != nil {
+				log.Errorf("Error watching kvstore romanaIP keys: %s", err)
+				select {
+				case <-time.After(time.Second):
+					continue
+				case <-ctx.Done():
+					log.Printf("\nStopping romanaIP watcher module.\n")
+					return
+				}
+			}
+		}
+
 		select {
-		case pair := <-events:
+		case pair, ok := <-events:
+			if !ok {
+				log.Infof("Lost watch on kvstore romanaIP keys, resuming after index %d", lastIndex)
+				events = nil
+				continue
+			}
+			lastIndex = pair.LastIndex
 			switch pair.Action {
-			case "create", "set", "update", "compareAndSwap":
+			case "create", "set", "update", "compareAndSwap", "get":
 				log.Debugf("creating/updating romanaIP: %#v\n", pair)
 				err := linkAddDeleteIP(pair, true, defaultLink, defaultLinkAddressList)
 				if err != nil {
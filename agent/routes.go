@@ -71,17 +71,26 @@ type nlHandleRoute interface {
 // createRouteToBlock creates ip route for given block->host pair in Romana routing table,
 // the function will fail if requested block is not directly adjacent and multihop false.
 func createRouteToBlock(block api.IPAMBlockResponse, host *api.Host, romanaRouteTableId int, multihop bool, nlHandle nlHandleRoute) error {
-	testRoutes, err := nlHandle.RouteGet(host.IP)
+	// IPv6 blocks are routed via the IPv6 address of the host.
+	hostIP := host.IP
+	if block.CIDR.IP.To4() == nil {
+		if host.IPv6 == nil {
+			return errors.New(fmt.Sprintf("host %s has no IPv6 address to route block %s", host.Name, block.CIDR))
+		}
+		hostIP = host.IPv6
+	}
+
+	testRoutes, err := nlHandle.RouteGet(hostIP)
 	if err != nil {
-		return errors.Wrapf(err, "couldn't test host %s adjacency", host.IP)
+		return errors.Wrapf(err, "couldn't test host %s adjacency", hostIP)
 	}
 
 	if len(testRoutes) > 1 {
-		return errors.New(fmt.Sprintf("more then one path available for host %s, multipath not currently supported", host.IP))
+		return errors.New(fmt.Sprintf("more then one path available for host %s, multipath not currently supported", hostIP))
 	}
 
 	if len(testRoutes) == 0 {
-		return errors.New(fmt.Sprintf("no way to reach %s, no default gateway?", host.IP))
+		return errors.New(fmt.Sprintf("no way to reach %s, no default gateway?", hostIP))
 	}
 
 	if testRoutes[0].Gw != nil && multihop == false {
@@ -90,7 +99,7 @@ func createRouteToBlock(block api.IPAMBlockResponse, host *api.Host, romanaRoute
 
 	route := netlink.Route{
 		Dst:   &block.CIDR.IPNet,
-		Gw:    host.IP,
+		Gw:    hostIP,
 		Table: romanaRouteTableId,
 	}
 
@@ -16,6 +16,7 @@
 package agent
 
 import (
+	"fmt"
 	"net"
 	"strings"
 	"testing"
@@ -42,6 +43,10 @@ func TestCreateRouteToBlock(t *testing.T) {
 	testBlock := api.IPAMBlockResponse{
 		CIDR: api.IPNet{IPNet: *ipnet},
 	}
+	_, ipnet6, _ := net.ParseCIDR("2001:db8::/120")
+	testBlockIPv6 := api.IPAMBlockResponse{
+		CIDR: api.IPNet{IPNet: *ipnet6},
+	}
 
 	cases := []struct {
 		name, message string
@@ -105,6 +110,24 @@ func TestCreateRouteToBlock(t *testing.T) {
 			testHandle: testHandle{re: nil, rg: []netlink.Route{netlink.Route{Gw: nil}}},
 			expect:     func(err error) bool { return err == nil },
 		},
+		{
+			name:       "detect error when host has no IPv6 address for IPv6 block",
+			message:    "failed to detect missing IPv6 address of the host",
+			block:      testBlockIPv6,
+			host:       &api.Host{IP: net.ParseIP("192.168.99.20")},
+			multihop:   false,
+			testHandle: testHandle{re: nil, rg: []netlink.Route{netlink.Route{Gw: nil}}},
+			expect:     func(err error) bool { return err != nil && strings.Contains(err.Error(), "no IPv6 address") },
+		},
+		{
+			name:       "confirm success for IPv6 block",
+			message:    "failed confirm success for IPv6 block",
+			block:      testBlockIPv6,
+			host:       &api.Host{IP: net.ParseIP("192.168.99.20"), IPv6: net.ParseIP("2001:db8:1::20")},
+			multihop:   false,
+			testHandle: testHandle{re: nil, rg: []netlink.Route{netlink.Route{Gw: nil}}},
+			expect:     func(err error) bool { return err == nil },
+		},
 	}
 
 	for _, tc := range cases {
@@ -116,3 +139,36 @@ func TestCreateRouteToBlock(t *testing.T) {
 		})
 	}
 }
+
+type recordingHandle struct {
+	testHandle
+	added *[]string
+}
+
+func (h recordingHandle) RouteAdd(r *netlink.Route) error {
+	*h.added = append(*h.added, r.Dst.String())
+	return h.re
+}
+
+func TestCreateRouteToBlocksOfMixedSizes(t *testing.T) {
+	blocks := make([]api.IPAMBlockResponse, 0)
+	for _, cidr := range []string{"10.0.0.0/30", "10.0.0.8/29", "10.0.0.4/30", "10.0.0.32/28"} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		blocks = append(blocks, api.IPAMBlockResponse{
+			CIDR: api.IPNet{IPNet: *ipnet},
+			Host: "host2",
+		})
+	}
+	hosts := IpamHosts{api.Host{Name: "host2", IP: net.ParseIP("192.168.99.20")}}
+	added := make([]string, 0)
+	handle := recordingHandle{
+		testHandle: testHandle{rg: []netlink.Route{netlink.Route{Gw: nil}}},
+		added:      &added,
+	}
+	CreateRouteToBlocks(blocks, hosts, 10, "host1", false, handle)
+
+	expected := "[10.0.0.0/30 10.0.0.8/29 10.0.0.4/30 10.0.0.32/28]"
+	if got := fmt.Sprint(added); got != expected {
+		t.Fatalf("Expected routes to %s, got %s", expected, got)
+	}
+}
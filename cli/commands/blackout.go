@@ -0,0 +1,196 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+
+	"github.com/romana/core/cli/util"
+	"github.com/romana/core/common/api"
+
+	"github.com/go-resty/resty"
+	cli "github.com/spf13/cobra"
+	config "github.com/spf13/viper"
+)
+
+var (
+	blackoutReason  string
+	blackoutCreator string
+	blackoutExpires string
+)
+
+var networkBlackoutCmd = &cli.Command{
+	Use:   "blackout [list|add|remove]",
+	Short: "Manage CIDRs excluded from address allocation.",
+	Long: `Manage CIDRs excluded from address allocation.
+
+blackout requires a subcommand, e.g. ` + "`romana network blackout list`." + `
+`,
+}
+
+func init() {
+	networkCmd.AddCommand(networkBlackoutCmd)
+	networkBlackoutCmd.AddCommand(networkBlackoutListCmd)
+	networkBlackoutCmd.AddCommand(networkBlackoutAddCmd)
+	networkBlackoutCmd.AddCommand(networkBlackoutRemoveCmd)
+
+	networkBlackoutAddCmd.Flags().StringVarP(&blackoutReason, "reason", "r",
+		"", "Reason for the blackout.")
+	networkBlackoutAddCmd.Flags().StringVarP(&blackoutCreator, "creator", "c",
+		"", "Creator of the blackout, current user by default.")
+	networkBlackoutAddCmd.Flags().StringVarP(&blackoutExpires, "expires", "e",
+		"", "When the blackout is lifted, as a duration (e.g. 24h) or RFC3339 time.")
+}
+
+var networkBlackoutListCmd = &cli.Command{
+	Use:          "list",
+	Short:        "List blacked out CIDRs.",
+	Long:         `List blacked out CIDRs of all networks.`,
+	RunE:         networkBlackoutList,
+	SilenceUsage: true,
+}
+
+var networkBlackoutAddCmd = &cli.Command{
+	Use:   "add [cidr]",
+	Short: "Black out a CIDR.",
+	Long: `Black out a CIDR, so that no addresses are allocated from it.
+The CIDR must not contain allocated addresses. With --expires,
+the blackout is lifted automatically.`,
+	RunE:         networkBlackoutAdd,
+	SilenceUsage: true,
+}
+
+var networkBlackoutRemoveCmd = &cli.Command{
+	Use:          "remove [cidr]",
+	Short:        "Lift the blackout of a CIDR.",
+	Long:         `Lift the blackout of a CIDR.`,
+	RunE:         networkBlackoutRemove,
+	SilenceUsage: true,
+}
+
+func networkBlackoutList(cmd *cli.Command, args []string) error {
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().Get(rootURL + "/blackouts")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if config.GetString("Format") == "json" {
+		JSONFormat(resp.Body(), os.Stdout)
+		return nil
+	}
+	var blackouts []api.IPAMBlackout
+	err = json.Unmarshal(resp.Body(), &blackouts)
+	if err != nil {
+		return err
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "Network\t",
+		"CIDR\t",
+		"Reason\t",
+		"Creator\t",
+		"Created\t",
+		"Expires\t",
+	)
+	for _, b := range blackouts {
+		created := ""
+		if !b.Created.IsZero() {
+			created = b.Created.Format(time.RFC3339)
+		}
+		expires := "never"
+		if b.Expires != nil {
+			expires = b.Expires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s \t %s \t %s \t %s \t %s \t %s \t\n",
+			b.Network, b.CIDR, b.Reason, b.Creator, created, expires)
+	}
+	w.Flush()
+	return nil
+}
+
+func networkBlackoutAdd(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "CIDR expected.")
+	}
+	blackout := api.IPAMBlackout{
+		CIDR:    args[0],
+		Reason:  blackoutReason,
+		Creator: blackoutCreator,
+	}
+	if blackout.Creator == "" {
+		if u, err := user.Current(); err == nil {
+			blackout.Creator = u.Username
+		}
+	}
+	if blackoutExpires != "" {
+		expires, err := parseExpiry(blackoutExpires)
+		if err != nil {
+			return util.UsageError(cmd, err.Error())
+		}
+		blackout.Expires = &expires
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetBody(blackout).Post(rootURL + "/blackouts")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	fmt.Printf("Blacked out %s\n", args[0])
+	return nil
+}
+
+func networkBlackoutRemove(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "CIDR expected.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetQueryParam("cidr", args[0]).Delete(rootURL + "/blackouts")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	fmt.Printf("Lifted blackout of %s\n", args[0])
+	return nil
+}
+
+// parseExpiry parses expiry given either as a duration
+// from now or as RFC3339 time.
+func parseExpiry(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid expiry %s, expected a duration or RFC3339 time", s)
+	}
+	return t, nil
+}
@@ -18,10 +18,13 @@ package commands
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"text/tabwriter"
 
+	"github.com/romana/core/cli/util"
 	"github.com/romana/core/common/api"
 
 	"github.com/go-resty/resty"
@@ -29,9 +32,18 @@ import (
 	config "github.com/spf13/viper"
 )
 
+var (
+	hostRemoveForce bool
+
+	hostUpdateIP        string
+	hostUpdateIPv6      string
+	hostUpdateAgentPort int
+	hostUpdateTags      []string
+)
+
 // hostCmd represents the host commands
 var hostCmd = &cli.Command{
-	Use:   "host [add|show|list|remove]",
+	Use:   "host [add|show|list|update|remove|cordon|uncordon|drain]",
 	Short: "Add, Remove or Show hosts for romana services.",
 	Long: `Add, Remove or Show hosts for romana services.
 
@@ -45,7 +57,22 @@ func init() {
 	hostCmd.AddCommand(hostAddCmd)
 	hostCmd.AddCommand(hostShowCmd)
 	hostCmd.AddCommand(hostListCmd)
+	hostCmd.AddCommand(hostUpdateCmd)
 	hostCmd.AddCommand(hostRemoveCmd)
+	hostCmd.AddCommand(hostCordonCmd)
+	hostCmd.AddCommand(hostUncordonCmd)
+	hostCmd.AddCommand(hostDrainCmd)
+
+	hostRemoveCmd.Flags().BoolVarP(&hostRemoveForce, "force", "f",
+		false, "Release addresses still allocated on the host.")
+	hostUpdateCmd.Flags().StringVar(&hostUpdateIP, "ip",
+		"", "New IP address of the host.")
+	hostUpdateCmd.Flags().StringVar(&hostUpdateIPv6, "ipv6",
+		"", "New IPv6 address of the host.")
+	hostUpdateCmd.Flags().IntVar(&hostUpdateAgentPort, "agent-port",
+		0, "New port of romana agent on the host.")
+	hostUpdateCmd.Flags().StringSliceVar(&hostUpdateTags, "tag",
+		nil, "Tag of the host as key=value, replacing all tags; may be repeated.")
 }
 
 var hostAddCmd = &cli.Command{
@@ -72,14 +99,56 @@ var hostListCmd = &cli.Command{
 	SilenceUsage: true,
 }
 
+var hostUpdateCmd = &cli.Command{
+	Use:   "update [hostname]",
+	Short: "Update IP, agent port or tags of a host.",
+	Long: `Update IP, agent port or tags of a host, keeping its blocks.
+Only attributes given are updated.
+
+If the host is no longer eligible for its group with the new tags, it
+is moved to a group it is eligible for; this is refused if the host
+has allocated blocks.`,
+	RunE:         hostUpdate,
+	SilenceUsage: true,
+}
+
 var hostRemoveCmd = &cli.Command{
-	Use:          "remove [hostip]",
-	Short:        "Remove a host.",
-	Long:         `Remove a host.`,
+	Use:   "remove [hostname]",
+	Short: "Remove a host.",
+	Long: `Remove a host, returning its blocks for reuse.
+
+If the host still has allocated addresses, it is not removed
+unless --force is given, in which case the addresses are released.`,
 	RunE:         hostRemove,
 	SilenceUsage: true,
 }
 
+var hostCordonCmd = &cli.Command{
+	Use:   "cordon [hostname]",
+	Short: "Stop assigning new blocks to a host.",
+	Long: `Stop assigning new blocks to a host. Addresses can still be
+allocated in blocks the host already has.`,
+	RunE:         hostCordon,
+	SilenceUsage: true,
+}
+
+var hostUncordonCmd = &cli.Command{
+	Use:          "uncordon [hostname]",
+	Short:        "Allow assigning new blocks to a host again.",
+	Long:         `Allow assigning new blocks to a host again.`,
+	RunE:         hostUncordon,
+	SilenceUsage: true,
+}
+
+var hostDrainCmd = &cli.Command{
+	Use:   "drain [hostname]",
+	Short: "Cordon a host and list addresses that must move off it.",
+	Long: `Cordon a host and list addresses still allocated on it, which
+must be moved before the host can be removed without --force.`,
+	RunE:         hostDrain,
+	SilenceUsage: true,
+}
+
 func hostAdd(cmd *cli.Command, args []string) error {
 	fmt.Println("Unimplemented: Add host/s.")
 	return nil
@@ -130,7 +199,151 @@ func hostList(cmd *cli.Command, args []string) error {
 	return nil
 }
 
+func hostUpdate(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "Host name expected.")
+	}
+
+	update := api.Host{}
+	if hostUpdateIP != "" {
+		update.IP = net.ParseIP(hostUpdateIP)
+		if update.IP == nil {
+			return util.UsageError(cmd, fmt.Sprintf("Invalid IP address %s.", hostUpdateIP))
+		}
+	}
+	if hostUpdateIPv6 != "" {
+		update.IPv6 = net.ParseIP(hostUpdateIPv6)
+		if update.IPv6 == nil {
+			return util.UsageError(cmd, fmt.Sprintf("Invalid IPv6 address %s.", hostUpdateIPv6))
+		}
+	}
+	if hostUpdateAgentPort < 0 || hostUpdateAgentPort > 65535 {
+		return util.UsageError(cmd, fmt.Sprintf("Invalid agent port %d.", hostUpdateAgentPort))
+	}
+	update.AgentPort = uint(hostUpdateAgentPort)
+	if len(hostUpdateTags) > 0 {
+		update.Tags = make(map[string]string)
+		for _, tag := range hostUpdateTags {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return util.UsageError(cmd, fmt.Sprintf("Invalid tag %s, key=value expected.", tag))
+			}
+			update.Tags[kv[0]] = kv[1]
+		}
+	}
+	if update.IP == nil && update.IPv6 == nil && update.AgentPort == 0 && update.Tags == nil {
+		return util.UsageError(cmd, "Nothing to update.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetBody(update).Patch(rootURL + "/hosts/" + args[0])
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	if config.GetString("Format") == "json" {
+		JSONFormat(resp.Body(), os.Stdout)
+		return nil
+	}
+	fmt.Printf("Host %s updated\n", args[0])
+	return nil
+}
+
 func hostRemove(cmd *cli.Command, args []string) error {
-	fmt.Println("Unimplemented: Remove a host.")
+	if len(args) != 1 {
+		return util.UsageError(cmd, "Host name expected.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetQueryParam("force", fmt.Sprintf("%t", hostRemoveForce)).
+		Delete(rootURL + "/hosts/" + args[0])
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	fmt.Printf("Host %s removed\n", args[0])
+	return nil
+}
+
+func hostCordon(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "Host name expected.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().Post(rootURL + "/hosts/" + args[0] + "/cordon")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	fmt.Printf("Host %s cordoned\n", args[0])
+	return nil
+}
+
+func hostUncordon(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "Host name expected.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().Delete(rootURL + "/hosts/" + args[0] + "/cordon")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	fmt.Printf("Host %s uncordoned\n", args[0])
+	return nil
+}
+
+func hostDrain(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "Host name expected.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().Post(rootURL + "/hosts/" + args[0] + "/drain")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if config.GetString("Format") == "json" {
+		JSONFormat(resp.Body(), os.Stdout)
+		return nil
+	}
+	drain := api.HostDrainResponse{}
+	err = json.Unmarshal(resp.Body(), &drain)
+	if err != nil {
+		return err
+	}
+	if len(drain.Addresses) == 0 {
+		fmt.Printf("Host %s is cordoned and has no addresses left, it can be removed\n", args[0])
+		return nil
+	}
+	fmt.Printf("Host %s is cordoned, addresses that must be moved:\n", args[0])
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "Name\t",
+		"IP\t",
+		"IPv6\t",
+	)
+	for _, addr := range drain.Addresses {
+		ipv6 := ""
+		if addr.IPv6 != nil {
+			ipv6 = addr.IPv6.String()
+		}
+		fmt.Fprintf(w, "%s \t %s \t %s \t\n", addr.Name, addr.IP, ipv6)
+	}
+	w.Flush()
 	return nil
 }
@@ -0,0 +1,462 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/romana/core/cli/util"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+
+	"github.com/go-resty/resty"
+	cli "github.com/spf13/cobra"
+	config "github.com/spf13/viper"
+)
+
+var (
+	snapshotRestoreConfirmed bool
+	checkRepair              bool
+
+	batchHost    string
+	batchTenant  string
+	batchSegment string
+	batchCount   int
+	batchPrefix  string
+)
+
+// ipamCmd represents the ipam commands
+var ipamCmd = &cli.Command{
+	Use:   "ipam [snapshot|check|whois|allocate|release]",
+	Short: "Manage IPAM state of romana services.",
+	Long: `Manage IPAM state of romana services.
+
+ipam requires a subcommand, e.g. ` + "`romana ipam snapshot save`." + `
+
+For more information, please check http://romana.io
+`,
+}
+
+var ipamSnapshotCmd = &cli.Command{
+	Use:   "snapshot [save|restore]",
+	Short: "Save or restore snapshots of IPAM state.",
+	Long: `Save or restore snapshots of IPAM state.
+
+snapshot requires a subcommand, e.g. ` + "`romana ipam snapshot save`." + `
+`,
+}
+
+func init() {
+	ipamCmd.AddCommand(ipamSnapshotCmd)
+	ipamCmd.AddCommand(ipamCheckCmd)
+	ipamCmd.AddCommand(ipamWhoisCmd)
+	ipamCmd.AddCommand(ipamAllocateCmd)
+	ipamCmd.AddCommand(ipamReleaseCmd)
+	ipamSnapshotCmd.AddCommand(ipamSnapshotSaveCmd)
+	ipamSnapshotCmd.AddCommand(ipamSnapshotRestoreCmd)
+
+	ipamSnapshotRestoreCmd.Flags().BoolVarP(&snapshotRestoreConfirmed, "yes", "y",
+		false, "Overwrite existing allocations without asking for confirmation.")
+	ipamCheckCmd.Flags().BoolVarP(&checkRepair, "repair", "",
+		false, "Repair inconsistencies that can be safely repaired.")
+
+	ipamAllocateCmd.Flags().StringVarP(&batchHost, "host", "", "", "Host to allocate addresses on.")
+	ipamAllocateCmd.Flags().StringVarP(&batchTenant, "tenant", "t", "", "Tenant to allocate addresses for.")
+	ipamAllocateCmd.Flags().StringVarP(&batchSegment, "segment", "s", "", "Segment to allocate addresses for.")
+	ipamAllocateCmd.Flags().IntVarP(&batchCount, "count", "n", 0, "Number of addresses to allocate, named with --prefix.")
+	ipamAllocateCmd.Flags().StringVarP(&batchPrefix, "prefix", "p", "", "Prefix of names of addresses allocated with --count.")
+	ipamReleaseCmd.Flags().StringVarP(&batchHost, "host", "", "", "Release addresses on the host.")
+	ipamReleaseCmd.Flags().StringVarP(&batchTenant, "tenant", "t", "", "Release addresses of the tenant.")
+	ipamReleaseCmd.Flags().StringVarP(&batchSegment, "segment", "s", "", "Release addresses of the segment.")
+}
+
+var ipamSnapshotSaveCmd = &cli.Command{
+	Use:          "save [file]",
+	Short:        "Save a snapshot of IPAM state.",
+	Long:         `Save a snapshot of IPAM state into the file, or to standard output if no file is given.`,
+	RunE:         ipamSnapshotSave,
+	SilenceUsage: true,
+}
+
+var ipamSnapshotRestoreCmd = &cli.Command{
+	Use:   "restore [file]",
+	Short: "Restore IPAM state from a snapshot.",
+	Long: `Restore IPAM state from a snapshot in the file, or from standard input
+if no file is given.
+
+The snapshot is checked for version compatibility and consistency before
+it is restored. If any addresses are currently allocated, restoring
+requires confirmation, which can be given in advance with --yes.`,
+	RunE:         ipamSnapshotRestore,
+	SilenceUsage: true,
+}
+
+var ipamCheckCmd = &cli.Command{
+	Use:   "check",
+	Short: "Check consistency of IPAM state.",
+	Long: `Check consistency of IPAM state, and list inconsistencies found.
+
+With --repair, inconsistencies that can be safely repaired are repaired.`,
+	RunE:         ipamCheck,
+	SilenceUsage: true,
+}
+
+var ipamWhoisCmd = &cli.Command{
+	Use:   "whois <ip|cidr>",
+	Short: "Show who holds an address.",
+	Long: `Show the name, block, host and tenant/segment owner of an address,
+and whether it is blacked out. If a CIDR is given, all allocated
+addresses in it are shown.`,
+	RunE:         ipamWhois,
+	SilenceUsage: true,
+}
+
+var ipamAllocateCmd = &cli.Command{
+	Use:   "allocate --host <host> [--tenant <tenant>] [--segment <segment>] [name...|--count <n> --prefix <prefix>]",
+	Short: "Allocate addresses in a batch.",
+	Long: `Allocate addresses for all the names given on the host, for the
+tenant and segment. With --count, names are made up of the prefix
+followed by a number, starting from 1.
+
+Addresses are allocated together, so if any of them cannot be
+allocated, none is.`,
+	RunE:         ipamAllocate,
+	SilenceUsage: true,
+}
+
+var ipamReleaseCmd = &cli.Command{
+	Use:   "release [name...|--tenant <tenant>] [--segment <segment>] [--host <host>]",
+	Short: "Release addresses in a batch.",
+	Long: `Release addresses with the names (or IPs) given, or, if none are
+given, all addresses of the tenant, segment and host.
+
+Addresses are released together, so if any of the named addresses
+is not allocated, none is released.`,
+	RunE:         ipamRelease,
+	SilenceUsage: true,
+}
+
+// responseError returns the error reported by romana services in
+// the response.
+func responseError(resp *resty.Response) error {
+	var httpErr common.HttpError
+	err := json.Unmarshal(resp.Body(), &httpErr)
+	if err != nil || httpErr.StatusCode == 0 {
+		return fmt.Errorf("Error: %s: %s", resp.Status(), string(resp.Body()))
+	}
+	return fmt.Errorf("Error %d: %v", httpErr.StatusCode, httpErr.Details)
+}
+
+// ipamSnapshotSave saves a snapshot of IPAM state.
+func ipamSnapshotSave(cmd *cli.Command, args []string) error {
+	if len(args) > 1 {
+		return util.UsageError(cmd, "At most one file name expected.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().Get(rootURL + "/ipam/snapshot")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if len(args) == 0 {
+		JSONFormat(resp.Body(), os.Stdout)
+		return nil
+	}
+	err = ioutil.WriteFile(args[0], resp.Body(), 0600)
+	if err != nil {
+		return fmt.Errorf("File error: %s", err)
+	}
+	snapshot := api.IPAMSnapshot{}
+	err = json.Unmarshal(resp.Body(), &snapshot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved snapshot of IPAM (allocation revision %d, topology revision %d) to %s\n",
+		snapshot.AllocationRevision, snapshot.TopologyRevision, args[0])
+	return nil
+}
+
+// ipamSnapshotRestore restores IPAM state from a snapshot. If
+// restoring would overwrite allocations, the user is asked for
+// confirmation unless --yes was given.
+func ipamSnapshotRestore(cmd *cli.Command, args []string) error {
+	var buf []byte
+	var err error
+	if len(args) == 0 {
+		buf, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("Cannot read 'STDIN': %s", err)
+		}
+	} else if len(args) == 1 {
+		buf, err = ioutil.ReadFile(args[0])
+		if err != nil {
+			return fmt.Errorf("File error: %s", err)
+		}
+	} else {
+		return util.UsageError(cmd, "At most one file name expected.")
+	}
+
+	snapshot := api.IPAMSnapshot{}
+	err = json.Unmarshal(buf, &snapshot)
+	if err != nil {
+		return fmt.Errorf("Cannot parse snapshot: %s", err)
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetBody(snapshot).
+		SetQueryParam("confirm", fmt.Sprintf("%t", snapshotRestoreConfirmed)).
+		Post(rootURL + "/ipam/snapshot")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusConflict {
+		if len(args) == 0 {
+			return fmt.Errorf("%s\nUse --yes to confirm when reading the snapshot from 'STDIN'.", responseError(resp))
+		}
+		fmt.Printf("%s\nOverwrite current IPAM state? [y/N]: ", responseError(resp))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("Snapshot not restored.")
+			return nil
+		}
+		resp, err = resty.R().SetBody(snapshot).
+			SetQueryParam("confirm", "true").
+			Post(rootURL + "/ipam/snapshot")
+		if err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	fmt.Printf("Restored IPAM from snapshot created at %s\n", snapshot.Created)
+	return nil
+}
+
+// ipamCheck checks consistency of IPAM state, and optionally
+// repairs it.
+func ipamCheck(cmd *cli.Command, args []string) error {
+	if len(args) > 0 {
+		return util.UsageError(cmd, "IPAM check takes no arguments.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	var resp *resty.Response
+	var err error
+	if checkRepair {
+		resp, err = resty.R().Post(rootURL + "/ipam/check")
+	} else {
+		resp, err = resty.R().Get(rootURL + "/ipam/check")
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if config.GetString("Format") == "json" {
+		JSONFormat(resp.Body(), os.Stdout)
+		return nil
+	}
+	result := api.IPAMCheckResponse{}
+	err = json.Unmarshal(resp.Body(), &result)
+	if err != nil {
+		return err
+	}
+	if len(result.Findings) == 0 {
+		fmt.Printf("No inconsistencies found (allocation revision %d)\n", result.AllocationRevision)
+		return nil
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "Kind\t",
+		"Network\t",
+		"Block\t",
+		"Repairable\t",
+		"Repaired\t",
+		"Message\t",
+	)
+	for _, f := range result.Findings {
+		fmt.Fprintf(w, "%s \t %s \t %s \t %t \t %t \t %s \t\n",
+			f.Kind, f.Network, f.Block, f.Repairable, f.Repaired, f.Message)
+	}
+	w.Flush()
+	return nil
+}
+
+// ipamWhois shows who holds an address, or the allocated
+// addresses in a CIDR.
+func ipamWhois(cmd *cli.Command, args []string) error {
+	if len(args) != 1 {
+		return util.UsageError(cmd, "IP address or CIDR expected.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetQueryParam("ip", args[0]).Get(rootURL + "/address")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if config.GetString("Format") == "json" {
+		JSONFormat(resp.Body(), os.Stdout)
+		return nil
+	}
+	var infos []api.IPAMAddressInfo
+	err = json.Unmarshal(resp.Body(), &infos)
+	if err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		fmt.Printf("No addresses allocated in %s\n", args[0])
+		return nil
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "IP\t",
+		"Name\t",
+		"Network\t",
+		"Block\t",
+		"Host\t",
+		"Tenant\t",
+		"Segment\t",
+		"Allocated\t",
+		"Blacked Out By\t",
+	)
+	for _, info := range infos {
+		host := info.Host
+		if info.HostAddress {
+			host += " (host address)"
+		}
+		fmt.Fprintf(w, "%s \t %s \t %s \t %s \t %s \t %s \t %s \t %t \t %s \t\n",
+			info.IP, info.Name, info.Network, info.Block, host,
+			info.Tenant, info.Segment, info.Allocated, info.BlackedOutBy)
+	}
+	w.Flush()
+	return nil
+}
+
+// ipamAllocate allocates addresses in a batch.
+func ipamAllocate(cmd *cli.Command, args []string) error {
+	if batchHost == "" {
+		return util.UsageError(cmd, "Host required.")
+	}
+	names := args
+	if batchCount > 0 {
+		if len(args) > 0 {
+			return util.UsageError(cmd, "Either names or --count expected, not both.")
+		}
+		if batchPrefix == "" {
+			return util.UsageError(cmd, "Prefix required with --count.")
+		}
+		names = make([]string, batchCount)
+		for i := range names {
+			names[i] = fmt.Sprintf("%s%d", batchPrefix, i+1)
+		}
+	}
+	if len(names) == 0 {
+		return util.UsageError(cmd, "Names or --count expected.")
+	}
+
+	req := api.IPAMBatchAddressRequest{
+		Names:   names,
+		Host:    batchHost,
+		Tenant:  batchTenant,
+		Segment: batchSegment,
+	}
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetBody(req).Post(rootURL + "/address/batch")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	return printBatchAddresses(resp, "Allocated")
+}
+
+// ipamRelease releases addresses in a batch.
+func ipamRelease(cmd *cli.Command, args []string) error {
+	if len(args) > 0 && (batchTenant != "" || batchSegment != "" || batchHost != "") {
+		return util.UsageError(cmd, "Either names or --tenant, --segment and --host expected, not both.")
+	}
+	if len(args) == 0 && batchTenant == "" && batchSegment == "" && batchHost == "" {
+		return util.UsageError(cmd, "Names, or at least one of --tenant, --segment and --host expected.")
+	}
+
+	req := api.IPAMBatchReleaseRequest{
+		Names:   args,
+		Tenant:  batchTenant,
+		Segment: batchSegment,
+		Host:    batchHost,
+	}
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetBody(req).Post(rootURL + "/address/batch/release")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	return printBatchAddresses(resp, "Released")
+}
+
+// printBatchAddresses prints addresses allocated or released in a batch.
+func printBatchAddresses(resp *resty.Response, verb string) error {
+	if config.GetString("Format") == "json" {
+		JSONFormat(resp.Body(), os.Stdout)
+		return nil
+	}
+	result := api.IPAMBatchAddressResponse{}
+	err := json.Unmarshal(resp.Body(), &result)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %d addresses\n", verb, len(result.Addresses))
+	if len(result.Addresses) == 0 {
+		return nil
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintln(w, "Name\t",
+		"IP\t",
+		"IPv6\t",
+	)
+	for _, addr := range result.Addresses {
+		ipv6 := ""
+		if addr.IPv6 != nil {
+			ipv6 = addr.IPv6.String()
+		}
+		fmt.Fprintf(w, "%s \t %s \t %s \t\n", addr.Name, addr.IP, ipv6)
+	}
+	w.Flush()
+	return nil
+}
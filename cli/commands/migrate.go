@@ -0,0 +1,99 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/romana/core/cli/util"
+	"github.com/romana/core/common/api"
+
+	"github.com/go-resty/resty"
+	cli "github.com/spf13/cobra"
+	config "github.com/spf13/viper"
+)
+
+var migrateDryRun bool
+
+// migrateCmd runs migrations of data in the store.
+var migrateCmd = &cli.Command{
+	Use:   "migrate",
+	Short: "Migrate data in the store to the current schema.",
+	Long: `Run migrations pending for data Romana keeps in the store, bringing
+its schema to the version of the running romanad.
+
+Use --dry-run to see what the migrations would change first.
+
+For more information, please check http://romana.io
+`,
+	RunE:         migrate,
+	SilenceUsage: true,
+}
+
+func init() {
+	migrateCmd.Flags().BoolVarP(&migrateDryRun, "dry-run", "",
+		false, "Show what the migrations would change without running them.")
+}
+
+// migrate runs pending migrations, or shows them with --dry-run.
+func migrate(cmd *cli.Command, args []string) error {
+	if len(args) > 0 {
+		return util.UsageError(cmd, "migrate takes no arguments.")
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().
+		SetQueryParam("dry_run", fmt.Sprint(migrateDryRun)).
+		Post(rootURL + "/migrations")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if config.GetString("Format") == "json" {
+		JSONFormat(resp.Body(), os.Stdout)
+		return nil
+	}
+	result := api.MigrationResult{}
+	err = json.Unmarshal(resp.Body(), &result)
+	if err != nil {
+		return err
+	}
+	if len(result.Steps) == 0 {
+		fmt.Printf("Schema is at version %d, no migrations pending\n", result.FromVersion)
+		return nil
+	}
+	if result.DryRun {
+		fmt.Printf("Migrations from schema version %d to %d (dry run):\n", result.FromVersion, result.ToVersion)
+	} else {
+		fmt.Printf("Migrated from schema version %d to %d:\n", result.FromVersion, result.ToVersion)
+	}
+	for _, step := range result.Steps {
+		fmt.Printf("%d: %s\n", step.Version, step.Description)
+		if len(step.Changes) == 0 {
+			fmt.Println("  no changes")
+		}
+		for _, change := range step.Changes {
+			fmt.Printf("  %s\n", change)
+		}
+	}
+	return nil
+}
@@ -31,7 +31,7 @@ import (
 
 // networkCmd represents the network commands
 var networkCmd = &cli.Command{
-	Use:   "network [add|show|list|remove]",
+	Use:   "network [add|show|list|remove|blackout]",
 	Short: "Add, Remove or Show networks for romana services.",
 	Long: `Add, Remove or Show networks for romana services.
 
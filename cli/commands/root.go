@@ -84,6 +84,9 @@ func init() {
 	RootCmd.AddCommand(policyCmd)
 	RootCmd.AddCommand(networkCmd)
 	RootCmd.AddCommand(blockCmd)
+	RootCmd.AddCommand(ipamCmd)
+	RootCmd.AddCommand(topologyCmd)
+	RootCmd.AddCommand(migrateCmd)
 
 	RootCmd.Flags().BoolVarP(&version, "version", "",
 		false, "Build and Versioning Information.")
@@ -0,0 +1,182 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/romana/core/cli/util"
+	"github.com/romana/core/common/api"
+
+	"github.com/go-resty/resty"
+	cli "github.com/spf13/cobra"
+	config "github.com/spf13/viper"
+)
+
+// topologyCmd represents the topology commands
+var topologyCmd = &cli.Command{
+	Use:   "topology [plan|apply]",
+	Short: "Plan and apply changes of topology.",
+	Long: `Plan and apply changes of topology.
+
+topology requires a subcommand, e.g. ` + "`romana topology plan`." + `
+
+For more information, please check http://romana.io
+`,
+}
+
+func init() {
+	topologyCmd.AddCommand(topologyPlanCmd)
+	topologyCmd.AddCommand(topologyApplyCmd)
+}
+
+var topologyPlanCmd = &cli.Command{
+	Use:   "plan [file]",
+	Short: "Show how a topology would change the current one.",
+	Long: `Show how the topology in the file, or from standard input if no
+file is given, would change the current topology, without applying it.
+
+The topology is validated the same way as when it is applied, including
+whether existing allocations fit into it.`,
+	RunE:         topologyPlan,
+	SilenceUsage: true,
+}
+
+var topologyApplyCmd = &cli.Command{
+	Use:   "apply [file]",
+	Short: "Apply a topology.",
+	Long: `Replace the current topology with the one in the file, or from
+standard input if no file is given. Use ` + "`romana topology plan`" + ` to
+review the changes first.`,
+	RunE:         topologyApply,
+	SilenceUsage: true,
+}
+
+// readTopology reads the topology update request from the file
+// given, or from standard input.
+func readTopology(cmd *cli.Command, args []string) (api.TopologyUpdateRequest, error) {
+	var buf []byte
+	var err error
+	req := api.TopologyUpdateRequest{}
+	if len(args) == 0 {
+		buf, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return req, fmt.Errorf("Cannot read 'STDIN': %s", err)
+		}
+	} else if len(args) == 1 {
+		buf, err = ioutil.ReadFile(args[0])
+		if err != nil {
+			return req, fmt.Errorf("File error: %s", err)
+		}
+	} else {
+		return req, util.UsageError(cmd, "At most one file name expected.")
+	}
+	err = json.Unmarshal(buf, &req)
+	if err != nil {
+		return req, fmt.Errorf("Cannot parse topology: %s", err)
+	}
+	return req, nil
+}
+
+// topologyPlan shows the changes the topology would make.
+func topologyPlan(cmd *cli.Command, args []string) error {
+	req, err := readTopology(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetBody(req).
+		SetQueryParam("dry_run", "true").
+		Post(rootURL + "/topology")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if config.GetString("Format") == "json" {
+		JSONFormat(resp.Body(), os.Stdout)
+		return nil
+	}
+	plan := api.TopologyPlan{}
+	err = json.Unmarshal(resp.Body(), &plan)
+	if err != nil {
+		return err
+	}
+	if len(plan.Changes) == 0 {
+		fmt.Printf("No changes to topology (revision %d)\n", plan.TopologyRevision)
+		return nil
+	}
+	fmt.Printf("Changes to topology (revision %d):\n", plan.TopologyRevision)
+	for _, change := range plan.Changes {
+		fmt.Println(formatTopologyChange(change))
+	}
+	return nil
+}
+
+// formatTopologyChange describes the change in one line, marked
+// with +, - or ~ for additions, removals and other changes.
+func formatTopologyChange(change api.TopologyChange) string {
+	mark := "~"
+	switch {
+	case strings.HasSuffix(change.Kind, "-added"):
+		mark = "+"
+	case strings.HasSuffix(change.Kind, "-removed"):
+		mark = "-"
+	}
+	var what string
+	switch {
+	case change.Host != "":
+		what = fmt.Sprintf("host %s in network %s", change.Host, change.Network)
+	case change.Group != "":
+		what = fmt.Sprintf("group %s in network %s", change.Group, change.Network)
+	default:
+		what = fmt.Sprintf("network %s", change.Network)
+	}
+	switch mark {
+	case "+":
+		return fmt.Sprintf("%s %s: %s", mark, what, change.New)
+	case "-":
+		return fmt.Sprintf("%s %s: %s", mark, what, change.Old)
+	}
+	return fmt.Sprintf("%s %s: %s -> %s", mark, what, change.Old, change.New)
+}
+
+// topologyApply replaces the current topology.
+func topologyApply(cmd *cli.Command, args []string) error {
+	req, err := readTopology(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	rootURL := config.GetString("RootURL")
+	resp, err := resty.R().SetBody(req).Post(rootURL + "/topology")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return responseError(resp)
+	}
+	fmt.Println("Topology applied")
+	return nil
+}
@@ -56,6 +56,12 @@ func main() {
 
 	etcdEndpoints := flag.String("endpoints", "", "csv list of etcd endpoints to romana storage")
 	etcdPrefix := flag.String("prefix", "", "string that prefixes all romana keys in etcd")
+	etcdAPIVersion := flag.Int("etcd-api", client.EtcdAPIv2, "version of etcd API to use, 2 or 3")
+	etcdCertFile := flag.String("etcd-cert", "", "client certificate file for etcd tls")
+	etcdKeyFile := flag.String("etcd-key", "", "client key file for etcd tls")
+	etcdCAFile := flag.String("etcd-cacert", "", "ca bundle to verify etcd with")
+	etcdUsername := flag.String("etcd-username", "", "username for etcd authentication")
+	etcdPassword := flag.String("etcd-password", "", "password for etcd authentication")
 	hostname := flag.String("hostname", "", "name of the host in romana database")
 	provisionIface := flag.Bool("provision-iface", false, "create romana-gw interface and ip")
 	provisionIfaceGwIp := flag.String("provision-iface-gw-ip", DefaultGwIP, "specifies ip address for gateway interface")
@@ -65,6 +71,7 @@ func main() {
 	multihop := flag.Bool("multihop-blocks", false, "allows multihop blocks")
 	policyEnforcer := flag.Bool("policy", false, "enable romana policies")
 	metricsPort := flag.Int("metrics", 9607, "tcp port to expose prometheus metrics, -1 means disable")
+	renewLeases := flag.Bool("renew-leases", true, "periodically renew leases of addresses of endpoints on the host")
 	flag.Parse()
 
 	fmt.Println(common.BuildInfo())
@@ -75,8 +82,14 @@ func main() {
 	}
 
 	romanaConfig := common.Config{
-		EtcdEndpoints: strings.Split(*etcdEndpoints, ","),
-		EtcdPrefix:    *etcdPrefix,
+		EtcdEndpoints:  strings.Split(*etcdEndpoints, ","),
+		EtcdPrefix:     *etcdPrefix,
+		EtcdAPIVersion: *etcdAPIVersion,
+		EtcdCertFile:   *etcdCertFile,
+		EtcdKeyFile:    *etcdKeyFile,
+		EtcdCAFile:     *etcdCAFile,
+		EtcdUsername:   *etcdUsername,
+		EtcdPassword:   *etcdPassword,
 	}
 
 	if *hostname == "" {
@@ -158,6 +171,14 @@ func main() {
 		os.Exit(4)
 	}
 
+	if *renewLeases {
+		err = agent.StartLeaseRenewal(ctx, romanaClient, *hostname)
+		if err != nil {
+			log.Errorf("failed to start renewing address leases: %s\n", err)
+			os.Exit(4)
+		}
+	}
+
 	blocksChannel, err := romanaClient.WatchBlocks(ctx.Done())
 	if err != nil {
 		log.Errorf("Failed to subscribe to Romana blocks updates, %s", err)
@@ -34,6 +34,12 @@ func main() {
 	host := flag.String("host", "localhost", "Host to listen on.")
 	port := flag.Int("port", 9602, "Port to listen on.")
 	prefix := flag.String("etcd-prefix", client.DefaultEtcdPrefix, "Prefix to use for etcd data.")
+	etcdAPIVersion := flag.Int("etcd-api", client.EtcdAPIv2, "Version of etcd API to use, 2 or 3.")
+	etcdCertFile := flag.String("etcd-cert", "", "Client certificate file for etcd TLS.")
+	etcdKeyFile := flag.String("etcd-key", "", "Client key file for etcd TLS.")
+	etcdCAFile := flag.String("etcd-cacert", "", "CA bundle to verify etcd with.")
+	etcdUsername := flag.String("etcd-username", "", "Username for etcd authentication.")
+	etcdPassword := flag.String("etcd-password", "", "Password for etcd authentication.")
 	flag.Parse()
 
 	fmt.Println(common.BuildInfo())
@@ -50,7 +56,13 @@ func main() {
 		pr = "/" + pr
 	}
 	config := common.Config{EtcdEndpoints: endpoints,
-		EtcdPrefix: pr,
+		EtcdPrefix:     pr,
+		EtcdAPIVersion: *etcdAPIVersion,
+		EtcdCertFile:   *etcdCertFile,
+		EtcdKeyFile:    *etcdKeyFile,
+		EtcdCAFile:     *etcdCAFile,
+		EtcdUsername:   *etcdUsername,
+		EtcdPassword:   *etcdPassword,
 	}
 	svcInfo, err := common.InitializeService(listener, config)
 	if err != nil {
@@ -86,6 +86,12 @@ func main() {
 
 	etcdEndpoints := flag.String("endpoints", "", "csv list of etcd endpoints to romana storage")
 	etcdPrefix := flag.String("prefix", "", "string that prefixes all romana keys in etcd")
+	etcdAPIVersion := flag.Int("etcd-api", client.EtcdAPIv2, "version of etcd API to use, 2 or 3")
+	etcdCertFile := flag.String("etcd-cert", "", "client certificate file for etcd tls")
+	etcdKeyFile := flag.String("etcd-key", "", "client key file for etcd tls")
+	etcdCAFile := flag.String("etcd-cacert", "", "ca bundle to verify etcd with")
+	etcdUsername := flag.String("etcd-username", "", "username for etcd authentication")
+	etcdPassword := flag.String("etcd-password", "", "password for etcd authentication")
 	hostname := flag.String("hostname", "", "name of the host in romana database")
 	flagTemplateFile := flag.String("template", "/etc/bird/bird.conf.t", "template file for bird config")
 	flagBirdConfigFile := flag.String("config", "/etc/bird/bird.conf", "location of the bird config file")
@@ -109,8 +115,14 @@ func main() {
 	}
 
 	romanaConfig := common.Config{
-		EtcdEndpoints: strings.Split(*etcdEndpoints, ","),
-		EtcdPrefix:    *etcdPrefix,
+		EtcdEndpoints:  strings.Split(*etcdEndpoints, ","),
+		EtcdPrefix:     *etcdPrefix,
+		EtcdAPIVersion: *etcdAPIVersion,
+		EtcdCertFile:   *etcdCertFile,
+		EtcdKeyFile:    *etcdKeyFile,
+		EtcdCAFile:     *etcdCAFile,
+		EtcdUsername:   *etcdUsername,
+		EtcdPassword:   *etcdPassword,
 	}
 
 	if *hostname == "" {
@@ -34,7 +34,18 @@ func main() {
 	host := flag.String("host", "localhost", "Host to listen on.")
 	port := flag.Int("port", 9600, "Port to listen on.")
 	prefix := flag.String("etcd-prefix", client.DefaultEtcdPrefix, "Prefix to use for etcd data.")
+	etcdAPIVersion := flag.Int("etcd-api", client.EtcdAPIv2, "Version of etcd API to use, 2 or 3.")
+	etcdCertFile := flag.String("etcd-cert", "", "Client certificate file for etcd TLS.")
+	etcdKeyFile := flag.String("etcd-key", "", "Client key file for etcd TLS.")
+	etcdCAFile := flag.String("etcd-cacert", "", "CA bundle to verify etcd with.")
+	etcdUsername := flag.String("etcd-username", "", "Username for etcd authentication.")
+	etcdPassword := flag.String("etcd-password", "", "Password for etcd authentication.")
+	storeBackend := flag.String("store", client.StoreEtcd, "Store backend to use: etcd, memory or bolt.")
+	storeFile := flag.String("store-file", "", "File of the bolt store.")
+	migrateEtcdV2 := flag.Bool("migrate-etcd-v2", false, "Copy data under the prefix from etcd v2 to v3 API, and exit.")
 	topologyFile := flag.String("initial-topology-file", "", "Initial topology")
+	leaseGracePeriod := flag.Duration("lease-grace-period", 0, "Release addresses whose leases are not renewed for this long, 0 means never.")
+	metricsPort := flag.Int("metrics", 9608, "tcp port to expose prometheus metrics, -1 means disable")
 	flag.Parse()
 
 	fmt.Println(common.BuildInfo())
@@ -44,7 +55,13 @@ func main() {
 		os.Exit(1)
 	}
 	endpoints := strings.Split(*endpointsStr, ",")
-	romanad := &server.Romanad{Addr: fmt.Sprintf("%s:%d", *host, *port)}
+	romanad := &server.Romanad{Addr: fmt.Sprintf("%s:%d", *host, *port),
+		LeaseGracePeriod: *leaseGracePeriod,
+	}
+
+	if err := server.MetricStart(*metricsPort); err != nil {
+		log.Errorf("Failed to start metrics collector: %s", err)
+	}
 
 	pr := *prefix
 	if !strings.HasPrefix(pr, "/") {
@@ -53,7 +70,25 @@ func main() {
 
 	config := common.Config{EtcdEndpoints: endpoints,
 		EtcdPrefix:          pr,
+		EtcdAPIVersion:      *etcdAPIVersion,
 		InitialTopologyFile: topologyFile,
+		StoreBackend:        *storeBackend,
+		StoreFile:           *storeFile,
+		EtcdCertFile:        *etcdCertFile,
+		EtcdKeyFile:         *etcdKeyFile,
+		EtcdCAFile:          *etcdCAFile,
+		EtcdUsername:        *etcdUsername,
+		EtcdPassword:        *etcdPassword,
+	}
+
+	if *migrateEtcdV2 {
+		count, err := client.MigrateEtcdV2ToV3(&config)
+		if err != nil {
+			log.Errorf("Error migrating from etcd v2 API: %s", err)
+			os.Exit(4)
+		}
+		fmt.Printf("Migrated %d keys under %s from etcd v2 to v3 API\n", count, pr)
+		return
 	}
 	svcInfo, err := common.InitializeService(romanad, config)
 	if err != nil {
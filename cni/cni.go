@@ -31,10 +31,31 @@ import (
 
 const DefaultSegmentID = "default"
 
+// RequestedAddressAnnotation is the pod annotation that specifies
+// the address to allocate for the pod, e.g. so that a pod of
+// a StatefulSet keeps its address across restarts.
+const RequestedAddressAnnotation = "romana.io/requested-address"
+
+// ErrorCodeQuotaExceeded is the code of the CNI error returned when
+// allocating an address would exceed a quota of the pod's tenant or
+// segment. Codes below 100 are reserved by the CNI specification.
+const ErrorCodeQuotaExceeded = 101
+
+// allocationError returns a CNI error with ErrorCodeQuotaExceeded for
+// quota errors, so that the runtime can tell them from other failures.
+func allocationError(err error, msg string) error {
+	if quotaErr, ok := err.(errors.RomanaQuotaExceededError); ok {
+		return &types.Error{Code: ErrorCodeQuotaExceeded, Msg: msg, Details: quotaErr.Error()}
+	}
+	return fmt.Errorf("%s: %s", msg, err)
+}
+
 // RomanaAddressManager describes functions that allow allocating and deallocating
 // IP addresses from Romana.
 type RomanaAddressManager interface {
-	Allocate(NetConf, *client.Client, RomanaAllocatorPodDescription) (*net.IPNet, error)
+	// Allocate returns the addresses allocated for the pod: a single
+	// address, or an IPv4 and IPv6 pair on dual-stack networks.
+	Allocate(NetConf, *client.Client, RomanaAllocatorPodDescription) ([]*net.IPNet, error)
 	Deallocate(NetConf, *client.Client, string) error
 }
 
@@ -84,7 +105,7 @@ type NetConf struct {
 
 type DefaultAddressManager struct{}
 
-func (DefaultAddressManager) Allocate(config NetConf, client *client.Client, pod RomanaAllocatorPodDescription) (*net.IPNet, error) {
+func (DefaultAddressManager) Allocate(config NetConf, client *client.Client, pod RomanaAllocatorPodDescription) ([]*net.IPNet, error) {
 	// Discover pod segment.
 	var segmentID string
 	var ok bool
@@ -99,22 +120,50 @@ func (DefaultAddressManager) Allocate(config NetConf, client *client.Client, pod
 	}
 	tenantID := listener.GetTenantIDFromNamespaceName(pod.Namespace)
 
-	ip, err := client.IPAM.AllocateIP(pod.Name, config.RomanaHostName, tenantID, segmentID)
-	log.Infof("Allocated IP address %s", ip)
+	if requested, ok := pod.Annotations[RequestedAddressAnnotation]; ok {
+		ip := net.ParseIP(requested)
+		if ip == nil {
+			return nil, fmt.Errorf("Failed to parse address %s requested by annotation %s", requested, RequestedAddressAnnotation)
+		}
+		err := client.IPAM.AllocateSpecificIP(pod.Name, ip, config.RomanaHostName, tenantID, segmentID)
+		if err != nil {
+			return nil, allocationError(err, fmt.Sprintf("Failed to allocate requested IP %s", ip))
+		}
+		log.Infof("Allocated requested IP address %s", ip)
+		ipamIP := &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+		if ip4 := ip.To4(); ip4 != nil {
+			ipamIP = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		}
+		return []*net.IPNet{ipamIP}, nil
+	}
+
+	ip, ipv6, err := client.IPAM.AllocateDualStackIP(pod.Name, config.RomanaHostName, tenantID, segmentID)
+	log.Infof("Allocated IP address %s, IPv6 address %s", ip, ipv6)
 
 	if err != nil {
-		return nil, fmt.Errorf("Failed to allocate IP: %s", err)
+		return nil, allocationError(err, "Failed to allocate IP")
 	}
-	if ip == nil {
+	if ip == nil && ipv6 == nil {
 		return nil, fmt.Errorf("No more IPs available.")
 	}
 
-	ipamIP, err := netlink.ParseIPNet(ip.String() + "/32")
-	if err != nil {
-		return nil, fmt.Errorf("Failed to parse IP address %s, err=(%s)", ip, err)
+	var addresses []*net.IPNet
+	if ip != nil {
+		ipamIP, err := netlink.ParseIPNet(ip.String() + "/32")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse IP address %s, err=(%s)", ip, err)
+		}
+		addresses = append(addresses, ipamIP)
+	}
+	if ipv6 != nil {
+		ipamIPv6, err := netlink.ParseIPNet(ipv6.String() + "/128")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse IP address %s, err=(%s)", ipv6, err)
+		}
+		addresses = append(addresses, ipamIPv6)
 	}
 
-	return ipamIP, nil
+	return addresses, nil
 }
 
 func (DefaultAddressManager) Deallocate(config NetConf, client *client.Client, targetName string) error {
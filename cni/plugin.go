@@ -75,7 +75,7 @@ func CmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	var podAddress *net.IPNet
+	var podAddresses []*net.IPNet
 	romanaClient, err := MakeRomanaClient(netConf)
 	if err != nil {
 		return err
@@ -84,7 +84,7 @@ func CmdAdd(args *skel.CmdArgs) error {
 	log.Tracef(4, "Process %d started IPAM transaction at %s", os.Getpid(), startTime)
 	defer func() {
 		stopTime := time.Now()
-		log.Tracef(4, "Process %d commited IPAM transaction at %s after %s, allocated %s", os.Getpid(), stopTime, stopTime.Sub(startTime), podAddress)
+		log.Tracef(4, "Process %d commited IPAM transaction at %s after %s, allocated %s", os.Getpid(), stopTime, stopTime.Sub(startTime), podAddresses)
 	}()
 
 	// Deferring deallocation before allocating ip address,
@@ -108,7 +108,7 @@ func CmdAdd(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	podAddress, err = allocator.Allocate(*netConf, romanaClient, RomanaAllocatorPodDescription{
+	podAddresses, err = allocator.Allocate(*netConf, romanaClient, RomanaAllocatorPodDescription{
 		Name:        pod.Name,
 		Hostname:    netConf.RomanaHostName,
 		Namespace:   pod.Namespace,
@@ -121,6 +121,17 @@ func CmdAdd(args *skel.CmdArgs) error {
 
 	// Networking setup
 	gwAddr := &net.IPNet{IP: net.ParseIP("172.142.0.1"), Mask: net.IPMask([]byte{0xff, 0xff, 0xff, 0xff})}
+	// IPv6 pods use a link-local gateway, configured on the host side
+	// of the veth pair.
+	gwAddrIPv6 := &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}
+	var hasIPv4, hasIPv6 bool
+	for _, podAddress := range podAddresses {
+		if podAddress.IP.To4() != nil {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+	}
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
@@ -137,6 +148,7 @@ func CmdAdd(args *skel.CmdArgs) error {
 		mtu = netConf.MTU
 	}
 	_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+	_, defaultNetIPv6, _ := net.ParseCIDR("::/0")
 
 	// And this is a callback inside the callback, it sets up networking
 	// withing a pod namespace, nice thing it save us from shellouts
@@ -148,27 +160,42 @@ func CmdAdd(args *skel.CmdArgs) error {
 			return err
 		}
 
-		// transportNet is a romana-gw cidr turned into romana-gw.IP/32
-		transportNet := net.IPNet{IP: gwAddr.IP, Mask: net.IPMask([]byte{0xff, 0xff, 0xff, 0xff})}
-		transportRoute := netlink.Route{
-			LinkIndex: containerVeth.Index,
-			Dst:       &transportNet,
-		}
+		if hasIPv4 {
+			// transportNet is a romana-gw cidr turned into romana-gw.IP/32
+			transportNet := net.IPNet{IP: gwAddr.IP, Mask: net.IPMask([]byte{0xff, 0xff, 0xff, 0xff})}
+			transportRoute := netlink.Route{
+				LinkIndex: containerVeth.Index,
+				Dst:       &transportNet,
+			}
 
-		// sets up transport route to allow installing default route
-		err = netlink.RouteAdd(&transportRoute)
-		if err != nil {
-			return fmt.Errorf("route add error=(%s)", err)
-		}
+			// sets up transport route to allow installing default route
+			err = netlink.RouteAdd(&transportRoute)
+			if err != nil {
+				return fmt.Errorf("route add error=(%s)", err)
+			}
 
-		// default route for the pod
-		defaultRoute := netlink.Route{
-			Dst:       defaultNet,
-			LinkIndex: containerVeth.Index,
+			// default route for the pod
+			defaultRoute := netlink.Route{
+				Dst:       defaultNet,
+				LinkIndex: containerVeth.Index,
+			}
+			err = netlink.RouteAdd(&defaultRoute)
+			if err != nil {
+				return fmt.Errorf("route add default error=(%s)", err)
+			}
 		}
-		err = netlink.RouteAdd(&defaultRoute)
-		if err != nil {
-			return fmt.Errorf("route add default error=(%s)", err)
+
+		if hasIPv6 {
+			// default IPv6 route for the pod, via link-local gateway
+			defaultRouteIPv6 := netlink.Route{
+				Dst:       defaultNetIPv6,
+				Gw:        gwAddrIPv6.IP,
+				LinkIndex: containerVeth.Index,
+			}
+			err = netlink.RouteAdd(&defaultRouteIPv6)
+			if err != nil {
+				return fmt.Errorf("route add default IPv6 error=(%s)", err)
+			}
 		}
 
 		containerVethLink, err := netlink.LinkByIndex(containerVeth.Index)
@@ -176,14 +203,16 @@ func CmdAdd(args *skel.CmdArgs) error {
 			return fmt.Errorf("failed to discover container veth, err=(%s)", err)
 		}
 
-		podIP, err := netlink.ParseAddr(podAddress.String())
-		if err != nil {
-			return fmt.Errorf("netlink failed to parse address %s, err=(%s)", podAddress, err)
-		}
+		for _, podAddress := range podAddresses {
+			podIP, err := netlink.ParseAddr(podAddress.String())
+			if err != nil {
+				return fmt.Errorf("netlink failed to parse address %s, err=(%s)", podAddress, err)
+			}
 
-		err = netlink.AddrAdd(containerVethLink, podIP)
-		if err != nil {
-			return fmt.Errorf("failed to add ip address %s to the interface %s, err=(%s)", podIP, containerVeth.Name, err)
+			err = netlink.AddrAdd(containerVethLink, podIP)
+			if err != nil {
+				return fmt.Errorf("failed to add ip address %s to the interface %s, err=(%s)", podIP, containerVeth.Name, err)
+			}
 		}
 
 		contIface.Name = containerVeth.Name
@@ -203,21 +232,33 @@ func CmdAdd(args *skel.CmdArgs) error {
 		log.Infof("Failed to set proxy_delay for %s, err=(%s)", hostIface.Name, err)
 	}
 
-	// Return route.
-	err = AddEndpointRoute(hostIface.Name, podAddress, nil)
-	if err != nil {
-		log.Debug(err)
-		return err
+	if hasIPv6 {
+		// Link-local gateway for the IPv6 default route of the pod.
+		err = addGatewayAddress(hostIface.Name, gwAddrIPv6)
+		if err != nil {
+			log.Debug(err)
+			return err
+		}
 	}
 
-	result := &current.Result{
-		IPs: []*current.IPConfig{
-			&current.IPConfig{
-				Version:   "4",
-				Address:   *podAddress,
-				Interface: 0,
-			},
-		},
+	result := &current.Result{}
+	for _, podAddress := range podAddresses {
+		// Return route.
+		err = AddEndpointRoute(hostIface.Name, podAddress, nil)
+		if err != nil {
+			log.Debug(err)
+			return err
+		}
+
+		version := "4"
+		if podAddress.IP.To4() == nil {
+			version = "6"
+		}
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Version:   version,
+			Address:   *podAddress,
+			Interface: 0,
+		})
 	}
 
 	result.Interfaces = []*current.Interface{hostIface}
@@ -290,6 +331,20 @@ func CmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
+// addGatewayAddress configures the provided gateway address on the host side
+// of the veth pair.
+func addGatewayAddress(ifaceName string, gw *net.IPNet) error {
+	veth, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return err
+	}
+	err = netlink.AddrAdd(veth, &netlink.Addr{IPNet: gw})
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add gateway address %s to the interface %s, err=(%s)", gw, ifaceName, err)
+	}
+	return nil
+}
+
 type nlRouteHandle interface {
 	LinkByName(name string) (netlink.Link, error)
 	RouteAdd(*netlink.Route) error
@@ -91,3 +91,67 @@ func (ree RomanaExistsError) Error() string {
 		return ree.Message
 	}
 }
+
+// RomanaConflictError represents an error when a request cannot be
+// satisfied because of the current state of the resource, e.g., when
+// the requested address is already taken.
+type RomanaConflictError struct {
+	Type string
+	// Attributes represent key-value pairs describing the request.
+	Attributes map[string]string
+	Message    string
+}
+
+// NewRomanaConflictError creates a RomanaConflictError. Each element
+// of attrs is interpreted as a "key=value" pair.
+func NewRomanaConflictError(message string, t string, attrs ...string) RomanaConflictError {
+	attrMap := make(map[string]string)
+	for _, attr := range attrs {
+		kv := strings.SplitN(attr, "=", 2)
+		k := kv[0]
+		v := kv[1]
+		attrMap[k] = v
+	}
+	err := RomanaConflictError{Message: message,
+		Type:       t,
+		Attributes: attrMap,
+	}
+	return err
+}
+
+func (rce RomanaConflictError) Error() string {
+	if rce.Message == "" {
+		return fmt.Sprintf("Request for %s object with attributes %v conflicts with current state", rce.Type, rce.Attributes)
+	} else {
+		return rce.Message
+	}
+}
+
+// RomanaQuotaExceededError represents an error when a request cannot be
+// satisfied because it would exceed a quota of a tenant or a segment.
+type RomanaQuotaExceededError struct {
+	Tenant  string
+	Segment string
+	// Resource is what the quota limits, e.g., "IP" or "block".
+	Resource string
+	Limit    int
+	Message  string
+}
+
+// NewRomanaQuotaExceededError creates a RomanaQuotaExceededError.
+func NewRomanaQuotaExceededError(message string, tenant string, segment string, resource string, limit int) RomanaQuotaExceededError {
+	return RomanaQuotaExceededError{Message: message,
+		Tenant:   tenant,
+		Segment:  segment,
+		Resource: resource,
+		Limit:    limit,
+	}
+}
+
+func (rqee RomanaQuotaExceededError) Error() string {
+	if rqee.Message == "" {
+		return fmt.Sprintf("Quota of %d %s(s) exceeded for tenant %s, segment %s", rqee.Limit, rqee.Resource, rqee.Tenant, rqee.Segment)
+	} else {
+		return rqee.Message
+	}
+}
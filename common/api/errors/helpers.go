@@ -17,6 +17,7 @@ package errors
 
 import (
 	"fmt"
+	"net/http"
 
 	"github.com/romana/core/common"
 )
@@ -35,8 +36,11 @@ func RomanaErrorToHTTPError(err error) error {
 	case RomanaNotFoundError:
 		return common.NewError404(err.Type, fmt.Sprintf("%v", err.Attributes))
 	case RomanaExistsError:
-		common.NewErrorConflict(err)
-
+		return common.NewErrorConflict(err)
+	case RomanaConflictError:
+		return common.NewErrorConflict(err)
+	case RomanaQuotaExceededError:
+		return common.NewHttpError(http.StatusForbidden, err)
 	}
 	return err
 }
@@ -16,8 +16,10 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
+	"time"
 )
 
 // TODO should this really be kept alongside BlocksResponse?
@@ -34,6 +36,8 @@ type Segment struct {
 type IPAMAddressResponse struct {
 	Name string `json:"id"`
 	IP   net.IP `json:"ip"`
+	// IPv6 is set when a dual-stack pair was allocated.
+	IPv6 net.IP `json:"ipv6,omitempty"`
 }
 
 type IPAMAddressRequest struct {
@@ -41,12 +45,219 @@ type IPAMAddressRequest struct {
 	Host    string `json:"host"`
 	Tenant  string `json:"tenant"`
 	Segment string `json:"segment"`
+	// IP, if specified, is the specific address requested.
+	IP net.IP `json:"ip,omitempty"`
+	// DualStack requests the response as IPAMAddressResponse, with
+	// the IPv6 address of a dual-stack pair. Otherwise, only the
+	// address is returned.
+	DualStack bool `json:"dual_stack,omitempty"`
+}
+
+// IPAMBatchAddressRequest requests addresses for all the names,
+// allocated on the host for the tenant and segment.
+type IPAMBatchAddressRequest struct {
+	Names   []string `json:"names"`
+	Host    string   `json:"host"`
+	Tenant  string   `json:"tenant"`
+	Segment string   `json:"segment"`
+}
+
+// IPAMBatchReleaseRequest requests release of the named addresses, or,
+// if no names are given, of all addresses matching the selector of
+// tenant, segment and host; at least one of these must be given then.
+type IPAMBatchReleaseRequest struct {
+	Names   []string `json:"names,omitempty"`
+	Tenant  string   `json:"tenant,omitempty"`
+	Segment string   `json:"segment,omitempty"`
+	Host    string   `json:"host,omitempty"`
+}
+
+// IPAMBatchAddressResponse lists addresses allocated or
+// released in a batch.
+type IPAMBatchAddressResponse struct {
+	Addresses []IPAMAddressResponse `json:"addresses"`
+}
+
+// IPAMAddressInfo describes who holds an address.
+type IPAMAddressInfo struct {
+	IP      net.IP `json:"ip"`
+	Network string `json:"network,omitempty"`
+	Block   string `json:"block,omitempty"`
+	// Allocated is true if the address is allocated in the block;
+	// Name is the name it was allocated for.
+	Allocated bool   `json:"allocated"`
+	Name      string `json:"name,omitempty"`
+	// Host the block of the address belongs to, or, if HostAddress
+	// is true, the host that has this address.
+	Host        string `json:"host,omitempty"`
+	HostAddress bool   `json:"host_address,omitempty"`
+	Tenant      string `json:"tenant,omitempty"`
+	Segment     string `json:"segment,omitempty"`
+	// BlackedOutBy is the blacked out CIDR the address is in, if any.
+	BlackedOutBy string `json:"blacked_out_by,omitempty"`
+}
+
+// IPAMAddressLease describes the lease of an allocated address.
+type IPAMAddressLease struct {
+	Name     string    `json:"name"`
+	IP       net.IP    `json:"ip"`
+	IPv6     net.IP    `json:"ipv6,omitempty"`
+	OwnerRef string    `json:"owner_ref"`
+	Host     string    `json:"host"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// IPAMLeaseRenewRequest reports owners of addresses that are
+// known to be in use on the host.
+type IPAMLeaseRenewRequest struct {
+	Host      string   `json:"host"`
+	OwnerRefs []string `json:"owner_refs"`
+}
+
+// IPAMLeaseGCResponse reports addresses released because their
+// leases were not renewed.
+type IPAMLeaseGCResponse struct {
+	LastRun  time.Time          `json:"last_run"`
+	Released []IPAMAddressLease `json:"released"`
+}
+
+// IPAMBlackout describes a CIDR excluded from allocation.
+type IPAMBlackout struct {
+	Network string    `json:"network,omitempty"`
+	CIDR    string    `json:"cidr"`
+	Reason  string    `json:"reason,omitempty"`
+	Creator string    `json:"creator,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+	// Expires, if set, is when the blackout is lifted.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// IPAMQuota limits the number of addresses and blocks a tenant,
+// or, if Segment is specified, a segment of a tenant, may use.
+// A limit of 0 means unlimited.
+type IPAMQuota struct {
+	Tenant    string `json:"tenant"`
+	Segment   string `json:"segment,omitempty"`
+	MaxIPs    int    `json:"max_ips"`
+	MaxBlocks int    `json:"max_blocks"`
+	// Current usage, reported when listing quotas.
+	UsedIPs    int `json:"used_ips"`
+	UsedBlocks int `json:"used_blocks"`
+}
+
+// IPAMUsage describes utilization of addresses of a network, a
+// topology group, a host or a tenant.
+type IPAMUsage struct {
+	Name    string `json:"name"`
+	Network string `json:"network,omitempty"`
+	CIDR    string `json:"cidr,omitempty"`
+
+	// Total is the number of addresses: in the CIDR for networks and
+	// groups, and in the blocks they have for hosts and tenants.
+	Total     uint64 `json:"total"`
+	Allocated uint64 `json:"allocated"`
+	// Reusable is the number of addresses in blocks that are not
+	// owned by any tenant and can be reused.
+	Reusable   uint64 `json:"reusable"`
+	BlackedOut uint64 `json:"blacked_out"`
+
+	Blocks int `json:"blocks"`
+	// FreeBlockSlots is the number of blocks that can still be given
+	// out: reusable blocks and blocks not carved out yet.
+	FreeBlockSlots int `json:"free_block_slots"`
+	// Fragmentation is the share of addresses in owned blocks
+	// that are neither allocated nor blacked out.
+	Fragmentation float64 `json:"fragmentation"`
+
+	// AllocationRate is the recent rate of allocation, in addresses
+	// per hour. Only reported for networks.
+	AllocationRate float64 `json:"allocation_rate,omitempty"`
+	// ExhaustionForecast is when the network is expected to run out of
+	// addresses at AllocationRate. Not set if allocation is not growing.
+	ExhaustionForecast *time.Time `json:"exhaustion_forecast,omitempty"`
+}
+
+// IPAMUtilization reports utilization of addresses.
+type IPAMUtilization struct {
+	Networks []IPAMUsage `json:"networks"`
+	Groups   []IPAMUsage `json:"groups"`
+	Hosts    []IPAMUsage `json:"hosts"`
+	Tenants  []IPAMUsage `json:"tenants"`
+}
+
+// IPAMSnapshot is a point-in-time copy of the entire IPAM state.
+type IPAMSnapshot struct {
+	// Version of the snapshot format.
+	Version int `json:"version"`
+	// CreatedBy is the build information of romanad that
+	// created the snapshot.
+	CreatedBy          string    `json:"created_by"`
+	Created            time.Time `json:"created"`
+	AllocationRevision int       `json:"allocation_revision"`
+	TopologyRevision   int       `json:"topology_revision"`
+	// IPAM is the IPAM state as stored.
+	IPAM json.RawMessage `json:"ipam"`
+}
+
+// Kinds of IPAM consistency check findings.
+const (
+	// A block ID referenced by one of the maps of a group does not exist.
+	IPAMCheckInvalidBlockID = "invalid-block-id"
+	// Owner of a block and blocks of an owner do not agree.
+	IPAMCheckOwnerMismatch = "owner-mismatch"
+	// A block is not assigned to a host of its group.
+	IPAMCheckMissingHost = "missing-host"
+	// A block is listed as reusable more than once, or is in use.
+	IPAMCheckReusableBlock = "reusable-block"
+	// A block has allocations but no owner.
+	IPAMCheckUnownedBlock = "unowned-block"
+	// A block is neither owned nor reusable.
+	IPAMCheckLostBlock = "lost-block"
+	// A block is not within the CIDR of its group.
+	IPAMCheckBlockOutsideGroup = "block-outside-group"
+	// An address has more than one name.
+	IPAMCheckDuplicateAddress = "duplicate-address"
+	// A named address is not within any block.
+	IPAMCheckAddressOutsideBlocks = "address-outside-blocks"
+	// A named address is not allocated in its block.
+	IPAMCheckUnallocatedAddress = "unallocated-address"
+	// An allocated address has no name.
+	IPAMCheckUnnamedAddress = "unnamed-address"
+	// An allocated address is blacked out.
+	IPAMCheckBlackedOutAddress = "blacked-out-address"
+	// A lease exists for a name that has no address.
+	IPAMCheckStaleLease = "stale-lease"
+)
+
+// IPAMCheckFinding describes a violation of an IPAM invariant.
+type IPAMCheckFinding struct {
+	Kind    string `json:"kind"`
+	Network string `json:"network,omitempty"`
+	Block   string `json:"block,omitempty"`
+	Address net.IP `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+	// Repairable is true if the violation can be safely repaired.
+	Repairable bool `json:"repairable"`
+	// Repaired is true if the violation was repaired.
+	Repaired bool `json:"repaired"`
+}
+
+// IPAMCheckResponse reports results of an IPAM consistency check.
+type IPAMCheckResponse struct {
+	AllocationRevision int                `json:"allocation_revision"`
+	Findings           []IPAMCheckFinding `json:"findings"`
 }
 
 type IPAMNetworkResponse struct {
-	Revision int    `json:"revision"`
-	Name     string `json:"id"`
-	CIDR     IPNet  `json:"cidr"`
+	Revision         int               `json:"revision"`
+	Name             string            `json:"id"`
+	CIDR             IPNet             `json:"cidr"`
+	AddressSelection string            `json:"address_selection,omitempty"`
+	BlockMask        uint              `json:"block_mask"`
+	TenantBlockMasks map[string]uint   `json:"tenant_block_masks,omitempty"`
+	MinBlockMask     uint              `json:"min_block_mask,omitempty"`
+	Reserved         *BlockReservation `json:"reserved,omitempty"`
 }
 
 type IPAMBlocksResponse struct {
@@ -68,12 +279,111 @@ type TopologyUpdateRequest struct {
 	Topologies []TopologyDefinition `json:"topologies"`
 }
 
+// TopologyPlan is the result of a dry run of a TopologyUpdateRequest:
+// the topology that would result from it, and how it differs from
+// the current one, at TopologyRevision.
+type TopologyPlan struct {
+	TopologyRevision int                   `json:"topology_revision"`
+	Networks         []TopologyPlanNetwork `json:"networks"`
+	Changes          []TopologyChange      `json:"changes"`
+}
+
+// TopologyPlanNetwork describes a network with its tree of groups.
+type TopologyPlanNetwork struct {
+	Name      string             `json:"name"`
+	CIDR      string             `json:"cidr"`
+	BlockMask uint               `json:"block_mask"`
+	Group     *TopologyPlanGroup `json:"group,omitempty"`
+}
+
+// TopologyPlanGroup describes a group, identified by Path, which is
+// its position in the tree of groups ("root.1.0" is the first subgroup
+// of the second subgroup of the network).
+type TopologyPlanGroup struct {
+	Path    string              `json:"path"`
+	Name    string              `json:"name,omitempty"`
+	CIDR    string              `json:"cidr"`
+	Dummy   bool                `json:"dummy,omitempty"`
+	Routing string              `json:"routing,omitempty"`
+	Hosts   []TopologyPlanHost  `json:"hosts,omitempty"`
+	Groups  []TopologyPlanGroup `json:"groups,omitempty"`
+}
+
+// TopologyPlanHost describes a host, the CIDR it is routed and
+// the allocated blocks it has.
+type TopologyPlanHost struct {
+	Name   string   `json:"name"`
+	IP     net.IP   `json:"ip"`
+	CIDR   string   `json:"cidr"`
+	Blocks []string `json:"blocks,omitempty"`
+}
+
+// Kinds of topology changes.
+const (
+	TopologyNetworkAdded   = "network-added"
+	TopologyNetworkRemoved = "network-removed"
+	TopologyNetworkChanged = "network-changed"
+	TopologyGroupAdded     = "group-added"
+	TopologyGroupRemoved   = "group-removed"
+	TopologyGroupChanged   = "group-changed"
+	TopologyHostAdded      = "host-added"
+	TopologyHostRemoved    = "host-removed"
+	TopologyHostMoved      = "host-moved"
+)
+
+// TopologyChange is a difference between the current topology and
+// a planned one. Old and New describe the network, group or host
+// before and after; one of them is empty if it is added or removed.
+type TopologyChange struct {
+	Kind    string `json:"kind"`
+	Network string `json:"network"`
+	Group   string `json:"group,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Old     string `json:"old,omitempty"`
+	New     string `json:"new,omitempty"`
+}
+
+// Strategies of selecting a free address within a block.
+const (
+	// Lowest free address first. This is the default.
+	AddressSelectionLowestFree = "lowest-free"
+	// Lowest free address after the one allocated last,
+	// wrapping around to the start of the block.
+	AddressSelectionNextAfterLast = "next-after-last"
+	// Any free address at random.
+	AddressSelectionRandom = "random"
+	// The free address that was freed the longest ago,
+	// never allocated addresses first.
+	AddressSelectionLeastRecentlyFreed = "least-recently-freed"
+)
+
 type NetworkDefinition struct {
 	Name      string `json:"name"`
 	CIDR      string `json:"cidr"`
 	BlockMask uint   `json:"block_mask"`
 	// List of allowed tenants.
 	Tenants []string `json:"tenants,omitempty"`
+	// Strategy of selecting addresses within blocks, one of
+	// AddressSelection* constants; lowest-free if empty.
+	AddressSelection string `json:"address_selection,omitempty"`
+	// Block masks of tenants that override BlockMask.
+	TenantBlockMasks map[string]uint `json:"tenant_block_masks,omitempty"`
+	// If specified, every further block given to the same tenant
+	// and segment on a host is twice as large as the previous
+	// one, until blocks reach this mask.
+	MinBlockMask uint `json:"min_block_mask,omitempty"`
+	// Addresses of every block that are not to be allocated.
+	Reserved *BlockReservation `json:"reserved,omitempty"`
+}
+
+// BlockReservation specifies addresses of every block of a network
+// that are reserved, e.g. for a gateway, and thus never allocated:
+// the First and Last so many addresses, and addresses at Offsets
+// from the start of the block.
+type BlockReservation struct {
+	First   uint64   `json:"first,omitempty"`
+	Last    uint64   `json:"last,omitempty"`
+	Offsets []uint64 `json:"offsets,omitempty"`
 }
 
 type TopologyDefinition struct {
@@ -85,27 +395,57 @@ type GroupOrHost struct {
 	// Assignment is a map of key-value pairs that specify what attributes (key=value)
 	// of a new host to use to assign it into a group.
 	Assignment map[string]string `json:"assignment,omitempty"`
-	Routing    string            `json:"routing,omitempty"`
-	Groups     []GroupOrHost     `json:"groups"`
+	// AssignmentExpressions are further requirements on tags of a new
+	// host, all of which (along with Assignment) it must satisfy.
+	AssignmentExpressions []AssignmentRequirement `json:"assignment_expressions,omitempty"`
+	// Priority decides between groups a new host is eligible for: the
+	// one with the highest priority is taken, then the one with the most
+	// requirements, and then the one with the fewest hosts.
+	Priority int           `json:"priority,omitempty"`
+	Routing  string        `json:"routing,omitempty"`
+	Groups   []GroupOrHost `json:"groups"`
 
 	// If the below are specified, this GroupSpec really represents a host,
 	// therefore the above elements MUST NOT be specified.
 	Name string `json:"name"`
 	IP   net.IP `json:"ip,omitempty"`
+	// IPv6 address of the host, if it is to route IPv6 blocks.
+	IPv6 net.IP `json:"ipv6,omitempty"`
 
 	// A dummy group is one used for padding to power of 2; it is not to
 	// be assigned hosts to
 	Dummy bool `json:"dummy"`
 }
 
+// Operators of assignment requirements.
+const (
+	AssignmentOpIn           = "In"
+	AssignmentOpNotIn        = "NotIn"
+	AssignmentOpExists       = "Exists"
+	AssignmentOpDoesNotExist = "DoesNotExist"
+)
+
+// AssignmentRequirement is a requirement on the tag Key of a host. With
+// In and NotIn, the tag must (or must not) have one of Values; with
+// Exists and DoesNotExist, the tag must (or must not) be present, and
+// Values must be empty.
+type AssignmentRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+}
+
 type Host struct {
 	IP        net.IP `json:"ip"`
+	IPv6      net.IP `json:"ipv6,omitempty"`
 	Name      string `json:"name"`
 	AgentPort uint   `json:"agent_port"`
 	// TODO this is a placeholder for now so that agent builds
 	RomanaIp string            `json:"romana_ip"`
 	Tags     map[string]string `json:"tags"`
 	K8SInfo  map[string]string `json:"k8s_info"`
+	// Cordoned hosts are not assigned new blocks.
+	Cordoned bool `json:"cordoned,omitempty"`
 }
 
 func (h Host) String() string {
@@ -119,6 +459,13 @@ func (h Host) String() string {
 	return val
 }
 
+// HostDrainResponse lists addresses that must be moved off
+// a cordoned host before it can be removed.
+type HostDrainResponse struct {
+	Host      string                `json:"host"`
+	Addresses []IPAMAddressResponse `json:"addresses"`
+}
+
 type HostList struct {
 	Hosts    []Host `json:"hosts"`
 	Revision int    `json:"revision"`
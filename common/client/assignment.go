@@ -0,0 +1,147 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+)
+
+// validateRequirements checks that the assignment requirements are
+// well-formed.
+func validateRequirements(reqs []api.AssignmentRequirement) error {
+	for _, req := range reqs {
+		if req.Key == "" {
+			return common.NewError("Assignment requirement %v has no key", req)
+		}
+		switch req.Operator {
+		case api.AssignmentOpIn, api.AssignmentOpNotIn:
+			if len(req.Values) == 0 {
+				return common.NewError("Assignment requirement %s %s needs values", req.Key, req.Operator)
+			}
+		case api.AssignmentOpExists, api.AssignmentOpDoesNotExist:
+			if len(req.Values) != 0 {
+				return common.NewError("Assignment requirement %s %s takes no values, got %v", req.Key, req.Operator, req.Values)
+			}
+		default:
+			return common.NewError("Unknown operator %s in assignment requirement on %s, must be one of %s, %s, %s, %s",
+				req.Operator, req.Key, api.AssignmentOpIn, api.AssignmentOpNotIn, api.AssignmentOpExists, api.AssignmentOpDoesNotExist)
+		}
+	}
+	return nil
+}
+
+// requirementString describes the requirement.
+func requirementString(req api.AssignmentRequirement) string {
+	if len(req.Values) == 0 {
+		return fmt.Sprintf("%s %s", req.Key, req.Operator)
+	}
+	return fmt.Sprintf("%s %s (%s)", req.Key, req.Operator, strings.Join(req.Values, ", "))
+}
+
+// requirementSatisfied checks if the tags satisfy the requirement.
+func requirementSatisfied(req api.AssignmentRequirement, tags map[string]string) bool {
+	value, ok := tags[req.Key]
+	switch req.Operator {
+	case api.AssignmentOpIn:
+		return ok && containsString(req.Values, value)
+	case api.AssignmentOpNotIn:
+		return !ok || !containsString(req.Values, value)
+	case api.AssignmentOpExists:
+		return ok
+	case api.AssignmentOpDoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// requirements returns all requirements of the group, with the exact
+// matches of Assignment expressed as In requirements, sorted by key.
+func (hg *Group) requirements() []api.AssignmentRequirement {
+	reqs := make([]api.AssignmentRequirement, 0, len(hg.Assignment)+len(hg.AssignmentExpressions))
+	for k, v := range hg.Assignment {
+		reqs = append(reqs, api.AssignmentRequirement{Key: k, Operator: api.AssignmentOpIn, Values: []string{v}})
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Key < reqs[j].Key })
+	return append(reqs, hg.AssignmentExpressions...)
+}
+
+// unsatisfiedRequirements returns descriptions of requirements of
+// the group the host does not satisfy.
+func (hg *Group) unsatisfiedRequirements(host *Host) []string {
+	failed := make([]string, 0)
+	for _, req := range hg.requirements() {
+		if requirementSatisfied(req, host.Tags) {
+			continue
+		}
+		tag := "no tag " + req.Key
+		if value, ok := host.Tags[req.Key]; ok {
+			tag = fmt.Sprintf("%s=%s", req.Key, value)
+		}
+		failed = append(failed, fmt.Sprintf("%s (host has %s)", requirementString(req), tag))
+	}
+	return failed
+}
+
+// takesPrecedence checks if, for a host eligible for both, group hg
+// takes precedence over group other: the one with higher Priority does,
+// then the one with more requirements. If neither does, false is returned.
+func (hg *Group) takesPrecedence(other *Group) bool {
+	if hg.Priority != other.Priority {
+		return hg.Priority > other.Priority
+	}
+	return len(hg.Assignment)+len(hg.AssignmentExpressions) > len(other.Assignment)+len(other.AssignmentExpressions)
+}
+
+// explainIneligibility returns, for the group at the path and each of
+// its subgroups, why the host could not be added to it.
+func (hg *Group) explainIneligibility(host *Host, path string) []string {
+	if hg.Dummy {
+		return nil
+	}
+	name := path
+	if hg.Name != "" && hg.Name != "/" {
+		name = fmt.Sprintf("%s (%s)", path, hg.Name)
+	}
+	if failed := hg.unsatisfiedRequirements(host); len(failed) > 0 {
+		return []string{fmt.Sprintf("group %s requires %s", name, strings.Join(failed, " and "))}
+	}
+	if hg.Hosts != nil {
+		return nil
+	}
+	reasons := make([]string, 0)
+	if len(hg.Groups) == 0 {
+		reasons = append(reasons, fmt.Sprintf("group %s has no groups for hosts", name))
+	}
+	for i, group := range hg.Groups {
+		reasons = append(reasons, group.explainIneligibility(host, path+"."+strconv.Itoa(i))...)
+	}
+	return reasons
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/romana/core/common/api"
+)
+
+const assignmentTopology = `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/16","block_mask":28}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"name":"store","groups":[],
+     "assignment_expressions":[{"key":"tier","operator":"In","values":["backend","db"]}]},
+    {"name":"edge","groups":[],
+     "assignment_expressions":[
+       {"key":"tier","operator":"NotIn","values":["backend","db"]},
+       {"key":"zone","operator":"Exists"}]},
+    {"name":"untiered","groups":[],
+     "assignment_expressions":[{"key":"tier","operator":"DoesNotExist"}]},
+    {"name":"db","groups":[],"priority":10,
+     "assignment_expressions":[{"key":"tier","operator":"In","values":["db"]}]}
+  ]}]
+}`
+
+func TestAssignmentExpressions(t *testing.T) {
+	ipam = initIpam(t, assignmentTopology)
+
+	cases := []struct {
+		tags  map[string]string
+		group string
+	}{
+		// Both store and db match; db has higher priority.
+		{map[string]string{"tier": "db"}, "db"},
+		{map[string]string{"tier": "backend"}, "store"},
+		{map[string]string{"tier": "web", "zone": "a"}, "edge"},
+		// Both edge (NotIn holds without the tag) and untiered
+		// match; edge has more requirements.
+		{map[string]string{"zone": "a"}, "edge"},
+		{nil, "untiered"},
+	}
+	for i, tc := range cases {
+		host := api.Host{
+			Name: fmt.Sprintf("host%d", i),
+			IP:   net.ParseIP(fmt.Sprintf("192.168.99.%d", i+1)),
+			Tags: tc.tags,
+		}
+		err := ipam.AddHost(host)
+		if err != nil {
+			t.Fatalf("Error adding host with tags %v: %s", tc.tags, err)
+		}
+		ipam.load(ipam, nil)
+		group := ipam.Networks["net1"].Group.findHostByName(host.Name).group
+		if group.Name != tc.group {
+			t.Fatalf("Expected host with tags %v in group %s, got %s", tc.tags, tc.group, group.Name)
+		}
+	}
+
+	// The error explains which requirements were not satisfied.
+	err := ipam.AddHost(api.Host{Name: "lost", IP: net.ParseIP("192.168.99.100"), Tags: map[string]string{"tier": "web"}})
+	if err == nil {
+		t.Fatalf("Expected error adding host with tier web and no zone")
+	}
+	for _, expected := range []string{
+		"group root.0 (store) requires tier In (backend, db) (host has tier=web)",
+		"group root.1 (edge) requires zone Exists (host has no tag zone)",
+		"group root.2 (untiered) requires tier DoesNotExist (host has tier=web)",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected error to contain %q, got %s", expected, err)
+		}
+	}
+
+	// Requirements are validated.
+	req := api.TopologyUpdateRequest{}
+	err = json.Unmarshal([]byte(strings.Replace(assignmentTopology, `"operator":"Exists"`, `"operator":"Exists","values":["a"]`, 1)), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.UpdateTopology(req, false)
+	if err == nil || !strings.Contains(err.Error(), "takes no values") {
+		t.Fatalf("Expected error about values of Exists, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/api/errors"
+	log "github.com/romana/rlog"
+)
+
+// AllocateIPs allocates addresses for all the names on the host for the
+// tenant and segment (see AllocateDualStackIP), in a single save. If any
+// of them cannot be allocated, none is.
+func (ipam *IPAM) AllocateIPs(names []string, host string, tenant string, segment string) ([]api.IPAMAddressResponse, error) {
+	if len(names) == 0 {
+		return nil, common.NewError400("At least one name required")
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name == "" {
+			return nil, common.NewError400("Names must not be empty")
+		}
+		if seen[name] {
+			return nil, common.NewError400(fmt.Sprintf("Name %s given more than once", name))
+		}
+		seen[name] = true
+	}
+
+	var resp []api.IPAMAddressResponse
+	err := ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		resp = make([]api.IPAMAddressResponse, 0, len(names))
+		for _, name := range names {
+			ipv4, ipv6, err := latestIPAM.allocateDualStackIP(name, host, tenant, segment)
+			if err != nil {
+				return false, err
+			}
+			if ipv4 == nil {
+				// Only an IPv6 address was allocated.
+				ipv4, ipv6 = ipv6, nil
+			}
+			resp = append(resp, api.IPAMAddressResponse{Name: name, IP: ipv4, IPv6: ipv6})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Allocated %d addresses on host %s for %s", len(resp), host, makeOwner(tenant, segment))
+	return resp, nil
+}
+
+// ReleaseIPs releases the addresses requested (see
+// api.IPAMBatchReleaseRequest) in a single save, and returns them.
+// If any of the named addresses is not allocated, none is released.
+func (ipam *IPAM) ReleaseIPs(req api.IPAMBatchReleaseRequest) ([]api.IPAMAddressResponse, error) {
+	if len(req.Names) == 0 && req.Tenant == "" && req.Segment == "" && req.Host == "" {
+		return nil, common.NewError400("Names, or at least one of tenant, segment or host, required")
+	}
+	if len(req.Names) > 0 && (req.Tenant != "" || req.Segment != "" || req.Host != "") {
+		return nil, common.NewError400("Either names or tenant, segment and host can be given, not both")
+	}
+
+	var resp []api.IPAMAddressResponse
+	err := ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		names := make([]string, 0)
+		if len(req.Names) > 0 {
+			for _, addressName := range req.Names {
+				name := latestIPAM.findAddressName(addressName)
+				if name == "" {
+					return false, errors.NewRomanaNotFoundError("", "address", fmt.Sprintf("name=%s", addressName))
+				}
+				names = append(names, name)
+			}
+		} else {
+			names = latestIPAM.selectAddressNames(req.Tenant, req.Segment, req.Host)
+		}
+
+		resp = make([]api.IPAMAddressResponse, 0, len(names))
+		released := make(map[string]bool, len(names))
+		for _, name := range names {
+			if released[name] {
+				continue
+			}
+			addr := api.IPAMAddressResponse{
+				Name: name,
+				IP:   latestIPAM.AddressNameToIP[name],
+				IPv6: latestIPAM.AddressNameToIPv6[name],
+			}
+			err := latestIPAM.deallocateName(name)
+			if err != nil {
+				return false, err
+			}
+			released[name] = true
+			resp = append(resp, addr)
+		}
+		if len(resp) == 0 {
+			return false, nil
+		}
+		latestIPAM.AllocationRevision++
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Released %d addresses", len(resp))
+	return resp, nil
+}
+
+// selectAddressNames returns names, sorted, of addresses allocated in
+// blocks of the tenant, segment and host; empty ones match any.
+func (ipam *IPAM) selectAddressNames(tenant string, segment string, host string) []string {
+	names := make([]string, 0)
+	for _, name := range ipam.sortedAddressNames() {
+		group, blockID := ipam.findBlock(ipam.AddressNameToIP[name])
+		if group == nil {
+			continue
+		}
+		blockTenant, blockSegment := parseOwner(group.BlockToOwner[blockID])
+		if tenant != "" && blockTenant != tenant {
+			continue
+		}
+		if segment != "" && blockSegment != segment {
+			continue
+		}
+		if host != "" && group.BlockToHost[blockID] != host {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/romana/core/common/api"
+)
+
+func TestBatchAllocateRelease(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/16","block_mask":28}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"groups":[{"name":"host1","ip":"192.168.99.10"}]},
+    {"groups":[{"name":"host2","ip":"192.168.99.11"}]}
+  ]}]
+}`)
+	saves := 0
+	ipam.save = func(latestIPAM *IPAM, ch <-chan struct{}) error {
+		saves++
+		return testSaver.save(latestIPAM, ch)
+	}
+
+	addrs, err := ipam.AllocateIPs([]string{"a1", "a2", "a3"}, "host1", "ten1", "seg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 3 || saves != 1 {
+		t.Fatalf("Expected 3 addresses in 1 save, got %v in %d", addrs, saves)
+	}
+	_, err = ipam.AllocateIPs([]string{"b1"}, "host2", "ten2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch that cannot be allocated entirely is not allocated at all.
+	saves = 0
+	_, err = ipam.AllocateIPs([]string{"a4", "a1"}, "host1", "ten1", "seg1")
+	if err == nil {
+		t.Fatalf("Expected error allocating already allocated a1")
+	}
+	_, err = ipam.AllocateIPs([]string{"a5", "a5"}, "host1", "ten1", "seg1")
+	if err == nil {
+		t.Fatalf("Expected error allocating a5 twice")
+	}
+	ipam.load(ipam, nil)
+	if ipam.AddressNameToIP["a4"] != nil || ipam.AddressNameToIP["a5"] != nil || saves != 0 {
+		t.Fatalf("Expected nothing to be saved, got %d saves of %v", saves, ipam.AddressNameToIP)
+	}
+
+	// Same for release by names.
+	_, err = ipam.ReleaseIPs(api.IPAMBatchReleaseRequest{Names: []string{"a1", "nope"}})
+	if err == nil {
+		t.Fatalf("Expected error releasing nope")
+	}
+	ipam.load(ipam, nil)
+	if ipam.AddressNameToIP["a1"] == nil {
+		t.Fatalf("Expected a1 to remain allocated")
+	}
+
+	// Release by selector.
+	saves = 0
+	addrs, err = ipam.ReleaseIPs(api.IPAMBatchReleaseRequest{Tenant: "ten1", Host: "host1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, addr := range addrs {
+		names = append(names, addr.Name)
+	}
+	if fmt.Sprint(names) != "[a1 a2 a3]" || saves != 1 {
+		t.Fatalf("Expected [a1 a2 a3] released in 1 save, got %v in %d", names, saves)
+	}
+	ipam.load(ipam, nil)
+	if len(ipam.AddressNameToIP) != 1 || ipam.AddressNameToIP["b1"] == nil {
+		t.Fatalf("Expected only b1 to remain allocated, got %v", ipam.AddressNameToIP)
+	}
+
+	_, err = ipam.ReleaseIPs(api.IPAMBatchReleaseRequest{})
+	if err == nil {
+		t.Fatalf("Expected error releasing without names or selector")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"time"
+
+	"github.com/romana/core/common/api"
+	log "github.com/romana/rlog"
+)
+
+// Blackout records why a CIDR was blacked out, by whom,
+// and, optionally, when the blackout is lifted.
+type Blackout struct {
+	Reason  string     `json:"reason,omitempty"`
+	Creator string     `json:"creator,omitempty"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// expired returns true if the blackout expired by now.
+func (b *Blackout) expired(now time.Time) bool {
+	return b != nil && b.Expires != nil && !now.Before(*b.Expires)
+}
+
+// networkForCIDR returns the network containing the CIDR,
+// or nil if not found.
+func (ipam *IPAM) networkForCIDR(cidr CIDR) *Network {
+	for _, network := range ipam.Networks {
+		if network.CIDR.Contains(cidr) {
+			return network
+		}
+	}
+	return nil
+}
+
+func (network *Network) setBlackout(cidr CIDR, blackout Blackout) {
+	if network.Blackouts == nil {
+		network.Blackouts = make(map[string]*Blackout)
+	}
+	network.Blackouts[cidr.String()] = &blackout
+}
+
+// unBlackOut removes the CIDR from the blackout list, returning
+// false if it is not in the list.
+func (network *Network) unBlackOut(cidr CIDR) bool {
+	for i, blackedOut := range network.BlackedOut {
+		if blackedOut.String() == cidr.String() {
+			network.BlackedOut = deleteElementCIDR(network.BlackedOut, i)
+			delete(network.Blackouts, cidr.String())
+			network.Revison++
+			return true
+		}
+	}
+	return false
+}
+
+func (network *Network) blackoutToAPI(cidr CIDR) api.IPAMBlackout {
+	blackout := api.IPAMBlackout{Network: network.Name, CIDR: cidr.String()}
+	if b, ok := network.Blackouts[cidr.String()]; ok {
+		blackout.Reason = b.Reason
+		blackout.Creator = b.Creator
+		blackout.Created = b.Created
+		blackout.Expires = b.Expires
+	}
+	return blackout
+}
+
+// ListBlackouts returns blacked out CIDRs of all networks.
+func (ipam *IPAM) ListBlackouts() []api.IPAMBlackout {
+	blackouts := make([]api.IPAMBlackout, 0)
+	for _, netName := range ipam.sortedNetworkNames() {
+		network := ipam.Networks[netName]
+		for _, cidr := range network.BlackedOut {
+			blackouts = append(blackouts, network.blackoutToAPI(cidr))
+		}
+	}
+	return blackouts
+}
+
+// LiftExpiredBlackouts un-blacks out CIDRs whose blackouts expired,
+// and returns them.
+func (ipam *IPAM) LiftExpiredBlackouts() ([]api.IPAMBlackout, error) {
+	var lifted []api.IPAMBlackout
+	err := ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		lifted = make([]api.IPAMBlackout, 0)
+		now := timeNow()
+		for _, netName := range latestIPAM.sortedNetworkNames() {
+			network := latestIPAM.Networks[netName]
+			expired := make([]CIDR, 0)
+			for _, cidr := range network.BlackedOut {
+				if network.Blackouts[cidr.String()].expired(now) {
+					expired = append(expired, cidr)
+				}
+			}
+			for _, cidr := range expired {
+				blackout := network.blackoutToAPI(cidr)
+				network.unBlackOut(cidr)
+				log.Infof("Lifted blackout of %s in network %s, expired at %s", cidr, network.Name, blackout.Expires)
+				lifted = append(lifted, blackout)
+			}
+		}
+		return len(lifted) > 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lifted, nil
+}
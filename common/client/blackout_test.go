@@ -0,0 +1,94 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlackoutExpiry(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/30","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.0.1"}
+  ]}]}]
+}`)
+	expires := now.Add(time.Hour)
+	err := ipam.AddBlackout("10.0.0.0/31", Blackout{Reason: "maintenance", Creator: "admin", Expires: &expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.BlackOut("10.0.0.2/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.load(ipam, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blackouts := ipam.ListBlackouts()
+	t.Logf("Blackouts: %+v", blackouts)
+	if len(blackouts) != 2 {
+		t.Fatalf("Expected 2 blackouts, got %d", len(blackouts))
+	}
+	b := blackouts[0]
+	if b.CIDR != "10.0.0.0/31" || b.Reason != "maintenance" || b.Creator != "admin" ||
+		!b.Created.Equal(now) || b.Expires == nil || !b.Expires.Equal(expires) {
+		t.Fatalf("Unexpected blackout %+v", b)
+	}
+	if blackouts[1].CIDR != "10.0.0.2/32" || blackouts[1].Expires != nil {
+		t.Fatalf("Unexpected blackout %+v", blackouts[1])
+	}
+
+	// Nothing expired yet.
+	lifted, err := ipam.LiftExpiredBlackouts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lifted) != 0 {
+		t.Fatalf("Expected no blackouts to be lifted, got %+v", lifted)
+	}
+
+	now = expires
+	lifted, err = ipam.LiftExpiredBlackouts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lifted) != 1 || lifted[0].CIDR != "10.0.0.0/31" {
+		t.Fatalf("Expected 10.0.0.0/31 to be lifted, got %+v", lifted)
+	}
+	err = ipam.load(ipam, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ipam.ListBlackouts()) != 1 {
+		t.Fatalf("Expected 1 blackout left, got %+v", ipam.ListBlackouts())
+	}
+
+	ip, err := ipam.AllocateIP("1", "host1", "ten1", "seg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" {
+		t.Fatalf("Expected 10.0.0.0, got %s", ip)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBlockSizes(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/24","block_mask":30,
+    "tenant_block_masks":{"ten2":29},"min_block_mask":28}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"}
+  ]}]}]
+}`)
+	allocate := func(name string, tenant string) string {
+		ip, err := ipam.AllocateIP(name, "host1", tenant, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ip.String()
+	}
+	// The first block of ten1 is a /30, the next one twice as large.
+	for i := 0; i < 4; i++ {
+		allocate(fmt.Sprintf("a%d", i), "ten1")
+	}
+	if ip := allocate("a4", "ten1"); ip != "10.0.0.8" {
+		t.Fatalf("Expected 10.0.0.8 from a new /29 block, got %s", ip)
+	}
+	// Blocks of ten2 are /29 from the start.
+	if ip := allocate("b0", "ten2"); ip != "10.0.0.16" {
+		t.Fatalf("Expected 10.0.0.16 from a new /29 block, got %s", ip)
+	}
+	// A /30 block fits into the gap left by alignment.
+	if ip := allocate("c0", "ten3"); ip != "10.0.0.4" {
+		t.Fatalf("Expected 10.0.0.4 from a new /30 block, got %s", ip)
+	}
+	// Blocks of ten1 do not grow beyond min_block_mask.
+	for i := 5; i < 12; i++ {
+		allocate(fmt.Sprintf("a%d", i), "ten1")
+	}
+	if ip := allocate("a12", "ten1"); ip != "10.0.0.32" {
+		t.Fatalf("Expected 10.0.0.32 from a new /28 block, got %s", ip)
+	}
+	for i := 13; i < 28; i++ {
+		allocate(fmt.Sprintf("a%d", i), "ten1")
+	}
+	if ip := allocate("a28", "ten1"); ip != "10.0.0.48" {
+		t.Fatalf("Expected 10.0.0.48 from a new /28 block, got %s", ip)
+	}
+
+	ipam.load(ipam, nil)
+	blocks := make([]string, 0)
+	for _, block := range ipam.ListAllBlocks().Blocks {
+		blocks = append(blocks, block.CIDR.String())
+	}
+	expected := "[10.0.0.0/30 10.0.0.8/29 10.0.0.16/29 10.0.0.4/30 10.0.0.32/28 10.0.0.48/28]"
+	if fmt.Sprint(blocks) != expected {
+		t.Fatalf("Expected blocks %s, got %v", expected, blocks)
+	}
+}
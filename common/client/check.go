@@ -0,0 +1,409 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/log/trace"
+	log "github.com/romana/rlog"
+)
+
+// checker collects findings of a consistency check, repairing
+// them as they are reported if so requested.
+type checker struct {
+	repair   bool
+	findings []api.IPAMCheckFinding
+}
+
+// report records the finding. A finding is repairable if repairFn
+// is provided; it is called to repair the finding in repair mode.
+func (c *checker) report(finding api.IPAMCheckFinding, repairFn func() error) {
+	finding.Repairable = repairFn != nil
+	if finding.Repairable && c.repair {
+		err := repairFn()
+		if err == nil {
+			finding.Repaired = true
+			log.Infof("Repaired IPAM inconsistency: %s", finding.Message)
+		} else {
+			finding.Message = fmt.Sprintf("%s (repair failed: %s)", finding.Message, err)
+		}
+	}
+	c.findings = append(c.findings, finding)
+}
+
+// removeInt returns arr without any occurrences of val.
+func removeInt(arr []int, val int) []int {
+	retval := make([]int, 0, len(arr))
+	for _, elt := range arr {
+		if elt != val {
+			retval = append(retval, elt)
+		}
+	}
+	return retval
+}
+
+// countInt returns number of occurrences of val in arr.
+func countInt(arr []int, val int) int {
+	count := 0
+	for _, elt := range arr {
+		if elt == val {
+			count++
+		}
+	}
+	return count
+}
+
+func sortedBlockIDs(m map[int]string) []int {
+	blockIDs := make([]int, 0, len(m))
+	for blockID := range m {
+		blockIDs = append(blockIDs, blockID)
+	}
+	sort.Ints(blockIDs)
+	return blockIDs
+}
+
+// leafGroups returns this group, if it holds hosts, or all
+// groups holding hosts below it.
+func (hg *Group) leafGroups() []*Group {
+	if hg.Hosts != nil {
+		return []*Group{hg}
+	}
+	retval := make([]*Group, 0)
+	for _, group := range hg.Groups {
+		retval = append(retval, group.leafGroups()...)
+	}
+	return retval
+}
+
+// sortedNetworkNames returns names of all networks, sorted.
+func (ipam *IPAM) sortedNetworkNames() []string {
+	names := make([]string, 0, len(ipam.Networks))
+	for name := range ipam.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check verifies invariants of the IPAM state, and returns a finding
+// for each violation. If repair is true, the violations that can be
+// safely repaired are repaired, and the repaired state is saved.
+func (ipam *IPAM) Check(repair bool) (api.IPAMCheckResponse, error) {
+	resp := api.IPAMCheckResponse{}
+	err := ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		findings := latestIPAM.check(repair)
+		repaired := 0
+		for _, finding := range findings {
+			if finding.Repaired {
+				repaired++
+			}
+		}
+		log.Tracef(trace.Inside, "IPAM.Check: %d finding(s), %d repaired", len(findings), repaired)
+		if repaired > 0 {
+			latestIPAM.AllocationRevision++
+		}
+		resp = api.IPAMCheckResponse{
+			AllocationRevision: latestIPAM.AllocationRevision,
+			Findings:           findings,
+		}
+		return repaired > 0, nil
+	})
+	if err != nil {
+		return api.IPAMCheckResponse{}, err
+	}
+	return resp, nil
+}
+
+// check verifies invariants of this IPAM (see Check).
+func (ipam *IPAM) check(repair bool) []api.IPAMCheckFinding {
+	c := &checker{repair: repair, findings: make([]api.IPAMCheckFinding, 0)}
+	for _, netName := range ipam.sortedNetworkNames() {
+		network := ipam.Networks[netName]
+		if network.Group == nil {
+			continue
+		}
+		for _, group := range network.Group.leafGroups() {
+			group.checkBlockIndexes(c, network)
+		}
+	}
+	ipam.checkAddresses(c)
+	return c.findings
+}
+
+// checkBlockIndexes verifies that maps of blocks of a group holding
+// hosts agree with each other and with the blocks.
+func (hg *Group) checkBlockIndexes(c *checker, network *Network) {
+	validID := func(blockID int) bool {
+		return blockID >= 0 && blockID < len(hg.Blocks)
+	}
+	finding := func(kind string, blockID int, format string, args ...interface{}) api.IPAMCheckFinding {
+		f := api.IPAMCheckFinding{
+			Kind:    kind,
+			Network: network.Name,
+			Message: fmt.Sprintf(format, args...),
+		}
+		if validID(blockID) {
+			f.Block = hg.Blocks[blockID].CIDR.String()
+		}
+		return f
+	}
+
+	// Block IDs must refer to existing blocks.
+	for _, blockID := range sortedBlockIDs(hg.BlockToOwner) {
+		if !validID(blockID) {
+			blockID := blockID
+			c.report(finding(api.IPAMCheckInvalidBlockID, blockID, "group %s: block %d of %s does not exist", hg.CIDR, blockID, hg.BlockToOwner[blockID]),
+				func() error { delete(hg.BlockToOwner, blockID); return nil })
+		}
+	}
+	for _, blockID := range sortedBlockIDs(hg.BlockToHost) {
+		if !validID(blockID) {
+			blockID := blockID
+			c.report(finding(api.IPAMCheckInvalidBlockID, blockID, "group %s: block %d on host %s does not exist", hg.CIDR, blockID, hg.BlockToHost[blockID]),
+				func() error { delete(hg.BlockToHost, blockID); return nil })
+		}
+	}
+	owners := make([]string, 0, len(hg.OwnerToBlocks))
+	for owner := range hg.OwnerToBlocks {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		for _, blockID := range hg.OwnerToBlocks[owner] {
+			if !validID(blockID) {
+				owner, blockID := owner, blockID
+				c.report(finding(api.IPAMCheckInvalidBlockID, blockID, "group %s: block %d of %s does not exist", hg.CIDR, blockID, owner),
+					func() error { hg.OwnerToBlocks[owner] = removeInt(hg.OwnerToBlocks[owner], blockID); return nil })
+			}
+		}
+	}
+	for _, blockID := range hg.ReusableBlocks {
+		if !validID(blockID) {
+			blockID := blockID
+			c.report(finding(api.IPAMCheckInvalidBlockID, blockID, "group %s: reusable block %d does not exist", hg.CIDR, blockID),
+				func() error { hg.ReusableBlocks = removeInt(hg.ReusableBlocks, blockID); return nil })
+		}
+	}
+
+	// BlockToOwner and OwnerToBlocks must agree; BlockToOwner
+	// is taken to be authoritative.
+	for _, blockID := range sortedBlockIDs(hg.BlockToOwner) {
+		if !validID(blockID) {
+			continue
+		}
+		blockID := blockID
+		owner := hg.BlockToOwner[blockID]
+		switch count := countInt(hg.OwnerToBlocks[owner], blockID); {
+		case count == 0:
+			c.report(finding(api.IPAMCheckOwnerMismatch, blockID, "block %s of %s is not among blocks of the owner", hg.Blocks[blockID].CIDR, owner),
+				func() error { hg.OwnerToBlocks[owner] = append(hg.OwnerToBlocks[owner], blockID); return nil })
+		case count > 1:
+			c.report(finding(api.IPAMCheckOwnerMismatch, blockID, "block %s is listed %d times among blocks of %s", hg.Blocks[blockID].CIDR, count, owner),
+				func() error {
+					hg.OwnerToBlocks[owner] = append(removeInt(hg.OwnerToBlocks[owner], blockID), blockID)
+					return nil
+				})
+		}
+	}
+	for _, owner := range owners {
+		for _, blockID := range hg.OwnerToBlocks[owner] {
+			if !validID(blockID) {
+				continue
+			}
+			actualOwner, ok := hg.BlockToOwner[blockID]
+			if ok && actualOwner == owner {
+				continue
+			}
+			owner, blockID := owner, blockID
+			msg := fmt.Sprintf("block %s is among blocks of %s but is not owned", hg.Blocks[blockID].CIDR, owner)
+			if ok {
+				msg = fmt.Sprintf("block %s is among blocks of %s but is owned by %s", hg.Blocks[blockID].CIDR, owner, actualOwner)
+			}
+			c.report(finding(api.IPAMCheckOwnerMismatch, blockID, "%s", msg),
+				func() error { hg.OwnerToBlocks[owner] = removeInt(hg.OwnerToBlocks[owner], blockID); return nil })
+		}
+	}
+
+	// Owned blocks must be on a host of this group.
+	hosts := make(map[string]bool)
+	for _, host := range hg.Hosts {
+		hosts[host.Name] = true
+	}
+	for _, blockID := range sortedBlockIDs(hg.BlockToOwner) {
+		if !validID(blockID) {
+			continue
+		}
+		host, ok := hg.BlockToHost[blockID]
+		if !ok {
+			c.report(finding(api.IPAMCheckMissingHost, blockID, "block %s of %s is not assigned to a host", hg.Blocks[blockID].CIDR, hg.BlockToOwner[blockID]), nil)
+		} else if !hosts[host] {
+			c.report(finding(api.IPAMCheckMissingHost, blockID, "block %s of %s is assigned to host %s which is not in group %s", hg.Blocks[blockID].CIDR, hg.BlockToOwner[blockID], host, hg.CIDR), nil)
+		}
+	}
+	for _, blockID := range sortedBlockIDs(hg.BlockToHost) {
+		if !validID(blockID) {
+			continue
+		}
+		if _, ok := hg.BlockToOwner[blockID]; ok || !hg.Blocks[blockID].isEmpty() {
+			continue
+		}
+		blockID := blockID
+		c.report(finding(api.IPAMCheckMissingHost, blockID, "empty block %s has no owner but is assigned to host %s", hg.Blocks[blockID].CIDR, hg.BlockToHost[blockID]),
+			func() error { delete(hg.BlockToHost, blockID); return nil })
+	}
+
+	// Reusable blocks must be listed once, and not be owned.
+	dedupReusable := func() error {
+		seen := make(map[int]bool)
+		reusable := make([]int, 0, len(hg.ReusableBlocks))
+		for _, blockID := range hg.ReusableBlocks {
+			if !seen[blockID] {
+				seen[blockID] = true
+				reusable = append(reusable, blockID)
+			}
+		}
+		hg.ReusableBlocks = reusable
+		return nil
+	}
+	seen := make(map[int]bool)
+	for _, blockID := range hg.ReusableBlocks {
+		if !validID(blockID) {
+			continue
+		}
+		blockID := blockID
+		if seen[blockID] {
+			c.report(finding(api.IPAMCheckReusableBlock, blockID, "block %s is listed as reusable more than once", hg.Blocks[blockID].CIDR), dedupReusable)
+			continue
+		}
+		seen[blockID] = true
+		if owner, ok := hg.BlockToOwner[blockID]; ok {
+			c.report(finding(api.IPAMCheckReusableBlock, blockID, "block %s is listed as reusable but is owned by %s", hg.Blocks[blockID].CIDR, owner),
+				func() error { hg.ReusableBlocks = removeInt(hg.ReusableBlocks, blockID); return nil })
+		}
+	}
+
+	// Every block must be within the group, and be either
+	// owned or, if empty, reusable.
+	for blockID, block := range hg.Blocks {
+		blockID := blockID
+		if !hg.CIDR.Contains(block.CIDR) {
+			c.report(finding(api.IPAMCheckBlockOutsideGroup, blockID, "block %s is not within group %s", block.CIDR, hg.CIDR), nil)
+		}
+		if _, ok := hg.BlockToOwner[blockID]; ok {
+			continue
+		}
+		if !block.isEmpty() {
+			c.report(finding(api.IPAMCheckUnownedBlock, blockID, "block %s has %d allocated address(es) but no owner", block.CIDR, len(block.ListAllocatedAddresses())), nil)
+		} else if countInt(hg.ReusableBlocks, blockID) == 0 {
+			c.report(finding(api.IPAMCheckLostBlock, blockID, "empty block %s is neither owned nor reusable", block.CIDR),
+				func() error { hg.ReusableBlocks = append(hg.ReusableBlocks, blockID); return nil })
+		}
+	}
+}
+
+// checkAddresses verifies that every allocated address has exactly
+// one name, that every named address is allocated, that no allocated
+// address is blacked out, and that every lease is of a named address.
+func (ipam *IPAM) checkAddresses(c *checker) {
+	named := make(map[string]string)
+	for _, addrMap := range []map[string]net.IP{ipam.AddressNameToIP, ipam.AddressNameToIPv6} {
+		names := make([]string, 0, len(addrMap))
+		for name := range addrMap {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ip := addrMap[name]
+			f := api.IPAMCheckFinding{Address: ip, Name: name}
+			if otherName, ok := named[ip.String()]; ok {
+				f.Kind = api.IPAMCheckDuplicateAddress
+				f.Message = fmt.Sprintf("address %s is named both %s and %s", ip, otherName, name)
+				c.report(f, nil)
+				continue
+			}
+			named[ip.String()] = name
+			group, blockID := ipam.findBlock(ip)
+			if group == nil {
+				f.Kind = api.IPAMCheckAddressOutsideBlocks
+				f.Message = fmt.Sprintf("address %s of %s is not in any block", ip, name)
+				c.report(f, nil)
+				continue
+			}
+			block := group.Blocks[blockID]
+			if block.isAllocated(ip) {
+				continue
+			}
+			f.Kind = api.IPAMCheckUnallocatedAddress
+			f.Network = group.network.Name
+			f.Block = block.CIDR.String()
+			f.Message = fmt.Sprintf("address %s of %s is not allocated in block %s", ip, name, block.CIDR)
+			var repairFn func() error
+			if _, ok := group.BlockToOwner[blockID]; ok {
+				// Only allocate in an owned block, as an owner
+				// cannot be determined for a reusable one.
+				repairFn = func() error { return block.allocateSpecificIP(ip) }
+			}
+			c.report(f, repairFn)
+		}
+	}
+
+	for _, netName := range ipam.sortedNetworkNames() {
+		network := ipam.Networks[netName]
+		if network.Group == nil {
+			continue
+		}
+		for _, block := range network.Group.ListBlocks() {
+			for _, ipStr := range block.ListAllocatedAddresses() {
+				ip := net.ParseIP(ipStr)
+				f := api.IPAMCheckFinding{Network: netName, Block: block.CIDR.String(), Address: ip}
+				name, ok := named[ip.String()]
+				if !ok {
+					f.Kind = api.IPAMCheckUnnamedAddress
+					f.Message = fmt.Sprintf("address %s in block %s is allocated but has no name", ip, block.CIDR)
+					c.report(f, func() error { return network.deallocateIP(ip) })
+					continue
+				}
+				if blackedOutBy := network.blackedOutBy(ip); blackedOutBy != nil {
+					f.Kind = api.IPAMCheckBlackedOutAddress
+					f.Name = name
+					f.Message = fmt.Sprintf("address %s of %s is blacked out by %s", ip, name, blackedOutBy)
+					c.report(f, nil)
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(ipam.AddressNameToLease))
+	for name := range ipam.AddressNameToLease {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := ipam.AddressNameToIP[name]; ok {
+			continue
+		}
+		name := name
+		c.report(api.IPAMCheckFinding{
+			Kind:    api.IPAMCheckStaleLease,
+			Name:    name,
+			Message: fmt.Sprintf("lease of %s is for an address that is not allocated", name),
+		}, func() error { delete(ipam.AddressNameToLease, name); return nil })
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/romana/core/common/api"
+)
+
+func TestCheck(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"}
+  ]}]}]
+}`)
+	for _, name := range []string{"pod1", "pod2", "pod3"} {
+		_, err := ipam.AllocateIP(name, "host1", "ten1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := ipam.AllocateIP("pod4", "host1", "ten2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := ipam.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Findings) != 0 {
+		t.Fatalf("Expected no findings, got %v", resp.Findings)
+	}
+
+	// Break the state in several ways.
+	ipam.load(ipam, nil)
+	group := ipam.Networks["net1"].Group.leafGroups()[0]
+	// pod1 loses its name, leaking 10.0.0.0.
+	delete(ipam.AddressNameToIP, "pod1")
+	// pod2 is no longer allocated in its block.
+	group.Blocks[0].Pool.ReclaimID(group.Blocks[0].CIDR.ipToInt(net.ParseIP("10.0.0.1")))
+	// Owner of block 1 forgets about it.
+	group.OwnerToBlocks["ten2:"] = nil
+	// Block 1 is also listed as reusable.
+	group.ReusableBlocks = append(group.ReusableBlocks, 1)
+	// pod3 is in a blacked out CIDR.
+	blackOut, _ := NewCIDR("10.0.0.2/31")
+	ipam.Networks["net1"].BlackedOut = append(ipam.Networks["net1"].BlackedOut, blackOut)
+	ipam.save(ipam, nil)
+
+	expected := []struct {
+		kind       string
+		repairable bool
+	}{
+		{api.IPAMCheckOwnerMismatch, true},
+		{api.IPAMCheckReusableBlock, true},
+		{api.IPAMCheckUnallocatedAddress, true},
+		{api.IPAMCheckUnnamedAddress, true},
+		{api.IPAMCheckBlackedOutAddress, false},
+		{api.IPAMCheckStaleLease, true},
+	}
+	for _, repair := range []bool{false, true} {
+		resp, err = ipam.Check(repair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Findings) != len(expected) {
+			t.Fatalf("Expected %d findings, got %v", len(expected), resp.Findings)
+		}
+		for i, f := range resp.Findings {
+			t.Logf("Finding: %s", f.Message)
+			if f.Kind != expected[i].kind || f.Repairable != expected[i].repairable {
+				t.Fatalf("Expected %s (repairable: %t) at %d, got %v", expected[i].kind, expected[i].repairable, i, f)
+			}
+			if f.Repaired != (repair && f.Repairable) {
+				t.Fatalf("Unexpected repair status of %v", f)
+			}
+		}
+	}
+
+	// Only the blacked out address is left.
+	resp, err = ipam.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Findings) != 1 || resp.Findings[0].Kind != api.IPAMCheckBlackedOutAddress {
+		t.Fatalf("Expected only blacked out address, got %v", resp.Findings)
+	}
+	ipam.load(ipam, nil)
+	if !ipam.Networks["net1"].Group.leafGroups()[0].Blocks[0].isAllocated(net.ParseIP("10.0.0.1")) {
+		t.Fatal("Expected 10.0.0.1 of pod2 to be allocated again")
+	}
+	ip, err := ipam.AllocateIP("pod5", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" {
+		t.Fatalf("Expected leaked 10.0.0.0 to be reused, got %s", ip)
+	}
+}
@@ -22,6 +22,7 @@ import (
 
 	"encoding/json"
 
+	libkvStore "github.com/docker/libkv/store"
 	"github.com/romana/core/common"
 	"github.com/romana/core/common/api"
 	"github.com/romana/core/common/log/trace"
@@ -40,9 +41,16 @@ const (
 type Client struct {
 	savingMutex *sync.RWMutex
 	config      *common.Config
-	Store       *Store
-	ipamLocker  Locker
-	IPAM        *IPAM
+	Store       Store
+	// Serializes changes of IPAM within this process; changes of
+	// different processes are saved with compare-and-swap instead.
+	ipamLocker Locker
+	IPAM       *IPAM
+
+	// Shards of IPAM as last loaded or saved, by the key
+	// they are stored under (which is never reused).
+	shardMutex sync.Mutex
+	shardCache map[string][]byte
 }
 
 // NewClient creates a new Client object based on provided config
@@ -50,7 +58,7 @@ func NewClient(config *common.Config) (*Client, error) {
 	if config.EtcdPrefix == "" {
 		config.EtcdPrefix = DefaultEtcdPrefix
 	}
-	store, err := NewStore(config.EtcdEndpoints, config.EtcdPrefix)
+	store, err := NewStore(config)
 	if err != nil {
 		return nil, err
 	}
@@ -61,6 +69,10 @@ func NewClient(config *common.Config) (*Client, error) {
 		savingMutex: &sync.RWMutex{},
 	}
 
+	err = c.checkSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
 	err = c.initIPAM(config.InitialTopologyFile)
 	if err != nil {
 		return nil, err
@@ -124,14 +136,14 @@ func (c *Client) WatchBlocksWithCallback(cb BlocksCallback) error {
 // to watching for blocks.
 func (c *Client) WatchBlocks(stopCh <-chan struct{}) (<-chan api.IPAMBlocksResponse, error) {
 	log.Tracef(trace.Public, "Entering WatchBlocks.")
-	ch, err := c.Store.ReconnectingWatch(ipamDataKey, stopCh)
+	ch, err := c.watchIPAMChanges(stopCh)
 	if err != nil {
 		return nil, err
 	}
 	outCh := make(chan api.IPAMBlocksResponse)
-	// Since for now everything is stored in a single blob, we are going to get
-	// notification on all changes. We can filter them out by checking for
-	// the revision in the block list.
+	// We are going to get notification on all changes of IPAM, not only
+	// of blocks. We can filter them out by checking for the revision in
+	// the block list.
 	lastBlockListRevision := -1
 
 	go func() {
@@ -141,16 +153,20 @@ func (c *Client) WatchBlocks(stopCh <-chan struct{}) (<-chan api.IPAMBlocksRespo
 			case <-stopCh:
 				log.Tracef(trace.Inside, "WatchBlocks: Stop message received")
 				return
-			case kv := <-ch:
+			case index := <-ch:
+				log.Tracef(trace.Inside, "WatchBlocks: got change at %d", index)
+				kv, err := c.Store.Get(ipamDataKey)
+				if err != nil {
+					log.Errorf("WatchBlocks: Error getting IPAM: %s", err)
+					break
+				}
 				ipamJson := string(kv.Value)
-				log.Tracef(trace.Inside, "WatchBlocks: got JSON [%s]", ipamJson)
-
-				ipam, err := parseIPAM(ipamJson)
+				ipam, err := c.loadIPAM(kv)
 				if err != nil {
 					if ipamJson == "" {
 						log.Warnf("WatchBlocks: Received empty IPAM JSON from KV store")
 					} else {
-						log.Errorf("WatchBlocks: Error parsing IPAM JSON ```%s ```: %s", ipamJson, err)
+						log.Errorf("WatchBlocks: Error loading IPAM ```%s ```: %s", ipamJson, err)
 					}
 					break
 				}
@@ -177,9 +193,10 @@ func (c *Client) WatchHosts(stopCh <-chan struct{}) (<-chan api.HostList, error)
 		return nil, err
 	}
 	outCh := make(chan api.HostList)
-	// Since for now everything is stored in a single blob, we are going to get
-	// notification on all changes. We can filter them out by checking for
-	// IPAM's TopologyRevision.
+	// The manifest of IPAM shards changes on all changes of topology, and
+	// possibly on others, so we are going to get notification on some of
+	// them too. We can filter them out by checking for IPAM's
+	// TopologyRevision.
 	lastHostListRevision := -1
 
 	go func() {
@@ -191,10 +208,10 @@ func (c *Client) WatchHosts(stopCh <-chan struct{}) (<-chan api.HostList, error)
 				return
 			case kv := <-ch:
 				ipamJson := string(kv.Value)
-				ipam, err := parseIPAM(ipamJson)
+				ipam, err := c.loadIPAM(kv)
 				log.Tracef(trace.Inside, "WatchHosts: got %s", ipamJson)
 				if err != nil {
-					log.Errorf("WatchHosts: Error parsing IPAM: %s", err)
+					log.Errorf("WatchHosts: Error loading IPAM: %s", err)
 					continue
 				}
 				hostList := ipam.ListHosts()
@@ -313,19 +330,22 @@ func (c *Client) initIPAM(initialTopologyFile *string) error {
 	} else {
 		log.Tracef(trace.Inside, "initIPAM(): Entered.")
 	}
-	var err error
-	c.ipamLocker, err = c.Store.NewLocker(ipamKey)
+	// Changes of IPAM are saved with compare-and-swap (see IPAM.update),
+	// so the lock in the store is only taken while initializing IPAM.
+	// Within this process, changes are serialized with a mutex.
+	c.ipamLocker = newMutexLocker()
+	initLocker, err := c.Store.NewLocker(ipamKey)
 	if err != nil {
 		return err
 	}
-	log.Tracef(trace.Inside, "initIPAM(): Created locker %v", c.ipamLocker)
+	log.Tracef(trace.Inside, "initIPAM(): Created locker %v", initLocker)
 
-	ch, err := c.ipamLocker.Lock()
+	ch, err := initLocker.Lock()
 	if err != nil {
 		return err
 	}
-	log.Tracef(trace.Inside, "initIPAM(): Got lock")
-	defer c.ipamLocker.Unlock()
+	log.Tracef(trace.Inside, "initIPAM(): Got lock with token %d", initLocker.Token())
+	defer initLocker.Unlock()
 
 	// Check if IPAM info exists in the store
 	var ipamExists bool
@@ -335,27 +355,30 @@ func (c *Client) initIPAM(initialTopologyFile *string) error {
 	}
 	log.Infof("IPAM exists at %s: %t", ipamDataKey, ipamExists)
 	// make sure there is sane data in ipam.
+	var kv *libkvStore.KVPair
 	if ipamExists {
-		ipamData, err := c.Store.GetString(ipamDataKey, "")
+		kv, err = c.Store.Get(ipamDataKey)
 		if err != nil {
 			log.Errorf("Error while fetching ipam data: %s", err)
 			return err
 		}
-		log.Debugf("IPAM data: %s", ipamData)
-		if ipamData == "" {
+		log.Debugf("IPAM data: %s", string(kv.Value))
+		if len(kv.Value) == 0 {
 			log.Trace(trace.Inside, "Setting ipamExists to false because ipamData = \"\"")
 			ipamExists = false
 		} else {
-			ipam := &IPAM{}
-			err := json.Unmarshal([]byte(ipamData), ipam)
+			c.IPAM, err = c.loadIPAM(kv)
 			if err != nil {
-				log.Errorf("Error while un-marshalling ipam data: %s", err)
+				log.Errorf("Error while loading ipam data: %s", err)
 				return err
 			}
-			if ipam.AllocationRevision < 1 && ipam.TopologyRevision < 1 {
-				log.Warnf("Allocation revision: %d, Topology revision %d, deleting", ipam.AllocationRevision, ipam.TopologyRevision)
-				c.Store.Delete(ipamDataKey)
-				log.Trace(trace.Inside, "Setting ipamExists to false because deleted")
+			if c.IPAM.AllocationRevision < 1 && c.IPAM.TopologyRevision < 1 {
+				// IPAM that was never changed is replaced, but only
+				// if it has nothing that would be lost.
+				if len(c.IPAM.Networks) > 0 || len(c.IPAM.AddressNameToIP) > 0 {
+					return common.NewError("IPAM at %s has allocation revision %d and topology revision %d, but is not empty, refusing to replace it", ipamDataKey, c.IPAM.AllocationRevision, c.IPAM.TopologyRevision)
+				}
+				log.Warnf("IPAM at %s was never changed (allocation revision %d, topology revision %d), replacing it", ipamDataKey, c.IPAM.AllocationRevision, c.IPAM.TopologyRevision)
 				ipamExists = false
 			}
 		}
@@ -365,27 +388,23 @@ func (c *Client) initIPAM(initialTopologyFile *string) error {
 		if initialTopologyFile != nil && *initialTopologyFile != "" {
 			log.Infof("Ignoring initial topology file %s as IPAM already exists", *initialTopologyFile)
 		}
-		// Load if exists
-		log.Infof("Loading IPAM data from %s", c.Store.getKey(ipamDataKey))
-		kv, err := c.Store.Get(ipamDataKey)
-		if err != nil {
-			return err
-		}
-		c.IPAM, err = parseIPAM(string(kv.Value))
-		if err != nil {
-			return err
-		}
+		log.Infof("Loaded IPAM data from %s", ipamDataKey)
 		c.IPAM.save = c.save
 		c.IPAM.load = c.load
 		c.IPAM.locker = c.ipamLocker
-		c.IPAM.SetPrevKVPair(kv)
+		c.IPAM.renewals = c
 	} else {
 		// If does not exist -- initialize with initial topology.
 
-		log.Infof("No IPAM data found at %s, initializing", c.Store.getKey(ipamDataKey))
+		log.Infof("No IPAM data found at %s, initializing", ipamDataKey)
 		c.IPAM = &IPAM{locker: c.ipamLocker,
-			save: c.save,
-			load: c.load,
+			save:     c.save,
+			load:     c.load,
+			renewals: c,
+		}
+		if kv != nil {
+			// Replace IPAM that was never changed.
+			c.IPAM.SetPrevKVPair(kv)
 		}
 
 		if initialTopologyFile != nil && *initialTopologyFile != "" {
@@ -404,7 +423,7 @@ func (c *Client) initIPAM(initialTopologyFile *string) error {
 			}
 			log.Infof("Initialized IPAM with %s", *initialTopologyFile)
 		}
-		err = c.save(c.IPAM, ch)
+		err = c.saveLocked(c.IPAM, ch, initLocker)
 		if err != nil {
 			return err
 		}
@@ -418,17 +437,22 @@ func (c *Client) load(ipam *IPAM, ch <-chan struct{}) error {
 	if err != nil {
 		return err
 	}
-	parsedIPAM, err := parseIPAM(string(kv.Value))
+	loadedIPAM, err := c.loadIPAM(kv)
 	if err != nil {
 		return err
 	}
-	*ipam = *parsedIPAM
-	ipam.SetPrevKVPair(kv)
+	*ipam = *loadedIPAM
 	return nil
 }
 
 // save implements the Saver interface of IPAM.
 func (c *Client) save(ipam *IPAM, ch <-chan struct{}) error {
+	return c.saveLocked(ipam, ch, nil)
+}
+
+// saveLocked saves IPAM changed under the lock in the store, if any,
+// with the fencing token of the lock (see saveIPAM).
+func (c *Client) saveLocked(ipam *IPAM, ch <-chan struct{}, locker Locker) error {
 	log.Tracef(trace.Inside, "Trying to acquire savingMutex\n")
 	c.savingMutex.Lock()
 	log.Tracef(trace.Inside, "Acquired savingMutex\n")
@@ -446,16 +470,25 @@ func (c *Client) save(ipam *IPAM, ch <-chan struct{}) error {
 
 		// Probably no need to reload the state at this point,
 		// as it would be detected by the watch.
-		//		err = common.NewError("Lost lock while saving in %d: %p", getGID(), &msg)
 		log.Warn(fmt.Sprintf("Lost lock while saving in %d: %p", getGID(), &msg))
-		return nil
+		return common.NewError("Lost lock while saving IPAM")
 	default:
-		err = c.Store.AtomicPut(ipamDataKey, ipam)
+		// A lock in the store may have been taken over by now even
+		// if its loss was not noticed yet. Saving is refused then,
+		// but it is cheaper to find out before writing any shards.
+		if locker != nil {
+			err = locker.Fence()
+			if err != nil {
+				log.Errorf("Not saving IPAM: %s", err)
+				return err
+			}
+		}
+		err = c.saveIPAM(ipam, locker)
 		if err != nil {
 			log.Errorf("Error saving IPAM: %s: %d", err, getGID())
 			return err
 		}
-		log.Tracef(trace.Inside, "%d: Saved IPAM (Alloc rev: %d, Topo rev: %d): IPAM rev %d", getGID(), ipam.AllocationRevision, ipam.TopologyRevision, c.IPAM.GetPrevKVPair().LastIndex)
+		log.Tracef(trace.Inside, "%d: Saved IPAM (Alloc rev: %d, Topo rev: %d): IPAM rev %d", getGID(), ipam.AllocationRevision, ipam.TopologyRevision, ipam.GetPrevKVPair().LastIndex)
 		return nil
 	}
 }
@@ -465,7 +498,7 @@ func (c *Client) save(ipam *IPAM, ch <-chan struct{}) error {
 func (c *Client) watchIPAM() error {
 	log.Tracef(trace.Public, "Entering watchIPAM.")
 	stopCh := make(<-chan struct{})
-	ch, err := c.Store.ReconnectingWatch(ipamDataKey, stopCh)
+	ch, err := c.watchIPAMChanges(stopCh)
 	if err != nil {
 		return err
 	}
@@ -475,11 +508,12 @@ func (c *Client) watchIPAM() error {
 		for {
 
 			select {
-			case kv := <-ch:
+			case index := <-ch:
 				c.savingMutex.RLock()
-				prevKV := c.IPAM.GetPrevKVPair()
-				if prevKV == nil || kv.LastIndex > prevKV.LastIndex {
-					log.Debugf("Received IPAM with revision %d, current last revision %d", kv.LastIndex, prevKV.LastIndex)
+				lastIndex := c.IPAM.lastIndex()
+				if index > lastIndex {
+					log.Debugf("Received IPAM change with revision %d, current last revision %d", index, lastIndex)
+					kv, err := c.Store.Get(ipamDataKey)
 					if err != nil {
 						log.Error(err)
 						// Nothing to do here, but since there is a new version,
@@ -488,16 +522,18 @@ func (c *Client) watchIPAM() error {
 						c.savingMutex.RUnlock()
 						continue
 					}
-					c.IPAM, err = parseIPAM(string(kv.Value))
+					ipam, err := c.loadIPAM(kv)
 					if err != nil {
 						log.Error(err)
 						c.savingMutex.RUnlock()
 						continue
 					}
+					c.IPAM = ipam
 					c.IPAM.save = c.save
 					c.IPAM.load = c.load
-					c.IPAM.SetPrevKVPair(kv)
-					log.Debugf("Loaded IPAM with revision %d", kv.LastIndex)
+					c.IPAM.locker = c.ipamLocker
+					c.IPAM.renewals = c
+					log.Debugf("Loaded IPAM with revision %d", c.IPAM.lastIndex())
 				}
 				c.savingMutex.RUnlock()
 			}
@@ -0,0 +1,799 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/docker/libkv"
+	libkvStore "github.com/docker/libkv/store"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/log/trace"
+	log "github.com/romana/rlog"
+)
+
+const (
+	// Versions of etcd API the Store can use.
+	EtcdAPIv2 = 2
+	EtcdAPIv3 = 3
+
+	etcdV3DialTimeout    = 5 * time.Second
+	etcdV3RequestTimeout = 10 * time.Second
+	// Same as libkv's default for etcd v2 locks.
+	etcdV3LockTTL = 20 * time.Second
+
+	// Key under the prefix recording that data was migrated
+	// from etcd v2 API.
+	etcdV2MigratedKey = "/migrations/etcdv2"
+)
+
+// etcdV3 implements libkv's store.Store interface with etcd v3 API,
+// so that Store can use either version of the API. LastIndex of
+// key-value pairs is the revision the key was last modified at, and
+// AfterIndex of watches is a revision to watch from (exclusive).
+// There are no directories in v3: a directory is all keys with
+// its name as prefix.
+type etcdV3 struct {
+	client *clientv3.Client
+}
+
+func newEtcdV3(etcdEndpoints []string, options *libkvStore.Config) (*etcdV3, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   etcdEndpoints,
+		DialTimeout: etcdV3DialTimeout,
+		TLS:         options.TLS,
+		Username:    options.Username,
+		Password:    options.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdV3{client: cli}, nil
+}
+
+func (e *etcdV3) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+}
+
+// dirPrefix returns the prefix of keys in the directory.
+func dirPrefix(directory string) string {
+	return strings.TrimSuffix(directory, "/") + "/"
+}
+
+func etcdV3KVPair(kv *mvccpb.KeyValue) *libkvStore.KVPair {
+	return &libkvStore.KVPair{
+		Key:       string(kv.Key),
+		Value:     kv.Value,
+		LastIndex: uint64(kv.ModRevision),
+	}
+}
+
+// etcdV3Action returns the etcd v2 action corresponding to the event,
+// as used in libkv's KVPairExt.
+func etcdV3Action(ev *clientv3.Event) string {
+	switch {
+	case ev.Type == mvccpb.DELETE:
+		return "delete"
+	case ev.IsCreate():
+		return "create"
+	}
+	return "set"
+}
+
+func etcdV3KVPairExt(ev *clientv3.Event) *libkvStore.KVPairExt {
+	kvp := &libkvStore.KVPairExt{
+		Key:       string(ev.Kv.Key),
+		Value:     string(ev.Kv.Value),
+		Action:    etcdV3Action(ev),
+		LastIndex: uint64(ev.Kv.ModRevision),
+	}
+	if ev.PrevKv != nil {
+		kvp.PrevValue = string(ev.PrevKv.Value)
+	}
+	return kvp
+}
+
+// leaseOptions grants a lease if options specify a TTL, and returns
+// options to put a key with it.
+func (e *etcdV3) leaseOptions(options *libkvStore.WriteOptions) ([]clientv3.OpOption, error) {
+	if options == nil || options.TTL == 0 {
+		return nil, nil
+	}
+	ttl := int64(options.TTL / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	ctx, cancel := e.ctx()
+	defer cancel()
+	lease, err := e.client.Grant(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return []clientv3.OpOption{clientv3.WithLease(lease.ID)}, nil
+}
+
+func (e *etcdV3) Put(key string, value []byte, options *libkvStore.WriteOptions) error {
+	opts, err := e.leaseOptions(options)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := e.ctx()
+	defer cancel()
+	_, err = e.client.Put(ctx, key, string(value), opts...)
+	return err
+}
+
+func (e *etcdV3) Get(key string) (*libkvStore.KVPair, error) {
+	ctx, cancel := e.ctx()
+	defer cancel()
+	resp, err := e.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, libkvStore.ErrKeyNotFound
+	}
+	return etcdV3KVPair(resp.Kvs[0]), nil
+}
+
+// GetExt gets the key, or if options are recursive, the revision of
+// the directory. Unlike with v2 API, there is no etcd response to
+// get from the result; use listTree for contents of directories.
+func (e *etcdV3) GetExt(key string, options libkvStore.GetOptions) (*libkvStore.KVPairExt, error) {
+	if !options.Recursive {
+		kvp, err := e.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return &libkvStore.KVPairExt{Key: kvp.Key, Value: string(kvp.Value), LastIndex: kvp.LastIndex}, nil
+	}
+	_, revision, err := e.listTree(key)
+	if err != nil {
+		return nil, err
+	}
+	return &libkvStore.KVPairExt{Key: key, Dir: true, LastIndex: revision}, nil
+}
+
+// listTree returns all key-value pairs under the directory, and the
+// revision they were listed at.
+func (e *etcdV3) listTree(directory string) ([]*libkvStore.KVPair, uint64, error) {
+	ctx, cancel := e.ctx()
+	defer cancel()
+	resp, err := e.client.Get(ctx, dirPrefix(directory), clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	kvps := make([]*libkvStore.KVPair, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvps = append(kvps, etcdV3KVPair(kv))
+	}
+	return kvps, uint64(resp.Header.Revision), nil
+}
+
+func (e *etcdV3) Delete(key string) error {
+	ctx, cancel := e.ctx()
+	defer cancel()
+	resp, err := e.client.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return libkvStore.ErrKeyNotFound
+	}
+	return nil
+}
+
+func (e *etcdV3) Exists(key string) (bool, error) {
+	ctx, cancel := e.ctx()
+	defer cancel()
+	resp, err := e.client.Get(ctx, key, clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return resp.Count > 0, nil
+}
+
+// List lists all key-value pairs under the directory, including
+// ones in its subdirectories.
+func (e *etcdV3) List(directory string) ([]*libkvStore.KVPair, error) {
+	kvps, _, err := e.listTree(directory)
+	if err != nil {
+		return nil, err
+	}
+	if len(kvps) == 0 {
+		return nil, libkvStore.ErrKeyNotFound
+	}
+	return kvps, nil
+}
+
+func (e *etcdV3) DeleteTree(directory string) error {
+	ctx, cancel := e.ctx()
+	defer cancel()
+	_, err := e.client.Delete(ctx, dirPrefix(directory), clientv3.WithPrefix())
+	return err
+}
+
+// atomicError returns the error libkv returns when the comparison of
+// an atomic operation fails; resp is expected to have the count of
+// the key.
+func atomicError(previous *libkvStore.KVPair, resp *clientv3.TxnResponse) error {
+	if previous == nil {
+		return libkvStore.ErrKeyExists
+	}
+	if len(resp.Responses) > 0 && resp.Responses[0].GetResponseRange().Count == 0 {
+		return libkvStore.ErrKeyNotFound
+	}
+	return libkvStore.ErrKeyModified
+}
+
+// AtomicPut puts the value in a transaction, provided the key was
+// not modified since the previous pair, or does not exist if there
+// is none.
+func (e *etcdV3) AtomicPut(key string, value []byte, previous *libkvStore.KVPair, options *libkvStore.WriteOptions) (bool, *libkvStore.KVPair, error) {
+	opts, err := e.leaseOptions(options)
+	if err != nil {
+		return false, nil, err
+	}
+	cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	if previous != nil {
+		cmp = clientv3.Compare(clientv3.ModRevision(key), "=", int64(previous.LastIndex))
+	}
+	ctx, cancel := e.ctx()
+	defer cancel()
+	resp, err := e.client.Txn(ctx).
+		If(cmp).
+		Then(clientv3.OpPut(key, string(value), opts...)).
+		Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return false, nil, err
+	}
+	if !resp.Succeeded {
+		return false, nil, atomicError(previous, resp)
+	}
+	return true, &libkvStore.KVPair{Key: key, Value: value, LastIndex: uint64(resp.Header.Revision)}, nil
+}
+
+// commit makes the changes in one transaction, provided none of their
+// keys were modified since their previous pairs, or exist if there are
+// none. As etcd limits operations in a transaction (128 by default), so
+// does this.
+func (e *etcdV3) commit(ops []StoreOp) (uint64, error) {
+	cmps := make([]clientv3.Cmp, 0, len(ops))
+	thenOps := make([]clientv3.Op, 0, len(ops))
+	for _, op := range ops {
+		if op.Previous == nil {
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(op.Key), "=", 0))
+		} else {
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(op.Key), "=", int64(op.Previous.LastIndex)))
+		}
+		switch {
+		case op.CompareOnly:
+		case op.Value == nil:
+			thenOps = append(thenOps, clientv3.OpDelete(op.Key))
+		default:
+			thenOps = append(thenOps, clientv3.OpPut(op.Key, string(op.Value)))
+		}
+	}
+	ctx, cancel := e.ctx()
+	defer cancel()
+	resp, err := e.client.Txn(ctx).If(cmps...).Then(thenOps...).Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, libkvStore.ErrKeyModified
+	}
+	return uint64(resp.Header.Revision), nil
+}
+
+// AtomicDelete deletes the key in a transaction, provided it was not
+// modified since the previous pair.
+func (e *etcdV3) AtomicDelete(key string, previous *libkvStore.KVPair) (bool, error) {
+	if previous == nil {
+		return false, libkvStore.ErrPreviousNotSpecified
+	}
+	ctx, cancel := e.ctx()
+	defer cancel()
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(previous.LastIndex))).
+		Then(clientv3.OpDelete(key)).
+		Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if !resp.Succeeded {
+		return false, atomicError(previous, resp)
+	}
+	return true, nil
+}
+
+// watch sends events on the key, from the revision on (or from now,
+// if 0), until stopCh is closed or the watch fails, closing the
+// returned channel. It is closed too if revisions to send next were
+// compacted, as events were lost; WatchExt then returns ErrCompacted
+// when resuming after the last one sent.
+func (e *etcdV3) watch(key string, rev int64, stopCh <-chan struct{}, opts ...clientv3.OpOption) <-chan *clientv3.Event {
+	out := make(chan *clientv3.Event)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stopCh:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	go func() {
+		defer close(out)
+		defer cancel()
+		watchOpts := append([]clientv3.OpOption{clientv3.WithRev(rev)}, opts...)
+		for wresp := range e.client.Watch(ctx, key, watchOpts...) {
+			if wresp.CompactRevision != 0 {
+				log.Warnf("Watch on %s: revision %d was compacted (up to %d), closing", key, rev, wresp.CompactRevision)
+				return
+			}
+			if err := wresp.Err(); err != nil {
+				log.Errorf("Watch on %s failed at revision %d: %s", key, rev, err)
+				return
+			}
+			for _, ev := range wresp.Events {
+				select {
+				case out <- ev:
+					rev = ev.Kv.ModRevision + 1
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		log.Tracef(trace.Inside, "Watch on %s closed at revision %d", key, rev)
+	}()
+	return out
+}
+
+// Watch sends the current value of the key, if any, and then its new
+// values; deletions are not sent.
+func (e *etcdV3) Watch(key string, stopCh <-chan struct{}) (<-chan *libkvStore.KVPair, error) {
+	ctx, cancel := e.ctx()
+	resp, err := e.client.Get(ctx, key)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	events := e.watch(key, resp.Header.Revision+1, stopCh)
+	out := make(chan *libkvStore.KVPair)
+	go func() {
+		defer close(out)
+		if len(resp.Kvs) > 0 {
+			select {
+			case out <- etcdV3KVPair(resp.Kvs[0]):
+			case <-stopCh:
+				return
+			}
+		}
+		for ev := range events {
+			if ev.Type == mvccpb.DELETE {
+				continue
+			}
+			select {
+			case out <- etcdV3KVPair(ev.Kv):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// WatchExt sends events on the key, or the keys under it if options
+// are recursive, after the revision in options. If there is none,
+// the current values are sent first, as "get" actions, unless
+// NoList is specified. If the revision was compacted, ErrCompacted
+// is returned.
+func (e *etcdV3) WatchExt(key string, options libkvStore.WatcherOptions, stopCh <-chan struct{}) (<-chan *libkvStore.KVPairExt, error) {
+	getOpts := make([]clientv3.OpOption, 0)
+	if options.Recursive {
+		key = dirPrefix(key)
+		getOpts = append(getOpts, clientv3.WithPrefix())
+	}
+	rev := int64(0)
+	current := make([]*libkvStore.KVPairExt, 0)
+	if options.AfterIndex > 0 {
+		rev = int64(options.AfterIndex) + 1
+		// Watching from a compacted revision only fails once the
+		// watch is established, so check for it first. A revision
+		// ahead of the store's, as after restoring it from a backup,
+		// has to be started over from too.
+		ctx, cancel := e.ctx()
+		_, err := e.client.Get(ctx, key, append([]clientv3.OpOption{clientv3.WithRev(rev - 1), clientv3.WithCountOnly()}, getOpts...)...)
+		cancel()
+		if err == rpctypes.ErrCompacted || err == rpctypes.ErrFutureRev {
+			return nil, ErrCompacted
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if !options.NoList {
+		ctx, cancel := e.ctx()
+		resp, err := e.client.Get(ctx, key, getOpts...)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			current = append(current, &libkvStore.KVPairExt{
+				Key:       string(kv.Key),
+				Value:     string(kv.Value),
+				Action:    "get",
+				LastIndex: uint64(kv.ModRevision),
+			})
+		}
+		rev = resp.Header.Revision + 1
+	}
+	events := e.watch(key, rev, stopCh, append(getOpts, clientv3.WithPrevKV())...)
+	out := make(chan *libkvStore.KVPairExt)
+	go func() {
+		defer close(out)
+		for _, kvp := range current {
+			select {
+			case out <- kvp:
+			case <-stopCh:
+				return
+			}
+		}
+		for ev := range events {
+			select {
+			case out <- etcdV3KVPairExt(ev):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// WatchTree sends all key-value pairs under the directory, and then
+// again every time they change.
+func (e *etcdV3) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*libkvStore.KVPair, error) {
+	kvps, revision, err := e.listTree(directory)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]*libkvStore.KVPair)
+	for _, kvp := range kvps {
+		tree[kvp.Key] = kvp
+	}
+	events := e.watch(dirPrefix(directory), int64(revision)+1, stopCh, clientv3.WithPrefix())
+	out := make(chan []*libkvStore.KVPair)
+	go func() {
+		defer close(out)
+		for {
+			list := make([]*libkvStore.KVPair, 0, len(tree))
+			for _, kvp := range tree {
+				list = append(list, kvp)
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+			select {
+			case out <- list:
+			case <-stopCh:
+				return
+			}
+			ev, ok := <-events
+			if !ok {
+				return
+			}
+			if ev.Type == mvccpb.DELETE {
+				delete(tree, string(ev.Kv.Key))
+			} else {
+				tree[string(ev.Kv.Key)] = etcdV3KVPair(ev.Kv)
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (e *etcdV3) WatchTreeExt(directory string, stopCh <-chan struct{}) (<-chan *libkvStore.KVPairExt, error) {
+	return e.WatchExt(directory, libkvStore.WatcherOptions{Recursive: true, NoList: true}, stopCh)
+}
+
+func (e *etcdV3) NewLock(key string, options *libkvStore.LockOptions) (libkvStore.Locker, error) {
+	ttl := etcdV3LockTTL
+	if options != nil && options.TTL != 0 {
+		ttl = options.TTL
+	}
+	return &etcdV3Lock{client: e.client, key: key, ttl: ttl}, nil
+}
+
+func (e *etcdV3) Close() {
+	err := e.client.Close()
+	if err != nil {
+		log.Errorf("Error closing etcd client: %s", err)
+	}
+}
+
+// etcdV3Lock implements libkv's store.Locker with a mutex of etcd's
+// concurrency package. The lock is held with a lease that is kept
+// alive for as long as the lock is held; if the lease is lost (e.g.
+// the holder cannot reach etcd), so is the lock.
+type etcdV3Lock struct {
+	client  *clientv3.Client
+	key     string
+	ttl     time.Duration
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+}
+
+// Lock waits for the lock until it gets it or stopChan is closed. The
+// returned channel is closed if the lock is lost.
+func (l *etcdV3Lock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+	session, err := concurrency.NewSession(l.client, concurrency.WithTTL(int(l.ttl/time.Second)))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	mutex := concurrency.NewMutex(session, l.key)
+	err = mutex.Lock(ctx)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	l.session = session
+	l.mutex = mutex
+	return session.Done(), nil
+}
+
+// Unlock releases the lock and revokes its lease.
+func (l *etcdV3Lock) Unlock() error {
+	if l.mutex == nil {
+		return common.NewError("Lock %s is not held", l.key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	err := l.mutex.Unlock(ctx)
+	l.session.Close()
+	l.session = nil
+	l.mutex = nil
+	return err
+}
+
+// etcdV3Locker implements Locker with a mutex of etcd's concurrency
+// package, for locks of Store (see kvStore.NewLocker). Unlike with
+// leaseLocker, the lease the lock is held with is expired by etcd
+// unless kept alive, so clocks of hosts need not agree. The fencing
+// token is the revision the lock was acquired at, which increases
+// with every acquisition.
+type etcdV3Locker struct {
+	client *clientv3.Client
+	name   string
+	key    string
+
+	mutex    sync.Mutex
+	session  *concurrency.Session
+	lock     *concurrency.Mutex
+	token    uint64
+	acquired time.Time
+	// Closed on Unlock, so that only losses of the lease
+	// while it is held are counted.
+	unlockCh chan struct{}
+}
+
+func (e *etcdV3) newLocker(name string, key string) Locker {
+	return &etcdV3Locker{client: e.client, name: name, key: key}
+}
+
+// Lock implements Lock method of Locker interface. It waits for the
+// lock for up to lockAcquireTimeout. The returned channel is closed
+// if the lease of the lock is lost.
+func (l *etcdV3Locker) Lock() (<-chan struct{}, error) {
+	start := time.Now()
+	session, err := concurrency.NewSession(l.client, concurrency.WithTTL(int(lockTTL/time.Second)))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lockAcquireTimeout)
+	defer cancel()
+	lock := concurrency.NewMutex(session, l.key)
+	err = lock.Lock(ctx)
+	if err != nil {
+		session.Close()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, lockTimeoutError(l.name, time.Since(start))
+		}
+		return nil, err
+	}
+
+	token := uint64(lock.Header().Revision)
+	unlockCh := make(chan struct{})
+	l.mutex.Lock()
+	l.session = session
+	l.lock = lock
+	l.token = token
+	l.acquired = time.Now()
+	l.unlockCh = unlockCh
+	l.mutex.Unlock()
+	go func() {
+		select {
+		case <-session.Done():
+			log.Errorf("Lost lock %s held with token %d", l.name, token)
+			LockLeasesLost.WithLabelValues(l.name).Inc()
+		case <-unlockCh:
+		}
+	}()
+
+	waited := time.Since(start)
+	LockAcquireSeconds.WithLabelValues(l.name).Observe(waited.Seconds())
+	LockHeld.WithLabelValues(l.name).Set(float64(token))
+	log.Infof("Acquired lock %s as %s with token %d after %s", l.name, lockHolder(), token, waited)
+	return session.Done(), nil
+}
+
+// Unlock implements Unlock method of Locker interface. The lock
+// is released and its lease revoked.
+func (l *etcdV3Locker) Unlock() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.lock == nil {
+		log.Errorf("Unlocking lock %s that is not held", l.name)
+		return
+	}
+	close(l.unlockCh)
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	err := l.lock.Unlock(ctx)
+	if err != nil {
+		// The lease is revoked anyway.
+		log.Errorf("Error releasing lock %s held with token %d: %s", l.name, l.token, err)
+	} else {
+		log.Infof("Released lock %s held with token %d for %s", l.name, l.token, time.Since(l.acquired))
+	}
+	l.session.Close()
+	LockHeld.DeleteLabelValues(l.name)
+	l.session = nil
+	l.lock = nil
+	l.token = 0
+}
+
+// Token implements Token method of Locker interface.
+func (l *etcdV3Locker) Token() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.token
+}
+
+// Fence implements Fence method of Locker interface, by checking that
+// the key of the lock, which is unique to its lease, still exists.
+func (l *etcdV3Locker) Fence() error {
+	l.mutex.Lock()
+	lock, token := l.lock, l.token
+	l.mutex.Unlock()
+	if lock == nil {
+		return common.NewError("Lock %s is not held", l.name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3RequestTimeout)
+	defer cancel()
+	resp, err := l.client.Get(ctx, lock.Key())
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return common.NewError("Lock %s held with token %d was lost", l.name, token)
+	}
+	return nil
+}
+
+// Name implements Name method of Locker interface.
+func (l *etcdV3Locker) Name() string {
+	return l.name
+}
+
+// v2Leaves returns key-value pairs of the node, if it is a key, or of
+// keys under it, if it is a directory.
+func v2Leaves(node *libkvStore.Node) []*libkvStore.KVPair {
+	if node == nil {
+		return nil
+	}
+	if !node.Dir {
+		return []*libkvStore.KVPair{{Key: node.Key, Value: []byte(node.Value), LastIndex: node.ModifiedIndex}}
+	}
+	kvps := make([]*libkvStore.KVPair, 0)
+	for _, child := range node.Nodes {
+		kvps = append(kvps, v2Leaves(child)...)
+	}
+	return kvps
+}
+
+// MigrateEtcdV2ToV3 copies keys under the prefix from etcd v2 API to
+// v3 API of the etcd in the config, except for locks, which are
+// only held by running processes. Keys that already exist in v3 are
+// not overwritten. Once done, this is recorded, and further
+// migrations do nothing. Returns the number of keys copied.
+func MigrateEtcdV2ToV3(config *common.Config) (int, error) {
+	prefix := config.EtcdPrefix
+	options, err := etcdStoreConfig(config)
+	if err != nil {
+		return 0, err
+	}
+	v3, err := newEtcdV3(config.EtcdEndpoints, options)
+	if err != nil {
+		return 0, err
+	}
+	defer v3.Close()
+	markerKey := normalize(prefix + etcdV2MigratedKey)
+	migrated, err := v3.Exists(markerKey)
+	if err != nil {
+		return 0, err
+	}
+	if migrated {
+		log.Infof("Keys under %s were already migrated from etcd v2 API", prefix)
+		return 0, nil
+	}
+
+	v2, err := libkv.NewStore(libkvStore.ETCD, config.EtcdEndpoints, options)
+	if err != nil {
+		return 0, err
+	}
+	defer v2.Close()
+	kvps := make([]*libkvStore.KVPair, 0)
+	root, err := v2.GetExt(normalize(prefix), libkvStore.GetOptions{Recursive: true})
+	switch {
+	case err == libkvStore.ErrKeyNotFound:
+		log.Infof("No keys under %s in etcd v2 API", prefix)
+	case err != nil:
+		return 0, err
+	default:
+		kvps = v2Leaves(root.GetResponse().Node)
+	}
+
+	lockPrefix := dirPrefix(normalize(prefix + "/lock"))
+	count := 0
+	for _, kvp := range kvps {
+		if strings.HasPrefix(kvp.Key, lockPrefix) {
+			continue
+		}
+		_, _, err = v3.AtomicPut(kvp.Key, kvp.Value, nil, nil)
+		if err == libkvStore.ErrKeyExists {
+			log.Infof("Key %s already exists in etcd v3 API, not migrating it", kvp.Key)
+			continue
+		}
+		if err != nil {
+			return count, common.NewError("Error migrating %s after %d keys: %s", kvp.Key, count, err)
+		}
+		log.Tracef(trace.Inside, "Migrated %s", kvp.Key)
+		count++
+	}
+	err = v3.Put(markerKey, []byte(time.Now().UTC().Format(time.RFC3339)), nil)
+	if err != nil {
+		return count, err
+	}
+	log.Infof("Migrated %d keys under %s from etcd v2 to v3 API", count, prefix)
+	return count, nil
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"testing"
+
+	libkvStore "github.com/docker/libkv/store"
+)
+
+func TestV2Leaves(t *testing.T) {
+	root := &libkvStore.Node{Key: "/romana", Dir: true, Nodes: []*libkvStore.Node{
+		{Key: "/romana/ipam", Dir: true, Nodes: []*libkvStore.Node{
+			{Key: "/romana/ipam/data", Value: "{}", ModifiedIndex: 7},
+			{Key: "/romana/ipam/shards", Dir: true},
+		}},
+		{Key: "/romana/policies", Dir: true, Nodes: []*libkvStore.Node{
+			{Key: "/romana/policies/p1", Value: "p1", ModifiedIndex: 3},
+		}},
+	}}
+	leaves := make([]string, 0)
+	for _, kvp := range v2Leaves(root) {
+		leaves = append(leaves, fmt.Sprintf("%s=%s@%d", kvp.Key, kvp.Value, kvp.LastIndex))
+	}
+	if fmt.Sprint(leaves) != "[/romana/ipam/data={}@7 /romana/policies/p1=p1@3]" {
+		t.Fatalf("Unexpected leaves %v", leaves)
+	}
+
+	if dirPrefix("/romana/policies") != "/romana/policies/" || dirPrefix("/romana/policies/") != "/romana/policies/" {
+		t.Fatalf("Unexpected directory prefixes %s, %s", dirPrefix("/romana/policies"), dirPrefix("/romana/policies/"))
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/api/errors"
+	log "github.com/romana/rlog"
+)
+
+// cordonedError is returned when a new block is needed
+// on a cordoned host.
+func cordonedError(hostName string) error {
+	return errors.NewRomanaConflictError(
+		fmt.Sprintf("Host %s is cordoned, no new blocks can be assigned to it", hostName),
+		"host", fmt.Sprintf("name=%s", hostName))
+}
+
+// hostAddressNames returns names, sorted, of addresses allocated
+// in blocks of the host.
+func (ipam *IPAM) hostAddressNames(hostName string) []string {
+	names := make([]string, 0)
+	for _, name := range ipam.sortedAddressNames() {
+		onHost := ipam.hostForIP(ipam.AddressNameToIP[name]) == hostName
+		if ipv6, ok := ipam.AddressNameToIPv6[name]; ok && !onHost {
+			onHost = ipam.hostForIP(ipv6) == hostName
+		}
+		if onHost {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// releaseBlock clears the block and returns it to ReusableBlocks.
+func (hg *Group) releaseBlock(blockID int) {
+	hg.Blocks[blockID].clear()
+	delete(hg.BlockToHost, blockID)
+	if owner, ok := hg.BlockToOwner[blockID]; ok {
+		delete(hg.BlockToOwner, blockID)
+		hg.OwnerToBlocks[owner] = removeInt(hg.OwnerToBlocks[owner], blockID)
+	}
+	if countInt(hg.ReusableBlocks, blockID) == 0 {
+		hg.ReusableBlocks = append(hg.ReusableBlocks, blockID)
+	}
+}
+
+// CordonHost marks the host as cordoned, so that no new blocks
+// are assigned to it, or, if cordoned is false, uncordons it.
+// Addresses can still be allocated in blocks the host already has.
+func (ipam *IPAM) CordonHost(hostName string, cordoned bool) error {
+	return ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		return latestIPAM.setCordoned(hostName, cordoned)
+	})
+}
+
+// setCordoned sets whether the host is cordoned, and returns whether
+// this changed anything.
+func (ipam *IPAM) setCordoned(hostName string, cordoned bool) (bool, error) {
+	found := false
+	changed := false
+	for _, network := range ipam.Networks {
+		if network.Group == nil {
+			continue
+		}
+		host := network.Group.findHostByName(hostName)
+		if host == nil {
+			continue
+		}
+		found = true
+		if host.Cordoned != cordoned {
+			host.Cordoned = cordoned
+			changed = true
+		}
+	}
+	if !found {
+		return false, errors.NewRomanaNotFoundError(fmt.Sprintf("Host %s not found", hostName),
+			"host",
+			fmt.Sprintf("hostname=%s", hostName))
+	}
+	if changed {
+		log.Infof("Host %s cordoned: %t", hostName, cordoned)
+		ipam.TopologyRevision++
+	}
+	return changed, nil
+}
+
+// DrainHost cordons the host and returns addresses still allocated
+// on it, which must be moved before the host can be removed without
+// forcing release of the addresses.
+func (ipam *IPAM) DrainHost(hostName string) (api.HostDrainResponse, error) {
+	var resp api.HostDrainResponse
+	err := ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		changed, err := latestIPAM.setCordoned(hostName, true)
+		if err != nil {
+			return false, err
+		}
+		resp = api.HostDrainResponse{Host: hostName, Addresses: make([]api.IPAMAddressResponse, 0)}
+		for _, name := range latestIPAM.hostAddressNames(hostName) {
+			resp.Addresses = append(resp.Addresses, api.IPAMAddressResponse{
+				Name: name,
+				IP:   latestIPAM.AddressNameToIP[name],
+				IPv6: latestIPAM.AddressNameToIPv6[name],
+			})
+		}
+		return changed, nil
+	})
+	if err != nil {
+		return api.HostDrainResponse{}, err
+	}
+	return resp, nil
+}
+
+// UpdateHost updates the IP, IPv6 address, agent port, tags and
+// Kubernetes info of the named host in all networks, keeping its
+// blocks. If replace is false, only attributes given (not empty)
+// are updated; otherwise all are replaced, and IP is required.
+//
+// If the host no longer satisfies requirements of its group with the
+// new tags, it is moved to a group it does satisfy them for (see
+// Group.addHost). This is refused if the host has allocated blocks,
+// as they cannot be moved along with it.
+func (ipam *IPAM) UpdateHost(hostName string, host api.Host, replace bool) (api.Host, error) {
+	if host.Name != "" && host.Name != hostName {
+		return api.Host{}, common.NewError400(fmt.Sprintf("Host %s cannot be renamed to %s", hostName, host.Name))
+	}
+	if replace && host.IP == nil {
+		return api.Host{}, common.NewError400("Host IP is required.")
+	}
+	var resp api.Host
+	err := ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		var err error
+		resp, err = latestIPAM.updateHost(hostName, host, replace)
+		return err == nil, err
+	})
+	if err != nil {
+		return api.Host{}, err
+	}
+	return resp, nil
+}
+
+func (ipam *IPAM) updateHost(hostName string, update api.Host, replace bool) (api.Host, error) {
+	found := false
+	var resp api.Host
+	for _, netName := range ipam.sortedNetworkNames() {
+		network := ipam.Networks[netName]
+		if network.Group == nil {
+			continue
+		}
+		host := network.Group.findHostByName(hostName)
+		if host == nil {
+			continue
+		}
+		found = true
+		if update.IP != nil && !update.IP.Equal(host.IP) {
+			if other := network.Group.findHostByIP(update.IP.String()); other != nil {
+				return api.Host{}, errors.NewRomanaExistsError("", update, "host", fmt.Sprintf("IP=%s", update.IP))
+			}
+		}
+
+		updated := *host
+		if replace || update.IP != nil {
+			updated.IP = update.IP
+		}
+		if replace || update.IPv6 != nil {
+			updated.IPv6 = update.IPv6
+		}
+		if replace || update.AgentPort != 0 {
+			updated.AgentPort = update.AgentPort
+		}
+		if updated.AgentPort == 0 {
+			updated.AgentPort = DefaultAgentPort
+		}
+		if replace || update.Tags != nil {
+			updated.Tags = update.Tags
+		}
+		if replace || update.K8SInfo != nil {
+			updated.K8SInfo = update.K8SInfo
+		}
+
+		err := network.Group.reassignHost(network, host, &updated)
+		if err != nil {
+			return api.Host{}, err
+		}
+		resp = api.Host{
+			IP:        updated.IP,
+			IPv6:      updated.IPv6,
+			Name:      updated.Name,
+			AgentPort: updated.AgentPort,
+			Tags:      updated.Tags,
+			K8SInfo:   updated.K8SInfo,
+			Cordoned:  updated.Cordoned,
+		}
+	}
+	if !found {
+		return api.Host{}, errors.NewRomanaNotFoundError(fmt.Sprintf("Host %s not found", hostName),
+			"host",
+			fmt.Sprintf("hostname=%s", hostName))
+	}
+	log.Infof("Updated host %s: IP %s, agent port %d, tags %v", hostName, resp.IP, resp.AgentPort, resp.Tags)
+	ipam.TopologyRevision++
+	return resp, nil
+}
+
+// groupPath returns groups from this one down to the target group,
+// or nil if the target is not in this group.
+func (hg *Group) groupPath(target *Group) []*Group {
+	if hg == target {
+		return []*Group{hg}
+	}
+	for _, group := range hg.Groups {
+		if path := group.groupPath(target); path != nil {
+			return append([]*Group{hg}, path...)
+		}
+	}
+	return nil
+}
+
+// reassignHost replaces the host in this group, the root group of the
+// network, with its updated version. The updated host stays in the
+// same group if it is still eligible for it and all groups above it;
+// otherwise it is added anew, provided it has no allocated blocks.
+func (hg *Group) reassignHost(network *Network, host *Host, updated *Host) error {
+	group := host.group
+	eligible := true
+	for _, g := range hg.groupPath(group) {
+		if !g.isHostEligible(updated) {
+			eligible = false
+			break
+		}
+	}
+	if eligible {
+		*host = *updated
+		return nil
+	}
+
+	for blockID, blockHost := range group.BlockToHost {
+		if blockHost == host.Name {
+			return errors.NewRomanaConflictError(
+				fmt.Sprintf("Host %s with tags %v is no longer eligible for group %s of network %s, and cannot be moved as it has allocated block %s",
+					host.Name, updated.Tags, group.Name, network.Name, group.Blocks[blockID].CIDR),
+				"host", fmt.Sprintf("name=%s", host.Name))
+		}
+	}
+
+	for i, h := range group.Hosts {
+		if h == host {
+			group.Hosts = append(group.Hosts[:i], group.Hosts[i+1:]...)
+			break
+		}
+	}
+	ok, err := hg.addHost(updated)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		reasons := hg.explainIneligibility(updated, "root")
+		return errors.NewRomanaConflictError(
+			fmt.Sprintf("Host %s with tags %v is no longer eligible for any group of network %s: %s",
+				host.Name, updated.Tags, network.Name, strings.Join(reasons, "; ")),
+			"host", fmt.Sprintf("name=%s", host.Name))
+	}
+	log.Infof("Moved host %s from group %s to group %s of network %s", host.Name, group.Name, updated.group.Name, network.Name)
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/api/errors"
+)
+
+func TestHostLifecycle(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"},
+    {"name":"host2","ip":"192.168.99.11"}
+  ]}]}]
+}`)
+	for _, name := range []string{"pod1", "pod2"} {
+		_, err := ipam.AllocateIP(name, "host1", "ten1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := ipam.AllocateIP("pod3", "host2", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ipam.CordonHost("host3", true)
+	if _, ok := err.(errors.RomanaNotFoundError); !ok {
+		t.Fatalf("Expected host3 not to be found, got %v", err)
+	}
+	err = ipam.CordonHost("host1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cordoning it again changes nothing, so nothing is saved.
+	saves := 0
+	save := ipam.save
+	ipam.save = func(latestIPAM *IPAM, ch <-chan struct{}) error {
+		saves++
+		return save(latestIPAM, ch)
+	}
+	err = ipam.CordonHost("host1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saves != 0 {
+		t.Fatalf("Expected no saves cordoning a cordoned host, got %d", saves)
+	}
+	ipam.save = save
+
+	// Existing block of ten1 on host1 can still be used...
+	_, err = ipam.AllocateIP("pod4", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ...but no new blocks are assigned.
+	_, err = ipam.AllocateIP("pod5", "host1", "ten2", "")
+	if _, ok := err.(errors.RomanaConflictError); !ok {
+		t.Fatalf("Expected host1 to be cordoned, got %v", err)
+	}
+	t.Logf("Got expected error: %s", err)
+
+	drain, err := ipam.DrainHost("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drain.Addresses) != 3 || drain.Addresses[0].Name != "pod1" ||
+		drain.Addresses[1].Name != "pod2" || drain.Addresses[2].Name != "pod4" {
+		t.Fatalf("Expected pod1, pod2 and pod4 to be drained, got %+v", drain.Addresses)
+	}
+
+	err = ipam.RemoveHost(api.Host{Name: "host1"}, false)
+	if _, ok := err.(errors.RomanaConflictError); !ok {
+		t.Fatalf("Expected host1 removal to be refused, got %v", err)
+	}
+	t.Logf("Got expected error: %s", err)
+
+	err = ipam.RemoveHost(api.Host{Name: "host1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.load(ipam, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"pod1", "pod2", "pod4"} {
+		if _, ok := ipam.AddressNameToIP[name]; ok {
+			t.Fatalf("Expected %s to be released", name)
+		}
+	}
+	if _, ok := ipam.AddressNameToIP["pod3"]; !ok {
+		t.Fatal("Expected pod3 on host2 to be kept")
+	}
+	group := ipam.Networks["net1"].Group
+	if group.findHostByName("host1") != nil {
+		t.Fatal("Expected host1 to be removed")
+	}
+	// Addresses of host1 were in one block.
+	if len(group.ReusableBlocks) != 1 || len(group.OwnerToBlocks["ten1:"]) != 1 {
+		t.Fatalf("Expected 1 reusable block and 1 block of ten1, got %v and %v",
+			group.ReusableBlocks, group.OwnerToBlocks)
+	}
+	if findings := ipam.check(false); len(findings) != 0 {
+		t.Fatalf("Expected no inconsistencies, got %+v", findings)
+	}
+}
+
+func TestUpdateHost(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/16","block_mask":28}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"name":"backend","assignment":{"tier":"backend"},"groups":[]},
+    {"name":"frontend","assignment":{"tier":"frontend"},"groups":[]}
+  ]}]
+}`)
+	for i, tier := range []string{"backend", "frontend"} {
+		err := ipam.AddHost(api.Host{
+			Name: fmt.Sprintf("host%d", i+1),
+			IP:   net.ParseIP(fmt.Sprintf("192.168.99.%d", i+1)),
+			Tags: map[string]string{"tier": tier},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	groupOf := func(name string) string {
+		ipam.load(ipam, nil)
+		return ipam.Networks["net1"].Group.findHostByName(name).group.Name
+	}
+
+	// Only attributes given are patched.
+	host, err := ipam.UpdateHost("host1", api.Host{AgentPort: 9700}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err = ipam.UpdateHost("host1", api.Host{IP: net.ParseIP("192.168.99.10")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.AgentPort != 9700 || host.IP.String() != "192.168.99.10" || host.Tags["tier"] != "backend" {
+		t.Fatalf("Expected host1 at 192.168.99.10:9700 with tier backend, got %v", host)
+	}
+	_, err = ipam.UpdateHost("host1", api.Host{IP: net.ParseIP("192.168.99.2")}, false)
+	if _, ok := err.(errors.RomanaExistsError); !ok {
+		t.Fatalf("Expected RomanaExistsError taking IP of host2, got %v (%T)", err, err)
+	}
+	_, err = ipam.UpdateHost("host9", api.Host{AgentPort: 9700}, false)
+	if _, ok := err.(errors.RomanaNotFoundError); !ok {
+		t.Fatalf("Expected RomanaNotFoundError, got %v (%T)", err, err)
+	}
+
+	// A host without allocations moves to the group its tags are for.
+	_, err = ipam.UpdateHost("host1", api.Host{Tags: map[string]string{"tier": "frontend"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group := groupOf("host1"); group != "frontend" {
+		t.Fatalf("Expected host1 in group frontend, got %s", group)
+	}
+
+	// A host with allocations does not.
+	_, err = ipam.AllocateIP("pod1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ipam.UpdateHost("host1", api.Host{Tags: map[string]string{"tier": "backend"}}, false)
+	if _, ok := err.(errors.RomanaConflictError); !ok {
+		t.Fatalf("Expected RomanaConflictError moving host with allocated block, got %v (%T)", err, err)
+	}
+	if group := groupOf("host1"); group != "frontend" {
+		t.Fatalf("Expected host1 to stay in group frontend, got %s", group)
+	}
+
+	// Replacing all attributes requires IP.
+	_, err = ipam.UpdateHost("host2", api.Host{Tags: map[string]string{"tier": "frontend"}}, true)
+	if err == nil {
+		t.Fatalf("Expected error replacing attributes without IP")
+	}
+	host, err = ipam.UpdateHost("host2", api.Host{IP: net.ParseIP("192.168.99.20"), Tags: map[string]string{"tier": "frontend"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.AgentPort != DefaultAgentPort {
+		t.Fatalf("Expected agent port of host2 to be reset to %d, got %d", DefaultAgentPort, host.AgentPort)
+	}
+}
@@ -152,11 +152,11 @@ func (ir IDRing) Invert() *IDRing {
 	for _, r := range ir.Ranges {
 		if prevMin < r.Min {
 			ranges = append(ranges, Range{Min: prevMin, Max: r.Min - 1})
-			if r.Max == ir.OrigMax {
-				prevMin = r.Max
-			} else {
-				prevMin = r.Max + 1
-			}
+		}
+		if r.Max == ir.OrigMax {
+			prevMin = r.Max
+		} else {
+			prevMin = r.Max + 1
 		}
 	}
 	lastRange := ir.Ranges[len(ir.Ranges)-1]
@@ -213,6 +213,35 @@ func (ir *IDRing) GetID() (uint64, error) {
 	return retval, nil
 }
 
+// GetSpecificID takes the provided ID out of the pool. It will return an
+// error if the ID is not available.
+func (ir *IDRing) GetSpecificID(id uint64) error {
+	if ir.locker != nil {
+		ir.locker.Lock()
+		defer ir.locker.Unlock()
+	}
+	for i, r := range ir.Ranges {
+		if id < r.Min || id > r.Max {
+			continue
+		}
+		newRanges := make([]Range, 0, len(ir.Ranges)+1)
+		newRanges = append(newRanges, ir.Ranges[:i]...)
+		if id > r.Min {
+			newRanges = append(newRanges, Range{Min: r.Min, Max: id - 1})
+		}
+		if id < r.Max {
+			newRanges = append(newRanges, Range{Min: id + 1, Max: r.Max})
+		}
+		newRanges = append(newRanges, ir.Ranges[i+1:]...)
+		if len(newRanges) == 0 {
+			newRanges = nil
+		}
+		ir.Ranges = newRanges
+		return nil
+	}
+	return common.NewError("ID %d is not available", id)
+}
+
 // ReclaimID returns and ID to the pool.
 func (ir *IDRing) ReclaimID(id uint64) error {
 	if ir.locker != nil {
@@ -260,7 +289,7 @@ func (idRing *IDRing) ReclaimIDNoLock(id uint64) error {
 		curRange := idRing.Ranges[i]
 		follRanges := make([]Range, 0)
 		if i+1 < len(idRing.Ranges) {
-			follRanges = idRing.Ranges[i : i+1]
+			follRanges = idRing.Ranges[i+1:]
 		}
 		//		log.Tracef(trace.Inside, "ReclaimID: prevRanges %s, curRange %s, follRanges %s", prevRanges, curRange, follRanges)
 		if id < curRange.Min {
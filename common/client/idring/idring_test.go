@@ -44,6 +44,20 @@ func TestInvert(t *testing.T) {
 		t.Errorf("Expected a single range for inversion of a filled up ring, got %s", invert)
 	}
 
+	// Free IDs at the start of the ring are not inverted into taken ones.
+	err = idRing.ReclaimID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idRing.ReclaimID(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invert = idRing.Invert()
+	if len(invert.Ranges) != 2 || invert.Ranges[0] != (Range{Min: 2, Max: 3}) || invert.Ranges[1] != (Range{Min: 5, Max: 5}) {
+		t.Errorf("Expected [2-3], [5-5] for inversion of %s, got %s", idRing, invert)
+	}
+
 }
 
 func TestClear(t *testing.T) {
@@ -84,6 +98,75 @@ func TestClear(t *testing.T) {
 	}
 }
 
+func TestGetSpecificID(t *testing.T) {
+	idRing := NewIDRing(1, 10, &sync.Mutex{})
+
+	err := idRing.GetSpecificID(5)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if len(idRing.Ranges) != 2 || idRing.Ranges[0].Max != 4 || idRing.Ranges[1].Min != 6 {
+		t.Fatalf("Expected [1-4] [6-10], got %s", idRing)
+	}
+	err = idRing.GetSpecificID(5)
+	if err == nil {
+		t.Fatalf("Expected error getting 5 twice from %s", idRing)
+	}
+	err = idRing.GetSpecificID(11)
+	if err == nil {
+		t.Fatalf("Expected error getting 11 from %s", idRing)
+	}
+
+	// Sequential allocation continues to skip the taken ID.
+	for _, expected := range []uint64{1, 2, 3, 4, 6} {
+		id, err := idRing.GetID()
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+		if id != expected {
+			t.Fatalf("Expected %d, got %d", expected, id)
+		}
+	}
+
+	err = idRing.ReclaimID(5)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	id, err := idRing.GetID()
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if id != 5 {
+		t.Fatalf("Expected 5, got %d", id)
+	}
+}
+
+func TestReclaimBeforeRanges(t *testing.T) {
+	idRing := NewIDRing(1, 10, &sync.Mutex{})
+	for i := 0; i < 10; i++ {
+		_, err := idRing.GetID()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []uint64{9, 7, 5, 2} {
+		err := idRing.ReclaimID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// All previously reclaimed IDs must still be available.
+	for _, expected := range []uint64{2, 5, 7, 9} {
+		id, err := idRing.GetID()
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+		if id != expected {
+			t.Fatalf("Expected %d, got %d", expected, id)
+		}
+	}
+}
+
 func TestAllocation(t *testing.T) {
 	var err error
 	var id uint64
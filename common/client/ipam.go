@@ -16,12 +16,15 @@
 package client
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"math"
 	"math/big"
 	"net"
 	"regexp"
+	"sort"
 	"strings"
 
 	libkvStore "github.com/docker/libkv/store"
@@ -35,7 +38,9 @@ import (
 )
 
 // This provides an implementation of an IPAM that can allocate
-// blocks of IPs for tenant/segment pair. It assumes IPv4.
+// blocks of IPs for tenant/segment pair. Both IPv4 and IPv6 networks
+// are supported; IPv6 networks must have a prefix of at least /64
+// (see initCIDR).
 //
 // Address blocks may be taken out more then one pre-configured
 // address range (Networks).
@@ -84,8 +89,22 @@ func parseOwner(owner string) (string, string) {
 	return tenSeg[0], tenSeg[1]
 }
 
+// hostMask returns a mask with the lowest hostBits bits set.
+func hostMask(hostBits uint) uint64 {
+	if hostBits == 0 {
+		return 0
+	}
+	return ^uint64(0) >> (64 - hostBits)
+}
+
 // CIDR represents a CIDR (net.IPNet, effectively) with some
 // extra functionality for convenience.
+//
+// Addresses within the CIDR are represented as uint64s (StartIPInt,
+// EndIPInt, IDs in Block pools). For IPv4 this is the entire address.
+// For IPv6 it is the lower 64 bits of the address -- the upper 64
+// bits are the same for every address in the CIDR, as IPv6 CIDRs
+// are required to be /64 or smaller.
 type CIDR struct {
 	// Represents the IPNet object corresponding to this CIDR.
 	*net.IPNet
@@ -101,14 +120,16 @@ func initCIDR(s string, cidr *CIDR) error {
 	if err != nil {
 		return err
 	}
+	ones, bits := ipNet.Mask.Size()
+	if bits == 8*net.IPv6len && ones < 64 {
+		return common.NewError("IPv6 CIDR %s is not supported, prefix must be /64 or longer", s)
+	}
 	cidr.IPNet = ipNet
 	if ip != nil {
 		cidr.StartIP = ip
-		cidr.StartIPInt = common.IPv4ToInt(ip)
-		ones, bits := ipNet.Mask.Size()
-		ipCount := 1 << uint(bits-ones)
-		cidr.EndIPInt = cidr.StartIPInt + uint64(ipCount) - 1
-		cidr.EndIP = common.IntToIPv4(cidr.EndIPInt)
+		cidr.StartIPInt = cidr.ipToInt(ip)
+		cidr.EndIPInt = cidr.StartIPInt + hostMask(uint(bits-ones))
+		cidr.EndIP = cidr.intToIP(cidr.EndIPInt)
 	}
 	return nil
 }
@@ -120,9 +141,49 @@ func NewCIDR(s string) (CIDR, error) {
 	return *cidr, err
 }
 
+// IsIPv6 returns true if this is an IPv6 CIDR.
+func (c CIDR) IsIPv6() bool {
+	return c.IPNet != nil && c.IPNet.IP.To4() == nil
+}
+
+// bits returns the length of addresses in this CIDR, in bits.
+func (c CIDR) bits() uint {
+	if c.IsIPv6() {
+		return 8 * net.IPv6len
+	}
+	return 8 * net.IPv4len
+}
+
+// ipToInt converts an IP in this CIDR to its integer representation
+// (see CIDR).
+func (c CIDR) ipToInt(ip net.IP) uint64 {
+	if c.IsIPv6() {
+		return binary.BigEndian.Uint64(ip.To16()[8:])
+	}
+	return common.IPv4ToInt(ip)
+}
+
+// intToIP converts an integer representation of an address in this CIDR
+// (see CIDR) to an IP.
+func (c CIDR) intToIP(i uint64) net.IP {
+	if c.IsIPv6() {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, c.IPNet.IP.To16()[:8])
+		binary.BigEndian.PutUint64(ip[8:], i)
+		return ip
+	}
+	return common.IntToIPv4(i)
+}
+
 // Contains returns true if this CIDR fully contains (is equivalent to or a superset
 // of) the provided CIDR.
 func (c CIDR) Contains(c2 CIDR) bool {
+	if c.IsIPv6() != c2.IsIPv6() {
+		return false
+	}
+	if c.IsIPv6() && !bytes.Equal(c.IPNet.IP.To16()[:8], c2.IPNet.IP.To16()[:8]) {
+		return false
+	}
 	log.Tracef(trace.Private, "%d<=%d && %d>=%d: %t", c.StartIPInt,
 		c2.StartIPInt, c.EndIPInt,
 		c2.EndIPInt,
@@ -163,12 +224,16 @@ func (cidr *CIDR) UnmarshalText(data []byte) error {
 
 // Host represents a host in Romana topology.
 type Host struct {
-	Name      string            `json:"name"`
-	IP        net.IP            `json:"ip"`
+	Name string `json:"name"`
+	IP   net.IP `json:"ip"`
+	// IPv6 address of the host, used as the next hop for IPv6 blocks.
+	IPv6      net.IP            `json:"ipv6,omitempty"`
 	AgentPort uint              `json:"agent_port"`
 	Tags      map[string]string `json:"tags"`
 	K8SInfo   map[string]string `json:"k8s_info"`
-	group     *Group
+	// Cordoned hosts are not assigned new blocks.
+	Cordoned bool `json:"cordoned,omitempty"`
+	group    *Group
 }
 
 func (h Host) String() string {
@@ -193,8 +258,11 @@ type Group struct {
 	Blocks         []*Block          `json:"blocks"`
 	ReusableBlocks []int             `json:"reusable_blocks"`
 	Assignment     map[string]string `json:"assignment"`
-	Routing        string            `json:"routing"`
-	network        *Network
+	// Further requirements on tags of hosts (see api.GroupOrHost).
+	AssignmentExpressions []api.AssignmentRequirement `json:"assignment_expressions,omitempty"`
+	Priority              int                         `json:"priority,omitempty"`
+	Routing               string                      `json:"routing"`
+	network               *Network
 
 	Dummy bool `json:"dummy"`
 }
@@ -223,22 +291,16 @@ func (hg *Group) isHostEligible(host *Host) bool {
 		return false
 	}
 	// Check assignment
-	if hg.Assignment != nil {
-		for k, v := range hg.Assignment {
-			if host.Tags == nil {
-				log.Tracef(trace.Inside, "Group %s has %v requirements, host %s has no tags, skipping", hg.Name, hg.Assignment, host)
-				return false
-			}
-			if host.Tags[k] != v {
-				log.Tracef(trace.Inside, "Group %s requires %s=%s, host has %s", hg.Name, k, v, host.Tags[k])
-				return false
-			}
-		}
+	if failed := hg.unsatisfiedRequirements(host); len(failed) > 0 {
+		log.Tracef(trace.Inside, "Group %s requires %s", hg.Name, failed)
+		return false
 	}
 	return true
 }
 
-// findSmallestGroup finds the group with fewest hosts
+// findSmallestEligibleGroup finds the group with fewest hosts among
+// groups the host is eligible for. Of subgroups of a group, those that
+// take precedence (see takesPrecedence) are considered first.
 func (hg *Group) findSmallestEligibleGroup(host *Host) *Group {
 	if !hg.isHostEligible(host) {
 		log.Tracef(trace.Inside, "Host %s not eligible for group %s", host, hg.Name)
@@ -250,6 +312,8 @@ func (hg *Group) findSmallestEligibleGroup(host *Host) *Group {
 	}
 	var g *Group
 	var curSmallest *Group
+	// Subgroup of this group curSmallest is in.
+	var curSubgroup *Group
 	minHosts := math.MaxInt32
 	for _, g = range hg.Groups {
 		ok := g.isHostEligible(host)
@@ -258,21 +322,20 @@ func (hg *Group) findSmallestEligibleGroup(host *Host) *Group {
 			continue
 		}
 		log.Tracef(trace.Inside, "In %s, considering %s", hg.Name, g.Name)
-		if g.Hosts != nil {
-			log.Tracef(trace.Inside, "In %s, considering %s with %d hosts (vs current smallest %d)", hg.Name, g.Name, len(g.Hosts), minHosts)
-			if minHosts > len(g.Hosts) {
-				minHosts = len(g.Hosts)
-				curSmallest = g
-			}
-		} else {
-			smallestCandidate := g.findSmallestEligibleGroup(host)
-			if smallestCandidate != nil {
-				if len(smallestCandidate.Hosts) < minHosts {
-					minHosts = len(smallestCandidate.Hosts)
-					curSmallest = smallestCandidate
-				}
+		candidate := g
+		if g.Hosts == nil {
+			candidate = g.findSmallestEligibleGroup(host)
+			if candidate == nil {
+				continue
 			}
 		}
+		log.Tracef(trace.Inside, "In %s, considering %s with %d hosts (vs current smallest %d)", hg.Name, g.Name, len(candidate.Hosts), minHosts)
+		if curSubgroup == nil || g.takesPrecedence(curSubgroup) ||
+			(!curSubgroup.takesPrecedence(g) && len(candidate.Hosts) < minHosts) {
+			minHosts = len(candidate.Hosts)
+			curSmallest = candidate
+			curSubgroup = g
+		}
 	}
 	if curSmallest == nil {
 		log.Tracef(trace.Inside, "Could not find eligible group for host %s", host)
@@ -315,7 +378,10 @@ func (hg *Group) addHost(host *Host) (bool, error) {
 	return true, nil
 }
 
-func (hg *Group) allocateIP(network *Network, hostName string, owner string) net.IP {
+// allocateIP allocates an IP for the owner on the host from blocks
+// the owner already has on it. If those are exhausted and newBlockAllowed
+// is true, a reusable or a new block is taken for the owner.
+func (hg *Group) allocateIP(network *Network, hostName string, owner string, newBlockAllowed bool) net.IP {
 	ownedBlockIDs := hg.OwnerToBlocks[owner]
 	var ip net.IP
 	if len(ownedBlockIDs) > 0 {
@@ -334,11 +400,57 @@ func (hg *Group) allocateIP(network *Network, hostName string, owner string) net
 	} else {
 		log.Tracef(trace.Inside, "Network %s has no blocks for owner <%s>, will try to reuse a block", network.Name, owner)
 	}
+	if !newBlockAllowed {
+		log.Tracef(trace.Inside, "Owner %s is not allowed any more blocks", owner)
+		return nil
+	}
 	// If we are here then all blocks are exhausted. Need to allocate a new block.
-	// First let's see if there are blocks on this group to be reused.
+	// First let's see if there are blocks of the right size on this group to be
+	// reused, then try to carve out a new one, and finally reuse a block of any size.
+	blockMask := network.blockMaskFor(owner, hg.hostBlockCount(owner, hostName))
+	ip = hg.reuseBlock(network, hostName, owner, func(block *Block) bool { return block.mask() == blockMask })
+	if ip != nil {
+		return ip
+	}
+	log.Tracef(trace.Inside, "Network %s has no /%d blocks to reuse for <%s>, creating new block", network.Name, blockMask, owner)
+
+	for {
+		newBlock, err := hg.appendNewBlock(network, blockMask)
+		if err != nil {
+			// This should not really happen...
+			log.Errorf("Error occurred allocating IP for %s in network %s: %s", owner, hg.CIDR, err)
+			return nil
+		}
+		if newBlock == nil {
+			break
+		}
+		newBlockID := len(hg.Blocks) - 1
+		hg.OwnerToBlocks[owner] = append(hg.OwnerToBlocks[owner], newBlockID)
+		hg.BlockToOwner[newBlockID] = owner
+		hg.BlockToHost[newBlockID] = hostName
+		log.Tracef(trace.Inside, "New block created in %s for owner %s and host %s: %s", hg.CIDR, owner, hostName, newBlock.CIDR)
+		ip := newBlock.allocateIP(network)
+		if ip == nil {
+			// This could happen if this is a new block but happens to be completely
+			// blacked out. Try allocating another.
+			log.Tracef(trace.Inside, "Cannot allocate any IPs from block %s", newBlock.CIDR)
+			continue
+		}
+		return ip
+	}
+	log.Tracef(trace.Inside, "No space for new /%d block in %s for <%s>, will try to reuse a block of any size", blockMask, hg.CIDR, owner)
+	return hg.reuseBlock(network, hostName, owner, func(block *Block) bool { return true })
+}
+
+// reuseBlock allocates an IP from the first reusable block that matches,
+// and gives the block to the owner on the host.
+func (hg *Group) reuseBlock(network *Network, hostName string, owner string, match func(*Block) bool) net.IP {
 	for blockIdx, blockID := range hg.ReusableBlocks {
 		block := hg.Blocks[blockID]
-		ip = block.allocateIP(network)
+		if !match(block) {
+			continue
+		}
+		ip := block.allocateIP(network)
 		if ip != nil {
 			// We can now remove this block from reusables.
 			log.Tracef(trace.Inside, "Reusing block %d for owner %s", blockID, owner)
@@ -349,56 +461,194 @@ func (hg *Group) allocateIP(network *Network, hostName string, owner string) net
 			return ip
 		}
 	}
-	log.Tracef(trace.Inside, "Network %s has no blocks to reuse for <%s>, creating new block", network.Name, owner)
+	return nil
+}
 
-	for {
-		var newBlockStartIPInt uint64
-		if len(hg.Blocks) > 0 {
-			lastBlock := hg.Blocks[len(hg.Blocks)-1]
-			newBlockStartIPInt = lastBlock.CIDR.EndIPInt + 1
-		} else {
-			newBlockStartIPInt = hg.CIDR.StartIPInt
+// hostBlockCount returns the number of blocks the owner has on the host.
+func (hg *Group) hostBlockCount(owner string, hostName string) int {
+	count := 0
+	for _, blockID := range hg.OwnerToBlocks[owner] {
+		if hg.BlockToHost[blockID] == hostName {
+			count++
 		}
-		if newBlockStartIPInt > hg.CIDR.EndIPInt {
-			// Cannot allocate any more blocks for this network, move on to another.
-			log.Tracef(trace.Inside, "Cannot allocate any more blocks from network %s", hg.CIDR)
-			return nil
+	}
+	return count
+}
+
+// findBlockSpace returns the start of the lowest free space in the CIDR
+// of this group that can hold a block with the provided mask, aligned to
+// the size of the block. It returns false if there is no such space.
+func (hg *Group) findBlockSpace(network *Network, blockMask uint) (uint64, bool) {
+	blockHostMask := hostMask(network.CIDR.bits() - blockMask)
+	align := func(ipInt uint64) uint64 {
+		offset := ipInt - hg.CIDR.StartIPInt
+		if offset&blockHostMask != 0 {
+			offset = (offset | blockHostMask) + 1
 		}
+		return hg.CIDR.StartIPInt + offset
+	}
+	blocks := make([]*Block, len(hg.Blocks))
+	copy(blocks, hg.Blocks)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].CIDR.StartIPInt < blocks[j].CIDR.StartIPInt
+	})
 
-		newBlockEndIPInt := newBlockStartIPInt + (1 << (32 - network.BlockMask)) - 1
-		if newBlockEndIPInt > network.CIDR.EndIPInt {
-			// Cannot allocate any more blocks for this network, move on to another.
-			// TODO: Or should we allocate as much as possible?
+	nextIPInt := hg.CIDR.StartIPInt
+	for _, block := range blocks {
+		start := align(nextIPInt)
+		end := start + blockHostMask
+		if start >= nextIPInt && end >= start && end < block.CIDR.StartIPInt {
+			return start, true
+		}
+		if block.CIDR.EndIPInt >= hg.CIDR.EndIPInt {
 			log.Tracef(trace.Inside, "Cannot allocate any more blocks from network %s", hg.CIDR)
-			return nil
+			return 0, false
+		}
+		if block.CIDR.EndIPInt+1 > nextIPInt {
+			nextIPInt = block.CIDR.EndIPInt + 1
 		}
+	}
+	start := align(nextIPInt)
+	if start < nextIPInt || start > hg.CIDR.EndIPInt {
+		// Cannot allocate any more blocks for this network, move on to another.
+		log.Tracef(trace.Inside, "Cannot allocate any more blocks from network %s", hg.CIDR)
+		return 0, false
+	}
+	end := start + blockHostMask
+	if end > network.CIDR.EndIPInt || end < start {
+		// Cannot allocate any more blocks for this network, move on to another.
+		// TODO: Or should we allocate as much as possible?
+		log.Tracef(trace.Inside, "Cannot allocate any more blocks from network %s", hg.CIDR)
+		return 0, false
+	}
+	return start, true
+}
 
-		newBlockCIDRStr := fmt.Sprintf("%s/%d", common.IntToIPv4(newBlockStartIPInt), network.BlockMask)
-		newBlockCIDR, err := NewCIDR(newBlockCIDRStr)
-		if err != nil {
-			// This should not really happen...
-			log.Errorf("Error occurred allocating IP for %s in network %s: %s", owner, hg.CIDR, err)
-			return nil
+// appendNewBlock carves out a new block with the provided mask from the
+// CIDR of this group (see findBlockSpace), and appends it to Blocks. It
+// returns nil if the CIDR of the group is exhausted.
+func (hg *Group) appendNewBlock(network *Network, blockMask uint) (*Block, error) {
+	newBlockStartIPInt, ok := hg.findBlockSpace(network, blockMask)
+	if !ok {
+		return nil, nil
+	}
+	block, err := makeBlock(network, newBlockStartIPInt, blockMask)
+	if err != nil {
+		return nil, err
+	}
+	hg.Blocks = append(hg.Blocks, block)
+	return block, nil
+}
+
+// makeBlock returns a new block with the provided start and mask.
+func makeBlock(network *Network, startIPInt uint64, blockMask uint) (*Block, error) {
+	newBlockCIDRStr := fmt.Sprintf("%s/%d", network.CIDR.intToIP(startIPInt), blockMask)
+	newBlockCIDR, err := NewCIDR(newBlockCIDRStr)
+	if err != nil {
+		return nil, err
+	}
+	return newBlock(newBlockCIDR), nil
+}
+
+// findBlockSpaceFor returns the start and mask of a block for the IP,
+// aligned the same way as in findBlockSpace, that does not overlap
+// existing blocks. The block has the provided mask if possible, or is
+// smaller, as existing blocks may leave only that much space around
+// the IP. It returns false if there is no such block in the group.
+func (hg *Group) findBlockSpaceFor(network *Network, blockMask uint, ip net.IP) (uint64, uint, bool) {
+	ipInt := network.CIDR.ipToInt(ip)
+	bits := network.CIDR.bits()
+	for mask := blockMask; mask <= bits; mask++ {
+		blockHostMask := hostMask(bits - mask)
+		start := hg.CIDR.StartIPInt + (ipInt-hg.CIDR.StartIPInt)&^blockHostMask
+		end := start + blockHostMask
+		if end > hg.CIDR.EndIPInt || end > network.CIDR.EndIPInt {
+			continue
 		}
-		newBlock := newBlock(newBlockCIDR)
-		hg.Blocks = append(hg.Blocks, newBlock)
-		newBlockID := len(hg.Blocks) - 1
-		hg.OwnerToBlocks[owner] = append(hg.OwnerToBlocks[owner], newBlockID)
-		hg.BlockToOwner[newBlockID] = owner
-		hg.BlockToHost[newBlockID] = hostName
-		log.Tracef(trace.Inside, "New block created in %s for owner %s and host %s: %s", hg.CIDR, owner, hostName, newBlockCIDR)
-		ip := newBlock.allocateIP(network)
-		if ip == nil {
-			// This could happen if this is a new block but happens to be completely
-			// blacked out. Try allocating another.
-			log.Tracef(trace.Inside, "Cannot allocate any IPs from block %s", newBlock.CIDR)
+		overlaps := false
+		for _, block := range hg.Blocks {
+			if block.CIDR.StartIPInt <= end && block.CIDR.EndIPInt >= start {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			return start, mask, true
+		}
+	}
+	return 0, 0, false
+}
+
+// allocateSpecificIP allocates the provided IP, which must be within
+// the CIDR of this group, for the owner on the provided host. The block
+// containing the IP must either belong to the same owner and host, or
+// be available for use.
+func (hg *Group) allocateSpecificIP(network *Network, hostName string, owner string, ip net.IP) error {
+	for blockID, block := range hg.Blocks {
+		if !block.CIDR.IPNet.Contains(ip) {
 			continue
 		}
-		return ip
+		if network.isReserved(block, ip) {
+			return reservedError(ip, block)
+		}
+		if blockOwner, ok := hg.BlockToOwner[blockID]; ok {
+			if blockOwner != owner || hg.BlockToHost[blockID] != hostName {
+				return errors.NewRomanaConflictError(
+					fmt.Sprintf("Address %s is in block %s of %s on host %s", ip, block.CIDR, blockOwner, hg.BlockToHost[blockID]),
+					"IP",
+					fmt.Sprintf("IP=%s", ip))
+			}
+			return block.allocateSpecificIP(ip)
+		}
+		// Block is not owned, so it must be reusable.
+		err := block.allocateSpecificIP(ip)
+		if err != nil {
+			return err
+		}
+		for blockIdx, reusableBlockID := range hg.ReusableBlocks {
+			if reusableBlockID == blockID {
+				hg.ReusableBlocks = deleteElementInt(hg.ReusableBlocks, blockIdx)
+				break
+			}
+		}
+		log.Tracef(trace.Inside, "Reusing block %d for owner %s", blockID, owner)
+		hg.OwnerToBlocks[owner] = append(hg.OwnerToBlocks[owner], blockID)
+		hg.BlockToOwner[blockID] = owner
+		hg.BlockToHost[blockID] = hostName
+		return nil
 	}
+
+	// No block contains the IP yet. Create only the block that does;
+	// space before it is left for findBlockSpace to fill later.
+	blockMask := network.blockMaskFor(owner, hg.hostBlockCount(owner, hostName))
+	start, mask, ok := hg.findBlockSpaceFor(network, blockMask, ip)
+	if !ok {
+		return errors.NewRomanaConflictError(
+			fmt.Sprintf("Address %s is outside of blocks available in %s", ip, hg.CIDR),
+			"IP",
+			fmt.Sprintf("IP=%s", ip))
+	}
+	block, err := makeBlock(network, start, mask)
+	if err != nil {
+		return err
+	}
+	if network.isReserved(block, ip) {
+		return reservedError(ip, block)
+	}
+	err = block.allocateSpecificIP(ip)
+	if err != nil {
+		return err
+	}
+	hg.Blocks = append(hg.Blocks, block)
+	blockID := len(hg.Blocks) - 1
+	hg.OwnerToBlocks[owner] = append(hg.OwnerToBlocks[owner], blockID)
+	hg.BlockToOwner[blockID] = owner
+	hg.BlockToHost[blockID] = hostName
+	log.Tracef(trace.Inside, "New block created in %s for owner %s and host %s: %s", hg.CIDR, owner, hostName, block.CIDR)
+	return nil
 }
 
-func (hg *Group) deallocateIP(ip net.IP) error {
+func (hg *Group) deallocateIP(network *Network, ip net.IP) error {
 	if hg.Hosts != nil {
 		// This is the right group
 		reclaimBlock := false
@@ -408,7 +658,7 @@ func (hg *Group) deallocateIP(ip net.IP) error {
 			//			log.Tracef(trace.Inside, "Checking if block %d (%s) contains %s: %v", blockID, block.CIDR, ip, block.CIDR.IPNet.Contains(ip))
 			if block.CIDR.IPNet.Contains(ip) {
 				log.Tracef(trace.Private, "Group.deallocateIP: IP to deallocate %s belongs to block %s", ip, block.CIDR)
-				err := block.deallocateIP(ip)
+				err := block.deallocateIP(network, ip)
 				if err != nil {
 					return err
 				}
@@ -442,7 +692,7 @@ func (hg *Group) deallocateIP(ip net.IP) error {
 	} else {
 		for _, group := range hg.Groups {
 			if group.CIDR.IPNet.Contains(ip) {
-				return group.deallocateIP(ip)
+				return group.deallocateIP(network, ip)
 			}
 		}
 	}
@@ -606,9 +856,9 @@ func (hg *Group) bitsForGroupElements(numGroups int, cidr CIDR) int {
 // group.
 func (hg *Group) cidrForCurrentGroup(groupIndex int, bitsPerElement int, cidr CIDR) (CIDR, error) {
 	// Calculate CIDR for the current group
-	incr := uint64(groupIndex << uint(bitsPerElement))
-	elementCIDRIP := common.IntToIPv4(cidr.StartIPInt + incr)
-	elementCIDRString := fmt.Sprintf("%s/%d", elementCIDRIP, (32 - bitsPerElement))
+	incr := uint64(groupIndex) << uint(bitsPerElement)
+	elementCIDRIP := cidr.intToIP(cidr.StartIPInt + incr)
+	elementCIDRString := fmt.Sprintf("%s/%d", elementCIDRIP, int(cidr.bits())-bitsPerElement)
 	log.Tracef(trace.Inside, "CIDR String for %s %d: %s", elementCIDRIP, bitsPerElement, elementCIDRString)
 	elementCidr, err := NewCIDR(elementCIDRString)
 	if err != nil {
@@ -627,7 +877,10 @@ func (hg *Group) parseMap(groupOrHosts []api.GroupOrHost, cidr CIDR, network *Ne
 	if len(groupOrHosts) == 1 {
 		log.Tracef(trace.Inside, "parseMap of size 1")
 		hg.Name = groupOrHosts[0].Name
-		hg.Assignment = groupOrHosts[0].Assignment
+		err = hg.setAssignment(groupOrHosts[0])
+		if err != nil {
+			return err
+		}
 		log.Tracef(trace.Inside, "Assignment for group %s: %s", hg.Name, hg.Assignment)
 		hg.Routing = groupOrHosts[0].Routing
 		hg.Dummy = groupOrHosts[0].Dummy
@@ -651,7 +904,10 @@ func (hg *Group) parseMap(groupOrHosts []api.GroupOrHost, cidr CIDR, network *Ne
 		}
 		hg.Groups[i] = &Group{}
 		hg.Groups[i].Name = elt.Name
-		hg.Groups[i].Assignment = elt.Assignment
+		err = hg.Groups[i].setAssignment(elt)
+		if err != nil {
+			return err
+		}
 		hg.Groups[i].Routing = elt.Routing
 		log.Tracef(trace.Inside, "Assignment for group %s: %s", hg.Groups[i].Name, hg.Groups[i].Assignment)
 
@@ -666,6 +922,19 @@ func (hg *Group) parseMap(groupOrHosts []api.GroupOrHost, cidr CIDR, network *Ne
 	return nil
 }
 
+// setAssignment sets the requirements for hosts of this group to
+// those of its definition.
+func (hg *Group) setAssignment(def api.GroupOrHost) error {
+	err := validateRequirements(def.AssignmentExpressions)
+	if err != nil {
+		return err
+	}
+	hg.Assignment = def.Assignment
+	hg.AssignmentExpressions = def.AssignmentExpressions
+	hg.Priority = def.Priority
+	return nil
+}
+
 // groupStructuresInit initializes a number of storage structures in a group.
 // If the forceInit parameter is true then it will re-initialize them, even if
 // they already had values.
@@ -722,7 +991,7 @@ func (hg *Group) parse(arr []api.GroupOrHost, cidr CIDR, network *Network) error
 				return common.NewError("Both name and IP are required for hosts: %v", elt)
 			}
 			// This is host, we inherit the CIDR
-			host := &Host{Name: elt.Name, IP: elt.IP}
+			host := &Host{Name: elt.Name, IP: elt.IP, IPv6: elt.IPv6}
 			host.group = hg
 			hg.Hosts[i] = host
 		} else {
@@ -732,7 +1001,10 @@ func (hg *Group) parse(arr []api.GroupOrHost, cidr CIDR, network *Network) error
 			}
 
 			hg.Groups[i] = &Group{}
-			hg.Groups[i].Assignment = elt.Assignment
+			err = hg.Groups[i].setAssignment(elt)
+			if err != nil {
+				return err
+			}
 			hg.Groups[i].Routing = elt.Routing
 			err = hg.Groups[i].parse(elt.Groups, elementCIDR, network)
 			if err != nil {
@@ -749,6 +1021,17 @@ type Block struct {
 	CIDR     CIDR           `json:"cidr"`
 	Pool     *idring.IDRing `json:"pool"`
 	Revision int            `json:"revision"`
+	// LastAllocated is the address allocated last.
+	LastAllocated uint64 `json:"last_allocated,omitempty"`
+	// Freed are addresses freed most recently, oldest first; kept
+	// only for the least-recently-freed address selection strategy.
+	Freed []uint64 `json:"freed,omitempty"`
+}
+
+// mask returns the length of the prefix of the block.
+func (b Block) mask() uint {
+	ones, _ := b.CIDR.IPNet.Mask.Size()
+	return uint(ones)
 }
 
 func (b Block) String() string {
@@ -767,13 +1050,27 @@ func newBlock(cidr CIDR) *Block {
 	return eb
 }
 
-// ListAvailableAddresses lists all available adresses in the block
-func (b Block) ListAvailableAddresses() []string {
-	retval := make([]string, 0)
+// AvailableAddress is an address of a block that is not allocated.
+// Reserved ones will not be allocated either.
+type AvailableAddress struct {
+	IP       string `json:"ip"`
+	Reserved bool   `json:"reserved,omitempty"`
+}
+
+// ListAvailableAddresses lists all available adresses in the block,
+// marking the ones reserved by the network's policy.
+func (b Block) ListAvailableAddresses(network *Network) []AvailableAddress {
+	retval := make([]AvailableAddress, 0)
 	for _, r := range b.Pool.Ranges {
 		for i := r.Min; i <= r.Max; i++ {
-			ip := common.IntToIPv4(i)
-			retval = append(retval, ip.String())
+			ip := b.CIDR.intToIP(i)
+			retval = append(retval, AvailableAddress{
+				IP:       ip.String(),
+				Reserved: network.isReservedID(&b, i),
+			})
+			if i == r.Max {
+				break
+			}
 		}
 	}
 	return retval
@@ -785,8 +1082,11 @@ func (b Block) ListAllocatedAddresses() []string {
 	retval := make([]string, 0)
 	for _, r := range allocated.Ranges {
 		for i := r.Min; i <= r.Max; i++ {
-			ip := common.IntToIPv4(i)
+			ip := b.CIDR.intToIP(i)
 			retval = append(retval, ip.String())
+			if i == r.Max {
+				break
+			}
 		}
 	}
 	return retval
@@ -804,40 +1104,60 @@ func (b Block) hasIPInCIDR(cidr CIDR) bool {
 	return false
 }
 
+// isAllocated checks whether the IP is allocated in the block.
+func (b Block) isAllocated(ip net.IP) bool {
+	if !b.CIDR.IPNet.Contains(ip) {
+		return false
+	}
+	ipInt := b.CIDR.ipToInt(ip)
+	for _, r := range b.Pool.Ranges {
+		if ipInt >= r.Min && ipInt <= r.Max {
+			return false
+		}
+	}
+	return true
+}
+
 // Returns true if there is nothing allocated.
 func (b *Block) isEmpty() bool {
 	return b.Pool.IsEmpty()
 }
 
-// allocateIP allocates an IP from the block. Returns nil if
-// exhausted.
+// allocateIP allocates an IP from the block, skipping the addresses
+// reserved by the network's policy. Returns nil if exhausted.
 func (b *Block) allocateIP(network *Network) net.IP {
 	var ip net.IP
+	min, max, ok := network.allocatableIDs(b)
+	if !ok {
+		return nil
+	}
+	excluded := network.reservedIDs(b)
 	blackedOutIPInts := make([]uint64, 0)
 	for {
-		ipInt, err := b.Pool.GetID()
-		if err == nil {
-			ip = common.IntToIPv4(ipInt)
-			blackedOutBy := network.blackedOutBy(ip)
-			if blackedOutBy == nil {
-				break
-			} else {
-				log.Tracef(trace.Private, "IP %s is blacked out by %s", ip, blackedOutBy)
-				blackedOutIPInts = append(blackedOutIPInts, ipInt)
-				ip = nil
-			}
-		} else {
+		ipInt, ok := b.selectID(network.AddressSelection, min, max, excluded)
+		if !ok {
 			// Exhausted
 			break
 		}
-	}
-	if len(blackedOutIPInts) > 0 {
-		log.Tracef(trace.Private, "Could not allocate these, as they are blacked out: %v", blackedOutIPInts)
-		err, _ := b.Pool.ReclaimIDs(blackedOutIPInts)
+		candidate := b.CIDR.intToIP(ipInt)
+		if blackedOutBy := network.blackedOutBy(candidate); blackedOutBy != nil {
+			log.Tracef(trace.Private, "IP %s is blacked out by %s", candidate, blackedOutBy)
+			blackedOutIPInts = append(blackedOutIPInts, ipInt)
+			excluded = insertSortedUint64(excluded, ipInt)
+			continue
+		}
+		err := b.Pool.GetSpecificID(ipInt)
 		if err != nil {
 			// Nothing much to do here...
-			log.Errorf("Could not reclaim IDs: %s", err)
+			log.Errorf("Could not take ID %d from %s: %s", ipInt, b.CIDR, err)
+			break
 		}
+		b.taken(ipInt)
+		ip = candidate
+		break
+	}
+	if len(blackedOutIPInts) > 0 {
+		log.Tracef(trace.Private, "Could not allocate these, as they are blacked out: %v", blackedOutIPInts)
 	}
 	log.Tracef(trace.Private, "Allocated %s from %s", ip, b.CIDR)
 
@@ -845,17 +1165,36 @@ func (b *Block) allocateIP(network *Network) net.IP {
 	return ip
 }
 
+// allocateSpecificIP allocates the specified IP within the block.
+func (b *Block) allocateSpecificIP(ip net.IP) error {
+	ipInt := b.CIDR.ipToInt(ip)
+	err := b.Pool.GetSpecificID(ipInt)
+	if err != nil {
+		return errors.NewRomanaConflictError(
+			fmt.Sprintf("Address %s is not available in block %s", ip, b.CIDR),
+			"IP",
+			fmt.Sprintf("IP=%s", ip))
+	}
+	b.taken(ipInt)
+	log.Tracef(trace.Private, "Allocated %s from %s", ip, b.CIDR)
+	b.Revision++
+	return nil
+}
+
 // deallocateIP deallocates the specified IP within the block.
-func (b *Block) deallocateIP(ip net.IP) error {
+func (b *Block) deallocateIP(network *Network, ip net.IP) error {
 	log.Tracef(trace.Inside, "Block.deallocateIP: Deallocating IP %s from block %s", ip, b)
 	if !b.CIDR.IPNet.Contains(ip) {
 		return common.NewError("Block.deallocateIP: IP %s not in this block %s", ip, b.CIDR)
 	}
-	ipInt := common.IPv4ToInt(ip)
+	ipInt := b.CIDR.ipToInt(ip)
 	err := b.Pool.ReclaimID(ipInt)
 	if err != nil {
 		return err
 	}
+	if network.AddressSelection == api.AddressSelectionLeastRecentlyFreed {
+		b.freed(ipInt)
+	}
 	b.Revision++
 	return nil
 
@@ -873,7 +1212,23 @@ type Network struct {
 	// (specify 32 for size 1, e.g.)
 	BlockMask uint `json:"block_mask"`
 
+	// Block masks of tenants that override BlockMask.
+	TenantBlockMasks map[string]uint `json:"tenant_block_masks,omitempty"`
+
+	// If not 0, each further block of an owner on a host is twice
+	// the size of the previous one, up to this mask.
+	MinBlockMask uint `json:"min_block_mask,omitempty"`
+
+	// Addresses of every block that are never allocated.
+	Reserved *api.BlockReservation `json:"reserved,omitempty"`
+
+	// Strategy of selecting addresses within blocks (see
+	// api.AddressSelection* constants); lowest-free if empty.
+	AddressSelection string `json:"address_selection,omitempty"`
+
 	BlackedOut []CIDR `json:"blacked_out"`
+	// Details of blackouts, by blacked out CIDR.
+	Blackouts map[string]*Blackout `json:"blackouts,omitempty"`
 
 	Group *Group `json:"host_groups"`
 
@@ -892,10 +1247,27 @@ func newNetwork(name string, cidr CIDR, blockMask uint) *Network {
 	return network
 }
 
+// blockMaskFor returns the mask of a new block for the owner,
+// which already has the provided number of blocks on the host.
+func (network *Network) blockMaskFor(owner string, hostBlocks int) uint {
+	tenant, _ := parseOwner(owner)
+	blockMask := network.BlockMask
+	if tenantBlockMask, ok := network.TenantBlockMasks[tenant]; ok {
+		blockMask = tenantBlockMask
+	}
+	if network.MinBlockMask == 0 || network.MinBlockMask >= blockMask {
+		return blockMask
+	}
+	if grow := blockMask - network.MinBlockMask; uint(hostBlocks) < grow {
+		return blockMask - uint(hostBlocks)
+	}
+	return network.MinBlockMask
+}
+
 // deallocateIP attempts to deallocate an IP from the network. If the block
 // an IP is deallocated from is empty, it is returned to an empty pool.
 func (network *Network) deallocateIP(ip net.IP) error {
-	err := network.Group.deallocateIP(ip)
+	err := network.Group.deallocateIP(network, ip)
 	if err == nil {
 		network.Revison++
 	}
@@ -915,9 +1287,23 @@ func (network *Network) allocateIP(hostName string, owner string) (net.IP, error
 			"host",
 			fmt.Sprintf("hostname=%s", hostName))
 	}
-	ip := host.group.allocateIP(network, hostName, owner)
+	var blockQuotaErr error
+	if network.ipam != nil {
+		err := network.ipam.checkQuota(owner, false)
+		if err != nil {
+			return nil, err
+		}
+		blockQuotaErr = network.ipam.checkQuota(owner, true)
+	}
+	ip := host.group.allocateIP(network, hostName, owner, blockQuotaErr == nil && !host.Cordoned)
 	if ip == nil {
-		return nil, nil
+		// If no new block could be taken because of the quota
+		// or because the host is cordoned, report that rather
+		// than exhaustion.
+		if blockQuotaErr == nil && host.Cordoned {
+			return nil, cordonedError(hostName)
+		}
+		return nil, blockQuotaErr
 	}
 	network.Revison++
 	return ip, nil
@@ -946,7 +1332,7 @@ type Saver func(ipam *IPAM, ch <-chan struct{}) error
 // mutexLocker is used. If an HA deployment is expected, then the locker
 // based on some external resource, e.g., a DB, should be provided.
 func NewIPAM(saver Saver, locker Locker) (*IPAM, error) {
-	ipam := &IPAM{}
+	ipam := &IPAM{renewals: newMemRenewals()}
 	if locker == nil {
 		ipam.locker = newMutexLocker()
 	} else {
@@ -976,9 +1362,26 @@ func parseIPAM(j string) (*IPAM, error) {
 	if err != nil {
 		return nil, err
 	}
+	prepareParsedIPAM(ipam)
+	return ipam, nil
+}
+
+// prepareParsedIPAM restores what is not stored in JSON of IPAM.
+func prepareParsedIPAM(ipam *IPAM) {
 	ipam.injectParents()
+	if ipam.AddressNameToIPv6 == nil {
+		ipam.AddressNameToIPv6 = make(map[string]net.IP)
+	}
+	if ipam.AddressNameToLease == nil {
+		ipam.AddressNameToLease = make(map[string]*Lease)
+	}
+	if ipam.TenantQuotas == nil {
+		ipam.TenantQuotas = make(map[string]Quota)
+	}
+	if ipam.SegmentQuotas == nil {
+		ipam.SegmentQuotas = make(map[string]Quota)
+	}
 	ipam.locker = newMutexLocker()
-	return ipam, nil
 }
 
 type IPAM struct {
@@ -991,15 +1394,32 @@ type IPAM struct {
 
 	// Map of address name to IP
 	AddressNameToIP map[string]net.IP `json:"address_name_to_ip"`
-	load            Loader
-	save            Saver
-	locker          Locker
+	// Map of address name to IPv6 address for names that were
+	// allocated a dual-stack pair. The IPv4 address of the pair
+	// is in AddressNameToIP.
+	AddressNameToIPv6 map[string]net.IP `json:"address_name_to_ipv6"`
+	// Map of address name to lease of that address.
+	AddressNameToLease map[string]*Lease `json:"address_name_to_lease"`
+	load               Loader
+	save               Saver
+	locker             Locker
+	// Where renewals of leases are kept (see HostRenewal).
+	renewals renewalStore
 
 	TenantToNetwork map[string][]string `json:"tenant_to_network"`
 
+	// Quotas of tenants, keyed by tenant.
+	TenantQuotas map[string]Quota `json:"tenant_quotas"`
+	// Quotas of segments, keyed by owner (see makeOwner).
+	SegmentQuotas map[string]Quota `json:"segment_quotas"`
+
 	//	OwnerToIP map[string][]string
 	//	IPToOwner map[string]string
 	prevKVPair *libkvStore.KVPair
+	// KV pairs of group and index shards IPAM was loaded from, by
+	// their names, if these are stored under keys of their own (see
+	// saveIPAM).
+	committedKVPairs map[string]*libkvStore.KVPair
 }
 
 func (ipam *IPAM) GetPrevKVPair() *libkvStore.KVPair {
@@ -1025,7 +1445,11 @@ func (ipam *IPAM) injectParents() {
 func clearIPAM(ipam *IPAM) {
 	ipam.Networks = make(map[string]*Network)
 	ipam.AddressNameToIP = make(map[string]net.IP)
+	ipam.AddressNameToIPv6 = make(map[string]net.IP)
+	ipam.AddressNameToLease = make(map[string]*Lease)
 	ipam.TenantToNetwork = make(map[string][]string)
+	ipam.TenantQuotas = make(map[string]Quota)
+	ipam.SegmentQuotas = make(map[string]Quota)
 }
 
 func (ipam *IPAM) ListHosts() api.HostList {
@@ -1037,8 +1461,12 @@ func (ipam *IPAM) ListHosts() api.HostList {
 			}
 			list = append(list, api.Host{
 				IP:        host.IP,
+				IPv6:      host.IPv6,
 				Name:      host.Name,
 				AgentPort: host.AgentPort,
+				Tags:      host.Tags,
+				K8SInfo:   host.K8SInfo,
+				Cordoned:  host.Cordoned,
 			})
 		}
 	}
@@ -1065,24 +1493,44 @@ func (ipam *IPAM) GetGroupsForNetwork(netName string) *Group {
 // and if all are exhausted, will try to allocate a new block for
 // this tenant/segment pair. Will return nil as IP if the entire
 // network is exhausted.
+// If the tenant is allowed on both IPv4 and IPv6 networks that the
+// host is part of, a dual-stack pair is allocated, and the IPv4 address
+// is returned; see AllocateDualStackIP.
 func (ipam *IPAM) AllocateIP(addressName string, host string, tenant string, segment string) (net.IP, error) {
-	log.Tracef(trace.Inside, "Entering IPAM.AllocateIP()")
-	ch, err := ipam.locker.Lock()
+	ipv4, ipv6, err := ipam.AllocateDualStackIP(addressName, host, tenant, segment)
 	if err != nil {
-		log.Tracef(trace.Inside, "IPAM.AllocateIP: error acquiring a lock")
 		return nil, err
 	}
-	log.Tracef(trace.Inside, "IPAM.AllocateIP: got a lock")
-	defer ipam.locker.Unlock()
-
-	latestIPAM := &IPAM{}
-	err = ipam.load(latestIPAM, ch)
+	if ipv4 != nil {
+		return ipv4, nil
+	}
+	return ipv6, nil
+}
+
+// AllocateDualStackIP is similar to AllocateIP, but returns both IPv4 and
+// IPv6 addresses allocated under the provided name. One of them will be nil
+// if the tenant is not allowed on (or the host is not part of) any network
+// of that address family. If one address of the pair cannot be allocated,
+// neither is.
+func (ipam *IPAM) AllocateDualStackIP(addressName string, host string, tenant string, segment string) (net.IP, net.IP, error) {
+	log.Tracef(trace.Inside, "Entering IPAM.AllocateDualStackIP()")
+	var ipv4, ipv6 net.IP
+	err := ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		var err error
+		ipv4, ipv6, err = latestIPAM.allocateDualStackIP(addressName, host, tenant, segment)
+		return err == nil, err
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return ipv4, ipv6, nil
+}
 
-	if addr, ok := latestIPAM.AddressNameToIP[addressName]; ok {
-		return nil, errors.NewRomanaExistsError(
+// allocateDualStackIP allocates addresses in this IPAM (see
+// AllocateDualStackIP).
+func (ipam *IPAM) allocateDualStackIP(addressName string, host string, tenant string, segment string) (net.IP, net.IP, error) {
+	if addr, ok := ipam.AddressNameToIP[addressName]; ok {
+		return nil, nil, errors.NewRomanaExistsError(
 			fmt.Sprintf("Address with name %s already allocated: %s", addressName, addr),
 			addressName,
 			"IP",
@@ -1092,13 +1540,22 @@ func (ipam *IPAM) AllocateIP(addressName string, host string, tenant string, seg
 	}
 
 	// Find eligible networks for the specified tenant
-	networksForTenant, err := latestIPAM.getNetworksForTenant(tenant)
+	networksForTenant, err := ipam.getNetworksForTenant(tenant)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	owner := makeOwner(tenant, segment)
+	var ipv4, ipv6 net.IP
+	// Address families (keyed by whether they are IPv6) that have
+	// networks this host is part of. An address must be allocated for
+	// each of them.
+	families := make(map[bool]bool)
 	for _, network := range networksForTenant {
+		isIPv6 := network.CIDR.IsIPv6()
+		if (isIPv6 && ipv6 != nil) || (!isIPv6 && ipv4 != nil) {
+			continue
+		}
 		log.Tracef(trace.Inside, "Trying to allocate IP for host %s on network %s.", host, network.Name)
 		ip, err := network.allocateIP(host, owner)
 		if err != nil {
@@ -1111,88 +1568,211 @@ func (ipam *IPAM) AllocateIP(addressName string, host string, tenant string, seg
 					log.Infof("Network %s does not have host %s defined, skipping.", network.Name, host)
 					continue
 				} else {
-					return nil, err
+					return nil, nil, err
 				}
 			default:
-				return nil, err
+				return nil, nil, err
 			}
 		}
+		if network.Group != nil {
+			families[isIPv6] = true
+		}
 
 		if ip != nil {
-			latestIPAM.AddressNameToIP[addressName] = ip
-			latestIPAM.AllocationRevision++
-			log.Tracef(trace.Inside, "Updated AllocationRevision to %d", latestIPAM.AllocationRevision)
-			err = ipam.save(latestIPAM, ch)
-			if err != nil {
-				return nil, err
+			if isIPv6 {
+				ipv6 = ip
+			} else {
+				ipv4 = ip
 			}
-			return ip, nil
 		}
 	}
-	return nil, common.NewError(msgNoAvailableIP)
-}
 
-// DeallocateIP will deallocate the provided IP (returning an
-// error if it never was allocated in the first place).
-func (ipam *IPAM) DeallocateIP(addressName string) error {
-	ch, err := ipam.locker.Lock()
+	if (families[false] && ipv4 == nil) || (families[true] && ipv6 == nil) || (ipv4 == nil && ipv6 == nil) {
+		return nil, nil, common.NewError(msgNoAvailableIP)
+	}
+
+	if ipv4 != nil {
+		ipam.AddressNameToIP[addressName] = ipv4
+		if ipv6 != nil {
+			ipam.AddressNameToIPv6[addressName] = ipv6
+		}
+	} else {
+		ipam.AddressNameToIP[addressName] = ipv6
+	}
+	ipam.AddressNameToLease[addressName] = newLease(addressName, host)
+	ipam.AllocationRevision++
+	log.Tracef(trace.Inside, "Updated AllocationRevision to %d", ipam.AllocationRevision)
+	return ipv4, ipv6, nil
+}
+
+// AllocateSpecificIP allocates the provided IP for the provided tenant and
+// segment on the host, and associates the provided name with it (see
+// AllocateIP). The IP must be in a network the tenant is allowed on, within
+// the part of it that is routed to the host. A RomanaConflictError is
+// returned if the IP is already allocated, blacked out, or in a block that
+// belongs to another tenant/segment or host.
+func (ipam *IPAM) AllocateSpecificIP(addressName string, ip net.IP, host string, tenant string, segment string) error {
+	log.Tracef(trace.Inside, "Entering IPAM.AllocateSpecificIP()")
+	return ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		err := latestIPAM.allocateSpecificIP(addressName, ip, host, tenant, segment)
+		return err == nil, err
+	})
+}
+
+// allocateSpecificIP allocates the IP in this IPAM (see AllocateSpecificIP).
+func (ipam *IPAM) allocateSpecificIP(addressName string, ip net.IP, host string, tenant string, segment string) error {
+	if addr, ok := ipam.AddressNameToIP[addressName]; ok {
+		return errors.NewRomanaExistsError(
+			fmt.Sprintf("Address with name %s already allocated: %s", addressName, addr),
+			addressName,
+			"IP",
+			fmt.Sprintf("name=%s", addressName),
+			fmt.Sprintf("IP=%s", addr))
+	}
+	if name := ipam.findAddressName(ip.String()); name != "" {
+		return errors.NewRomanaConflictError(
+			fmt.Sprintf("Address %s already allocated to %s", ip, name),
+			"IP",
+			fmt.Sprintf("IP=%s", ip))
+	}
+
+	networksForTenant, err := ipam.getNetworksForTenant(tenant)
 	if err != nil {
 		return err
 	}
-	defer ipam.locker.Unlock()
+	var network *Network
+	for _, n := range networksForTenant {
+		if n.CIDR.IPNet.Contains(ip) {
+			network = n
+			break
+		}
+	}
+	if network == nil || network.Group == nil {
+		return errors.NewRomanaConflictError(
+			fmt.Sprintf("Address %s is not in any network available to tenant %s", ip, tenant),
+			"IP",
+			fmt.Sprintf("IP=%s", ip))
+	}
+	hostObj := network.Group.findHostByName(host)
+	if hostObj == nil {
+		return errors.NewRomanaNotFoundError(fmt.Sprintf("Host %s not found", host),
+			"host",
+			fmt.Sprintf("hostname=%s", host))
+	}
+	if !hostObj.group.CIDR.IPNet.Contains(ip) {
+		return errors.NewRomanaConflictError(
+			fmt.Sprintf("Address %s is not within %s, which is routed to host %s", ip, hostObj.group.CIDR, host),
+			"IP",
+			fmt.Sprintf("IP=%s", ip))
+	}
+	if blackedOutBy := network.blackedOutBy(ip); blackedOutBy != nil {
+		return errors.NewRomanaConflictError(
+			fmt.Sprintf("Address %s is blacked out by %s", ip, blackedOutBy),
+			"IP",
+			fmt.Sprintf("IP=%s", ip))
+	}
 
-	latestIPAM := &IPAM{}
-	clearIPAM(latestIPAM)
-	err = ipam.load(latestIPAM, ch)
+	owner := makeOwner(tenant, segment)
+	newBlock := true
+	for blockID, block := range hostObj.group.Blocks {
+		if block.CIDR.IPNet.Contains(ip) {
+			_, owned := hostObj.group.BlockToOwner[blockID]
+			newBlock = !owned
+			break
+		}
+	}
+	if newBlock && hostObj.Cordoned {
+		return cordonedError(host)
+	}
+	err = ipam.checkQuota(owner, newBlock)
 	if err != nil {
 		return err
 	}
 
-	if ip, ok := latestIPAM.AddressNameToIP[addressName]; ok {
-		log.Tracef(trace.Inside, "IPAM.DeallocateIP: Request to deallocate %s: %s", addressName, ip)
-		for _, network := range latestIPAM.Networks {
-			if network.CIDR.IPNet.Contains(ip) {
-				log.Tracef(trace.Inside, "IPAM.DeallocateIP: IP %s belongs to network %s", ip, network.Name)
-				err := network.deallocateIP(ip)
-				if err == nil {
-					delete(latestIPAM.AddressNameToIP, addressName)
-					latestIPAM.AllocationRevision++
-					err = ipam.save(latestIPAM, ch)
-					if err != nil {
-						return err
-					}
-				}
-				return err
-			}
+	err = hostObj.group.allocateSpecificIP(network, host, owner, ip)
+	if err != nil {
+		return err
+	}
+	network.Revison++
+
+	ipam.AddressNameToIP[addressName] = ip
+	ipam.AddressNameToLease[addressName] = newLease(addressName, host)
+	ipam.AllocationRevision++
+	log.Tracef(trace.Inside, "Updated AllocationRevision to %d", ipam.AllocationRevision)
+	return nil
+}
+
+// DeallocateIP will deallocate the provided IP (returning an
+// error if it never was allocated in the first place). The address
+// can be specified by its name or by the IP itself. If the name was
+// allocated a dual-stack pair, both addresses are deallocated.
+func (ipam *IPAM) DeallocateIP(addressName string) error {
+	return ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		name := latestIPAM.findAddressName(addressName)
+		if name == "" {
+			return false, errors.NewRomanaNotFoundError("", "address", fmt.Sprintf("name=%s", addressName))
+		}
+		err := latestIPAM.deallocateName(name)
+		if err != nil {
+			return false, err
 		}
-		return errors.NewRomanaNotFoundError("", "IP", fmt.Sprintf("IP=%s", ip))
+		latestIPAM.AllocationRevision++
+		return true, nil
+	})
+}
+
+// deallocateName deallocates the address(es) allocated under the
+// provided name, and forgets the name.
+func (ipam *IPAM) deallocateName(name string) error {
+	ip := ipam.AddressNameToIP[name]
+	log.Tracef(trace.Inside, "IPAM.DeallocateIP: Request to deallocate %s: %s", name, ip)
+	err := ipam.deallocateAddress(ip)
+	if err != nil {
+		return err
 	}
-	// find by IPAddress instead of name, so that all
-	// platforms are supported.
-	for name, ip := range latestIPAM.AddressNameToIP {
+	if ipv6, ok := ipam.AddressNameToIPv6[name]; ok {
+		log.Tracef(trace.Inside, "IPAM.DeallocateIP: Request to deallocate %s: %s", name, ipv6)
+		err = ipam.deallocateAddress(ipv6)
+		if err != nil {
+			return err
+		}
+		delete(ipam.AddressNameToIPv6, name)
+	}
+	delete(ipam.AddressNameToIP, name)
+	delete(ipam.AddressNameToLease, name)
+	return nil
+}
+
+// findAddressName returns the name under which the provided address is
+// allocated. The address may be specified either by name or by IP
+// (so that all platforms are supported). Empty string is returned if
+// not found.
+func (ipam *IPAM) findAddressName(addressName string) string {
+	if _, ok := ipam.AddressNameToIP[addressName]; ok {
+		return addressName
+	}
+	for name, ip := range ipam.AddressNameToIP {
 		if ip.String() == addressName {
-			for _, network := range latestIPAM.Networks {
-				if network.CIDR.IPNet.Contains(ip) {
-					log.Tracef(trace.Inside,
-						"IPAM.DeallocateIP: IP %s belongs to network %s",
-						ip, network.Name)
-					err := network.deallocateIP(ip)
-					if err == nil {
-						delete(latestIPAM.AddressNameToIP, name)
-						latestIPAM.AllocationRevision++
-						err = ipam.save(latestIPAM, ch)
-						if err != nil {
-							return err
-						}
-					}
-					return err
-				}
-			}
-			return common.NewError404("IP", ip.String())
+			return name
+		}
+	}
+	for name, ip := range ipam.AddressNameToIPv6 {
+		if ip.String() == addressName {
+			return name
 		}
 	}
+	return ""
+}
 
-	return errors.NewRomanaNotFoundError("", "address", fmt.Sprintf("name=%s", addressName))
+// deallocateAddress deallocates the IP from the network it belongs to.
+func (ipam *IPAM) deallocateAddress(ip net.IP) error {
+	for _, network := range ipam.Networks {
+		if network.CIDR.IPNet.Contains(ip) {
+			log.Tracef(trace.Inside, "IPAM.DeallocateIP: IP %s belongs to network %s", ip, network.Name)
+			return network.deallocateIP(ip)
+		}
+	}
+	return errors.NewRomanaNotFoundError("", "IP", fmt.Sprintf("IP=%s", ip))
 }
 
 // getNetworksForTenant gets all eligible networks for the
@@ -1225,72 +1805,114 @@ func (ipam *IPAM) getNetworksForTenant(tenant string) ([]*Network, error) {
 }
 
 // updateTopology updates the entire topology, returning an error if it is
-// in conflict with the previous topology.
+// in conflict with the previous topology. If addresses have already been
+// allocated, existing hosts are re-parented into the new topology, and
+// allocated blocks are moved along with them (see migrateAllocations).
+// If lockAndSave is true, the latest IPAM is updated and saved (see
+// update), otherwise this IPAM is updated in place.
 func (ipam *IPAM) UpdateTopology(req api.TopologyUpdateRequest, lockAndSave bool) error {
-	var err error
-	var ch <-chan struct{}
 	if lockAndSave {
-		ch, err = ipam.locker.Lock()
-		if err != nil {
-			return err
-		}
-		defer ipam.locker.Unlock()
+		return ipam.update(func(latestIPAM *IPAM) (bool, error) {
+			err := latestIPAM.UpdateTopology(req, false)
+			return err == nil, err
+		})
 	}
-	allocatedBlocks := false
-
-	for _, netDef := range ipam.Networks {
-		// Blocks that have IPs assigned -- if they didn't, they would be
-		// in ReusableBlocks but not here
-		if netDef.Group.BlockToOwner != nil && len(netDef.Group.BlockToOwner) > 0 {
-			allocatedBlocks = true
-			break
-		}
-	}
-
-	if allocatedBlocks {
-		return common.NewError("Updating topology after IPs have been allocated currently not implemented.")
-	}
-	clearIPAM(ipam)
+	var err error
+	// The new topology is built separately, so that the current one
+	// is left intact should it turn out to be invalid.
+	newIPAM := &IPAM{}
+	clearIPAM(newIPAM)
 
 	var netDef api.NetworkDefinition
 	for _, netDef = range req.Networks {
 		log.Infof("Parsing network %s", netDef.Name)
-		if _, ok := ipam.Networks[netDef.Name]; ok {
+		if _, ok := newIPAM.Networks[netDef.Name]; ok {
 			return common.NewError("Network with name %s already defined", netDef.Name)
 		}
-		if netDef.BlockMask == 0 {
-			return common.NewError("Block mask %d (or unspecified) for %s is invalid, must be > 8", netDef.BlockMask, netDef.Name)
-		}
-		if netDef.BlockMask <= 8 {
-			return common.NewError("Block mask %d for %s is invalid, must be > 8", netDef.BlockMask, netDef.Name)
-		}
 		netDefCIDR, err := NewCIDR(netDef.CIDR)
 		if err != nil {
 			return err
 		}
+		if netDefCIDR.IsIPv6() {
+			// Host bits of a block must fit into 64 bits (see CIDR).
+			if netDef.BlockMask <= 64 || netDef.BlockMask > 128 {
+				return common.NewError("Block mask %d for IPv6 network %s is invalid, must be > 64 and <= 128", netDef.BlockMask, netDef.Name)
+			}
+		} else {
+			if netDef.BlockMask == 0 {
+				return common.NewError("Block mask %d (or unspecified) for %s is invalid, must be > 8", netDef.BlockMask, netDef.Name)
+			}
+			if netDef.BlockMask <= 8 {
+				return common.NewError("Block mask %d for %s is invalid, must be > 8", netDef.BlockMask, netDef.Name)
+			}
+		}
 
 		// If empty, all tenants are allowed.
 		if netDef.Tenants == nil || len(netDef.Tenants) == 0 {
-			if networksForTenant, ok := ipam.TenantToNetwork["*"]; ok {
-				ipam.TenantToNetwork["*"] = append(networksForTenant, netDef.Name)
+			if networksForTenant, ok := newIPAM.TenantToNetwork["*"]; ok {
+				newIPAM.TenantToNetwork["*"] = append(networksForTenant, netDef.Name)
 			} else {
-				ipam.TenantToNetwork["*"] = []string{netDef.Name}
+				newIPAM.TenantToNetwork["*"] = []string{netDef.Name}
 			}
 		} else {
 			for _, tenantName := range netDef.Tenants {
 				if !tenantNameRegexp.MatchString(tenantName) {
 					return common.NewError("Bad tenant name: %s", tenantName)
 				}
-				if _, ok := ipam.TenantToNetwork[tenantName]; !ok {
-					ipam.TenantToNetwork[tenantName] = make([]string, 0)
+				if _, ok := newIPAM.TenantToNetwork[tenantName]; !ok {
+					newIPAM.TenantToNetwork[tenantName] = make([]string, 0)
 				}
-				ipam.TenantToNetwork[tenantName] = append(ipam.TenantToNetwork[tenantName], netDef.Name)
+				newIPAM.TenantToNetwork[tenantName] = append(newIPAM.TenantToNetwork[tenantName], netDef.Name)
 			}
 		}
+		switch netDef.AddressSelection {
+		case "", api.AddressSelectionLowestFree, api.AddressSelectionNextAfterLast,
+			api.AddressSelectionRandom, api.AddressSelectionLeastRecentlyFreed:
+		default:
+			return common.NewError("Unknown address selection strategy %s for %s", netDef.AddressSelection, netDef.Name)
+		}
+
+		prefixLen, bits := netDefCIDR.IPNet.Mask.Size()
+		checkMask := func(what string, mask uint) error {
+			if mask < uint(prefixLen) || mask > uint(bits) {
+				return common.NewError("%s %d for %s is invalid, must be between %d and %d", what, mask, netDef.Name, prefixLen, bits)
+			}
+			if netDefCIDR.IsIPv6() && mask <= 64 {
+				return common.NewError("%s %d for IPv6 network %s is invalid, must be > 64", what, mask, netDef.Name)
+			}
+			return nil
+		}
+		for tenantName, mask := range netDef.TenantBlockMasks {
+			if !tenantNameRegexp.MatchString(tenantName) {
+				return common.NewError("Bad tenant name: %s", tenantName)
+			}
+			err = checkMask(fmt.Sprintf("Block mask of tenant %s", tenantName), mask)
+			if err != nil {
+				return err
+			}
+		}
+		if netDef.MinBlockMask != 0 {
+			err = checkMask("Minimal block mask", netDef.MinBlockMask)
+			if err != nil {
+				return err
+			}
+			if netDef.MinBlockMask > netDef.BlockMask {
+				return common.NewError("Minimal block mask %d for %s is invalid, must not be greater than block mask %d", netDef.MinBlockMask, netDef.Name, netDef.BlockMask)
+			}
+		}
+		err = validateReservation(netDef, netDefCIDR.bits())
+		if err != nil {
+			return err
+		}
+
 		network := newNetwork(netDef.Name, netDefCIDR, netDef.BlockMask)
-		network.ipam = ipam
+		network.AddressSelection = netDef.AddressSelection
+		network.TenantBlockMasks = netDef.TenantBlockMasks
+		network.MinBlockMask = netDef.MinBlockMask
+		network.Reserved = netDef.Reserved
+		network.ipam = newIPAM
 		log.Infof("Adding network %s: %v", netDef.Name, network)
-		ipam.Networks[netDef.Name] = network
+		newIPAM.Networks[netDef.Name] = network
 	}
 
 	// Now check if we got any overlapping CIDRs...
@@ -1299,8 +1921,8 @@ func (ipam *IPAM) UpdateTopology(req api.TopologyUpdateRequest, lockAndSave bool
 	// n^2 nested loop is ok - there will not be a lot of networks.
 	var net1 *Network
 	var net2 *Network
-	for _, net1 = range ipam.Networks {
-		for _, net2 = range ipam.Networks {
+	for _, net1 = range newIPAM.Networks {
+		for _, net2 = range newIPAM.Networks {
 			if net1 == net2 {
 				continue
 			}
@@ -1315,7 +1937,7 @@ func (ipam *IPAM) UpdateTopology(req api.TopologyUpdateRequest, lockAndSave bool
 	}
 
 	processedNetworks := make(map[string]bool)
-	log.Tracef(trace.Inside, "Tenants to network mapping: %v", ipam.TenantToNetwork)
+	log.Tracef(trace.Inside, "Tenants to network mapping: %v", newIPAM.TenantToNetwork)
 	var ok bool
 	var network *Network
 	for _, topoDef := range req.Topologies {
@@ -1323,7 +1945,7 @@ func (ipam *IPAM) UpdateTopology(req api.TopologyUpdateRequest, lockAndSave bool
 			if _, ok = processedNetworks[netName]; ok {
 				return common.NewError("Network %s appears more than once.", netName)
 			}
-			if network, ok = ipam.Networks[netName]; ok {
+			if network, ok = newIPAM.Networks[netName]; ok {
 				hg := &Group{}
 
 				err = hg.parseMap(topoDef.Map, network.CIDR, network)
@@ -1338,13 +1960,25 @@ func (ipam *IPAM) UpdateTopology(req api.TopologyUpdateRequest, lockAndSave bool
 			processedNetworks[netName] = true
 		}
 	}
-	ipam.TopologyRevision++
-	if lockAndSave {
-		err = ipam.save(ipam, ch)
+
+	if ipam.hasAllocations() {
+		// Carry existing allocations over into the new topology.
+		err = ipam.migrateAllocations(newIPAM)
 		if err != nil {
 			return err
 		}
+		newIPAM.AddressNameToIP = ipam.AddressNameToIP
+		newIPAM.AddressNameToIPv6 = ipam.AddressNameToIPv6
+		newIPAM.AddressNameToLease = ipam.AddressNameToLease
 	}
+
+	ipam.Networks = newIPAM.Networks
+	ipam.TenantToNetwork = newIPAM.TenantToNetwork
+	ipam.AddressNameToIP = newIPAM.AddressNameToIP
+	ipam.AddressNameToIPv6 = newIPAM.AddressNameToIPv6
+	ipam.AddressNameToLease = newIPAM.AddressNameToLease
+	ipam.injectParents()
+	ipam.TopologyRevision++
 	return nil
 }
 
@@ -1371,21 +2005,29 @@ func (ipam *IPAM) ListNetworkBlocks(netName string) *api.IPAMBlocksResponse {
 	return nil
 }
 
-func (ipam *IPAM) RemoveHost(host api.Host) error {
-	ch, err := ipam.locker.Lock()
-	if err != nil {
-		return err
-	}
-	defer ipam.locker.Unlock()
-
+// RemoveHost removes the host from all networks. If the host has
+// allocated addresses, it is an error unless force is true, in which
+// case the addresses are released. All blocks of the host are
+// returned to ReusableBlocks.
+func (ipam *IPAM) RemoveHost(host api.Host, force bool) error {
 	if host.IP == nil && host.Name == "" {
 		return common.NewError("At least one of IP, Name must be specified to delete a host")
 	}
-	removedHost := false
-	var hostToRemove *Host
+	return ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		err := latestIPAM.removeHost(host, force)
+		return err == nil, err
+	})
+}
+
+// removeHost removes the host from this IPAM (see RemoveHost).
+func (ipam *IPAM) removeHost(host api.Host, force bool) error {
+	hostsToRemove := make(map[*Network]*Host)
 	for _, net := range ipam.Networks {
 		log.Tracef(trace.Inside, "Looking for host %v (%s) to remove from net %s", host.IP, host.Name, net.Name)
-		hostToRemove = nil
+		if net.Group == nil {
+			continue
+		}
+		var hostToRemove *Host
 		if host.IP == nil {
 			hostToRemove = net.Group.findHostByName(host.Name)
 		} else {
@@ -1400,56 +2042,77 @@ func (ipam *IPAM) RemoveHost(host api.Host) error {
 				return common.NewError("Found host with IP %s but it has name %s, not %s", host.IP, hostToRemove.Name, host.Name)
 			}
 		}
-		var i int
-		var curHost *Host
+		hostsToRemove[net] = hostToRemove
+	}
+	if len(hostsToRemove) == 0 {
+		return errors.NewRomanaNotFoundError(fmt.Sprintf("No host found with IP %s and/or name %s", host.IP, host.Name),
+			"host", fmt.Sprintf("name=%s", host.Name), fmt.Sprintf("IP=%s", host.IP))
+	}
 
-		for i, curHost = range hostToRemove.group.Hosts {
-			if curHost.IP.String() == hostToRemove.IP.String() {
-				log.Tracef(trace.Inside, "Net %s: removing host %s (%d) from group %s (%v)\n", net.Name, hostToRemove, i, hostToRemove.group.Name, hostToRemove.group.Hosts)
-				hostToRemove.group.Hosts = deleteElementHost(hostToRemove.group.Hosts, i)
-				log.Tracef(trace.Inside, "Net %s, group %s, after removal: %v", net.Name, hostToRemove.group.Name, hostToRemove.group.Hosts)
-				removedHost = true
+	released := 0
+	for _, hostToRemove := range hostsToRemove {
+		names := ipam.hostAddressNames(hostToRemove.Name)
+		if len(names) > 0 && !force {
+			return errors.NewRomanaConflictError(
+				fmt.Sprintf("Host %s has %d allocated address(es), drain it first or force removal", hostToRemove.Name, len(names)),
+				"host", fmt.Sprintf("name=%s", hostToRemove.Name))
+		}
+		for _, name := range names {
+			log.Infof("Releasing address %s (%s) of host %s being removed", name, ipam.AddressNameToIP[name], hostToRemove.Name)
+			err := ipam.deallocateName(name)
+			if err != nil {
+				return err
+			}
+			released++
+		}
+	}
+
+	for net, hostToRemove := range hostsToRemove {
+		group := hostToRemove.group
+		for i, curHost := range group.Hosts {
+			if curHost.Name == hostToRemove.Name {
+				log.Tracef(trace.Inside, "Net %s: removing host %s (%d) from group %s (%v)\n", net.Name, hostToRemove, i, group.Name, group.Hosts)
+				group.Hosts = deleteElementHost(group.Hosts, i)
+				log.Tracef(trace.Inside, "Net %s, group %s, after removal: %v", net.Name, group.Name, group.Hosts)
 				break
 			}
 		}
-		for k, v := range hostToRemove.group.BlockToHost {
-			if v == curHost.Name {
-				delete(hostToRemove.group.BlockToHost, k)
-				hostToRemove.group.Blocks[k].clear()
-				hostToRemove.group.ReusableBlocks = append(hostToRemove.group.ReusableBlocks, k)
+		// Blocks still left to the host only have addresses without names.
+		for _, blockID := range sortedBlockIDs(group.BlockToHost) {
+			if group.BlockToHost[blockID] != hostToRemove.Name {
+				continue
 			}
+			group.releaseBlock(blockID)
 		}
+		net.Revison++
 	}
-	if removedHost {
-		ipam.TopologyRevision++
-		err = ipam.save(ipam, ch)
-		if err != nil {
-			return err
-		}
-	} else {
-		return common.NewError("No host found with IP %s and/or name %s", host.IP, host.Name)
+	if released > 0 {
+		ipam.AllocationRevision++
 	}
+	ipam.TopologyRevision++
 	return nil
 }
 
 // AddHost adds host to the current IPAM.
 func (ipam *IPAM) AddHost(host api.Host) error {
-	ch, err := ipam.locker.Lock()
-	if err != nil {
-		return err
-	}
-	defer ipam.locker.Unlock()
-
 	if host.IP == nil {
 		return common.NewError("Host IP is required.")
 	}
 	if host.Name == "" {
 		return common.NewError("Host name is required.")
 	}
+	return ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		err := latestIPAM.addHost(host)
+		return err == nil, err
+	})
+}
+
+// addHost adds host to this IPAM (see AddHost).
+func (ipam *IPAM) addHost(host api.Host) error {
 	log.Tracef(trace.Inside, "Entering AddHost with %d networks\n", len(ipam.Networks))
 	addedHost := false
 	for _, net := range ipam.Networks {
-		myHost := &Host{IP: host.IP, Name: host.Name, Tags: host.Tags}
+		myHost := &Host{IP: host.IP, IPv6: host.IPv6, Name: host.Name, Tags: host.Tags}
 		log.Tracef(trace.Inside, "Attempting to add host %s (%s) to network %s\n", host.Name, host.IP, net.Name)
 		if net.Group == nil {
 			continue
@@ -1462,15 +2125,22 @@ func (ipam *IPAM) AddHost(host api.Host) error {
 			addedHost = true
 		}
 	}
-	if addedHost {
-		ipam.TopologyRevision++
-		err = ipam.save(ipam, ch)
-		if err != nil {
-			return err
+	if !addedHost {
+		reasons := make([]string, 0)
+		myHost := &Host{IP: host.IP, Name: host.Name, Tags: host.Tags}
+		for _, netName := range ipam.sortedNetworkNames() {
+			if group := ipam.Networks[netName].Group; group != nil {
+				for _, reason := range group.explainIneligibility(myHost, "root") {
+					reasons = append(reasons, fmt.Sprintf("network %s: %s", netName, reason))
+				}
+			}
 		}
-	} else {
-		return common.NewError("No suitable groups to add host %s to.", host)
+		if len(reasons) == 0 {
+			return common.NewError("No suitable groups to add host %s to.", host)
+		}
+		return common.NewError("No suitable groups to add host %s to: %s", host, strings.Join(reasons, "; "))
 	}
+	ipam.TopologyRevision++
 	return nil
 }
 
@@ -1479,32 +2149,36 @@ func (ipam *IPAM) AddHost(host api.Host) error {
 // result if CIDRs smaller than ipam. Blocks are blacked out and then
 // un-blacked out.
 func (ipam *IPAM) BlackOut(cidrStr string) error {
-	ch, err := ipam.locker.Lock()
-	if err != nil {
-		return err
-	}
-	defer ipam.locker.Unlock()
+	return ipam.AddBlackout(cidrStr, Blackout{})
+}
 
+// AddBlackout is like BlackOut, but records the reason for the
+// blackout, who created it and, optionally, when it expires.
+func (ipam *IPAM) AddBlackout(cidrStr string, blackout Blackout) error {
 	log.Tracef(trace.Private, "BlackOut: Black out request for %s", cidrStr)
 	cidr, err := NewCIDR(cidrStr)
 	if err != nil {
-		return err
+		return common.NewError400(err.Error())
 	}
-	var network *Network
-	found := false
-	for _, network = range ipam.Networks {
-		if network.CIDR.Contains(cidr) {
-			// We found the network...
-			found = true
-			break
-		}
-	}
-	if !found {
-		return common.NewError("No network found for %s", cidrStr)
+	return ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		return latestIPAM.addBlackout(cidr, blackout)
+	})
+}
+
+// addBlackout blacks out the CIDR in this IPAM (see AddBlackout),
+// and returns whether it was not blacked out already.
+func (ipam *IPAM) addBlackout(cidr CIDR, blackout Blackout) (bool, error) {
+	cidrStr := cidr.String()
+	network := ipam.networkForCIDR(cidr)
+	if network == nil {
+		return false, common.NewError400(fmt.Sprintf("No network found for %s", cidrStr))
 	}
 	// Do a bit of a sanity check
 	if cidr.Contains(network.CIDR) {
-		return common.NewError("Cannot black out the entire network (%s vs %s)", cidr, network.CIDR)
+		return false, common.NewError400(fmt.Sprintf("Cannot black out the entire network (%s vs %s)", cidr, network.CIDR))
+	}
+	if blackout.Created.IsZero() {
+		blackout.Created = timeNow()
 	}
 
 	for i, blackedOut := range network.BlackedOut {
@@ -1512,7 +2186,7 @@ func (ipam *IPAM) BlackOut(cidrStr string) error {
 		if blackedOut.Contains(cidr) {
 			// We already have a bigger CIDR in the list. Do nothing.
 			log.Tracef(trace.Private, "Already have a CIDR equivalent or bigger to requested %s: %s", cidr, blackedOut)
-			return nil
+			return false, nil
 		}
 		log.Tracef(trace.Inside, "BlackOut: Checking if %s contains %s in network %s", cidr, blackedOut, network.Name)
 		if cidr.Contains(blackedOut) {
@@ -1522,17 +2196,15 @@ func (ipam *IPAM) BlackOut(cidrStr string) error {
 			log.Tracef(trace.Inside, "BlackOut: Checking blocks %v if they have IP in %s", networkBlocks, cidr)
 			for _, block := range networkBlocks {
 				if block.hasIPInCIDR(cidr) {
-					return common.NewError("Blackout block contains already allocated IPs.")
+					return false, errors.NewRomanaConflictError("Blackout block contains already allocated IPs.", "blackout", fmt.Sprintf("cidr=%s", cidrStr))
 				}
 			}
 			network.BlackedOut[i] = cidr
+			delete(network.Blackouts, blackedOut.String())
+			network.setBlackout(cidr, blackout)
 			network.Revison++
-			err := ipam.save(ipam, ch)
-			if err != nil {
-				return err
-			}
 			log.Tracef(trace.Private, "Blacked out %s; current list of blacked out CIDRs for %s: %s", cidr, network.CIDR, network.BlackedOut)
-			return nil
+			return true, nil
 		}
 	}
 
@@ -1543,18 +2215,15 @@ func (ipam *IPAM) BlackOut(cidrStr string) error {
 	log.Tracef(trace.Inside, "BlackOut: Checking blocks %v if they have IP in %s", networkBlocks, cidr)
 	for _, block := range networkBlocks {
 		if block.hasIPInCIDR(cidr) {
-			return common.NewError("Blackout block contains already allocated IPs.")
+			return false, errors.NewRomanaConflictError("Blackout block contains already allocated IPs.", "blackout", fmt.Sprintf("cidr=%s", cidrStr))
 		}
 	}
 
 	network.BlackedOut = append(network.BlackedOut, cidr)
+	network.setBlackout(cidr, blackout)
 	network.Revison++
-	err = ipam.save(ipam, ch)
-	if err != nil {
-		return err
-	}
 	log.Tracef(trace.Private, "Blacked out %s; current list of blacked out CIDRs for %s: %s", cidr, network.CIDR, network.BlackedOut)
-	return nil
+	return true, nil
 }
 
 // UnBlackOut adds CIDR backs into the pool for consideration.
@@ -1562,42 +2231,19 @@ func (ipam *IPAM) UnBlackOut(cidrStr string) error {
 	// TODO it is possible for this to leave fragmentation - if a block was previously
 	// completely blacked out.
 	// To defragment - defragment the list of allocated IPs in every block.
-	ch, err := ipam.locker.Lock()
-	if err != nil {
-		return err
-	}
-	defer ipam.locker.Unlock()
-
 	cidr, err := NewCIDR(cidrStr)
 	if err != nil {
-		return err
+		return common.NewError400(err.Error())
 	}
-	var network *Network
-	found := false
-	for _, network = range ipam.Networks {
-		if network.CIDR.Contains(cidr) {
-			// We found the network...
-			found = true
-			break
+	return ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		network := latestIPAM.networkForCIDR(cidr)
+		if network == nil {
+			return false, common.NewError400(fmt.Sprintf("No network found for %s", cidrStr))
 		}
-	}
-	if !found {
-		return common.NewError("No network found for %s", cidrStr)
-	}
-
-	var i int
-	var blackedOut CIDR
-	found = false
-	for i, blackedOut = range network.BlackedOut {
-		if blackedOut.String() == cidr.String() {
-			found = true
-			break
+		if !network.unBlackOut(cidr) {
+			return false, errors.NewRomanaNotFoundError(fmt.Sprintf("No such CIDR %s found in the blackout list: %s ", cidrStr, network.BlackedOut),
+				"blackout", fmt.Sprintf("cidr=%s", cidrStr))
 		}
-	}
-	if !found {
-		return common.NewError("No such CIDR %s found in the blackout list: %s ", cidrStr, network.BlackedOut)
-	}
-	network.BlackedOut = deleteElementCIDR(network.BlackedOut, i)
-	network.Revison++
-	return ipam.save(ipam, ch)
+		return true, nil
+	})
 }
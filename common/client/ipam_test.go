@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/romana/core/common/api"
@@ -94,6 +95,7 @@ func (s *TestSaver) load(ipam *IPAM, ch <-chan struct{}) error {
 	}
 	parsedIPAM.save = ipam.save
 	parsedIPAM.load = ipam.load
+	parsedIPAM.renewals = ipam.renewals
 	*ipam = *parsedIPAM
 
 	return nil
@@ -116,6 +118,42 @@ func TestNewCIDR(t *testing.T) {
 	}
 }
 
+func TestNewCIDRIPv6(t *testing.T) {
+	cidr, err := NewCIDR("2001:db8::/120")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cidr.IsIPv6() {
+		t.Fatalf("Expected %s to be IPv6", cidr)
+	}
+	if cidr.StartIP.String() != "2001:db8::" {
+		t.Fatalf("Expected start to be 2001:db8::, got %s", cidr.StartIP)
+	}
+	if cidr.EndIP.String() != "2001:db8::ff" {
+		t.Fatalf("Expected end to be 2001:db8::ff, got %s", cidr.EndIP)
+	}
+	if !cidr.Contains(MustParseCIDR(t, "2001:db8::10/124")) {
+		t.Fatalf("Expected %s to contain 2001:db8::10/124", cidr)
+	}
+	if cidr.Contains(MustParseCIDR(t, "2001:db9::10/124")) {
+		t.Fatalf("Expected %s not to contain 2001:db9::10/124", cidr)
+	}
+
+	// Host part must fit into 64 bits.
+	_, err = NewCIDR("2001:db8::/48")
+	if err == nil {
+		t.Fatal("Expected error for 2001:db8::/48")
+	}
+}
+
+func MustParseCIDR(t *testing.T, s string) CIDR {
+	cidr, err := NewCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cidr
+}
+
 func TestBlackout(t *testing.T) {
 	var err error
 	ipam = initIpam(t, "")
@@ -331,6 +369,207 @@ func TestIPAM_DeallocateIP(t *testing.T) {
 	}
 }
 
+func TestIPv6Allocate(t *testing.T) {
+	ipam = initIpam(t, "")
+
+	expected := []string{"2001:db8::", "2001:db8::1", "2001:db8::2", "2001:db8::3", "2001:db8::4"}
+	for i, exp := range expected {
+		ip, err := ipam.AllocateIP(fmt.Sprintf("addr%d", i), "host1", "ten1", "seg1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != exp {
+			t.Fatalf("Expected %s, got %s", exp, ip)
+		}
+	}
+
+	ipam.load(ipam, nil)
+	blocks := ipam.ListAllBlocks().Blocks
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 blocks, got %d", len(blocks))
+	}
+	if blocks[1].CIDR.String() != "2001:db8::4/126" {
+		t.Fatalf("Expected second block to be 2001:db8::4/126, got %s", blocks[1].CIDR)
+	}
+
+	err := ipam.DeallocateIP("2001:db8::4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, err := ipam.AllocateIP("addr5", "host1", "ten1", "seg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "2001:db8::4" {
+		t.Fatalf("Expected 2001:db8::4 to be reused, got %s", ip)
+	}
+}
+
+func TestDualStackAllocate(t *testing.T) {
+	ipam = initIpam(t, "")
+
+	ip, ipv6, err := ipam.AllocateDualStackIP("addr1", "host1", "ten1", "seg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" {
+		t.Fatalf("Expected 10.0.0.0, got %s", ip)
+	}
+	if ipv6.String() != "2001:db8::" {
+		t.Fatalf("Expected 2001:db8::, got %s", ipv6)
+	}
+
+	ip, err = ipam.AllocateIP("addr2", "host1", "ten1", "seg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.1" {
+		t.Fatalf("Expected 10.0.0.1, got %s", ip)
+	}
+
+	// Deallocating by IPv6 address releases the pair.
+	err = ipam.DeallocateIP("2001:db8::")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam.load(ipam, nil)
+	if _, ok := ipam.AddressNameToIP["addr1"]; ok {
+		t.Fatalf("Expected addr1 to be deallocated")
+	}
+	if _, ok := ipam.AddressNameToIPv6["addr1"]; ok {
+		t.Fatalf("Expected IPv6 address of addr1 to be deallocated")
+	}
+
+	ip, ipv6, err = ipam.AllocateDualStackIP("addr3", "host1", "ten1", "seg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" || ipv6.String() != "2001:db8::" {
+		t.Fatalf("Expected 10.0.0.0 and 2001:db8:: to be reused, got %s and %s", ip, ipv6)
+	}
+}
+
+func TestAllocateSpecificIP(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"name":"rack1","groups":[{"name":"host1","ip":"192.168.99.10"}]},
+    {"name":"rack2","groups":[{"name":"host2","ip":"192.168.99.11"}]}
+  ]}]
+}`)
+
+	err := ipam.AllocateSpecificIP("s1", net.ParseIP("10.0.0.9"), "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Block of the requested address is used for further allocations,
+	// and the blocks preceding it are available for reuse.
+	ip, err := ipam.AllocateIP("a1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.8" {
+		t.Fatalf("Expected 10.0.0.8, got %s", ip)
+	}
+	ip, err = ipam.AllocateIP("a2", "host1", "ten2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" {
+		t.Fatalf("Expected 10.0.0.0, got %s", ip)
+	}
+
+	conflicts := []struct {
+		ip     string
+		host   string
+		tenant string
+	}{
+		// Already allocated
+		{"10.0.0.9", "host1", "ten1"},
+		// Block belongs to another tenant
+		{"10.0.0.10", "host1", "ten2"},
+		// Not routed to the host
+		{"10.128.0.1", "host1", "ten1"},
+		// Not in any network
+		{"11.0.0.1", "host1", "ten1"},
+	}
+	for i, c := range conflicts {
+		err = ipam.AllocateSpecificIP(fmt.Sprintf("c%d", i), net.ParseIP(c.ip), c.host, c.tenant, "")
+		if _, ok := err.(errors.RomanaConflictError); !ok {
+			t.Fatalf("Expected RomanaConflictError for %s on %s for %s, got %v", c.ip, c.host, c.tenant, err)
+		}
+		t.Logf("Got expected error: %s", err)
+	}
+
+	// Address can be requested again once released.
+	err = ipam.DeallocateIP("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.AllocateSpecificIP("s1", net.ParseIP("10.0.0.9"), "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateSpecificIPFar(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/12","block_mask":30,
+    "tenant_block_masks":{"ten2":28}}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"}
+  ]}]}]
+}`)
+	blocks := func() []*Block {
+		err := ipam.load(ipam, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ipam.Networks["net1"].Group.leafGroups()[0].Blocks
+	}
+
+	// Only the block containing the address is created, not the
+	// ones preceding it.
+	err := ipam.AllocateSpecificIP("s1", net.ParseIP("10.2.255.254"), "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := blocks(); len(b) != 1 || b[0].CIDR.String() != "10.2.255.252/30" {
+		t.Fatalf("Expected only block 10.2.255.252/30, got %v", b)
+	}
+	if reusable := ipam.Networks["net1"].Group.leafGroups()[0].ReusableBlocks; len(reusable) != 0 {
+		t.Fatalf("Expected no reusable blocks, got %v", reusable)
+	}
+
+	// The block mask of the tenant is used.
+	err = ipam.AllocateSpecificIP("s2", net.ParseIP("10.2.255.231"), "host1", "ten2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := blocks(); len(b) != 2 || b[1].CIDR.String() != "10.2.255.224/28" {
+		t.Fatalf("Expected block 10.2.255.224/28, got %v", b)
+	}
+
+	// A block smaller than the mask fills space left between blocks.
+	err = ipam.AllocateSpecificIP("s3", net.ParseIP("10.2.255.241"), "host1", "ten2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := blocks(); len(b) != 3 || b[2].CIDR.String() != "10.2.255.240/29" {
+		t.Fatalf("Expected block 10.2.255.240/29, got %v", b)
+	}
+
+	// Space before the blocks is used for new blocks.
+	ip, err := ipam.AllocateIP("a1", "host1", "ten3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" {
+		t.Fatalf("Expected 10.0.0.0, got %s", ip)
+	}
+}
+
 func TestBlockReuseMask32(t *testing.T) {
 	var err error
 	ipam = initIpam(t, "")
@@ -710,8 +949,8 @@ func TestUpdateTopology(t *testing.T) {
 	if err == nil {
 		t.Fatal("Expected error on updating topology with allocated IPs, did not get it.")
 	}
-	expectedError := "Updating topology after IPs have been allocated currently not implemented."
-	if err.Error() == expectedError {
+	expectedError := "10.0.0.0/30 (owner tenant1:, host ip-192-168-99-10) in network net1: network removed from topology"
+	if strings.Contains(err.Error(), expectedError) {
 		t.Logf("Got expected error: %s", err)
 	} else {
 		t.Fatalf("Expected %s, got %v", expectedError, err)
@@ -739,6 +978,109 @@ func TestUpdateTopology(t *testing.T) {
 	// t.Logf("Saved state: %s", testSaver.lastJson)
 }
 
+func TestUpdateTopologyWithAllocations(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"},
+    {"name":"host2","ip":"192.168.99.11"}
+  ]}]}]
+}`)
+
+	err := ipam.AddHost(api.Host{Name: "host3", IP: net.ParseIP("192.168.99.12"), Tags: map[string]string{"rack": "rack1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ipam.AllocateIP("x1", "host1", "tenant1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, err := ipam.AllocateIP("x2", "host3", "tenant1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.4" {
+		t.Fatalf("Expected 10.0.0.4, got %s", ip)
+	}
+	ipam.load(ipam, nil)
+
+	// Moving host1 into a group that does not contain its block
+	// must be refused, leaving the current topology intact.
+	topoReq := api.TopologyUpdateRequest{}
+	err = json.Unmarshal([]byte(`{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"name":"rack1","groups":[{"name":"host2","ip":"192.168.99.11"}]},
+    {"name":"rack2","groups":[{"name":"host1","ip":"192.168.99.10"}]}
+  ]}]
+}`), &topoReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.UpdateTopology(topoReq, false)
+	if err == nil {
+		t.Fatal("Expected error on orphaning a block, did not get it.")
+	}
+	if !strings.Contains(err.Error(), "10.0.0.0/30 (owner tenant1:, host host1)") {
+		t.Fatalf("Expected error to list 10.0.0.0/30, got %s", err)
+	}
+	if ipam.Networks["net1"].Group.findHostByName("host3") == nil {
+		t.Fatal("Expected topology to be left intact")
+	}
+
+	// Adding a rack group keeps existing allocations, and re-parents
+	// host3 (which is not in the topology) by its tags.
+	topoReq = api.TopologyUpdateRequest{}
+	err = json.Unmarshal([]byte(`{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"name":"rack1","groups":[
+      {"name":"host1","ip":"192.168.99.10"},
+      {"name":"host2","ip":"192.168.99.11"}
+    ]},
+    {"name":"rack2","assignment":{"rack":"rack2"},"groups":[]}
+  ]}]
+}`), &topoReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.UpdateTopology(topoReq, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam.save(ipam, nil)
+
+	host3 := ipam.Networks["net1"].Group.findHostByName("host3")
+	if host3 == nil {
+		t.Fatal("Expected host3 to be re-parented")
+	}
+	if host3.group.CIDR.String() != "10.0.0.0/9" {
+		t.Fatalf("Expected host3 to be in 10.0.0.0/9, got %s", host3.group.CIDR)
+	}
+	if ipam.AddressNameToIP["x1"].String() != "10.0.0.0" {
+		t.Fatalf("Expected x1 to be kept, got %s", ipam.AddressNameToIP["x1"])
+	}
+
+	ip, err = ipam.AllocateIP("x3", "host1", "tenant1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.1" {
+		t.Fatalf("Expected 10.0.0.1, got %s", ip)
+	}
+	ip, err = ipam.AllocateIP("x4", "host2", "tenant1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.8" {
+		t.Fatalf("Expected 10.0.0.8, got %s", ip)
+	}
+	err = ipam.DeallocateIP("x2")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestListBlocks(t *testing.T) {
 	ipam = initIpam(t, "")
 	// t.Log(testSaver.lastJson)
@@ -943,6 +1285,7 @@ func TestHostAdditionSimple(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
+	ipam.load(ipam, nil)
 
 	hosts := ipam.ListHosts()
 	for _, host := range hosts.Hosts {
@@ -967,10 +1310,11 @@ func TestHostAdditionSimple(t *testing.T) {
 
 	// Test host removal.
 	t.Logf("Removing host 'host0'")
-	err = ipam.RemoveHost(api.Host{Name: "host0"})
+	err = ipam.RemoveHost(api.Host{Name: "host0"}, false)
 	if err != nil {
 		t.Fatal(err)
 	}
+	ipam.load(ipam, nil)
 
 	//	t.Logf(testSaver.lastJson)
 	// One of the groups in each network should only have one host left now
@@ -1002,10 +1346,11 @@ func TestHostAdditionSimple(t *testing.T) {
 	}
 	t.Log("Loaded new IPAM...")
 
-	err = ipam.RemoveHost(api.Host{Name: "host1"})
+	err = ipam.RemoveHost(api.Host{Name: "host1"}, false)
 	if err != nil {
 		t.Fatal(err)
 	}
+	ipam.load(ipam, nil)
 
 	net1 := ipam.Networks["net1"]
 	grp := net1.Group.Groups[0]
@@ -1059,6 +1404,8 @@ func TestHostAdditionTags(t *testing.T) {
 		t.Logf("Adding host %s (%s) with tags %v", host.Name, host.IP, tags)
 	}
 
+	ipam.load(ipam, nil)
+
 	// We should have 4 hosts in groups 1 and 3 and 2 in groups 2 and 4
 	net1 := ipam.Networks["net1"]
 	for i, grp := range net1.Group.Groups {
@@ -1196,6 +1543,7 @@ func TestNodeAssignment(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
+	ipam.load(ipam, nil)
 	if len(ipam.Networks["rnet-1"].Group.Hosts) != 1 {
 		t.Fatalf("Expected 1 host in rnet-1, got %v", ipam.Networks["rnet-1"].Group.Hosts)
 	}
@@ -0,0 +1,395 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	libkvStore "github.com/docker/libkv/store"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/log/trace"
+	log "github.com/romana/rlog"
+)
+
+// timeNow returns current time; it can be replaced in tests.
+var timeNow = time.Now
+
+// Lease records what an address is allocated for, and when that
+// allocation was last confirmed to be in use.
+type Lease struct {
+	// OwnerRef refers to the entity the address is allocated for.
+	// It is the address name, which, for Kubernetes pods, is the
+	// name of the pod.
+	OwnerRef string `json:"owner_ref"`
+	// Host the address is allocated on.
+	Host     string    `json:"host"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func newLease(ownerRef string, host string) *Lease {
+	return &Lease{OwnerRef: ownerRef, Host: host, LastSeen: timeNow()}
+}
+
+// findBlock returns the leaf group and the index of the block
+// that contains the IP, or nil and -1 if not found.
+func (ipam *IPAM) findBlock(ip net.IP) (*Group, int) {
+	for _, network := range ipam.Networks {
+		if network.Group == nil || !network.CIDR.IPNet.Contains(ip) {
+			continue
+		}
+		group := network.Group
+		for group.Hosts == nil {
+			var next *Group
+			for _, g := range group.Groups {
+				if g.CIDR.IPNet.Contains(ip) {
+					next = g
+					break
+				}
+			}
+			if next == nil {
+				return nil, -1
+			}
+			group = next
+		}
+		for blockID, block := range group.Blocks {
+			if block.CIDR.IPNet.Contains(ip) {
+				return group, blockID
+			}
+		}
+	}
+	return nil, -1
+}
+
+// hostForIP returns the name of the host the block containing
+// the IP belongs to, or empty string if not found.
+func (ipam *IPAM) hostForIP(ip net.IP) string {
+	group, blockID := ipam.findBlock(ip)
+	if group == nil {
+		return ""
+	}
+	return group.BlockToHost[blockID]
+}
+
+// sortedAddressNames returns names of all allocated addresses, sorted.
+func (ipam *IPAM) sortedAddressNames() []string {
+	names := make([]string, 0, len(ipam.AddressNameToIP))
+	for name := range ipam.AddressNameToIP {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ipam *IPAM) leaseToAPI(name string, lease *Lease) api.IPAMAddressLease {
+	return api.IPAMAddressLease{
+		Name:     name,
+		IP:       ipam.AddressNameToIP[name],
+		IPv6:     ipam.AddressNameToIPv6[name],
+		OwnerRef: lease.OwnerRef,
+		Host:     lease.Host,
+		LastSeen: lease.LastSeen,
+	}
+}
+
+// HostRenewal records when leases of addresses on a host were last
+// reported on, and when each of these addresses, by name, was last seen
+// in use. Renewals are kept outside of IPAM, one record per host, so
+// that renewing leases neither changes IPAM nor conflicts with changes
+// of it.
+type HostRenewal struct {
+	Host      string               `json:"host"`
+	RenewedAt time.Time            `json:"renewed_at"`
+	LastSeen  map[string]time.Time `json:"last_seen"`
+}
+
+// renewalStore keeps renewals of leases by host.
+type renewalStore interface {
+	getRenewals() (map[string]*HostRenewal, error)
+	putRenewal(renewal *HostRenewal) error
+	deleteRenewal(host string) error
+}
+
+// memRenewals is a renewalStore in memory.
+type memRenewals struct {
+	sync.Mutex
+	renewals map[string]*HostRenewal
+}
+
+func newMemRenewals() *memRenewals {
+	return &memRenewals{renewals: make(map[string]*HostRenewal)}
+}
+
+func (m *memRenewals) getRenewals() (map[string]*HostRenewal, error) {
+	m.Lock()
+	defer m.Unlock()
+	renewals := make(map[string]*HostRenewal)
+	for host, renewal := range m.renewals {
+		renewals[host] = renewal
+	}
+	return renewals, nil
+}
+
+func (m *memRenewals) putRenewal(renewal *HostRenewal) error {
+	m.Lock()
+	defer m.Unlock()
+	m.renewals[renewal.Host] = renewal
+	return nil
+}
+
+func (m *memRenewals) deleteRenewal(host string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.renewals, host)
+	return nil
+}
+
+// renewalsKey is where Client keeps renewals, under a key for each host.
+const renewalsKey = ipamKey + "/renewals"
+
+func (c *Client) getRenewals() (map[string]*HostRenewal, error) {
+	kvs, err := c.Store.ListObjects(renewalsKey)
+	if err == libkvStore.ErrKeyNotFound {
+		kvs, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	renewals := make(map[string]*HostRenewal)
+	for _, kv := range kvs {
+		renewal := &HostRenewal{}
+		err = json.Unmarshal(kv.Value, renewal)
+		if err != nil {
+			return nil, common.NewError("Error parsing lease renewals at %s: %s", kv.Key, err)
+		}
+		renewals[renewal.Host] = renewal
+	}
+	return renewals, nil
+}
+
+func (c *Client) putRenewal(renewal *HostRenewal) error {
+	b, err := json.Marshal(renewal)
+	if err != nil {
+		return err
+	}
+	return c.Store.PutObject(renewalsKey+"/"+url.PathEscape(renewal.Host), b)
+}
+
+func (c *Client) deleteRenewal(host string) error {
+	_, err := c.Store.Delete(renewalsKey + "/" + url.PathEscape(host))
+	if err == libkvStore.ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+// lastSeen returns when the named address with the lease was last
+// seen in use, according to renewals of its host, if any.
+func lastSeen(name string, lease *Lease, renewal *HostRenewal) time.Time {
+	if renewal != nil {
+		if seen, ok := renewal.LastSeen[name]; ok && seen.After(lease.LastSeen) {
+			return seen
+		}
+	}
+	return lease.LastSeen
+}
+
+// ListLeases lists leases of all allocated addresses.
+func (ipam *IPAM) ListLeases() ([]api.IPAMAddressLease, error) {
+	renewals, err := ipam.renewals.getRenewals()
+	if err != nil {
+		return nil, err
+	}
+	leases := make([]api.IPAMAddressLease, 0)
+	for _, name := range ipam.sortedAddressNames() {
+		lease, ok := ipam.AddressNameToLease[name]
+		if !ok {
+			// Allocated before leases were introduced.
+			lease = &Lease{OwnerRef: name}
+		}
+		apiLease := ipam.leaseToAPI(name, lease)
+		apiLease.LastSeen = lastSeen(name, lease, renewals[lease.Host])
+		leases = append(leases, apiLease)
+	}
+	return leases, nil
+}
+
+// RenewLeases marks leases of addresses allocated for the provided
+// owners, keyed by the host the addresses are allocated on, as being in
+// use now. Owners that have no addresses allocated on their host are
+// ignored. Hosts are recorded as reported on, even if no owners are
+// reported for them, so that their stale leases can be released (see
+// ReleaseStaleLeases).
+func (ipam *IPAM) RenewLeases(ownerRefsByHost map[string][]string) error {
+	hosts := make([]string, 0, len(ownerRefsByHost))
+	live := make(map[string]map[string]bool)
+	for host, ownerRefs := range ownerRefsByHost {
+		hosts = append(hosts, host)
+		live[host] = make(map[string]bool)
+		for _, ownerRef := range ownerRefs {
+			live[host][ownerRef] = true
+		}
+	}
+	return ipam.renewLeases(hosts, func(latestIPAM *IPAM, name string, lease *Lease) bool {
+		return live[lease.Host][lease.OwnerRef]
+	})
+}
+
+// RenewLeasesByIP marks leases of addresses allocated on the host that
+// are among the provided IPs as being in use now, and records the host
+// as reported on, like RenewLeases.
+func (ipam *IPAM) RenewLeasesByIP(host string, ips []net.IP) error {
+	live := make(map[string]bool)
+	for _, ip := range ips {
+		live[ip.String()] = true
+	}
+	return ipam.renewLeases([]string{host}, func(latestIPAM *IPAM, name string, lease *Lease) bool {
+		if ip, ok := latestIPAM.AddressNameToIP[name]; ok && live[ip.String()] {
+			return true
+		}
+		ipv6, ok := latestIPAM.AddressNameToIPv6[name]
+		return ok && live[ipv6.String()]
+	})
+}
+
+// renewLeases records the hosts as reported on now, along with the addresses on them for which isLive
+// returns true as last seen now. Renewals are saved outside of IPAM
+// (see HostRenewal), one host at a time, as each host is expected to be
+// reported on by one reporter only; if by more, they may overwrite one
+// another, which only delays when addresses are seen in use.
+func (ipam *IPAM) renewLeases(hosts []string, isLive func(latestIPAM *IPAM, name string, lease *Lease) bool) error {
+	latestIPAM := &IPAM{}
+	err := ipam.load(latestIPAM, nil)
+	if err != nil {
+		return err
+	}
+	renewals, err := ipam.renewals.getRenewals()
+	if err != nil {
+		return err
+	}
+	now := timeNow()
+	for _, host := range hosts {
+		renewal := &HostRenewal{Host: host, RenewedAt: now, LastSeen: make(map[string]time.Time)}
+		renewed := 0
+		for _, name := range latestIPAM.sortedAddressNames() {
+			lease, ok := latestIPAM.AddressNameToLease[name]
+			if !ok {
+				lease = &Lease{OwnerRef: name, Host: latestIPAM.hostForIP(latestIPAM.AddressNameToIP[name])}
+			}
+			if lease.Host != host {
+				continue
+			}
+			if isLive(latestIPAM, name, lease) {
+				renewal.LastSeen[name] = now
+				renewed++
+			} else if prev, ok := renewals[host]; ok {
+				if seen, ok := prev.LastSeen[name]; ok {
+					renewal.LastSeen[name] = seen
+				}
+			}
+		}
+		err = ipam.renewals.putRenewal(renewal)
+		if err != nil {
+			return err
+		}
+		log.Tracef(trace.Inside, "IPAM.renewLeases: renewed %d leases on host %s", renewed, host)
+	}
+	return nil
+}
+
+// ReleaseStaleLeases deallocates addresses whose leases have not been
+// renewed for longer than gracePeriod, and returns leases of the released
+// addresses. Addresses allocated before leases were introduced are given
+// a lease starting now.
+//
+// Leases on a host are only released if the host was reported on
+// within gracePeriod, as otherwise they may be stale only because
+// whatever renews them is not running. If maxReleases is positive, at
+// most that many addresses are released, the rest are left for the
+// next call. Renewals of hosts that are gone are removed.
+func (ipam *IPAM) ReleaseStaleLeases(gracePeriod time.Duration, maxReleases int) ([]api.IPAMAddressLease, error) {
+	renewals, err := ipam.renewals.getRenewals()
+	if err != nil {
+		return nil, err
+	}
+	var released []api.IPAMAddressLease
+	var hosts map[string]bool
+	err = ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		released = make([]api.IPAMAddressLease, 0)
+		hosts = make(map[string]bool)
+		for _, host := range latestIPAM.ListHosts().Hosts {
+			hosts[host.Name] = true
+		}
+		now := timeNow()
+		changed := false
+		unreported := make(map[string]int)
+		for _, name := range latestIPAM.sortedAddressNames() {
+			lease, ok := latestIPAM.AddressNameToLease[name]
+			if !ok {
+				latestIPAM.AddressNameToLease[name] = newLease(name, latestIPAM.hostForIP(latestIPAM.AddressNameToIP[name]))
+				changed = true
+				continue
+			}
+			renewal := renewals[lease.Host]
+			seen := lastSeen(name, lease, renewal)
+			if now.Sub(seen) <= gracePeriod {
+				continue
+			}
+			if renewal == nil || now.Sub(renewal.RenewedAt) > gracePeriod {
+				unreported[lease.Host]++
+				continue
+			}
+			if maxReleases > 0 && len(released) >= maxReleases {
+				log.Warnf("Released %d addresses with stale leases, the most allowed at once, leaving the rest for later", len(released))
+				break
+			}
+			releasedLease := latestIPAM.leaseToAPI(name, lease)
+			releasedLease.LastSeen = seen
+			err := latestIPAM.deallocateName(name)
+			if err != nil {
+				return false, err
+			}
+			log.Infof("Released address %s (%s) of %s on host %s, last seen at %s", name, releasedLease.IP, lease.OwnerRef, lease.Host, seen)
+			released = append(released, releasedLease)
+			changed = true
+		}
+		for host, count := range unreported {
+			log.Warnf("Keeping %d addresses with stale leases on host %s, as it was not reported on within %s", count, host, gracePeriod)
+		}
+		if len(released) > 0 {
+			latestIPAM.AllocationRevision++
+		}
+		return changed, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for host := range renewals {
+		if hosts[host] {
+			continue
+		}
+		err = ipam.renewals.deleteRenewal(host)
+		if err != nil {
+			log.Errorf("Error removing lease renewals of host %s, which is gone: %s", host, err)
+		}
+	}
+	return released, nil
+}
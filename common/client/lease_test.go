@@ -0,0 +1,194 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReleaseStaleLeases(t *testing.T) {
+	now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"},
+    {"name":"host2","ip":"192.168.99.11"}
+  ]}]}]
+}`)
+	for _, alloc := range []struct{ name, host string }{
+		{"pod1", "host1"},
+		{"pod2", "host1"},
+		{"pod3", "host2"},
+	} {
+		_, err := ipam.AllocateIP(alloc.name, alloc.host, "ten1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	// pod1 is reported on the wrong host, so its lease is not renewed.
+	// Renewals are kept outside of IPAM, which is left as is.
+	saved := testSaver.lastJson
+	err := ipam.RenewLeases(map[string][]string{"host2": {"pod1", "pod3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testSaver.lastJson != saved {
+		t.Fatal("Expected IPAM not to be saved by renewing leases")
+	}
+
+	// Leases on host1 are not released while host1 is not reported on.
+	now = now.Add(time.Minute)
+	released, err := ipam.ReleaseStaleLeases(90*time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 0 {
+		t.Fatalf("Expected nothing to be released, got %v", released)
+	}
+
+	// Renewals of hosts that are gone are removed.
+	err = ipam.RenewLeases(map[string][]string{"host1": {}, "gone": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	released, err = ipam.ReleaseStaleLeases(90*time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 2 || released[0].Name != "pod1" || released[1].Name != "pod2" {
+		t.Fatalf("Expected pod1 and pod2 to be released, got %v", released)
+	}
+	if released[0].Host != "host1" || released[0].IP.String() != "10.0.0.0" {
+		t.Fatalf("Expected pod1 at 10.0.0.0 on host1, got %v", released[0])
+	}
+
+	renewals, err := ipam.renewals.getRenewals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewals["host1"] == nil || renewals["gone"] != nil {
+		t.Fatalf("Expected renewals of host1 and not of gone, got %v", renewals)
+	}
+
+	ipam.load(ipam, nil)
+	leases, err := ipam.ListLeases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 || leases[0].Name != "pod3" {
+		t.Fatalf("Expected only pod3 to be left, got %v", leases)
+	}
+	if !leases[0].LastSeen.Equal(now.Add(-time.Minute)) {
+		t.Fatalf("Expected pod3 to be last seen at %s, got %s", now.Add(-time.Minute), leases[0].LastSeen)
+	}
+
+	// Released addresses are available again.
+	ip, err := ipam.AllocateIP("pod4", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" {
+		t.Fatalf("Expected 10.0.0.0, got %s", ip)
+	}
+}
+
+func TestReleaseStaleLeasesWithoutLeases(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"}
+  ]}]}]
+}`)
+	_, err := ipam.AllocateIP("pod1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an address allocated before leases were introduced.
+	ipam.load(ipam, nil)
+	delete(ipam.AddressNameToLease, "pod1")
+	ipam.save(ipam, nil)
+
+	released, err := ipam.ReleaseStaleLeases(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 0 {
+		t.Fatalf("Expected nothing to be released, got %v", released)
+	}
+	ipam.load(ipam, nil)
+	lease := ipam.AddressNameToLease["pod1"]
+	if lease == nil || lease.Host != "host1" {
+		t.Fatalf("Expected lease for pod1 on host1, got %v", lease)
+	}
+}
+
+func TestReleaseStaleLeasesLimit(t *testing.T) {
+	now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"}
+  ]}]}]
+}`)
+	for _, name := range []string{"pod1", "pod2", "pod3"} {
+		_, err := ipam.AllocateIP(name, "host1", "ten1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pod3 is reported by its address.
+	now = now.Add(time.Minute)
+	err := ipam.RenewLeasesByIP("host1", []net.IP{net.ParseIP("10.0.0.2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := ipam.ReleaseStaleLeases(30*time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 1 || released[0].Name != "pod1" {
+		t.Fatalf("Expected only pod1 to be released, got %v", released)
+	}
+	released, err = ipam.ReleaseStaleLeases(30*time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 1 || released[0].Name != "pod2" {
+		t.Fatalf("Expected pod2 to be released next, got %v", released)
+	}
+
+	// Once host1 is no longer reported on, nothing more is released.
+	now = now.Add(time.Minute)
+	released, err = ipam.ReleaseStaleLeases(30*time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 0 {
+		t.Fatalf("Expected nothing to be released, got %v", released)
+	}
+}
@@ -0,0 +1,683 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	libkvStore "github.com/docker/libkv/store"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/log/trace"
+	log "github.com/romana/rlog"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// Number of latest changes kept for watches to resume after,
+	// same as etcd v2 keeps.
+	localStoreHistory = 1000
+
+	boltOpenTimeout = 5 * time.Second
+)
+
+var (
+	boltKVBucket    = []byte("kv")
+	boltMetaBucket  = []byte("meta")
+	boltRevisionKey = []byte("revision")
+	errStoreClosed  = common.NewError("Store is closed")
+)
+
+// localStore implements libkv's store.Store interface in memory, for a
+// single process, e.g. tests and single-node labs that run without etcd.
+// As with etcd v3, every change increments the revision of the store,
+// which becomes LastIndex of the changed key.
+//
+// If it has a bolt database, changes are written to it before they are
+// made, and loaded from it when the store is opened, so they survive
+// restarts. Keys with a TTL and locks are only kept in memory, as
+// they do not outlive the process that holds them anyway.
+type localStore struct {
+	mutex    sync.Mutex
+	revision uint64
+	kvs      map[string]*libkvStore.KVPair
+	// Keys that are not written to the database.
+	ephemeral map[string]bool
+	// Latest changes, by increasing revision, after the compacted one.
+	history   []*libkvStore.KVPairExt
+	compacted uint64
+	// Closed and replaced on every change, to wake up watches
+	// and locks waiting for one.
+	changed chan struct{}
+	closed  bool
+	db      *bolt.DB
+}
+
+func newLocalStore() *localStore {
+	return &localStore{
+		kvs:       make(map[string]*libkvStore.KVPair),
+		ephemeral: make(map[string]bool),
+		history:   make([]*libkvStore.KVPairExt, 0),
+		changed:   make(chan struct{}),
+	}
+}
+
+// openBoltStore opens a localStore backed by the bolt database in
+// the file, creating it if needed. As bolt locks the file, only one
+// process at a time can have it open.
+func openBoltStore(path string) (*localStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, common.NewError("Error opening store %s: %s", path, err)
+	}
+	s := newLocalStore()
+	s.db = db
+	err = db.Update(func(tx *bolt.Tx) error {
+		kvBucket, err := tx.CreateBucketIfNotExists(boltKVBucket)
+		if err != nil {
+			return err
+		}
+		metaBucket, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if rev := metaBucket.Get(boltRevisionKey); len(rev) == 8 {
+			s.revision = binary.BigEndian.Uint64(rev)
+		}
+		// Changes are not persisted.
+		s.compacted = s.revision
+		return kvBucket.ForEach(func(k []byte, v []byte) error {
+			if len(v) < 8 {
+				return common.NewError("Invalid value of %s in %s", string(k), path)
+			}
+			value := make([]byte, len(v)-8)
+			copy(value, v[8:])
+			s.kvs[string(k)] = &libkvStore.KVPair{
+				Key:       string(k),
+				Value:     value,
+				LastIndex: binary.BigEndian.Uint64(v[:8]),
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Infof("Opened store %s with %d keys at revision %d", path, len(s.kvs), s.revision)
+	return s, nil
+}
+
+// localChange is a change of a key: value is put or, if nil, the key
+// is deleted, recording the change with the action.
+type localChange struct {
+	key       string
+	value     []byte
+	action    string
+	ephemeral bool
+}
+
+// persist writes the next revision to the database, if any, along with
+// durable changes made at it. Must be called with the mutex held.
+func (s *localStore) persist(changes []localChange) error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rev := make([]byte, 8)
+		binary.BigEndian.PutUint64(rev, s.revision+1)
+		err := tx.Bucket(boltMetaBucket).Put(boltRevisionKey, rev)
+		if err != nil {
+			return err
+		}
+		for _, ch := range changes {
+			// Ephemeral values are not written, but the ones
+			// they replace are deleted.
+			_, exists := s.kvs[ch.key]
+			stored := exists && !s.ephemeral[ch.key]
+			switch {
+			case ch.value != nil && !ch.ephemeral:
+				err = tx.Bucket(boltKVBucket).Put([]byte(ch.key), append(rev, ch.value...))
+			case stored:
+				err = tx.Bucket(boltKVBucket).Delete([]byte(ch.key))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// set puts or, if value is nil, deletes the key, recording the
+// change with the action. Must be called with the mutex held.
+func (s *localStore) set(key string, value []byte, action string, ephemeral bool) (*libkvStore.KVPair, error) {
+	kvps, err := s.setAll([]localChange{{key: key, value: value, action: action, ephemeral: ephemeral}})
+	if err != nil {
+		return nil, err
+	}
+	return kvps[0], nil
+}
+
+// setAll makes the changes at the next revision, returning the new
+// KV pairs of their keys (nil for deleted ones). Must be called with
+// the mutex held.
+func (s *localStore) setAll(changes []localChange) ([]*libkvStore.KVPair, error) {
+	if s.closed {
+		return nil, errStoreClosed
+	}
+	err := s.persist(changes)
+	if err != nil {
+		return nil, err
+	}
+	s.revision++
+
+	kvps := make([]*libkvStore.KVPair, len(changes))
+	for i, ch := range changes {
+		ev := &libkvStore.KVPairExt{Key: ch.key, Action: ch.action, LastIndex: s.revision}
+		if prev, ok := s.kvs[ch.key]; ok {
+			ev.PrevValue = string(prev.Value)
+		}
+		if ch.value == nil {
+			delete(s.kvs, ch.key)
+			delete(s.ephemeral, ch.key)
+		} else {
+			kvps[i] = &libkvStore.KVPair{Key: ch.key, Value: ch.value, LastIndex: s.revision}
+			ev.Value = string(ch.value)
+			s.kvs[ch.key] = kvps[i]
+			if ch.ephemeral {
+				s.ephemeral[ch.key] = true
+			} else {
+				delete(s.ephemeral, ch.key)
+			}
+		}
+		s.history = append(s.history, ev)
+		log.Tracef(trace.Inside, "localStore: %s %s at revision %d", ch.action, ch.key, s.revision)
+	}
+	if len(s.history) > localStoreHistory {
+		s.compact(s.history[len(s.history)-localStoreHistory-1].LastIndex)
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return kvps, nil
+}
+
+// put puts the value, expiring it after the TTL in options, if any.
+// Must be called with the mutex held.
+func (s *localStore) put(key string, value []byte, options *libkvStore.WriteOptions) (*libkvStore.KVPair, error) {
+	action := "set"
+	if _, ok := s.kvs[key]; !ok {
+		action = "create"
+	}
+	ttl := time.Duration(0)
+	if options != nil {
+		ttl = options.TTL
+	}
+	kvp, err := s.set(key, value, action, ttl > 0)
+	if err != nil || ttl == 0 {
+		return kvp, err
+	}
+	time.AfterFunc(ttl, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if cur, ok := s.kvs[key]; ok && cur.LastIndex == kvp.LastIndex {
+			s.set(key, nil, "expire", true)
+		}
+	})
+	return kvp, nil
+}
+
+func (s *localStore) Put(key string, value []byte, options *libkvStore.WriteOptions) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.put(key, value, options)
+	return err
+}
+
+func (s *localStore) Get(key string) (*libkvStore.KVPair, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	kvp, ok := s.kvs[key]
+	if !ok {
+		return nil, libkvStore.ErrKeyNotFound
+	}
+	return kvp, nil
+}
+
+// GetExt gets the key, or if options are recursive, the revision of
+// the directory. As with etcd v3, there is no etcd response to get
+// from the result; use listTree for contents of directories.
+func (s *localStore) GetExt(key string, options libkvStore.GetOptions) (*libkvStore.KVPairExt, error) {
+	if !options.Recursive {
+		kvp, err := s.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return &libkvStore.KVPairExt{Key: kvp.Key, Value: string(kvp.Value), LastIndex: kvp.LastIndex}, nil
+	}
+	_, revision, err := s.listTree(key)
+	if err != nil {
+		return nil, err
+	}
+	return &libkvStore.KVPairExt{Key: key, Dir: true, LastIndex: revision}, nil
+}
+
+// list returns key-value pairs under the directory, sorted by key.
+// Must be called with the mutex held.
+func (s *localStore) list(directory string) []*libkvStore.KVPair {
+	prefix := dirPrefix(directory)
+	kvps := make([]*libkvStore.KVPair, 0)
+	for key, kvp := range s.kvs {
+		if strings.HasPrefix(key, prefix) {
+			kvps = append(kvps, kvp)
+		}
+	}
+	sort.Slice(kvps, func(i, j int) bool { return kvps[i].Key < kvps[j].Key })
+	return kvps
+}
+
+// listTree returns all key-value pairs under the directory, and the
+// revision they were listed at.
+func (s *localStore) listTree(directory string) ([]*libkvStore.KVPair, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.list(directory), s.revision, nil
+}
+
+func (s *localStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.kvs[key]; !ok {
+		return libkvStore.ErrKeyNotFound
+	}
+	_, err := s.set(key, nil, "delete", false)
+	return err
+}
+
+func (s *localStore) Exists(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.kvs[key]
+	return ok, nil
+}
+
+// List lists all key-value pairs under the directory, including
+// ones in its subdirectories.
+func (s *localStore) List(directory string) ([]*libkvStore.KVPair, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	kvps := s.list(directory)
+	if len(kvps) == 0 {
+		return nil, libkvStore.ErrKeyNotFound
+	}
+	return kvps, nil
+}
+
+func (s *localStore) DeleteTree(directory string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, kvp := range s.list(directory) {
+		_, err := s.set(kvp.Key, nil, "delete", false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPrevious returns the error libkv returns if the key was modified
+// since the previous pair, or exists if there is none. Must be called
+// with the mutex held.
+func (s *localStore) checkPrevious(key string, previous *libkvStore.KVPair) error {
+	cur, ok := s.kvs[key]
+	switch {
+	case previous == nil && ok:
+		return libkvStore.ErrKeyExists
+	case previous == nil:
+		return nil
+	case !ok:
+		return libkvStore.ErrKeyNotFound
+	case cur.LastIndex != previous.LastIndex:
+		return libkvStore.ErrKeyModified
+	}
+	return nil
+}
+
+func (s *localStore) AtomicPut(key string, value []byte, previous *libkvStore.KVPair, options *libkvStore.WriteOptions) (bool, *libkvStore.KVPair, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.checkPrevious(key, previous)
+	if err != nil {
+		return false, nil, err
+	}
+	kvp, err := s.put(key, value, options)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, kvp, nil
+}
+
+// commit makes the changes at one revision, provided none of their
+// keys were modified since their previous pairs, or exist if there
+// are none.
+func (s *localStore) commit(ops []StoreOp) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changes := make([]localChange, 0, len(ops))
+	for _, op := range ops {
+		err := s.checkPrevious(op.Key, op.Previous)
+		if err != nil {
+			return 0, err
+		}
+		if op.CompareOnly {
+			continue
+		}
+		ch := localChange{key: op.Key, value: op.Value, action: "delete"}
+		if op.Value != nil {
+			ch.action = "set"
+			if op.Previous == nil {
+				ch.action = "create"
+			}
+		}
+		changes = append(changes, ch)
+	}
+	if len(changes) == 0 {
+		return s.revision, nil
+	}
+	_, err := s.setAll(changes)
+	if err != nil {
+		return 0, err
+	}
+	return s.revision, nil
+}
+
+func (s *localStore) AtomicDelete(key string, previous *libkvStore.KVPair) (bool, error) {
+	if previous == nil {
+		return false, libkvStore.ErrPreviousNotSpecified
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.checkPrevious(key, previous)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.set(key, nil, "delete", false)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// compact drops changes up to the revision, and those before it, from
+// history. Must be called with the mutex held.
+func (s *localStore) compact(revision uint64) {
+	start := sort.Search(len(s.history), func(i int) bool { return s.history[i].LastIndex > revision })
+	s.history = s.history[start:]
+	if revision > s.compacted {
+		s.compacted = revision
+	}
+}
+
+// changesAfter returns the changes of the key, or of keys under it if
+// recursive, after the revision, and a channel closed on the next
+// change. If changes right after the revision are no longer kept,
+// ErrCompacted is returned.
+func (s *localStore) changesAfter(key string, recursive bool, revision uint64) ([]*libkvStore.KVPairExt, <-chan struct{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if revision < s.compacted {
+		return nil, nil, ErrCompacted
+	}
+	prefix := dirPrefix(key)
+	changes := make([]*libkvStore.KVPairExt, 0)
+	start := sort.Search(len(s.history), func(i int) bool { return s.history[i].LastIndex > revision })
+	for _, ev := range s.history[start:] {
+		if ev.Key == key || (recursive && strings.HasPrefix(ev.Key, prefix)) {
+			changes = append(changes, ev)
+		}
+	}
+	return changes, s.changed, nil
+}
+
+// watch sends changes after the revision, as WatchExt does, until
+// stopCh is closed or the store is, or changes to send next are
+// compacted.
+func (s *localStore) watch(key string, recursive bool, revision uint64, stopCh <-chan struct{}) <-chan *libkvStore.KVPairExt {
+	out := make(chan *libkvStore.KVPairExt)
+	go func() {
+		defer close(out)
+		for {
+			changes, changed, err := s.changesAfter(key, recursive, revision)
+			if err != nil {
+				log.Warnf("Watch on %s: changes after revision %d are no longer kept, closing", key, revision)
+				return
+			}
+			for _, ev := range changes {
+				select {
+				case out <- ev:
+				case <-stopCh:
+					return
+				}
+			}
+			if len(changes) > 0 {
+				revision = changes[len(changes)-1].LastIndex
+				continue
+			}
+			select {
+			case <-changed:
+				s.mutex.Lock()
+				closed := s.closed
+				s.mutex.Unlock()
+				if closed {
+					return
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// WatchExt sends changes of the key, or the keys under it if options
+// are recursive, after the revision in options. If there is none, the
+// current values are sent first, as "get" actions, unless NoList is
+// specified. If changes after it are no longer kept, ErrCompacted is
+// returned.
+func (s *localStore) WatchExt(key string, options libkvStore.WatcherOptions, stopCh <-chan struct{}) (<-chan *libkvStore.KVPairExt, error) {
+	s.mutex.Lock()
+	revision := options.AfterIndex
+	if revision != 0 && revision < s.compacted {
+		s.mutex.Unlock()
+		return nil, ErrCompacted
+	}
+	current := make([]*libkvStore.KVPairExt, 0)
+	if revision == 0 {
+		revision = s.revision
+		if !options.NoList {
+			kvps := make([]*libkvStore.KVPair, 0)
+			if options.Recursive {
+				kvps = s.list(key)
+			} else if kvp, ok := s.kvs[key]; ok {
+				kvps = append(kvps, kvp)
+			}
+			for _, kvp := range kvps {
+				current = append(current, &libkvStore.KVPairExt{Key: kvp.Key, Value: string(kvp.Value), Action: "get", LastIndex: kvp.LastIndex})
+			}
+		}
+	}
+	s.mutex.Unlock()
+	if len(current) == 0 {
+		return s.watch(key, options.Recursive, revision, stopCh), nil
+	}
+	changes := s.watch(key, options.Recursive, revision, stopCh)
+	out := make(chan *libkvStore.KVPairExt)
+	go func() {
+		defer close(out)
+		for _, kvp := range current {
+			select {
+			case out <- kvp:
+			case <-stopCh:
+				return
+			}
+		}
+		for ev := range changes {
+			select {
+			case out <- ev:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Watch sends the current value of the key, if any, and then its new
+// values; deletions are not sent.
+func (s *localStore) Watch(key string, stopCh <-chan struct{}) (<-chan *libkvStore.KVPair, error) {
+	s.mutex.Lock()
+	kvp := s.kvs[key]
+	revision := s.revision
+	s.mutex.Unlock()
+	changes := s.watch(key, false, revision, stopCh)
+	out := make(chan *libkvStore.KVPair)
+	go func() {
+		defer close(out)
+		if kvp != nil {
+			select {
+			case out <- kvp:
+			case <-stopCh:
+				return
+			}
+		}
+		for ev := range changes {
+			if ev.Action == "delete" || ev.Action == "expire" {
+				continue
+			}
+			select {
+			case out <- &libkvStore.KVPair{Key: ev.Key, Value: []byte(ev.Value), LastIndex: ev.LastIndex}:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// WatchTree sends all key-value pairs under the directory, and then
+// again every time they change.
+func (s *localStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*libkvStore.KVPair, error) {
+	s.mutex.Lock()
+	kvps := s.list(directory)
+	revision := s.revision
+	s.mutex.Unlock()
+	changes := s.watch(directory, true, revision, stopCh)
+	out := make(chan []*libkvStore.KVPair)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case out <- kvps:
+			case <-stopCh:
+				return
+			}
+			ev, ok := <-changes
+			if !ok {
+				return
+			}
+			s.mutex.Lock()
+			kvps = s.list(directory)
+			s.mutex.Unlock()
+			log.Tracef(trace.Inside, "localStore: %s changed at revision %d", directory, ev.LastIndex)
+		}
+	}()
+	return out, nil
+}
+
+func (s *localStore) WatchTreeExt(directory string, stopCh <-chan struct{}) (<-chan *libkvStore.KVPairExt, error) {
+	return s.WatchExt(directory, libkvStore.WatcherOptions{Recursive: true, NoList: true}, stopCh)
+}
+
+func (s *localStore) NewLock(key string, options *libkvStore.LockOptions) (libkvStore.Locker, error) {
+	value := []byte("locked")
+	if options != nil && options.Value != nil {
+		value = options.Value
+	}
+	return &localLock{store: s, key: key, value: value}, nil
+}
+
+// Close closes the database, if any, and stops all watches.
+func (s *localStore) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.changed)
+	s.changed = make(chan struct{})
+	if s.db != nil {
+		err := s.db.Close()
+		if err != nil {
+			log.Errorf("Error closing store: %s", err)
+		}
+	}
+}
+
+// localLock implements libkv's store.Locker for localStore. The lock
+// is a key that exists while the lock is held.
+type localLock struct {
+	store *localStore
+	key   string
+	value []byte
+	held  bool
+}
+
+// Lock waits for the lock until it gets it or stopChan is closed. As
+// the lock is in the same process, it cannot be lost, so the returned
+// channel is never closed.
+func (l *localLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+	for {
+		l.store.mutex.Lock()
+		if _, locked := l.store.kvs[l.key]; !locked {
+			_, err := l.store.set(l.key, l.value, "create", true)
+			l.store.mutex.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			l.held = true
+			return make(chan struct{}), nil
+		}
+		changed := l.store.changed
+		l.store.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-stopChan:
+			return nil, libkvStore.ErrAbortTryLock
+		}
+	}
+}
+
+func (l *localLock) Unlock() error {
+	if !l.held {
+		return common.NewError("Lock %s is not held", l.key)
+	}
+	l.held = false
+	return l.store.Delete(l.key)
+}
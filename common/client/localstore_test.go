@@ -0,0 +1,335 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+
+	libkvStore "github.com/docker/libkv/store"
+)
+
+const localStoreTopology = `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/16","block_mask":29}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"groups":[{"name":"host1","ip":"192.168.99.10"}]}
+  ]}]
+}`
+
+func TestMockClient(t *testing.T) {
+	c, err := NewClient(&common.Config{EtcdPrefix: "/romana", Mock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Store.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	blocksCh, err := c.WatchBlocks(stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := api.TopologyUpdateRequest{}
+	err = json.Unmarshal([]byte(localStoreTopology), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.IPAM.UpdateTopology(req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, err := c.IPAM.AllocateIP("a1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.0" {
+		t.Fatalf("Expected 10.0.0.0, got %s", ip)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case blocks := <-blocksCh:
+			if len(blocks.Blocks) == 1 {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for the block")
+		}
+	}
+}
+
+func TestLocalStoreAtomicPutAndLock(t *testing.T) {
+	s := newLocalStore()
+	defer s.Close()
+
+	ok, kvp, err := s.AtomicPut("/a", []byte("1"), nil, nil)
+	if !ok || err != nil {
+		t.Fatalf("Expected to create /a, got %v", err)
+	}
+	_, _, err = s.AtomicPut("/a", []byte("2"), nil, nil)
+	if err != libkvStore.ErrKeyExists {
+		t.Fatalf("Expected %v, got %v", libkvStore.ErrKeyExists, err)
+	}
+	ok, _, err = s.AtomicPut("/a", []byte("2"), kvp, nil)
+	if !ok || err != nil {
+		t.Fatalf("Expected to update /a, got %v", err)
+	}
+	_, _, err = s.AtomicPut("/a", []byte("3"), kvp, nil)
+	if err != libkvStore.ErrKeyModified {
+		t.Fatalf("Expected %v, got %v", libkvStore.ErrKeyModified, err)
+	}
+
+	lock1, _ := s.NewLock("/lock", nil)
+	lock2, _ := s.NewLock("/lock", nil)
+	_, err = lock1.Lock(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error)
+	go func() {
+		_, err := lock2.Lock(nil)
+		locked <- err
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Lock acquired while held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	err = lock1.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock not acquired after unlock")
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &common.Config{EtcdPrefix: "/romana", StoreBackend: StoreBolt, StoreFile: filepath.Join(dir, "romana.db")}
+
+	store, err := NewStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PutObject("/hosts/host1", []byte("host1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PutObject("/hosts/host2", []byte("host2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Delete("/hosts/host2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rev, err := store.ListTreeExt("/romana/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = NewStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	kvps, rev2, err := store.ListTreeExt("/romana/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvps) != 1 || string(kvps[0].Value) != "host1" {
+		t.Fatalf("Unexpected keys after reopening: %v", kvps)
+	}
+	if rev2 != rev {
+		t.Fatalf("Expected revision %d after reopening, got %d", rev, rev2)
+	}
+}
+
+func TestStoreCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &common.Config{EtcdPrefix: "/romana", StoreBackend: StoreBolt, StoreFile: filepath.Join(dir, "romana.db")}
+
+	store, err := NewStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Transactional() {
+		t.Fatal("Expected bolt store to support transactions")
+	}
+	index, err := store.Commit([]StoreOp{
+		{Key: "/groups/g1", Value: []byte("1")},
+		{Key: "/groups/g2", Value: []byte("2")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g1, _ := store.Get("/groups/g1")
+	g2, _ := store.Get("/groups/g2")
+	if g1.LastIndex != index || g2.LastIndex != index {
+		t.Fatalf("Expected both keys at %d, got %d and %d", index, g1.LastIndex, g2.LastIndex)
+	}
+
+	// Nothing changes if any key was modified.
+	err = store.PutObject("/groups/g2", []byte("2b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Commit([]StoreOp{
+		{Key: "/groups/g1", Value: []byte("1c"), Previous: g1},
+		{Key: "/groups/g2", Previous: g2, CompareOnly: true},
+	})
+	if err != ErrModified {
+		t.Fatalf("Expected %v, got %v", ErrModified, err)
+	}
+	g2, _ = store.Get("/groups/g2")
+	_, err = store.Commit([]StoreOp{
+		{Key: "/groups/g1", Previous: g1},
+		{Key: "/groups/g2", Value: []byte("2c"), Previous: g2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = NewStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	kvps, err := store.ListObjects("/groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvps) != 1 || string(kvps[0].Value) != "2c" {
+		t.Fatalf("Unexpected keys after reopening: %v", kvps)
+	}
+}
+
+func TestWatchCompaction(t *testing.T) {
+	store, err := NewStore(&common.Config{EtcdPrefix: "/romana", Mock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	local := store.(*kvStore).Store.(*localStore)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	err = store.PutObject("/data", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PutObject("/groups/g1", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataCh, err := store.ReconnectingWatch("/data", stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeCh, err := store.ReconnectingWatchTree("/groups", stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PutObject("/groups/g2", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case kv := <-dataCh:
+		if string(kv.Value) != "1" {
+			t.Fatalf("Expected current value 1, got %s", kv.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the current value")
+	}
+	var lastIndex uint64
+	select {
+	case kv := <-treeCh:
+		if kv.Key != "/romana/groups/g2" || kv.Action != "create" {
+			t.Fatalf("Expected g2 to be created, got %s of %s", kv.Action, kv.Key)
+		}
+		lastIndex = kv.LastIndex
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for g2")
+	}
+
+	// Changes are compacted before the watches wake up to send them.
+	local.mutex.Lock()
+	_, err = local.setAll([]localChange{
+		{key: "/romana/data", value: []byte("2"), action: "set"},
+		{key: "/romana/groups/g1", action: "delete"},
+		{key: "/romana/groups/g3", value: []byte("3"), action: "create"},
+	})
+	local.compact(local.revision)
+	local.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.WatchExt("/romana/groups", libkvStore.WatcherOptions{Recursive: true, AfterIndex: lastIndex}, stopCh)
+	if err != ErrCompacted {
+		t.Fatalf("Expected %v, got %v", ErrCompacted, err)
+	}
+
+	// Watches start over from current values.
+	select {
+	case kv := <-dataCh:
+		if string(kv.Value) != "2" {
+			t.Fatalf("Expected current value 2, got %s", kv.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the value after compaction")
+	}
+	listed := make([]string, 0)
+	for len(listed) < 2 {
+		select {
+		case kv := <-treeCh:
+			listed = append(listed, kv.Action+" "+kv.Key+"="+kv.Value)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for groups after compaction, got %v", listed)
+		}
+	}
+	sort.Strings(listed)
+	if fmt.Sprint(listed) != "[get /romana/groups/g2=2 get /romana/groups/g3=3]" {
+		t.Fatalf("Unexpected groups after compaction: %v", listed)
+	}
+}
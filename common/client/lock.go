@@ -0,0 +1,272 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	libkvStore "github.com/docker/libkv/store"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/log/trace"
+	log "github.com/romana/rlog"
+)
+
+var (
+	// lockTTL is how long a lease of a lock lasts unless renewed.
+	// Leases are renewed every third of it while the lock is held.
+	lockTTL = 15 * time.Second
+	// lockRetryInterval is how often a held lock is checked by
+	// those waiting for it.
+	lockRetryInterval = 250 * time.Millisecond
+	// lockAcquireTimeout is how long to wait for a held lock
+	// before giving up.
+	lockAcquireTimeout = 2 * time.Minute
+)
+
+// leaseRecord is stored at the key of a lock. It is kept when the
+// lock is released, so that the fencing token keeps increasing.
+type leaseRecord struct {
+	// Holder is empty if the lock is released.
+	Holder string `json:"holder"`
+	Token  uint64 `json:"token"`
+}
+
+func (r leaseRecord) String() string {
+	return fmt.Sprintf("%s (token %d)", r.Holder, r.Token)
+}
+
+// lockHolder returns the identity this process holds locks with.
+func lockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", hostname, os.Getpid())
+}
+
+// lockTimeoutError returns the error of giving up waiting for a lock.
+func lockTimeoutError(name string, waited time.Duration) error {
+	return common.NewError("Timed out waiting for lock %s after %s", name, waited)
+}
+
+// leaseLocker implements Locker with a lease in the store, for stores
+// without leases of their own. The lease is renewed while the lock is
+// held, each renewal changing the index of its key in the store. If the
+// holder dies or stalls, the index stops changing, and the lock is taken
+// over once those waiting for it see it unchanged for lockTTL. As this
+// is measured by the clock of each waiter, clocks of hosts need not
+// agree. Every acquisition increments the fencing token of the lock,
+// which writers store along with what they write, so that writes of
+// earlier holders are refused.
+type leaseLocker struct {
+	store  libkvStore.Store
+	name   string
+	key    string
+	holder string
+
+	mutex sync.Mutex
+	// Pair and record of the lease while the lock is held.
+	kvp      *libkvStore.KVPair
+	record   leaseRecord
+	acquired time.Time
+	// Closed to stop renewals, and by renewals when they stop.
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// get returns the pair and record of the lock; the pair is nil if
+// the lock was never taken.
+func (l *leaseLocker) get() (*libkvStore.KVPair, leaseRecord, error) {
+	rec := leaseRecord{}
+	kvp, err := l.store.Get(l.key)
+	if err == libkvStore.ErrKeyNotFound {
+		return nil, rec, nil
+	}
+	if err != nil {
+		return nil, rec, err
+	}
+	err = json.Unmarshal(kvp.Value, &rec)
+	if err != nil {
+		return nil, rec, common.NewError("Error parsing lease of lock %s: %s", l.key, err)
+	}
+	return kvp, rec, nil
+}
+
+// put replaces the previous pair of the lock with the record.
+func (l *leaseLocker) put(previous *libkvStore.KVPair, rec leaseRecord) (*libkvStore.KVPair, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	_, kvp, err := l.store.AtomicPut(l.key, b, previous, nil)
+	return kvp, err
+}
+
+// Lock implements Lock method of Locker interface. It waits until the
+// lock is released or its lease expires, for up to lockAcquireTimeout.
+// The returned channel is closed if the lease is lost, that is, could
+// not be renewed in time or was taken over.
+func (l *leaseLocker) Lock() (<-chan struct{}, error) {
+	start := time.Now()
+	// Index of the lease of the holder, and when it was first seen.
+	var seenIndex uint64
+	var seen time.Time
+	for {
+		previous, rec, err := l.get()
+		if err != nil {
+			return nil, err
+		}
+		if rec.Holder != "" {
+			now := time.Now()
+			if previous.LastIndex != seenIndex {
+				seenIndex = previous.LastIndex
+				seen = now
+			}
+			if now.Sub(seen) < lockTTL {
+				if now.Sub(start) >= lockAcquireTimeout {
+					return nil, lockTimeoutError(l.name, now.Sub(start))
+				}
+				log.Tracef(trace.Inside, "Lock %s is held by %s, waiting", l.name, rec)
+				time.Sleep(lockRetryInterval)
+				continue
+			}
+			log.Warnf("Lease of lock %s held by %s was not renewed for %s, taking over", l.name, rec, now.Sub(seen))
+			LockExpirations.WithLabelValues(l.name).Inc()
+		}
+		newRec := leaseRecord{Holder: l.holder, Token: rec.Token + 1}
+		kvp, err := l.put(previous, newRec)
+		if err == libkvStore.ErrKeyModified || err == libkvStore.ErrKeyExists {
+			// Someone else got there first.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		lostCh := make(chan struct{})
+		l.mutex.Lock()
+		l.kvp = kvp
+		l.record = newRec
+		l.acquired = time.Now()
+		l.stopCh = make(chan struct{})
+		l.doneCh = make(chan struct{})
+		go l.renew(l.stopCh, l.doneCh, lostCh)
+		l.mutex.Unlock()
+
+		waited := time.Since(start)
+		LockAcquireSeconds.WithLabelValues(l.name).Observe(waited.Seconds())
+		LockHeld.WithLabelValues(l.name).Set(float64(newRec.Token))
+		log.Infof("Acquired lock %s as %s with token %d after %s", l.name, l.holder, newRec.Token, waited)
+		return lostCh, nil
+	}
+}
+
+// renew extends the lease until stopped, closing lostCh if it is
+// taken over, or if it is not extended for two thirds of lockTTL,
+// before waiters could see it unchanged for all of it.
+func (l *leaseLocker) renew(stopCh <-chan struct{}, doneCh chan<- struct{}, lostCh chan<- struct{}) {
+	defer close(doneCh)
+	ticker := time.NewTicker(lockTTL / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		l.mutex.Lock()
+		kvp, err := l.put(l.kvp, l.record)
+		if err == nil {
+			l.kvp = kvp
+			l.mutex.Unlock()
+			renewed = time.Now()
+			continue
+		}
+		token := l.record.Token
+		l.mutex.Unlock()
+		if err != libkvStore.ErrKeyModified && err != libkvStore.ErrKeyNotFound && time.Since(renewed) < 2*lockTTL/3 {
+			log.Warnf("Error renewing lease of lock %s, retrying: %s", l.name, err)
+			continue
+		}
+		log.Errorf("Lost lock %s held as %s with token %d: %s", l.name, l.holder, token, err)
+		LockLeasesLost.WithLabelValues(l.name).Inc()
+		close(lostCh)
+		return
+	}
+}
+
+// Unlock implements Unlock method of Locker interface. The lease is
+// released unless it was taken over already.
+func (l *leaseLocker) Unlock() {
+	l.mutex.Lock()
+	stopCh, doneCh := l.stopCh, l.doneCh
+	l.stopCh = nil
+	l.mutex.Unlock()
+	if stopCh == nil {
+		log.Errorf("Unlocking lock %s that is not held", l.name)
+		return
+	}
+	close(stopCh)
+	<-doneCh
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	rec := l.record
+	rec.Holder = ""
+	_, err := l.put(l.kvp, rec)
+	if err != nil {
+		log.Errorf("Error releasing lock %s held as %s with token %d: %s", l.name, l.holder, rec.Token, err)
+	} else {
+		log.Infof("Released lock %s held as %s with token %d for %s", l.name, l.holder, rec.Token, time.Since(l.acquired))
+	}
+	LockHeld.DeleteLabelValues(l.name)
+	l.kvp = nil
+	l.record = leaseRecord{}
+}
+
+// Token implements Token method of Locker interface.
+func (l *leaseLocker) Token() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.record.Token
+}
+
+// Fence implements Fence method of Locker interface, by checking that
+// the lease in the store is still the one acquired.
+func (l *leaseLocker) Fence() error {
+	token := l.Token()
+	if token == 0 {
+		return common.NewError("Lock %s is not held", l.name)
+	}
+	_, rec, err := l.get()
+	if err != nil {
+		return err
+	}
+	if rec.Token != token || rec.Holder != l.holder {
+		return common.NewError("Lock %s held with token %d was taken over by %s", l.name, token, rec)
+	}
+	return nil
+}
+
+// Name implements Name method of Locker interface.
+func (l *leaseLocker) Name() string {
+	return l.name
+}
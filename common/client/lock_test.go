@@ -0,0 +1,188 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// tokenLocker is a Locker that is held with a fixed token.
+type tokenLocker struct {
+	name  string
+	token uint64
+}
+
+func (l *tokenLocker) Lock() (<-chan struct{}, error) { return make(chan struct{}), nil }
+func (l *tokenLocker) Unlock()                        {}
+func (l *tokenLocker) Token() uint64                  { return l.token }
+func (l *tokenLocker) Fence() error                   { return nil }
+func (l *tokenLocker) Name() string                   { return l.name }
+
+func TestLeaseLocker(t *testing.T) {
+	store := &kvStore{prefix: "/romana", Store: newLocalStore()}
+	defer store.Close()
+
+	l1, _ := store.NewLocker("ipam")
+	l2, _ := store.NewLocker("ipam")
+	_, err := l1.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l1.Token() != 1 {
+		t.Fatalf("Expected token 1, got %d", l1.Token())
+	}
+	if err = l1.Fence(); err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan error)
+	go func() {
+		_, err := l2.Lock()
+		locked <- err
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Lock acquired while held")
+	case <-time.After(3 * lockRetryInterval):
+	}
+	l1.Unlock()
+	select {
+	case err = <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock not acquired after unlock")
+	}
+	if l2.Token() != 2 {
+		t.Fatalf("Expected token 2, got %d", l2.Token())
+	}
+	if err = l1.Fence(); err == nil {
+		t.Fatal("Expected fencing error after unlock")
+	}
+	l2.Unlock()
+}
+
+func TestLeaseLockerExpiration(t *testing.T) {
+	store := &kvStore{prefix: "/romana", Store: newLocalStore()}
+	defer store.Close()
+	savedTTL, savedTimeout := lockTTL, lockAcquireTimeout
+	lockTTL = 30 * time.Millisecond
+	lockAcquireTimeout = 5 * lockTTL
+	defer func() { lockTTL, lockAcquireTimeout = savedTTL, savedTimeout }()
+
+	// A holder that died with its lease, which is taken over
+	// once it is seen unchanged for the TTL.
+	b, _ := json.Marshal(leaseRecord{Holder: "dead/1", Token: 7})
+	err := store.PutObject("/lease/ipam", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l1, _ := store.NewLocker("ipam")
+	start := time.Now()
+	lostCh, err := l1.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Unlock()
+	if waited := time.Since(start); waited < lockTTL {
+		t.Fatalf("Expected lease to be taken over after %s, got %s", lockTTL, waited)
+	}
+	if l1.Token() != 8 {
+		t.Fatalf("Expected token 8, got %d", l1.Token())
+	}
+	// Renewals keep the lease past its TTL, so those
+	// waiting for it time out.
+	l2, _ := store.NewLocker("ipam")
+	_, err = l2.Lock()
+	if err == nil {
+		t.Fatal("Expected lock to time out while renewed")
+	}
+	if err = l1.Fence(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Now l1 stalls, and its lease is taken over.
+	b, _ = json.Marshal(leaseRecord{Holder: "other/2", Token: 9})
+	err = store.PutObject("/lease/ipam", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l1.Fence(); err == nil {
+		t.Fatal("Expected fencing error after takeover")
+	}
+	select {
+	case <-lostCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Loss of lease not reported")
+	}
+}
+
+func TestSaveFencing(t *testing.T) {
+	ipam = initIpam(t, localStoreTopology)
+	c := &Client{Store: &kvStore{prefix: "/romana", Store: newLocalStore()}}
+	defer c.Store.Close()
+	err := c.initSchemaVersion(SchemaVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(ipam, &tokenLocker{name: "ipam", token: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := &IPAM{}
+	err = c.load(stale, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is taken over, and the new holder saves first.
+	latest := &IPAM{}
+	err = c.load(latest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(latest, &tokenLocker{name: "ipam", token: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(stale, &tokenLocker{name: "ipam", token: 1})
+	if err != ErrModified {
+		t.Fatalf("Expected %v saving under the lost lock, got %v", ErrModified, err)
+	}
+	// Nor can it save what it loads next.
+	err = c.load(stale, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(stale, &tokenLocker{name: "ipam", token: 1})
+	if err == nil {
+		t.Fatal("Expected error saving under the lost lock")
+	}
+
+	// Saving without the lock keeps the token.
+	err = c.saveIPAM(latest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := parseManifest(latest.GetPrevKVPair().Value)
+	if manifest.FencingTokens["ipam"] != 2 {
+		t.Fatalf("Expected fencing token 2, got %v", manifest.FencingTokens)
+	}
+}
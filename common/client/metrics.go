@@ -0,0 +1,97 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	IPAMWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "romana_ipam_writes_total",
+			Help: "Number of attempts to save IPAM changes by result (saved, conflict, failed).",
+		},
+		[]string{"result"},
+	)
+	IPAMWriteAttempts = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "romana_ipam_write_attempts",
+			Help:    "Number of attempts it took to save an IPAM change.",
+			Buckets: []float64{1, 2, 3, 5, 10},
+		},
+	)
+	IPAMWriteBackoffSeconds = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "romana_ipam_write_backoff_seconds_total",
+			Help: "Time spent backing off after conflicting IPAM changes.",
+		},
+	)
+	LockAcquireSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "romana_lock_acquire_seconds",
+			Help: "Time it took to acquire a lock in the store, by lock.",
+		},
+		[]string{"lock"},
+	)
+	LockHeld = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "romana_lock_held_token",
+			Help: "Fencing token of locks held by this process, by lock.",
+		},
+		[]string{"lock"},
+	)
+	LockExpirations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "romana_lock_expirations_total",
+			Help: "Number of expired leases of locks taken over from their holders, by lock.",
+		},
+		[]string{"lock"},
+	)
+	LockLeasesLost = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "romana_lock_leases_lost_total",
+			Help: "Number of leases of locks this process lost while holding them, by lock.",
+		},
+		[]string{"lock"},
+	)
+)
+
+// MetricsRegister registers IPAM and lock client metrics with the registry.
+func MetricsRegister(registry *prometheus.Registry) error {
+	if registry == nil {
+		return fmt.Errorf("registry must not be nil")
+	}
+
+	for _, c := range []prometheus.Collector{
+		IPAMWrites,
+		IPAMWriteAttempts,
+		IPAMWriteBackoffSeconds,
+		LockAcquireSeconds,
+		LockHeld,
+		LockExpirations,
+		LockLeasesLost,
+	} {
+		err := registry.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
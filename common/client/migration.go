@@ -0,0 +1,314 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	libkvStore "github.com/docker/libkv/store"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	log "github.com/romana/rlog"
+)
+
+const (
+	// schemaVersionKey stores the version of the schema of data in
+	// the store. Data stored before it was introduced has no
+	// version, which is version 0.
+	//
+	// Only IPAM is versioned, as its layout in the store is its own
+	// (see ipamLayout). Policies (under PoliciesPrefix), RomanaIPs
+	// (under RomanaIPPrefix) and the listener's config (under
+	// ListenerConfigPrefix) are not, on purpose: they are stored as
+	// their API objects, which are kept compatible instead.
+	schemaVersionKey = "/schema/version"
+	// ListenerConfigPrefix is where the listener keeps its config.
+	ListenerConfigPrefix = "/kubelistener/config/"
+)
+
+// Migration changes data in the store from the previous version of
+// the schema to Version. Migrate must be safe to run again on data it
+// already migrated, and, if dryRun, only describe the changes it would
+// make. Changes are made under the lock of migrations, and must carry
+// its fencing token (see Client.saveMigrated).
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(c *Client, locker Locker, dryRun bool) ([]string, error)
+}
+
+// migrations are all migrations, ordered by version, which starts at 1
+// and increments by 1 with every migration.
+var migrations = []Migration{
+	{Version: 1, Description: "Store IPAM in shards", Migrate: migrateIPAMShards},
+	{Version: 2, Description: "Store IPAM address names with their groups", Migrate: migrateIPAMGroups},
+}
+
+// SchemaVersion is the version of the schema of data in the store
+// this code works with.
+var SchemaVersion = migrations[len(migrations)-1].Version
+
+// schemaRecord is stored at schemaVersionKey. FencingToken is the
+// token of the lock of migrations it was last written under, if any.
+type schemaRecord struct {
+	Version      int    `json:"version"`
+	FencingToken uint64 `json:"fencing_token,omitempty"`
+
+	prevKVPair *libkvStore.KVPair
+}
+
+func (r *schemaRecord) GetPrevKVPair() *libkvStore.KVPair {
+	return r.prevKVPair
+}
+
+func (r *schemaRecord) SetPrevKVPair(kvp *libkvStore.KVPair) {
+	r.prevKVPair = kvp
+}
+
+// getSchemaRecord returns the record of the schema version of data in
+// the store, which has version 0 and no previous KV pair if not set.
+func (c *Client) getSchemaRecord() (*schemaRecord, error) {
+	rec := &schemaRecord{}
+	kvp, err := c.Store.GetObject(schemaVersionKey)
+	if err != nil || kvp == nil {
+		return rec, err
+	}
+	value := strings.TrimSpace(string(kvp.Value))
+	if strings.HasPrefix(value, "{") {
+		err = json.Unmarshal(kvp.Value, rec)
+	} else {
+		// Just the version, as set by hand.
+		rec.Version, err = strconv.Atoi(value)
+	}
+	if err != nil {
+		return nil, common.NewError("Invalid schema version %s at %s", kvp.Value, schemaVersionKey)
+	}
+	rec.SetPrevKVPair(kvp)
+	return rec, nil
+}
+
+// getSchemaVersion returns the version of the schema of data in the
+// store, and whether it was set.
+func (c *Client) getSchemaVersion() (int, bool, error) {
+	rec, err := c.getSchemaRecord()
+	if err != nil {
+		return 0, false, err
+	}
+	return rec.Version, rec.GetPrevKVPair() != nil, nil
+}
+
+// newerSchemaError reports that data in the store has a schema version
+// newer than this code supports.
+func newerSchemaError(version int) error {
+	return common.NewError("Data in the store has schema version %d, this version of Romana only supports up to %d, upgrade Romana", version, SchemaVersion)
+}
+
+// initSchemaVersion sets the schema version of an empty store.
+func (c *Client) initSchemaVersion(version int) error {
+	err := c.Store.AtomicPut(schemaVersionKey, &schemaRecord{Version: version})
+	if err == ErrModified {
+		// Set by another process at the same time.
+		return nil
+	}
+	return err
+}
+
+// hasVersionedData checks whether there is data in the store whose
+// schema is versioned, which is IPAM.
+func (c *Client) hasVersionedData() (bool, error) {
+	kvps, err := c.Store.ListObjects(ipamKey)
+	if err != nil && err != libkvStore.ErrKeyNotFound {
+		return false, err
+	}
+	return len(kvps) > 0, nil
+}
+
+// checkSchemaVersion refuses data with a schema newer than this code
+// supports, and warns about pending migrations, until which IPAM
+// cannot be changed (see saveIPAM). A store without versioned data
+// gets the current version.
+func (c *Client) checkSchemaVersion() error {
+	version, ok, err := c.getSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return newerSchemaError(version)
+	}
+	if !ok {
+		versioned, err := c.hasVersionedData()
+		if err != nil {
+			return err
+		}
+		if !versioned {
+			log.Infof("No IPAM in the store at %s, setting schema version to %d", ipamKey, SchemaVersion)
+			return c.initSchemaVersion(SchemaVersion)
+		}
+	}
+	if version < SchemaVersion {
+		log.Warnf("Data in the store has schema version %d, %d migrations to version %d are pending, IPAM cannot be changed until `romana migrate` is run", version, SchemaVersion-version, SchemaVersion)
+	}
+	return nil
+}
+
+// Migrate runs the migrations pending for data in the store, recording
+// the version reached after each of them. With dryRun, nothing is
+// changed, and each migration reports what it would change in data as
+// it is now, not as earlier migrations would leave it.
+//
+// Migrations are pending too if IPAM is stored in a layout older than
+// the version has, as when it was copied from a store without
+// transactions (see MigrateEtcdV2ToV3).
+//
+// The version is recorded with the fencing token of the lock of
+// migrations, with compare-and-swap, so that if the lock is taken over
+// while migrating, either this or the new holder fails to record it.
+func (c *Client) Migrate(dryRun bool) (*api.MigrationResult, error) {
+	locker, err := c.Store.NewLocker(schemaVersionKey)
+	if err != nil {
+		return nil, err
+	}
+	_, err = locker.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer locker.Unlock()
+
+	rec, err := c.getSchemaRecord()
+	if err != nil {
+		return nil, err
+	}
+	version := rec.Version
+	if version > SchemaVersion {
+		return nil, newerSchemaError(version)
+	}
+	if rec.FencingToken > locker.Token() {
+		return nil, common.NewError("Lock %s held with token %d was taken over, schema version was set with token %d", locker.Name(), locker.Token(), rec.FencingToken)
+	}
+	kvp, err := c.Store.GetObject(ipamDataKey)
+	if err != nil {
+		return nil, err
+	}
+	if kvp != nil && len(kvp.Value) > 0 {
+		layout := storedLayout(kvp.Value)
+		for version > 0 && ipamLayout(version, c.Store.Transactional()) > layout {
+			version--
+		}
+	}
+	result := &api.MigrationResult{FromVersion: version,
+		ToVersion: version,
+		DryRun:    dryRun,
+		Steps:     make([]api.MigrationStep, 0),
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		changes, err := m.Migrate(c, locker, dryRun)
+		if err != nil {
+			return result, common.NewError("Migration to schema version %d (%s) failed: %s", m.Version, m.Description, err)
+		}
+		if changes == nil {
+			changes = make([]string, 0)
+		}
+		result.Steps = append(result.Steps, api.MigrationStep{Version: m.Version,
+			Description: m.Description,
+			Changes:     changes,
+		})
+		result.ToVersion = m.Version
+		if dryRun {
+			continue
+		}
+		rec.Version = m.Version
+		rec.FencingToken = locker.Token()
+		err = c.Store.AtomicPut(schemaVersionKey, rec)
+		if err == ErrModified {
+			return result, common.NewError("Schema version at %s was changed while migrating, lock %s held with token %d was taken over", schemaVersionKey, locker.Name(), locker.Token())
+		}
+		if err != nil {
+			return result, err
+		}
+		log.Infof("Migrated data in the store to schema version %d (%s): %d changes", m.Version, m.Description, len(changes))
+	}
+	return result, nil
+}
+
+// migrateIPAMShards splits IPAM stored under a single key into shards.
+func migrateIPAMShards(c *Client, locker Locker, dryRun bool) ([]string, error) {
+	kvp, err := c.Store.GetObject(ipamDataKey)
+	if err != nil || kvp == nil || len(kvp.Value) == 0 {
+		return nil, err
+	}
+	if _, sharded := parseManifest(kvp.Value); sharded {
+		return nil, nil
+	}
+	changes := []string{fmt.Sprintf("Split IPAM data at %s into shards under %s", ipamDataKey, ipamShardsKey)}
+	if dryRun {
+		return changes, nil
+	}
+	ipam, err := c.loadIPAM(kvp)
+	if err != nil {
+		return nil, err
+	}
+	return changes, c.saveMigrated(ipam, locker, ipamShardedLayout)
+}
+
+// migrateIPAMGroups moves address names and leases of IPAM in shards
+// from shards of their networks to shards of their groups, storing
+// groups under keys of their own if the store supports transactions.
+func migrateIPAMGroups(c *Client, locker Locker, dryRun bool) ([]string, error) {
+	kvp, err := c.Store.GetObject(ipamDataKey)
+	if err != nil || kvp == nil || len(kvp.Value) == 0 {
+		return nil, err
+	}
+	manifest, sharded := parseManifest(kvp.Value)
+	if !sharded {
+		// Split into shards of the current layout by migrateIPAMShards.
+		return nil, nil
+	}
+	changes := make([]string, 0)
+	for _, key := range manifest.Shards {
+		if strings.HasPrefix(key, namesShards) {
+			changes = append(changes, fmt.Sprintf("Move address names in IPAM shard %s to shards of their groups", shardName(key)))
+		}
+	}
+	if c.Store.Transactional() && manifest.Layout < ipamGroupLayout {
+		changes = append(changes, fmt.Sprintf("Store IPAM groups under %s", ipamGroupsKey))
+	}
+	if dryRun || len(changes) == 0 {
+		return changes, nil
+	}
+	ipam, err := c.loadIPAM(kvp)
+	if err != nil {
+		return nil, err
+	}
+	return changes, c.saveMigrated(ipam, locker, ipamLayout(2, c.Store.Transactional()))
+}
+
+// saveMigrated saves IPAM in the layout a migration converts it to,
+// under the lock of migrations, as saveLocked does.
+func (c *Client) saveMigrated(ipam *IPAM, locker Locker, layout int) error {
+	c.savingMutex.Lock()
+	defer c.savingMutex.Unlock()
+	err := locker.Fence()
+	if err != nil {
+		return err
+	}
+	return c.saveIPAMLayout(ipam, locker, layout)
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/romana/core/common"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	c, err := NewClient(&common.Config{EtcdPrefix: "/romana", Mock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Store.Close()
+	version, ok, err := c.getSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || version != SchemaVersion {
+		t.Fatalf("Expected empty store to get schema version %d, got %d (%t)", SchemaVersion, version, ok)
+	}
+
+	err = c.Store.PutObject(schemaVersionKey, []byte(strconv.Itoa(SchemaVersion+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.checkSchemaVersion()
+	if err == nil || !strings.Contains(err.Error(), "upgrade Romana") {
+		t.Fatalf("Expected error about newer schema, got %v", err)
+	}
+	_, err = c.Migrate(false)
+	if err == nil {
+		t.Fatal("Expected migration of newer schema to fail")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ipam = initIpam(t, localStoreTopology)
+	_, err := ipam.AllocateIP("a1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam.load(ipam, nil)
+
+	// Unversioned IPAM stored under a single key.
+	c := &Client{Store: &kvStore{prefix: "/romana", Store: newLocalStore()},
+		savingMutex: &sync.RWMutex{},
+		IPAM:        ipam,
+	}
+	defer c.Store.Close()
+	legacy, err := json.Marshal(ipam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Store.PutObject(ipamDataKey, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.checkSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FromVersion != 0 || result.ToVersion != SchemaVersion || len(result.Steps) != SchemaVersion {
+		t.Fatalf("Unexpected dry run %+v", result)
+	}
+	if len(result.Steps[0].Changes) != 1 {
+		t.Fatalf("Expected IPAM to be split into shards, got %v", result.Steps[0].Changes)
+	}
+	version, ok, _ := c.getSchemaVersion()
+	if ok || version != 0 {
+		t.Fatalf("Expected dry run to leave schema unversioned, got %d", version)
+	}
+
+	result, err = c.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ToVersion != SchemaVersion || len(result.Steps) != SchemaVersion {
+		t.Fatalf("Unexpected migration %+v", result)
+	}
+	rec, err := c.getSchemaRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Version != SchemaVersion || rec.FencingToken == 0 {
+		t.Fatalf("Expected schema version %d set under the lock after migration, got %+v", SchemaVersion, rec)
+	}
+	kvp, err := c.Store.Get(ipamDataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, sharded := parseManifest(kvp.Value); !sharded {
+		t.Fatal("Expected IPAM in shards after migration")
+	}
+	migrated := &IPAM{}
+	err = c.load(migrated, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored per group, revisions are indexes of the store.
+	if migrated.AllocationRevision < ipam.AllocationRevision || migrated.Networks["net1"].Revison < ipam.Networks["net1"].Revison {
+		t.Fatalf("Expected revisions not to decrease from %d, got %d", ipam.AllocationRevision, migrated.AllocationRevision)
+	}
+	migrated.AllocationRevision = ipam.AllocationRevision
+	migrated.Networks["net1"].Revison = ipam.Networks["net1"].Revison
+	b, _ := json.Marshal(migrated)
+	if string(b) != string(legacy) {
+		t.Fatalf("Expected\n%s\nafter migration, got\n%s", legacy, b)
+	}
+
+	result, err = c.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Steps) != 0 {
+		t.Fatalf("Expected no pending migrations, got %+v", result)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	ipam = initIpam(t, localStoreTopology)
+	c := &Client{Store: &kvStore{prefix: "/romana", Store: newLocalStore()},
+		savingMutex: &sync.RWMutex{},
+	}
+	defer c.Store.Close()
+	err := c.initSchemaVersion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(ipam, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvp, _ := c.Store.Get(ipamDataKey)
+	if layout := storedLayout(kvp.Value); layout != ipamShardedLayout {
+		t.Fatalf("Expected IPAM in layout %d at schema version 1, got %d", ipamShardedLayout, layout)
+	}
+
+	// As if copied from a store without transactions.
+	err = c.Store.PutObject(schemaVersionKey, []byte(strconv.Itoa(SchemaVersion)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(ipam, nil)
+	if err == nil || !strings.Contains(err.Error(), "romana migrate") {
+		t.Fatalf("Expected saving IPAM in an older layout to be refused, got %v", err)
+	}
+	result, err := c.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FromVersion != 1 || result.ToVersion != SchemaVersion || len(result.Steps) != 1 {
+		t.Fatalf("Expected migration from the version of the layout, got %+v", result)
+	}
+	latest := &IPAM{}
+	err = c.load(latest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout := storedLayout(latest.GetPrevKVPair().Value); layout != ipamGroupLayout {
+		t.Fatalf("Expected IPAM in layout %d after migration, got %d", ipamGroupLayout, layout)
+	}
+	err = c.saveIPAM(latest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
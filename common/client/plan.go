@@ -0,0 +1,225 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/romana/core/common/api"
+)
+
+// PlanTopology is a dry run of UpdateTopology: the request is parsed and
+// validated against the latest IPAM the same way, but nothing is saved.
+// It returns the resulting topology and its differences from the
+// current one.
+func (ipam *IPAM) PlanTopology(req api.TopologyUpdateRequest) (api.TopologyPlan, error) {
+	current := &IPAM{}
+	err := ipam.load(current, nil)
+	if err != nil {
+		return api.TopologyPlan{}, err
+	}
+	planned := &IPAM{}
+	err = ipam.load(planned, nil)
+	if err != nil {
+		return api.TopologyPlan{}, err
+	}
+	err = planned.UpdateTopology(req, false)
+	if err != nil {
+		return api.TopologyPlan{}, err
+	}
+
+	plan := api.TopologyPlan{
+		TopologyRevision: current.TopologyRevision,
+		Networks:         make([]api.TopologyPlanNetwork, 0),
+		Changes:          make([]api.TopologyChange, 0),
+	}
+	for _, netName := range planned.sortedNetworkNames() {
+		plan.Networks = append(plan.Networks, describeNetwork(planned.Networks[netName]))
+	}
+
+	netNames := current.sortedNetworkNames()
+	for _, netName := range planned.sortedNetworkNames() {
+		if _, ok := current.Networks[netName]; !ok {
+			netNames = append(netNames, netName)
+		}
+	}
+	sort.Strings(netNames)
+	for _, netName := range netNames {
+		plan.Changes = append(plan.Changes, diffNetwork(netName, current.Networks[netName], planned.Networks[netName])...)
+	}
+	return plan, nil
+}
+
+// describeNetwork describes the network with its tree of groups.
+func describeNetwork(network *Network) api.TopologyPlanNetwork {
+	desc := api.TopologyPlanNetwork{
+		Name:      network.Name,
+		CIDR:      network.CIDR.String(),
+		BlockMask: network.BlockMask,
+	}
+	if network.Group != nil {
+		group := describeGroup(network.Group, "root")
+		desc.Group = &group
+	}
+	return desc
+}
+
+// describeGroup describes the group at the path, and its subgroups.
+func describeGroup(hg *Group, path string) api.TopologyPlanGroup {
+	desc := api.TopologyPlanGroup{
+		Path:    path,
+		Name:    hg.Name,
+		CIDR:    hg.CIDR.String(),
+		Dummy:   hg.Dummy,
+		Routing: hg.Routing,
+	}
+	if hg.Hosts != nil {
+		blockIDs := make([]int, 0, len(hg.BlockToOwner))
+		for blockID := range hg.BlockToOwner {
+			blockIDs = append(blockIDs, blockID)
+		}
+		sort.Ints(blockIDs)
+		for _, host := range hg.Hosts {
+			hostDesc := api.TopologyPlanHost{
+				Name: host.Name,
+				IP:   host.IP,
+				CIDR: hg.CIDR.String(),
+			}
+			for _, blockID := range blockIDs {
+				if hg.BlockToHost[blockID] == host.Name {
+					hostDesc.Blocks = append(hostDesc.Blocks, hg.Blocks[blockID].CIDR.String())
+				}
+			}
+			desc.Hosts = append(desc.Hosts, hostDesc)
+		}
+	}
+	for i, group := range hg.Groups {
+		desc.Groups = append(desc.Groups, describeGroup(group, path+"."+strconv.Itoa(i)))
+	}
+	return desc
+}
+
+// flattenGroups collects groups and hosts of the tree, by path
+// and by name, respectively.
+func flattenGroups(desc *api.TopologyPlanGroup, groups map[string]api.TopologyPlanGroup, hosts map[string]api.TopologyPlanHost, hostPaths map[string]string) {
+	if desc == nil {
+		return
+	}
+	groups[desc.Path] = *desc
+	for _, host := range desc.Hosts {
+		hosts[host.Name] = host
+		hostPaths[host.Name] = desc.Path
+	}
+	for i := range desc.Groups {
+		flattenGroups(&desc.Groups[i], groups, hosts, hostPaths)
+	}
+}
+
+// sortedKeys returns the keys of both maps, sorted.
+func sortedKeys(m1 map[string]api.TopologyPlanGroup, m2 map[string]api.TopologyPlanGroup) []string {
+	keys := make([]string, 0, len(m1))
+	for key := range m1 {
+		keys = append(keys, key)
+	}
+	for key := range m2 {
+		if _, ok := m1[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffNetwork returns changes to the network, either of which
+// may be nil if it is added or removed.
+func diffNetwork(netName string, oldNet *Network, newNet *Network) []api.TopologyChange {
+	describe := func(network *Network) string {
+		return fmt.Sprintf("%s (block mask %d)", network.CIDR, network.BlockMask)
+	}
+	switch {
+	case oldNet == nil:
+		return []api.TopologyChange{{Kind: api.TopologyNetworkAdded, Network: netName, New: describe(newNet)}}
+	case newNet == nil:
+		return []api.TopologyChange{{Kind: api.TopologyNetworkRemoved, Network: netName, Old: describe(oldNet)}}
+	}
+
+	changes := make([]api.TopologyChange, 0)
+	if describe(oldNet) != describe(newNet) {
+		changes = append(changes, api.TopologyChange{
+			Kind:    api.TopologyNetworkChanged,
+			Network: netName,
+			Old:     describe(oldNet),
+			New:     describe(newNet),
+		})
+	}
+
+	oldDesc := describeNetwork(oldNet)
+	newDesc := describeNetwork(newNet)
+	oldGroups := make(map[string]api.TopologyPlanGroup)
+	newGroups := make(map[string]api.TopologyPlanGroup)
+	oldHosts := make(map[string]api.TopologyPlanHost)
+	newHosts := make(map[string]api.TopologyPlanHost)
+	oldHostPaths := make(map[string]string)
+	newHostPaths := make(map[string]string)
+	flattenGroups(oldDesc.Group, oldGroups, oldHosts, oldHostPaths)
+	flattenGroups(newDesc.Group, newGroups, newHosts, newHostPaths)
+
+	for _, path := range sortedKeys(oldGroups, newGroups) {
+		oldGroup, inOld := oldGroups[path]
+		newGroup, inNew := newGroups[path]
+		switch {
+		case !inOld:
+			changes = append(changes, api.TopologyChange{Kind: api.TopologyGroupAdded, Network: netName, Group: path, New: newGroup.CIDR})
+		case !inNew:
+			changes = append(changes, api.TopologyChange{Kind: api.TopologyGroupRemoved, Network: netName, Group: path, Old: oldGroup.CIDR})
+		case oldGroup.CIDR != newGroup.CIDR:
+			changes = append(changes, api.TopologyChange{Kind: api.TopologyGroupChanged, Network: netName, Group: path, Old: oldGroup.CIDR, New: newGroup.CIDR})
+		}
+	}
+
+	hostNames := make([]string, 0, len(oldHosts))
+	for name := range oldHosts {
+		hostNames = append(hostNames, name)
+	}
+	for name := range newHosts {
+		if _, ok := oldHosts[name]; !ok {
+			hostNames = append(hostNames, name)
+		}
+	}
+	sort.Strings(hostNames)
+	for _, name := range hostNames {
+		oldHost, inOld := oldHosts[name]
+		newHost, inNew := newHosts[name]
+		switch {
+		case !inOld:
+			changes = append(changes, api.TopologyChange{Kind: api.TopologyHostAdded, Network: netName, Group: newHostPaths[name], Host: name, New: newHost.CIDR})
+		case !inNew:
+			changes = append(changes, api.TopologyChange{Kind: api.TopologyHostRemoved, Network: netName, Group: oldHostPaths[name], Host: name, Old: oldHost.CIDR})
+		case oldHost.CIDR != newHost.CIDR || oldHostPaths[name] != newHostPaths[name]:
+			changes = append(changes, api.TopologyChange{
+				Kind:    api.TopologyHostMoved,
+				Network: netName,
+				Group:   newHostPaths[name],
+				Host:    name,
+				Old:     fmt.Sprintf("%s (group %s)", oldHost.CIDR, oldHostPaths[name]),
+				New:     fmt.Sprintf("%s (group %s)", newHost.CIDR, newHostPaths[name]),
+			})
+		}
+	}
+	return changes
+}
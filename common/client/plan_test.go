@@ -0,0 +1,97 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/romana/core/common/api"
+)
+
+func TestPlanTopology(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/16","block_mask":28}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"groups":[{"name":"host1","ip":"192.168.99.10"}]},
+    {"groups":[{"name":"host2","ip":"192.168.99.11"}]}
+  ]}]
+}`)
+	_, err := ipam.AllocateIP("a1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam.load(ipam, nil)
+	revision := ipam.TopologyRevision
+
+	req := api.TopologyUpdateRequest{}
+	err = json.Unmarshal([]byte(`{
+  "networks":[
+    {"name":"net1","cidr":"10.0.0.0/16","block_mask":28},
+    {"name":"net2","cidr":"10.1.0.0/16","block_mask":28}
+  ],
+  "topologies":[{"networks":["net1","net2"],"map":[
+    {"groups":[{"name":"host1","ip":"192.168.99.10"}]},
+    {"groups":[{"name":"host2","ip":"192.168.99.11"}]},
+    {"groups":[{"name":"host3","ip":"192.168.99.12"}]}
+  ]}]
+}`), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := ipam.PlanTopology(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.TopologyRevision != revision {
+		t.Fatalf("Expected plan for revision %d, got %d", revision, plan.TopologyRevision)
+	}
+	changes := make([]string, 0)
+	for _, change := range plan.Changes {
+		changes = append(changes, fmt.Sprintf("%s %s %s %s %s -> %s", change.Kind, change.Network, change.Group, change.Host, change.Old, change.New))
+	}
+	expected := []string{
+		"group-changed net1 root.0  10.0.0.0/17 -> 10.0.0.0/18",
+		"group-changed net1 root.1  10.0.128.0/17 -> 10.0.64.0/18",
+		"group-added net1 root.2   -> 10.0.128.0/18",
+		"group-added net1 root.3   -> 10.0.192.0/18",
+		"host-moved net1 root.0 host1 10.0.0.0/17 (group root.0) -> 10.0.0.0/18 (group root.0)",
+		"host-moved net1 root.1 host2 10.0.128.0/17 (group root.1) -> 10.0.64.0/18 (group root.1)",
+		"host-added net1 root.2 host3  -> 10.0.128.0/18",
+		"network-added net2    -> 10.1.0.0/16 (block mask 28)",
+	}
+	if fmt.Sprintf("%q", changes) != fmt.Sprintf("%q", expected) {
+		t.Fatalf("Expected changes\n%q\ngot\n%q", expected, changes)
+	}
+	host1 := plan.Networks[0].Group.Groups[0].Hosts[0]
+	if host1.Name != "host1" || fmt.Sprint(host1.Blocks) != "[10.0.0.0/28]" {
+		t.Fatalf("Expected host1 to keep block 10.0.0.0/28, got %v", host1)
+	}
+
+	// Nothing is saved.
+	ipam.load(ipam, nil)
+	if ipam.TopologyRevision != revision || ipam.Networks["net2"] != nil {
+		t.Fatalf("Expected topology to remain at revision %d, got %d with %d networks", revision, ipam.TopologyRevision, len(ipam.Networks))
+	}
+
+	// Requests are validated as when applied.
+	req.Networks[1].BlockMask = 0
+	_, err = ipam.PlanTopology(req)
+	if err == nil {
+		t.Fatalf("Expected error planning network without block mask")
+	}
+}
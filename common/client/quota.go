@@ -0,0 +1,179 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/api/errors"
+	"github.com/romana/core/common/log/trace"
+	log "github.com/romana/rlog"
+)
+
+// Quota limits the number of addresses and blocks that can be
+// allocated to a tenant or a tenant's segment. A limit of 0 means
+// unlimited. Each address of a dual-stack pair counts separately.
+type Quota struct {
+	MaxIPs    int `json:"max_ips,omitempty"`
+	MaxBlocks int `json:"max_blocks,omitempty"`
+}
+
+// quotaUsage is the number of addresses and blocks in use.
+type quotaUsage struct {
+	ips    int
+	blocks int
+}
+
+// allocatedCount returns the number of addresses allocated in the block.
+func (b Block) allocatedCount() int {
+	free := uint64(0)
+	for _, r := range b.Pool.Ranges {
+		free += r.Max - r.Min + 1
+	}
+	return int(b.CIDR.EndIPInt - b.CIDR.StartIPInt + 1 - free)
+}
+
+// quotaUsage returns usage of the tenant, and of the segment of
+// the tenant, across all networks.
+func (ipam *IPAM) quotaUsage(tenant string, segment string) (quotaUsage, quotaUsage) {
+	var tenantUsage, segmentUsage quotaUsage
+	segmentOwner := makeOwner(tenant, segment)
+	for _, network := range ipam.Networks {
+		if network.Group == nil {
+			continue
+		}
+		for _, group := range network.Group.leafGroups() {
+			for blockID, owner := range group.BlockToOwner {
+				ownerTenant, _ := parseOwner(owner)
+				if ownerTenant != tenant || blockID >= len(group.Blocks) {
+					continue
+				}
+				ips := group.Blocks[blockID].allocatedCount()
+				tenantUsage.blocks++
+				tenantUsage.ips += ips
+				if owner == segmentOwner {
+					segmentUsage.blocks++
+					segmentUsage.ips += ips
+				}
+			}
+		}
+	}
+	return tenantUsage, segmentUsage
+}
+
+// checkQuota returns a RomanaQuotaExceededError if allocating another
+// address for the owner, and, if newBlock is true, another block, would
+// exceed the quota of its tenant or segment.
+func (ipam *IPAM) checkQuota(owner string, newBlock bool) error {
+	tenant, segment := parseOwner(owner)
+	tenantQuota, tenantOk := ipam.TenantQuotas[tenant]
+	segmentQuota, segmentOk := ipam.SegmentQuotas[owner]
+	if !tenantOk && !segmentOk {
+		return nil
+	}
+	tenantUsage, segmentUsage := ipam.quotaUsage(tenant, segment)
+	check := func(quota Quota, usage quotaUsage, segment string) error {
+		scope := fmt.Sprintf("tenant %s", tenant)
+		if segment != "" {
+			scope = fmt.Sprintf("segment %s of tenant %s", segment, tenant)
+		}
+		if quota.MaxIPs > 0 && usage.ips >= quota.MaxIPs {
+			return errors.NewRomanaQuotaExceededError(
+				fmt.Sprintf("Quota of %d IPs for %s exceeded", quota.MaxIPs, scope),
+				tenant, segment, "IP", quota.MaxIPs)
+		}
+		if newBlock && quota.MaxBlocks > 0 && usage.blocks >= quota.MaxBlocks {
+			return errors.NewRomanaQuotaExceededError(
+				fmt.Sprintf("Quota of %d blocks for %s exceeded", quota.MaxBlocks, scope),
+				tenant, segment, "block", quota.MaxBlocks)
+		}
+		return nil
+	}
+	if tenantOk {
+		err := check(tenantQuota, tenantUsage, "")
+		if err != nil {
+			return err
+		}
+	}
+	if segmentOk {
+		return check(segmentQuota, segmentUsage, segment)
+	}
+	return nil
+}
+
+// SetQuota sets the quota of the tenant or, if segment is not empty,
+// of the segment of the tenant. A quota with no limits removes it.
+// Allocations already made over the new quota are kept.
+func (ipam *IPAM) SetQuota(tenant string, segment string, quota Quota) error {
+	if tenant == "" {
+		return common.NewError400("Tenant required")
+	}
+	if quota.MaxIPs < 0 || quota.MaxBlocks < 0 {
+		return common.NewError400("Quota limits cannot be negative")
+	}
+	return ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		quotas := latestIPAM.TenantQuotas
+		key := tenant
+		if segment != "" {
+			quotas = latestIPAM.SegmentQuotas
+			key = makeOwner(tenant, segment)
+		}
+		if quota.MaxIPs == 0 && quota.MaxBlocks == 0 {
+			delete(quotas, key)
+		} else {
+			quotas[key] = quota
+		}
+		log.Tracef(trace.Inside, "IPAM.SetQuota: set quota of %s to %v", key, quota)
+		return true, nil
+	})
+}
+
+// ListQuotas returns all quotas along with their current usage.
+func (ipam *IPAM) ListQuotas() []api.IPAMQuota {
+	quotas := make([]api.IPAMQuota, 0, len(ipam.TenantQuotas)+len(ipam.SegmentQuotas))
+	for tenant, quota := range ipam.TenantQuotas {
+		usage, _ := ipam.quotaUsage(tenant, "")
+		quotas = append(quotas, api.IPAMQuota{
+			Tenant:     tenant,
+			MaxIPs:     quota.MaxIPs,
+			MaxBlocks:  quota.MaxBlocks,
+			UsedIPs:    usage.ips,
+			UsedBlocks: usage.blocks,
+		})
+	}
+	for owner, quota := range ipam.SegmentQuotas {
+		tenant, segment := parseOwner(owner)
+		_, usage := ipam.quotaUsage(tenant, segment)
+		quotas = append(quotas, api.IPAMQuota{
+			Tenant:     tenant,
+			Segment:    segment,
+			MaxIPs:     quota.MaxIPs,
+			MaxBlocks:  quota.MaxBlocks,
+			UsedIPs:    usage.ips,
+			UsedBlocks: usage.blocks,
+		})
+	}
+	sort.Slice(quotas, func(i, j int) bool {
+		if quotas[i].Tenant != quotas[j].Tenant {
+			return quotas[i].Tenant < quotas[j].Tenant
+		}
+		return quotas[i].Segment < quotas[j].Segment
+	})
+	return quotas
+}
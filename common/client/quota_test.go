@@ -0,0 +1,102 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/romana/core/common/api/errors"
+)
+
+func TestQuota(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"},
+    {"name":"host2","ip":"192.168.99.11"}
+  ]}]}]
+}`)
+	err := ipam.SetQuota("ten1", "", Quota{MaxIPs: 10, MaxBlocks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.SetQuota("ten1", "seg1", Quota{MaxIPs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectQuotaError := func(err error, resource string) {
+		quotaErr, ok := err.(errors.RomanaQuotaExceededError)
+		if !ok || quotaErr.Resource != resource {
+			t.Fatalf("Expected %s quota to be exceeded, got %v", resource, err)
+		}
+		t.Logf("Got expected error: %s", err)
+	}
+
+	// Segment quota of IPs.
+	for _, name := range []string{"s1", "s2"} {
+		_, err = ipam.AllocateIP(name, "host1", "ten1", "seg1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = ipam.AllocateIP("s3", "host1", "ten1", "seg1")
+	expectQuotaError(err, "IP")
+
+	// Tenant quota of blocks: the block of seg1 and one for seg2
+	// are allowed, but not one on another host.
+	for _, name := range []string{"a1", "a2", "a3", "a4"} {
+		_, err = ipam.AllocateIP(name, "host1", "ten1", "seg2")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = ipam.AllocateIP("a5", "host1", "ten1", "seg2")
+	expectQuotaError(err, "block")
+	_, err = ipam.AllocateIP("b1", "host2", "ten1", "seg2")
+	expectQuotaError(err, "block")
+	err = ipam.AllocateSpecificIP("b2", net.ParseIP("10.128.0.1"), "host2", "ten1", "seg2")
+	expectQuotaError(err, "block")
+
+	// Other tenants are not affected.
+	_, err = ipam.AllocateIP("o1", "host2", "ten2", "seg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ipam.load(ipam, nil)
+	quotas := ipam.ListQuotas()
+	if len(quotas) != 2 {
+		t.Fatalf("Expected 2 quotas, got %v", quotas)
+	}
+	if quotas[0].Segment != "" || quotas[0].UsedIPs != 6 || quotas[0].UsedBlocks != 2 {
+		t.Fatalf("Expected 6 IPs in 2 blocks used by ten1, got %v", quotas[0])
+	}
+	if quotas[1].Segment != "seg1" || quotas[1].UsedIPs != 2 || quotas[1].UsedBlocks != 1 {
+		t.Fatalf("Expected 2 IPs in 1 block used by ten1:seg1, got %v", quotas[1])
+	}
+
+	// Removing the quota allows allocation again.
+	err = ipam.SetQuota("ten1", "", Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ipam.AllocateIP("b1", "host2", "ten1", "seg2")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
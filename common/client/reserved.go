@@ -0,0 +1,144 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/api/errors"
+)
+
+// unreservedRange returns the first and last offsets, from the start of
+// a block of the provided size (0 for 2^64), of addresses between those
+// reserved first and last by res, and false if there are none.
+func unreservedRange(res *api.BlockReservation, size uint64) (uint64, uint64, bool) {
+	last := size - 1
+	if res == nil {
+		return 0, last, true
+	}
+	if res.First > last || res.Last > last-res.First {
+		return 0, 0, false
+	}
+	return res.First, last - res.Last, true
+}
+
+// isReservedOffset checks whether the offset, from the start of a
+// block of the provided size (0 for 2^64), is of an address reserved
+// by res.
+func isReservedOffset(res *api.BlockReservation, size uint64, offset uint64) bool {
+	if res == nil {
+		return false
+	}
+	first, last, ok := unreservedRange(res, size)
+	if !ok || offset < first || offset > last {
+		return true
+	}
+	for _, o := range res.Offsets {
+		if o == offset {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedOffsets returns the sorted offsets, from the start of a
+// block of the provided size (0 for 2^64), of addresses reserved by
+// res between those reserved first and last (see unreservedRange).
+func reservedOffsets(res *api.BlockReservation, size uint64) []uint64 {
+	offsets := make([]uint64, 0)
+	first, last, ok := unreservedRange(res, size)
+	if res == nil || !ok {
+		return offsets
+	}
+	for _, offset := range res.Offsets {
+		if offset >= first && offset <= last {
+			offsets = insertSortedUint64(offsets, offset)
+		}
+	}
+	return offsets
+}
+
+// validateReservation checks that the reservation leaves at least
+// one address to allocate in the smallest block of the network.
+func validateReservation(netDef api.NetworkDefinition, bits uint) error {
+	res := netDef.Reserved
+	if res == nil {
+		return nil
+	}
+	maxMask := netDef.BlockMask
+	for _, mask := range netDef.TenantBlockMasks {
+		if mask > maxMask {
+			maxMask = mask
+		}
+	}
+	// 0 for 2^64 addresses.
+	size := hostMask(bits-maxMask) + 1
+	for _, offset := range res.Offsets {
+		if offset > size-1 {
+			return common.NewError("Reserved offset %d for %s is invalid, must be less than %d, the size of smallest block", offset, netDef.Name, size)
+		}
+	}
+	first, last, ok := unreservedRange(res, size)
+	if !ok || uint64(len(reservedOffsets(res, size))) > last-first {
+		return common.NewError("Reservation %v for %s is invalid, leaves no addresses in /%d blocks", *res, netDef.Name, maxMask)
+	}
+	return nil
+}
+
+// allocatableIDs returns the first and last IDs of the block between
+// those reserved first and last by the network's policy, and false if
+// there are none.
+func (network *Network) allocatableIDs(b *Block) (uint64, uint64, bool) {
+	first, last, ok := unreservedRange(network.Reserved, b.CIDR.size())
+	if !ok {
+		return 0, 0, false
+	}
+	return b.CIDR.StartIPInt + first, b.CIDR.StartIPInt + last, true
+}
+
+// reservedIDs returns the sorted IDs of addresses of the block reserved
+// by the network's policy between its allocatable IDs.
+func (network *Network) reservedIDs(b *Block) []uint64 {
+	offsets := reservedOffsets(network.Reserved, b.CIDR.size())
+	for i := range offsets {
+		offsets[i] += b.CIDR.StartIPInt
+	}
+	return offsets
+}
+
+// isReservedID checks whether the ID of the block is reserved by the
+// network's policy.
+func (network *Network) isReservedID(b *Block, id uint64) bool {
+	return isReservedOffset(network.Reserved, b.CIDR.size(), id-b.CIDR.StartIPInt)
+}
+
+// isReserved checks whether the IP of the block is reserved by the
+// network's policy.
+func (network *Network) isReserved(b *Block, ip net.IP) bool {
+	return network.isReservedID(b, b.CIDR.ipToInt(ip))
+}
+
+// reservedError reports that the IP may not be allocated as it is
+// reserved.
+func reservedError(ip net.IP, b *Block) error {
+	return errors.NewRomanaConflictError(
+		fmt.Sprintf("Address %s is reserved in block %s", ip, b.CIDR),
+		"IP",
+		fmt.Sprintf("IP=%s", ip))
+}
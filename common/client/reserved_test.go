@@ -0,0 +1,135 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/romana/core/common/api"
+)
+
+const reservedTopology = `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/16","block_mask":29,
+    "reserved":{"first":1,"last":1,"offsets":[3]}}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"groups":[{"name":"host1","ip":"192.168.99.10"}]}
+  ]}]
+}`
+
+func TestReservedAddresses(t *testing.T) {
+	ipam = initIpam(t, reservedTopology)
+
+	// First, last and offset 3 of each block of 8 are skipped.
+	expected := []string{"10.0.0.1", "10.0.0.2", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.9"}
+	for i, exp := range expected {
+		ip, err := ipam.AllocateIP(fmt.Sprintf("a%d", i), "host1", "ten1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != exp {
+			t.Fatalf("Expected %s, got %s", exp, ip)
+		}
+	}
+
+	err := ipam.AllocateSpecificIP("s1", net.ParseIP("10.0.0.11"), "host1", "ten1", "")
+	if err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Fatalf("Expected error allocating reserved address, got %v", err)
+	}
+	// Also in a block not yet created.
+	err = ipam.AllocateSpecificIP("s1", net.ParseIP("10.0.0.23"), "host1", "ten1", "")
+	if err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Fatalf("Expected error allocating reserved address, got %v", err)
+	}
+	err = ipam.AllocateSpecificIP("s1", net.ParseIP("10.0.0.12"), "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ipam.load(ipam, nil)
+	network := ipam.Networks["net1"]
+	block := network.Group.findHostByName("host1").group.Blocks[1]
+	available := make([]string, 0)
+	for _, addr := range block.ListAvailableAddresses(network) {
+		if addr.Reserved {
+			available = append(available, addr.IP+"*")
+		} else {
+			available = append(available, addr.IP)
+		}
+	}
+	if fmt.Sprint(available) != "[10.0.0.8* 10.0.0.10 10.0.0.11* 10.0.0.13 10.0.0.14 10.0.0.15*]" {
+		t.Fatalf("Unexpected available addresses %v", available)
+	}
+
+	// Reservations must leave addresses in the smallest block.
+	req := api.TopologyUpdateRequest{}
+	err = json.Unmarshal([]byte(strings.Replace(reservedTopology, `"block_mask":29`, `"block_mask":29,"tenant_block_masks":{"ten2":31}`, 1)), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.UpdateTopology(req, false)
+	if err == nil || !strings.Contains(err.Error(), "must be less than 2") {
+		t.Fatalf("Expected error about reserved offset, got %v", err)
+	}
+	req.Networks[0].TenantBlockMasks = nil
+	req.Networks[0].Reserved = &api.BlockReservation{First: 4, Last: 4}
+	err = ipam.UpdateTopology(req, false)
+	if err == nil || !strings.Contains(err.Error(), "leaves no addresses") {
+		t.Fatalf("Expected error about reservation leaving no addresses, got %v", err)
+	}
+	req.Networks[0].Reserved = &api.BlockReservation{First: 1 << 63, Last: 1 << 63}
+	err = ipam.UpdateTopology(req, false)
+	if err == nil || !strings.Contains(err.Error(), "leaves no addresses") {
+		t.Fatalf("Expected error about reservation leaving no addresses, got %v", err)
+	}
+}
+
+func TestLargeReservations(t *testing.T) {
+	// Blocks of 2^64 addresses.
+	netDef := api.NetworkDefinition{Name: "net6", BlockMask: 64,
+		Reserved: &api.BlockReservation{First: 1 << 63, Last: 1 << 63},
+	}
+	err := validateReservation(netDef, 128)
+	if err == nil || !strings.Contains(err.Error(), "leaves no addresses") {
+		t.Fatalf("Expected error about reservation leaving no addresses, got %v", err)
+	}
+	netDef.Reserved = &api.BlockReservation{First: 1 << 40, Last: 1 << 40, Offsets: []uint64{3, 1 << 41}}
+	err = validateReservation(netDef, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reserved offsets are checked by range, not listed.
+	for offset, reserved := range map[uint64]bool{
+		0:                      true,
+		1<<40 - 1:              true,
+		1 << 40:                false,
+		1 << 41:                true,
+		^uint64(0) - 1<<40:     false,
+		^uint64(0) - 1<<40 + 1: true,
+		^uint64(0):             true,
+	} {
+		if isReservedOffset(netDef.Reserved, 0, offset) != reserved {
+			t.Errorf("Expected offset %d to be reserved: %t", offset, reserved)
+		}
+	}
+	if offsets := reservedOffsets(netDef.Reserved, 0); fmt.Sprint(offsets) != fmt.Sprint([]uint64{1 << 41}) {
+		t.Fatalf("Expected only offset %d to be listed, got %v", uint64(1<<41), offsets)
+	}
+}
@@ -0,0 +1,922 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	libkvStore "github.com/docker/libkv/store"
+	"github.com/pborman/uuid"
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/log/trace"
+	log "github.com/romana/rlog"
+)
+
+// IPAM is stored split into shards, so that a change only rewrites the
+// parts of IPAM it changed, rather than all of it. The shards are:
+//
+//   meta                 - IPAM without networks and address names
+//   networks/<net>       - network with its topology, without allocations
+//   groups/<net>/<path>  - blocks of a group holding hosts, with names
+//                          and leases of addresses in them
+//
+// The key ipamDataKey holds a manifest listing the shards. Before
+// sharding, ipamDataKey held all of IPAM, which is still understood and
+// is migrated on startup (see initIPAM). So are names/<net> shards, which
+// held names of all addresses of a network before names were kept with
+// their groups (see migrations).
+//
+// The meta and network shards are never rewritten in place: every version
+// of them is stored under its name suffixed with a unique version, and
+// only the manifest decides which versions make up IPAM. This way, a
+// writer that loses the race for the manifest (see IPAM.update) cannot
+// clobber shards of the IPAM that won, and shards already read never need
+// to be read again.
+//
+// Where groups are stored depends on the layout in the manifest:
+//
+//   ipamShardedLayout  - in versions of their shards as well, so that the
+//                        manifest, written after them with AtomicPut, is
+//                        what commits every change. This is the layout
+//                        with stores without transactions (etcd v2 API).
+//   ipamGroupLayout    - each under a key of its own under ipamGroupsKey,
+//                        committed in a transaction over the groups that
+//                        changed, which also compares the manifest (see
+//                        Store.Commit). The manifest is only written when
+//                        topology, meta or networks change, so changes of
+//                        different groups, such as allocations on hosts
+//                        in different groups, do not conflict.
+//
+// Changes of different groups must still conflict if they are checked
+// against all of IPAM, which is not compared when only groups change.
+// With ipamGroupLayout, what such checks read is therefore also kept in
+// index shards, each under a key of its own under ipamIndexKey, which
+// are committed along with groups:
+//
+//   index/names/<bucket>     - names of addresses, in buckets by hash of
+//                              the name, to keep names unique
+//   index/tenants/<tenant>   - usage of tenants with quotas
+//   index/segments/<owner>   - usage of segments with quotas
+//
+// An allocation changes the bucket of its name and, if its tenant or
+// segment has a quota, its usage, so that allocations of the same name,
+// or under the same quota, conflict; allocations of names in different
+// buckets do not.
+//
+// As with ipamGroupLayout nothing is written on every change to keep a
+// count of them in, revisions of allocations and of networks are instead
+// the greatest index in the store of the manifest and of the groups (of
+// the network), which increases with every change too.
+
+const (
+	ipamShardsKey = ipamKey + "/shards"
+	ipamGroupsKey = ipamKey + "/groups"
+	ipamIndexKey  = ipamKey + "/index"
+
+	// Layouts of IPAM in the store, as indicated by the manifest;
+	// IPAM stored under a single key has no manifest.
+	ipamSingleKeyLayout = 0
+	ipamShardedLayout   = 1
+	ipamGroupLayout     = 2
+
+	metaShard     = "meta"
+	networkShards = "networks/"
+	groupShards   = "groups/"
+	namesShards   = "names/"
+
+	indexShards        = "index/"
+	nameIndexShards    = indexShards + "names/"
+	tenantIndexShards  = indexShards + "tenants/"
+	segmentIndexShards = indexShards + "segments/"
+
+	// How many buckets names of addresses are indexed in. With more,
+	// allocations conflict less often, but a transaction of a batch
+	// of allocations may need to change more of them.
+	nameIndexBuckets = 64
+
+	// How many times to retry reading shards if they
+	// are being written at the same time.
+	shardReadAttempts = 5
+
+	// Separates name of a shard from its version in the manifest.
+	shardVersionSeparator = "@"
+)
+
+// newShardKey returns a key to store a new version of the named shard under.
+func newShardKey(name string) string {
+	return name + shardVersionSeparator + uuid.New()
+}
+
+// shardName returns name of the shard stored under key.
+func shardName(key string) string {
+	if i := strings.LastIndex(key, shardVersionSeparator); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// ipamManifest lists shards IPAM is stored in.
+type ipamManifest struct {
+	Layout int `json:"layout"`
+	// AllocationRevision and NetworkRevisions, which are revisions
+	// of networks by their names, are only kept with
+	// ipamShardedLayout.
+	AllocationRevision int            `json:"allocation_revision"`
+	TopologyRevision   int            `json:"topology_revision"`
+	NetworkRevisions   map[string]int `json:"network_revisions,omitempty"`
+	Shards             []string       `json:"shards"`
+	// FencingTokens are the greatest tokens of locks in the store
+	// IPAM was saved under, by name of the lock (see saveIPAM).
+	FencingTokens map[string]uint64 `json:"fencing_tokens,omitempty"`
+
+	prevKVPair *libkvStore.KVPair
+}
+
+func (m *ipamManifest) GetPrevKVPair() *libkvStore.KVPair {
+	return m.prevKVPair
+}
+
+func (m *ipamManifest) SetPrevKVPair(kvp *libkvStore.KVPair) {
+	m.prevKVPair = kvp
+}
+
+// ipamLayout returns the layout IPAM is stored in with the schema
+// version; stores without transactions keep ipamShardedLayout.
+func ipamLayout(version int, transactional bool) int {
+	switch {
+	case version < 1:
+		return ipamSingleKeyLayout
+	case version < 2 || !transactional:
+		return ipamShardedLayout
+	}
+	return ipamGroupLayout
+}
+
+// storedLayout returns the layout of IPAM stored under ipamDataKey
+// with the value.
+func storedLayout(value []byte) int {
+	if manifest, ok := parseManifest(value); ok {
+		return manifest.Layout
+	}
+	return ipamSingleKeyLayout
+}
+
+// parseManifest parses the value stored under ipamDataKey as manifest.
+// It returns false if the value is IPAM stored under a single key.
+func parseManifest(value []byte) (*ipamManifest, bool) {
+	manifest := &ipamManifest{}
+	err := json.Unmarshal(value, manifest)
+	if err != nil || manifest.Layout == 0 {
+		return nil, false
+	}
+	return manifest, true
+}
+
+// groupShard holds blocks of a group holding hosts, and names and
+// leases of addresses in them. Of a dual-stack pair, the IPv6 address
+// is kept with its own group, and the lease with the IPv4 address.
+type groupShard struct {
+	BlockToOwner   map[int]string   `json:"block_to_owner"`
+	OwnerToBlocks  map[string][]int `json:"owner_to_block"`
+	BlockToHost    map[int]string   `json:"block_to_host"`
+	Blocks         []*Block         `json:"blocks"`
+	ReusableBlocks []int            `json:"reusable_blocks"`
+
+	AddressNameToIP    map[string]net.IP `json:"address_name_to_ip,omitempty"`
+	AddressNameToIPv6  map[string]net.IP `json:"address_name_to_ipv6,omitempty"`
+	AddressNameToLease map[string]*Lease `json:"address_name_to_lease,omitempty"`
+}
+
+// namesShard held address names allocated from a network, along with
+// the revision of the network, before names were kept with their
+// groups. It is only read, to load IPAM stored that way.
+type namesShard struct {
+	Revision           int               `json:"revision"`
+	AddressNameToIP    map[string]net.IP `json:"address_name_to_ip"`
+	AddressNameToIPv6  map[string]net.IP `json:"address_name_to_ipv6"`
+	AddressNameToLease map[string]*Lease `json:"address_name_to_lease"`
+}
+
+// usageShard holds usage of a tenant or segment with a quota.
+type usageShard struct {
+	IPs    int `json:"ips"`
+	Blocks int `json:"blocks"`
+}
+
+// committedKey returns the key the group or index shard of the given
+// name is stored under with ipamGroupLayout.
+func committedKey(name string) string {
+	return ipamKey + "/" + name
+}
+
+// committedShardName returns name of the group or index shard stored
+// under key, as listed from the store.
+func committedShardName(key string) string {
+	i := strings.Index(key, ipamKey+"/")
+	return key[i+len(ipamKey)+1:]
+}
+
+// nameIndexShard returns name of the index shard of the bucket
+// the address name is in.
+func nameIndexShard(addressName string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(addressName))
+	return fmt.Sprintf("%s%02x", nameIndexShards, hash.Sum32()%nameIndexBuckets)
+}
+
+// indexIPAM returns index shards of IPAM (see ipamIndexKey).
+func indexIPAM(ipam *IPAM) map[string]interface{} {
+	buckets := make(map[string][]string)
+	for addressName := range ipam.AddressNameToIP {
+		shard := nameIndexShard(addressName)
+		buckets[shard] = append(buckets[shard], addressName)
+	}
+	for addressName := range ipam.AddressNameToIPv6 {
+		if _, ok := ipam.AddressNameToIP[addressName]; !ok {
+			shard := nameIndexShard(addressName)
+			buckets[shard] = append(buckets[shard], addressName)
+		}
+	}
+
+	index := make(map[string]interface{})
+	for shard, addressNames := range buckets {
+		sort.Strings(addressNames)
+		index[shard] = addressNames
+	}
+	for tenant := range ipam.TenantQuotas {
+		usage, _ := ipam.quotaUsage(tenant, "")
+		index[tenantIndexShards+url.PathEscape(tenant)] = usageShard{IPs: usage.ips, Blocks: usage.blocks}
+	}
+	for owner := range ipam.SegmentQuotas {
+		_, usage := ipam.quotaUsage(parseOwner(owner))
+		index[segmentIndexShards+url.PathEscape(owner)] = usageShard{IPs: usage.ips, Blocks: usage.blocks}
+	}
+	return index
+}
+
+// splitGroup takes blocks of the group, and of its subgroups,
+// out of it into shards. The path identifies the group by its
+// position in the tree of groups of the network.
+func splitGroup(group *Group, networkName string, path string, shards map[string]*groupShard) {
+	if group.Hosts != nil {
+		shards[groupShards+networkName+"/"+path] = &groupShard{
+			BlockToOwner:   group.BlockToOwner,
+			OwnerToBlocks:  group.OwnerToBlocks,
+			BlockToHost:    group.BlockToHost,
+			Blocks:         group.Blocks,
+			ReusableBlocks: group.ReusableBlocks,
+
+			AddressNameToIP:    make(map[string]net.IP),
+			AddressNameToIPv6:  make(map[string]net.IP),
+			AddressNameToLease: make(map[string]*Lease),
+		}
+		group.BlockToOwner = nil
+		group.OwnerToBlocks = nil
+		group.BlockToHost = nil
+		group.Blocks = nil
+		group.ReusableBlocks = nil
+	}
+	for i, subgroup := range group.Groups {
+		splitGroup(subgroup, networkName, path+"."+strconv.Itoa(i), shards)
+	}
+}
+
+// blockShard is a block along with the group shard it is in.
+type blockShard struct {
+	cidr  *net.IPNet
+	shard string
+}
+
+// blockShards finds group shards by addresses in their blocks,
+// which are sorted by their first address.
+type blockShards []blockShard
+
+func newBlockShards(shards map[string]*groupShard) blockShards {
+	blocks := make(blockShards, 0)
+	for name, shard := range shards {
+		for _, block := range shard.Blocks {
+			if block.CIDR.IPNet != nil {
+				blocks = append(blocks, blockShard{cidr: block.CIDR.IPNet, shard: name})
+			}
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return bytes.Compare(blocks[i].cidr.IP.To16(), blocks[j].cidr.IP.To16()) < 0
+	})
+	return blocks
+}
+
+// find returns name of the shard of the group with the block
+// the address is in, or "" if it is in none.
+func (blocks blockShards) find(ip net.IP) string {
+	ip16 := ip.To16()
+	i := sort.Search(len(blocks), func(i int) bool {
+		return bytes.Compare(blocks[i].cidr.IP.To16(), ip16) > 0
+	})
+	if i > 0 && blocks[i-1].cidr.Contains(ip) {
+		return blocks[i-1].shard
+	}
+	return ""
+}
+
+// findGroupByPath returns the group identified by the path
+// (see splitGroup), or nil if there is no such group.
+func findGroupByPath(group *Group, path string) *Group {
+	elts := strings.Split(path, ".")
+	if group == nil || elts[0] != "root" {
+		return nil
+	}
+	for _, elt := range elts[1:] {
+		i, err := strconv.Atoi(elt)
+		if err != nil || i < 0 || i >= len(group.Groups) {
+			return nil
+		}
+		group = group.Groups[i]
+	}
+	return group
+}
+
+// splitIPAM returns serialized shards of IPAM, keyed by their names,
+// along with its index shards.
+func splitIPAM(ipam *IPAM) (map[string][]byte, error) {
+	shards := indexIPAM(ipam)
+
+	// Work on a copy, so that parts can be taken out of it.
+	b, err := json.Marshal(ipam)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := parseIPAM(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*groupShard)
+	for name, network := range rest.Networks {
+		if network.Group != nil {
+			splitGroup(network.Group, name, "root", groups)
+		}
+		// Revisions are kept in the manifest, if at all, so that
+		// the network shard only changes with the network.
+		network.Revison = 0
+		shards[networkShards+name] = network
+	}
+
+	// Names are kept with the group their address is in; names
+	// not in any block, if any, are left in the meta shard.
+	blocks := newBlockShards(groups)
+	for addressName, ip := range rest.AddressNameToIP {
+		shard, ok := groups[blocks.find(ip)]
+		if !ok {
+			continue
+		}
+		shard.AddressNameToIP[addressName] = ip
+		delete(rest.AddressNameToIP, addressName)
+		if lease, ok := rest.AddressNameToLease[addressName]; ok {
+			shard.AddressNameToLease[addressName] = lease
+			delete(rest.AddressNameToLease, addressName)
+		}
+	}
+	for addressName, ip := range rest.AddressNameToIPv6 {
+		shard, ok := groups[blocks.find(ip)]
+		if !ok {
+			continue
+		}
+		shard.AddressNameToIPv6[addressName] = ip
+		delete(rest.AddressNameToIPv6, addressName)
+	}
+	for name, shard := range groups {
+		shards[name] = shard
+	}
+
+	rest.Networks = make(map[string]*Network)
+	// Kept in the manifest.
+	rest.AllocationRevision = 0
+	rest.TopologyRevision = 0
+	shards[metaShard] = rest
+
+	retval := make(map[string][]byte)
+	for key, shard := range shards {
+		b, err := json.Marshal(shard)
+		if err != nil {
+			return nil, err
+		}
+		retval[key] = b
+	}
+	return retval, nil
+}
+
+// joinIPAM assembles IPAM from shards (see splitIPAM).
+func joinIPAM(shards map[string][]byte) (*IPAM, error) {
+	meta, ok := shards[metaShard]
+	if !ok {
+		return nil, common.NewError("IPAM shard %s missing", metaShard)
+	}
+	ipam := &IPAM{}
+	err := json.Unmarshal(meta, ipam)
+	if err != nil {
+		return nil, err
+	}
+	if ipam.Networks == nil {
+		ipam.Networks = make(map[string]*Network)
+	}
+	if ipam.AddressNameToIP == nil {
+		ipam.AddressNameToIP = make(map[string]net.IP)
+	}
+	if ipam.AddressNameToIPv6 == nil {
+		ipam.AddressNameToIPv6 = make(map[string]net.IP)
+	}
+	if ipam.AddressNameToLease == nil {
+		ipam.AddressNameToLease = make(map[string]*Lease)
+	}
+
+	// Networks must be in place before their groups.
+	keys := make([]string, 0, len(shards))
+	for key := range shards {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, networkShards) {
+			continue
+		}
+		network := &Network{}
+		err = json.Unmarshal(shards[key], network)
+		if err != nil {
+			return nil, err
+		}
+		ipam.Networks[strings.TrimPrefix(key, networkShards)] = network
+	}
+	for _, key := range keys {
+		switch {
+		case strings.HasPrefix(key, groupShards):
+			elts := strings.SplitN(strings.TrimPrefix(key, groupShards), "/", 2)
+			network, ok := ipam.Networks[elts[0]]
+			if !ok || len(elts) != 2 {
+				return nil, common.NewError("IPAM shard %s does not belong to any network", key)
+			}
+			group := findGroupByPath(network.Group, elts[1])
+			if group == nil {
+				return nil, common.NewError("IPAM shard %s does not belong to any group", key)
+			}
+			shard := groupShard{}
+			err = json.Unmarshal(shards[key], &shard)
+			if err != nil {
+				return nil, err
+			}
+			group.BlockToOwner = shard.BlockToOwner
+			group.OwnerToBlocks = shard.OwnerToBlocks
+			group.BlockToHost = shard.BlockToHost
+			group.Blocks = shard.Blocks
+			group.ReusableBlocks = shard.ReusableBlocks
+			for addressName, ip := range shard.AddressNameToIP {
+				ipam.AddressNameToIP[addressName] = ip
+			}
+			for addressName, ip := range shard.AddressNameToIPv6 {
+				ipam.AddressNameToIPv6[addressName] = ip
+			}
+			for addressName, lease := range shard.AddressNameToLease {
+				ipam.AddressNameToLease[addressName] = lease
+			}
+		case strings.HasPrefix(key, namesShards):
+			shard := namesShard{}
+			err = json.Unmarshal(shards[key], &shard)
+			if err != nil {
+				return nil, err
+			}
+			if network, ok := ipam.Networks[strings.TrimPrefix(key, namesShards)]; ok {
+				network.Revison = shard.Revision
+			}
+			for addressName, ip := range shard.AddressNameToIP {
+				ipam.AddressNameToIP[addressName] = ip
+			}
+			for addressName, ip := range shard.AddressNameToIPv6 {
+				ipam.AddressNameToIPv6[addressName] = ip
+			}
+			for addressName, lease := range shard.AddressNameToLease {
+				ipam.AddressNameToLease[addressName] = lease
+			}
+		}
+	}
+	prepareParsedIPAM(ipam)
+	return ipam, nil
+}
+
+// loadIPAM loads IPAM described by the value of ipamDataKey, which is
+// either a manifest of shards or, before migration, all of IPAM.
+func (c *Client) loadIPAM(kv *libkvStore.KVPair) (*IPAM, error) {
+	for attempt := 1; ; attempt++ {
+		manifest, ok := parseManifest(kv.Value)
+		if !ok {
+			ipam, err := parseIPAM(string(kv.Value))
+			if err != nil {
+				return nil, err
+			}
+			ipam.SetPrevKVPair(kv)
+			return ipam, nil
+		}
+		if manifest.Layout > ipamGroupLayout {
+			return nil, common.NewError("IPAM at %s has layout %d, only layouts up to %d are supported", ipamDataKey, manifest.Layout, ipamGroupLayout)
+		}
+
+		stored, missing, err := c.getShards(manifest.Shards)
+		if err != nil {
+			return nil, err
+		}
+		committedKVs := make([]*libkvStore.KVPair, 0)
+		if !missing && manifest.Layout == ipamGroupLayout {
+			for _, key := range []string{ipamGroupsKey, ipamIndexKey} {
+				kvs, err := c.Store.ListObjects(key)
+				if err == libkvStore.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					return nil, common.NewError("Error loading IPAM shards under %s: %s", key, err)
+				}
+				committedKVs = append(committedKVs, kvs...)
+			}
+		}
+		if missing || manifest.Layout == ipamGroupLayout {
+			// Shards of a manifest are removed once it is replaced,
+			// and groups and indexes are only valid with the manifest
+			// they were committed with, in which case the newer
+			// manifest is loaded instead.
+			latestKV, err := c.Store.Get(ipamDataKey)
+			if err != nil {
+				return nil, err
+			}
+			if latestKV.LastIndex != kv.LastIndex {
+				if attempt >= shardReadAttempts {
+					return nil, common.NewError("IPAM at %s keeps changing while being loaded", ipamDataKey)
+				}
+				log.Tracef(trace.Inside, "IPAM changed from %d to %d while loading shards, reloading", kv.LastIndex, latestKV.LastIndex)
+				kv = latestKV
+				continue
+			}
+			if missing {
+				return nil, common.NewError("IPAM at %s refers to missing shards", ipamDataKey)
+			}
+		}
+
+		shards := make(map[string][]byte)
+		for key, value := range stored {
+			shards[shardName(key)] = value
+		}
+		committedKVPairs := make(map[string]*libkvStore.KVPair)
+		for _, committedKV := range committedKVs {
+			name := committedShardName(committedKV.Key)
+			shards[name] = committedKV.Value
+			committedKVPairs[name] = committedKV
+		}
+		ipam, err := joinIPAM(shards)
+		if err != nil {
+			return nil, err
+		}
+		ipam.TopologyRevision = manifest.TopologyRevision
+		ipam.AllocationRevision = manifest.AllocationRevision
+		ipam.SetPrevKVPair(kv)
+		if manifest.Layout == ipamGroupLayout {
+			ipam.committedKVPairs = committedKVPairs
+			setIndexRevisions(ipam)
+		} else {
+			for name, revision := range manifest.NetworkRevisions {
+				if network, ok := ipam.Networks[name]; ok {
+					network.Revison = revision
+				}
+			}
+		}
+		c.shardMutex.Lock()
+		c.shardCache = stored
+		c.shardMutex.Unlock()
+		return ipam, nil
+	}
+}
+
+// setIndexRevisions sets revisions of IPAM stored with ipamGroupLayout
+// to indexes of its manifest and groups in the store. IPAM without any
+// topology keeps the allocation revision in the manifest, to tell if
+// it was ever changed (see initIPAM).
+func setIndexRevisions(ipam *IPAM) {
+	manifestIndex := uint64(0)
+	if prevKV := ipam.GetPrevKVPair(); prevKV != nil {
+		manifestIndex = prevKV.LastIndex
+	}
+	allocationRevision := manifestIndex
+	for networkName, network := range ipam.Networks {
+		revision := manifestIndex
+		for name, kv := range ipam.committedKVPairs {
+			if strings.HasPrefix(name, groupShards+networkName+"/") && kv.LastIndex > revision {
+				revision = kv.LastIndex
+			}
+		}
+		network.Revison = int(revision)
+		if revision > allocationRevision {
+			allocationRevision = revision
+		}
+	}
+	if len(ipam.Networks) > 0 || ipam.TopologyRevision > 0 {
+		ipam.AllocationRevision = int(allocationRevision)
+	}
+}
+
+// lastIndex returns the greatest index in the store of the parts
+// IPAM was loaded from, to tell if a change of them is newer.
+func (ipam *IPAM) lastIndex() uint64 {
+	index := uint64(0)
+	if prevKV := ipam.GetPrevKVPair(); prevKV != nil {
+		index = prevKV.LastIndex
+	}
+	for _, kv := range ipam.committedKVPairs {
+		if kv.LastIndex > index {
+			index = kv.LastIndex
+		}
+	}
+	return index
+}
+
+// watchIPAMChanges sends indexes of changes of IPAM in the store: of
+// its manifest and, with stores that support transactions, of groups
+// stored under keys of their own. As with ReconnectingWatch, the index
+// of the current manifest, if any, is sent first.
+func (c *Client) watchIPAMChanges(stopCh <-chan struct{}) (<-chan uint64, error) {
+	dataCh, err := c.Store.ReconnectingWatch(ipamDataKey, stopCh)
+	if err != nil {
+		return nil, err
+	}
+	// Never receives with stores that have no groups stored so.
+	var groupCh <-chan *libkvStore.KVPairExt
+	if c.Store.Transactional() {
+		groupCh, err = c.Store.ReconnectingWatchTree(ipamGroupsKey, stopCh)
+		if err != nil {
+			return nil, err
+		}
+	}
+	outCh := make(chan uint64)
+	go func() {
+		for {
+			var index uint64
+			select {
+			case <-stopCh:
+				return
+			case kv := <-dataCh:
+				index = kv.LastIndex
+			case kv := <-groupCh:
+				index = kv.LastIndex
+			}
+			select {
+			case outCh <- index:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return outCh, nil
+}
+
+// getShards gets values of shards stored under the given keys,
+// from the cache if possible. It returns true if any are missing.
+func (c *Client) getShards(keys []string) (map[string][]byte, bool, error) {
+	c.shardMutex.Lock()
+	cache := c.shardCache
+	c.shardMutex.Unlock()
+
+	stored := make(map[string][]byte)
+	for _, key := range keys {
+		if value, ok := cache[key]; ok {
+			stored[key] = value
+			continue
+		}
+		kv, err := c.Store.Get(ipamShardsKey + "/" + key)
+		if err == libkvStore.ErrKeyNotFound {
+			return nil, true, nil
+		}
+		if err != nil {
+			return nil, false, common.NewError("Error loading IPAM shard %s: %s", key, err)
+		}
+		stored[key] = kv.Value
+	}
+	return stored, false, nil
+}
+
+// saveIPAM saves IPAM in the layout of the schema version of data in
+// the store. IPAM loaded from another layout is refused, as only
+// migrations convert it, recording the version they convert it to;
+// `romana migrate` has to be run then.
+func (c *Client) saveIPAM(ipam *IPAM, locker Locker) error {
+	version, _, err := c.getSchemaVersion()
+	if err != nil {
+		return err
+	}
+	layout := ipamLayout(version, c.Store.Transactional())
+	if layout == ipamSingleKeyLayout {
+		return common.NewError("Data in the store has schema version %d, run `romana migrate` before changing IPAM", version)
+	}
+	if prevKV := ipam.GetPrevKVPair(); prevKV != nil && len(prevKV.Value) > 0 {
+		if prevLayout := storedLayout(prevKV.Value); prevLayout != layout {
+			return common.NewError("IPAM at %s has layout %d, but data in the store has schema version %d, with layout %d; run `romana migrate`", ipamDataKey, prevLayout, version, layout)
+		}
+	}
+	return c.saveIPAMLayout(ipam, locker, layout)
+}
+
+// saveIPAMLayout saves shards of IPAM that changed since IPAM was
+// loaded or saved, in the layout. Shards stored as versions are saved as their new versions, and
+// then committed along with the manifest, either by AtomicPut of the
+// manifest or, if the store supports it, in a transaction along with
+// the groups and indexes that changed (see commitShards). Versions that are no
+// longer listed in the manifest are removed; if it could not be saved,
+// these are the versions just written.
+//
+// If IPAM is saved under a lock in the store, the fencing token of the
+// lock is stored in the manifest. Saving is refused if the manifest has
+// a greater token of the lock, as the lock was taken over then; as the
+// manifest is saved with compare-and-swap, this also holds if it is
+// saved by the new holder in the meantime.
+func (c *Client) saveIPAMLayout(ipam *IPAM, locker Locker, layout int) error {
+	// Versions of shards IPAM was loaded from, by shard name.
+	prevKV := ipam.GetPrevKVPair()
+	prevKeys := make(map[string]string)
+	fencingTokens := make(map[string]uint64)
+	if prevKV != nil {
+		if prevManifest, ok := parseManifest(prevKV.Value); ok {
+			for _, key := range prevManifest.Shards {
+				prevKeys[shardName(key)] = key
+			}
+			for name, token := range prevManifest.FencingTokens {
+				fencingTokens[name] = token
+			}
+		}
+	}
+	if locker != nil && locker.Token() > 0 {
+		token := locker.Token()
+		if fencingTokens[locker.Name()] > token {
+			return common.NewError("Lock %s held with token %d was taken over, IPAM was saved with token %d", locker.Name(), token, fencingTokens[locker.Name()])
+		}
+		fencingTokens[locker.Name()] = token
+	}
+	if len(fencingTokens) == 0 {
+		fencingTokens = nil
+	}
+
+	shards, err := splitIPAM(ipam)
+	if err != nil {
+		return err
+	}
+	c.shardMutex.Lock()
+	defer c.shardMutex.Unlock()
+
+	manifest := &ipamManifest{
+		Layout:           layout,
+		TopologyRevision: ipam.TopologyRevision,
+		Shards:           make([]string, 0, len(shards)),
+		FencingTokens:    fencingTokens,
+		prevKVPair:       prevKV,
+	}
+	committed := make(map[string][]byte)
+	if layout == ipamGroupLayout {
+		for name, value := range shards {
+			if strings.HasPrefix(name, groupShards) || strings.HasPrefix(name, indexShards) {
+				committed[name] = value
+				delete(shards, name)
+			}
+		}
+	} else {
+		// Changes conflict on the manifest anyway.
+		for name := range shards {
+			if strings.HasPrefix(name, indexShards) {
+				delete(shards, name)
+			}
+		}
+		manifest.AllocationRevision = ipam.AllocationRevision
+		manifest.NetworkRevisions = make(map[string]int)
+		for name, network := range ipam.Networks {
+			manifest.NetworkRevisions[name] = network.Revison
+		}
+	}
+	stored := make(map[string][]byte)
+	written := make([]string, 0)
+	for name, value := range shards {
+		key, ok := prevKeys[name]
+		if cached, isCached := c.shardCache[key]; !ok || !isCached || !bytes.Equal(cached, value) {
+			key = newShardKey(name)
+			err = c.Store.PutObject(ipamShardsKey+"/"+key, value)
+			if err != nil {
+				c.deleteShards(written)
+				return err
+			}
+			written = append(written, key)
+		}
+		manifest.Shards = append(manifest.Shards, key)
+		stored[key] = value
+	}
+	sort.Strings(manifest.Shards)
+
+	if manifest.Layout == ipamGroupLayout {
+		err = c.commitShards(ipam, manifest, committed)
+	} else {
+		err = c.Store.AtomicPut(ipamDataKey, manifest)
+	}
+	if err != nil {
+		c.deleteShards(written)
+		return err
+	}
+	ipam.SetPrevKVPair(manifest.GetPrevKVPair())
+	if manifest.Layout == ipamGroupLayout {
+		setIndexRevisions(ipam)
+	}
+	c.shardCache = stored
+	log.Tracef(trace.Inside, "Saved %d of %d IPAM shards", len(written), len(shards))
+
+	replaced := make([]string, 0)
+	for _, key := range prevKeys {
+		if _, ok := stored[key]; !ok {
+			replaced = append(replaced, key)
+		}
+	}
+	c.deleteShards(replaced)
+	return nil
+}
+
+// commitShards commits group and index shards of IPAM that changed,
+// and the manifest if it changed, in one transaction. As these shards
+// are only valid along with the manifest they were loaded with, the
+// transaction compares it if it did not change; if it did, the
+// transaction compares all of them, as a change of topology may move
+// allocations between groups. Given that etcd limits operations in a
+// transaction to 128 by default, so are groups.
+func (c *Client) commitShards(ipam *IPAM, manifest *ipamManifest, committed map[string][]byte) error {
+	value, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	prevKV := manifest.GetPrevKVPair()
+	manifestChanged := prevKV == nil || !bytes.Equal(prevKV.Value, value)
+	ops := []StoreOp{{Key: ipamDataKey, Value: value, Previous: prevKV, CompareOnly: !manifestChanged}}
+	changed := make(map[string]bool)
+	for name, value := range committed {
+		prev := ipam.committedKVPairs[name]
+		if prev != nil && bytes.Equal(prev.Value, value) {
+			if manifestChanged {
+				ops = append(ops, StoreOp{Key: committedKey(name), Previous: prev, CompareOnly: true})
+			}
+			continue
+		}
+		ops = append(ops, StoreOp{Key: committedKey(name), Value: value, Previous: prev})
+		changed[name] = true
+	}
+	for name, prev := range ipam.committedKVPairs {
+		if _, ok := committed[name]; !ok {
+			ops = append(ops, StoreOp{Key: committedKey(name), Previous: prev})
+		}
+	}
+	index, err := c.Store.Commit(ops)
+	if err != nil {
+		return err
+	}
+	committedKVPairs := make(map[string]*libkvStore.KVPair)
+	for name, value := range committed {
+		if changed[name] {
+			committedKVPairs[name] = &libkvStore.KVPair{Key: committedKey(name), Value: value, LastIndex: index}
+		} else {
+			committedKVPairs[name] = ipam.committedKVPairs[name]
+		}
+	}
+	ipam.committedKVPairs = committedKVPairs
+	if manifestChanged {
+		manifest.SetPrevKVPair(&libkvStore.KVPair{Key: ipamDataKey, Value: value, LastIndex: index})
+	}
+	log.Tracef(trace.Inside, "Committed %d of %d IPAM group and index shards at %d, manifest changed: %t", len(changed), len(committed), index, manifestChanged)
+	return nil
+}
+
+// deleteShards removes shards stored under the given keys.
+func (c *Client) deleteShards(keys []string) {
+	for _, key := range keys {
+		_, err := c.Store.Delete(ipamShardsKey + "/" + key)
+		if err != nil {
+			// Not listed in the manifest, so harmless if left behind.
+			log.Warnf("Error removing IPAM shard %s: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	libkvStore "github.com/docker/libkv/store"
+)
+
+// memKV is a libkv store in memory, implementing only
+// what saving and loading of IPAM needs.
+type memKV struct {
+	libkvStore.Store
+	index uint64
+	kvs   map[string]*libkvStore.KVPair
+	// Keys put since last reset.
+	puts []string
+}
+
+func newMemKV() *memKV {
+	return &memKV{kvs: make(map[string]*libkvStore.KVPair)}
+}
+
+func (m *memKV) Put(key string, value []byte, options *libkvStore.WriteOptions) error {
+	m.index++
+	m.kvs[key] = &libkvStore.KVPair{Key: key, Value: value, LastIndex: m.index}
+	m.puts = append(m.puts, key)
+	return nil
+}
+
+func (m *memKV) Get(key string) (*libkvStore.KVPair, error) {
+	kv, ok := m.kvs[key]
+	if !ok {
+		return nil, libkvStore.ErrKeyNotFound
+	}
+	return kv, nil
+}
+
+func (m *memKV) Exists(key string) (bool, error) {
+	_, ok := m.kvs[key]
+	return ok, nil
+}
+
+func (m *memKV) Delete(key string) error {
+	if _, ok := m.kvs[key]; !ok {
+		return libkvStore.ErrKeyNotFound
+	}
+	delete(m.kvs, key)
+	return nil
+}
+
+func (m *memKV) AtomicPut(key string, value []byte, previous *libkvStore.KVPair, options *libkvStore.WriteOptions) (bool, *libkvStore.KVPair, error) {
+	current, ok := m.kvs[key]
+	if (previous == nil && ok) || (previous != nil && (!ok || current.LastIndex != previous.LastIndex)) {
+		return false, nil, libkvStore.ErrKeyModified
+	}
+	m.Put(key, value, options)
+	return true, m.kvs[key], nil
+}
+
+func TestShardedIPAM(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[
+    {"name":"net1","cidr":"10.0.0.0/16","block_mask":28},
+    {"name":"net2","cidr":"10.1.0.0/16","block_mask":28}
+  ],
+  "topologies":[{"networks":["net1","net2"],"map":[
+    {"groups":[{"name":"host1","ip":"192.168.99.10"}]},
+    {"groups":[{"name":"host2","ip":"192.168.99.11"}]}
+  ]}]
+}`)
+	_, err := ipam.AllocateIP("a1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ipam.AllocateIP("a2", "host2", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam.load(ipam, nil)
+
+	// Start from IPAM stored under a single key.
+	kv := newMemKV()
+	c := &Client{Store: &kvStore{prefix: "/romana", Store: kv}}
+	legacy, err := json.Marshal(ipam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Store.PutObject(ipamDataKey, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.load(ipam, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam.load = c.load
+	ipam.save = func(ipam *IPAM, ch <-chan struct{}) error { return c.saveIPAM(ipam, nil) }
+
+	// Only migrations convert the layout.
+	err = ipam.save(ipam, nil)
+	if err == nil || !strings.Contains(err.Error(), "romana migrate") {
+		t.Fatalf("Expected saving unversioned IPAM to be refused, got %v", err)
+	}
+	err = c.initSchemaVersion(SchemaVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.save(ipam, nil)
+	if err == nil || !strings.Contains(err.Error(), "romana migrate") {
+		t.Fatalf("Expected saving IPAM in an older layout to be refused, got %v", err)
+	}
+
+	// Migration writes all shards.
+	kv.puts = nil
+	err = c.saveIPAMLayout(ipam, nil, ipamShardedLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kv.puts) != 8 {
+		t.Fatalf("Expected 7 shards and the manifest to be written, got %v", kv.puts)
+	}
+	migrated := &IPAM{}
+	err = c.load(migrated, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(migrated)
+	if string(b) != string(legacy) {
+		t.Fatalf("Expected\n%s\nafter migration, got\n%s", legacy, b)
+	}
+
+	// An allocation only writes shards it changed.
+	kv.puts = nil
+	_, err = ipam.AllocateIP("a3", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make([]string, 0)
+	for _, key := range kv.puts {
+		written = append(written, shardName(strings.TrimPrefix(key, "/romana"+ipamKey+"/")))
+	}
+	sort.Strings(written)
+	expected := "[data shards/groups/net1/root.0]"
+	if fmt.Sprint(written) != expected {
+		t.Fatalf("Expected %s to be written, got %v", expected, written)
+	}
+	stale := &IPAM{}
+	err = c.load(stale, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale.AddressNameToIP["a3"] == nil || stale.AddressNameToIP["a1"] == nil {
+		t.Fatalf("Expected a1 and a3 to be allocated, got %v", stale.AddressNameToIP)
+	}
+
+	// A stale writer neither overwrites shards of the
+	// latest IPAM nor leaves its own behind.
+	_, err = ipam.AllocateIP("a4", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = stale.allocateDualStackIP("a5", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(stale, nil)
+	if err != ErrModified {
+		t.Fatalf("Expected %v saving stale IPAM, got %v", ErrModified, err)
+	}
+	latest := &IPAM{}
+	err = c.load(latest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.AddressNameToIP["a4"] == nil || latest.AddressNameToIP["a5"] != nil {
+		t.Fatalf("Expected a4 and not a5 to be allocated, got %v", latest.AddressNameToIP)
+	}
+	manifest, _ := parseManifest(latest.GetPrevKVPair().Value)
+	if len(kv.kvs) != len(manifest.Shards)+2 {
+		t.Fatalf("Expected only %d shards, the manifest and the schema version to be stored, got %d keys", len(manifest.Shards), len(kv.kvs))
+	}
+}
+
+func TestGroupCommits(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[
+    {"name":"net1","cidr":"10.0.0.0/16","block_mask":28},
+    {"name":"net2","cidr":"10.1.0.0/16","block_mask":28}
+  ],
+  "topologies":[{"networks":["net1","net2"],"map":[
+    {"groups":[{"name":"host1","ip":"192.168.99.10"}]},
+    {"groups":[{"name":"host2","ip":"192.168.99.11"}]}
+  ]}]
+}`)
+	_, err := ipam.AllocateIP("a1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam.load(ipam, nil)
+
+	c := &Client{Store: &kvStore{prefix: "/romana", Store: newLocalStore()}}
+	defer c.Store.Close()
+	err = c.initSchemaVersion(SchemaVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(ipam, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam.load = c.load
+	ipam.save = func(ipam *IPAM, ch <-chan struct{}) error { return c.saveIPAM(ipam, nil) }
+	manifestKV, err := c.Store.Get(ipamDataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest, _ := parseManifest(manifestKV.Value); manifest.Layout != ipamGroupLayout || len(manifest.Shards) != 3 {
+		t.Fatalf("Expected manifest of layout %d with meta and network shards, got %s", ipamGroupLayout, manifestKV.Value)
+	}
+	before := &IPAM{}
+	err = c.load(before, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An allocation only commits the group it changed.
+	_, err = ipam.AllocateIP("a2", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := &IPAM{}
+	err = c.load(after, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.GetPrevKVPair().LastIndex != manifestKV.LastIndex {
+		t.Fatalf("Expected manifest at %d to be left as is, got %d", manifestKV.LastIndex, after.GetPrevKVPair().LastIndex)
+	}
+	changed := make([]string, 0)
+	for name, kv := range after.committedKVPairs {
+		if strings.HasPrefix(name, groupShards) && kv.LastIndex != before.committedKVPairs[name].LastIndex {
+			changed = append(changed, name)
+		}
+	}
+	if fmt.Sprint(changed) != "[groups/net1/root.0]" {
+		t.Fatalf("Expected only groups/net1/root.0 to be committed, got %v", changed)
+	}
+	if after.AddressNameToIP["a1"] == nil || after.AddressNameToIP["a2"] == nil || after.AddressNameToLease["a2"] == nil {
+		t.Fatalf("Expected a1 and a2 to be allocated, got %v", after.AddressNameToIP)
+	}
+	if after.AllocationRevision <= before.AllocationRevision || after.Networks["net1"].Revison <= before.Networks["net1"].Revison {
+		t.Fatalf("Expected revisions to increase from %d, got %d", before.AllocationRevision, after.AllocationRevision)
+	}
+	if after.Networks["net2"].Revison != before.Networks["net2"].Revison {
+		t.Fatalf("Expected revision of net2 to stay %d, got %d", before.Networks["net2"].Revison, after.Networks["net2"].Revison)
+	}
+
+	// Changes of different groups do not conflict, but
+	// changes of the same group do.
+	if nameIndexShard("a3") == nameIndexShard("a4") {
+		t.Fatal("Expected a3 and a4 to be indexed in different buckets")
+	}
+	host1 := &IPAM{}
+	host2 := &IPAM{}
+	stale := &IPAM{}
+	for _, loaded := range []*IPAM{host1, host2, stale} {
+		err = c.load(loaded, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err = host1.allocateDualStackIP("a3", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(host1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = host2.allocateDualStackIP("a4", "host2", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(host2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = stale.allocateDualStackIP("a5", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(stale, nil)
+	if err != ErrModified {
+		t.Fatalf("Expected %v saving stale group, got %v", ErrModified, err)
+	}
+	latest := &IPAM{}
+	err = c.load(latest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.AddressNameToIP["a3"] == nil || latest.AddressNameToIP["a4"] == nil || latest.AddressNameToIP["a5"] != nil {
+		t.Fatalf("Expected a3 and a4 and not a5 to be allocated, got %v", latest.AddressNameToIP)
+	}
+
+	// A change of the manifest compares all groups,
+	// as topology may move allocations between them.
+	err = c.load(stale, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = latest.allocateDualStackIP("a6", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.saveIPAM(latest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.TopologyRevision++
+	err = c.saveIPAM(stale, nil)
+	if err != ErrModified {
+		t.Fatalf("Expected %v saving topology with stale group, got %v", ErrModified, err)
+	}
+	latest.TopologyRevision++
+	err = c.saveIPAM(latest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.GetPrevKVPair().LastIndex == manifestKV.LastIndex {
+		t.Fatal("Expected manifest to be committed with topology")
+	}
+
+	// Changes of different groups conflict if they are checked against
+	// all of IPAM, as of the same name, or under the same quota.
+	err = ipam.SetQuota("ten2", "", Quota{MaxIPs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nameIndexShard("q1") == nameIndexShard("q2") {
+		t.Fatal("Expected q1 and q2 to be indexed in different buckets")
+	}
+	saveConcurrently := func(tenant string, names ...string) int {
+		hosts := []string{"host1", "host2"}
+		loaded := make([]*IPAM, len(names))
+		for i, name := range names {
+			loaded[i] = &IPAM{}
+			err := c.load(loaded[i], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = loaded[i].allocateDualStackIP(name, hosts[i], tenant, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		errCh := make(chan error, len(loaded))
+		for _, l := range loaded {
+			go func(l *IPAM) {
+				errCh <- c.saveIPAM(l, nil)
+			}(l)
+		}
+		saved := 0
+		for range loaded {
+			err := <-errCh
+			switch err {
+			case nil:
+				saved++
+			case ErrModified:
+			default:
+				t.Fatal(err)
+			}
+		}
+		return saved
+	}
+	if saved := saveConcurrently("ten1", "dup", "dup"); saved != 1 {
+		t.Fatalf("Expected one of concurrent allocations of the same name to be saved, got %d", saved)
+	}
+	if saved := saveConcurrently("ten2", "q1", "q2"); saved != 1 {
+		t.Fatalf("Expected one of concurrent allocations under a quota of 1 IP to be saved, got %d", saved)
+	}
+	err = c.load(latest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantUsage, _ := latest.quotaUsage("ten1", "")
+	quotaUsage, _ := latest.quotaUsage("ten2", "")
+	if quotaUsage.ips != 1 {
+		t.Fatalf("Expected 1 IP to be used under quota, got %d", quotaUsage.ips)
+	}
+	if tenantUsage.ips+quotaUsage.ips != len(latest.AddressNameToIP) {
+		t.Fatalf("Expected %d IPs to be allocated, got %d", len(latest.AddressNameToIP), tenantUsage.ips+quotaUsage.ips)
+	}
+}
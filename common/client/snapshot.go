@@ -0,0 +1,111 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/api/errors"
+	log "github.com/romana/rlog"
+)
+
+const (
+	// IPAMSnapshotVersion is the version of snapshots created
+	// by Snapshot. Restore accepts snapshots of versions up to
+	// and including this one.
+	IPAMSnapshotVersion = 1
+)
+
+// Snapshot returns a copy of the current IPAM state.
+func (ipam *IPAM) Snapshot() (api.IPAMSnapshot, error) {
+	latestIPAM := &IPAM{}
+	err := ipam.load(latestIPAM, nil)
+	if err != nil {
+		return api.IPAMSnapshot{}, err
+	}
+	b, err := json.Marshal(latestIPAM)
+	if err != nil {
+		return api.IPAMSnapshot{}, err
+	}
+	return api.IPAMSnapshot{
+		Version:            IPAMSnapshotVersion,
+		CreatedBy:          common.BuildInfo(),
+		Created:            timeNow(),
+		AllocationRevision: latestIPAM.AllocationRevision,
+		TopologyRevision:   latestIPAM.TopologyRevision,
+		IPAM:               b,
+	}, nil
+}
+
+// Restore replaces the current IPAM state with the one from the snapshot.
+// The snapshot is checked for consistency first (see Check).
+// Unless overwrite is true, Restore refuses to replace a state that has
+// addresses allocated. Revisions of the restored state are advanced past
+// the current ones, so that watchers of hosts and blocks pick it up.
+func (ipam *IPAM) Restore(snapshot api.IPAMSnapshot, overwrite bool) error {
+	if snapshot.Version < 1 || snapshot.Version > IPAMSnapshotVersion {
+		return common.NewError400(fmt.Sprintf("Unsupported snapshot version %d, supported versions are 1 to %d", snapshot.Version, IPAMSnapshotVersion))
+	}
+	if len(snapshot.IPAM) == 0 {
+		return common.NewError400("Snapshot contains no IPAM data")
+	}
+	restoredIPAM, err := parseIPAM(string(snapshot.IPAM))
+	if err != nil {
+		return common.NewError400(fmt.Sprintf("Cannot parse IPAM data in snapshot: %s", err))
+	}
+	findings := restoredIPAM.check(false)
+	if len(findings) > 0 {
+		problems := make([]string, len(findings))
+		for i, finding := range findings {
+			problems[i] = finding.Message
+		}
+		return common.NewError400(fmt.Sprintf("Snapshot is inconsistent: %s", strings.Join(problems, "; ")))
+	}
+
+	err = ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		if latestIPAM.hasAllocations() && !overwrite {
+			return false, errors.NewRomanaConflictError(
+				fmt.Sprintf("Restoring snapshot would overwrite %d allocated address(es), confirmation required", len(latestIPAM.AddressNameToIP)),
+				"IPAM",
+				fmt.Sprintf("AllocationRevision=%d", latestIPAM.AllocationRevision))
+		}
+
+		// Parsed anew, as this may be retried.
+		restoredIPAM, err := parseIPAM(string(snapshot.IPAM))
+		if err != nil {
+			return false, err
+		}
+		if restoredIPAM.AllocationRevision <= latestIPAM.AllocationRevision {
+			restoredIPAM.AllocationRevision = latestIPAM.AllocationRevision + 1
+		}
+		if restoredIPAM.TopologyRevision <= latestIPAM.TopologyRevision {
+			restoredIPAM.TopologyRevision = latestIPAM.TopologyRevision + 1
+		}
+		restoredIPAM.SetPrevKVPair(latestIPAM.GetPrevKVPair())
+		restoredIPAM.committedKVPairs = latestIPAM.committedKVPairs
+		*latestIPAM = *restoredIPAM
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Restored IPAM from snapshot created at %s by %s", snapshot.Created, snapshot.CreatedBy)
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/romana/core/common/api/errors"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"},
+    {"name":"host2","ip":"192.168.99.11"}
+  ]}]}]
+}`)
+	for _, name := range []string{"pod1", "pod2"} {
+		_, err := ipam.AllocateIP(name, "host1", "ten1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot, err := ipam.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Allocations made after the snapshot are lost on restore,
+	// so confirmation is required.
+	err = ipam.DeallocateIP("pod1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ipam.AllocateIP("pod3", "host2", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam.load(ipam, nil)
+	allocRev := ipam.AllocationRevision
+	err = ipam.Restore(snapshot, false)
+	if _, ok := err.(errors.RomanaConflictError); !ok {
+		t.Fatalf("Expected RomanaConflictError, got %v", err)
+	}
+	err = ipam.Restore(snapshot, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ipam.load(ipam, nil)
+	if ipam.AllocationRevision <= allocRev {
+		t.Fatalf("Expected allocation revision past %d, got %d", allocRev, ipam.AllocationRevision)
+	}
+	if len(ipam.AddressNameToIP) != 2 || ipam.AddressNameToIP["pod1"].String() != "10.0.0.0" {
+		t.Fatalf("Expected pod1 and pod2 to be restored, got %v", ipam.AddressNameToIP)
+	}
+	ip, err := ipam.AllocateIP("pod4", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.0.0.2" {
+		t.Fatalf("Expected 10.0.0.2, got %s", ip)
+	}
+
+	snapshot.Version = IPAMSnapshotVersion + 1
+	err = ipam.Restore(snapshot, true)
+	if err == nil || !strings.Contains(err.Error(), "Unsupported snapshot version") {
+		t.Fatalf("Expected unsupported version error, got %v", err)
+	}
+}
+
+func TestSnapshotRestoreInconsistent(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/8","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"}
+  ]}]}]
+}`)
+	_, err := ipam.AllocateIP("pod1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ipam.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.IPAM = []byte(strings.Replace(string(snapshot.IPAM), `"pod1":"10.0.0.0"`, `"pod1":"10.0.0.1"`, 1))
+
+	err = ipam.Restore(snapshot, true)
+	if err == nil {
+		t.Fatal("Expected restore of inconsistent snapshot to fail")
+	}
+	for _, problem := range []string{
+		"address 10.0.0.1 of pod1 is not allocated",
+		"address 10.0.0.0 in block 10.0.0.0/30 is allocated but has no name",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Expected %q in %s", problem, err)
+		}
+	}
+}
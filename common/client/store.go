@@ -18,6 +18,7 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"runtime"
 	"strconv"
 	"strings"
@@ -32,38 +33,100 @@ import (
 	log "github.com/romana/rlog"
 )
 
-// Store is a structure storing information specific to KV-based
-// implementation of Store.
-type Store struct {
+// Backends of Store.
+const (
+	StoreEtcd   = "etcd"
+	StoreMemory = "memory"
+	StoreBolt   = "bolt"
+)
+
+// Store is the interface of the store Romana keeps its data in. Keys
+// are relative to the prefix of the store, except for keys of Ext
+// methods, which, like their libkv counterparts, are used as is.
+type Store interface {
+	Exists(key string) (bool, error)
+	Get(key string) (*libkvStore.KVPair, error)
+	// GetObject is like Get, but returns nil if the key does not exist.
+	GetObject(key string) (*libkvStore.KVPair, error)
+	GetBool(key string, defaultValue bool) (bool, error)
+	GetString(key string, defaultValue string) (string, error)
+	GetInt(key string, defaultValue int) (int, error)
+	ListObjects(key string) ([]*libkvStore.KVPair, error)
+	PutObject(key string, value []byte) error
+	AtomicPut(key string, value Atomizable) error
+	// Commit makes all changes of the ops in one transaction, and
+	// returns the index they were made at. If any of their keys was
+	// modified, nothing is changed, and ErrModified is returned.
+	Commit(ops []StoreOp) (uint64, error)
+	// Transactional returns whether the backend supports Commit.
+	Transactional() bool
+	Delete(key string) (bool, error)
+	ReconnectingWatch(key string, stopCh <-chan struct{}) (<-chan *libkvStore.KVPair, error)
+	// ReconnectingWatchTree is like ReconnectingWatch, but sends
+	// changes, including deletions, of all keys under the key.
+	ReconnectingWatchTree(key string, stopCh <-chan struct{}) (<-chan *libkvStore.KVPairExt, error)
+	NewLocker(name string) (Locker, error)
+
+	ListTreeExt(key string) ([]*libkvStore.KVPair, uint64, error)
+	WatchExt(key string, options libkvStore.WatcherOptions, stopCh <-chan struct{}) (<-chan *libkvStore.KVPairExt, error)
+
+	Close()
+}
+
+// kvStore implements Store with any libkv store: etcd (with either
+// version of its API), or a local one, in memory or in a bolt file.
+type kvStore struct {
 	prefix string
 	libkvStore.Store
-	//	etcdCli *clientv3.Client
 }
 
-func NewStore(etcdEndpoints []string, prefix string) (*Store, error) {
+// NewStore creates a Store with the backend in the config: etcd by
+// default, or memory if the config is a mock.
+func NewStore(config *common.Config) (Store, error) {
 	var err error
 
-	myStore := &Store{prefix: prefix}
-
-	myStore.Store, err = libkv.NewStore(
-		libkvStore.ETCD,
-		etcdEndpoints,
-		&libkvStore.Config{},
-	)
+	myStore := &kvStore{prefix: config.EtcdPrefix}
 
+	backend := config.StoreBackend
+	if backend == "" {
+		backend = StoreEtcd
+		if config.Mock {
+			backend = StoreMemory
+		}
+	}
+	switch backend {
+	case StoreEtcd:
+		var options *libkvStore.Config
+		options, err = etcdStoreConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		switch config.EtcdAPIVersion {
+		case 0, EtcdAPIv2:
+			myStore.Store, err = libkv.NewStore(
+				libkvStore.ETCD,
+				config.EtcdEndpoints,
+				options,
+			)
+		case EtcdAPIv3:
+			myStore.Store, err = newEtcdV3(config.EtcdEndpoints, options)
+		default:
+			return nil, common.NewError("Unsupported etcd API version %d, must be %d or %d", config.EtcdAPIVersion, EtcdAPIv2, EtcdAPIv3)
+		}
+	case StoreMemory:
+		myStore.Store = newLocalStore()
+	case StoreBolt:
+		if config.StoreFile == "" {
+			return nil, common.NewError("No file specified for %s store", StoreBolt)
+		}
+		myStore.Store, err = openBoltStore(config.StoreFile)
+	default:
+		return nil, common.NewError("Unsupported store backend %s, must be one of %s, %s, %s", backend, StoreEtcd, StoreMemory, StoreBolt)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// BEGIN EXPERIMENT...
-	//	myStore.etcdCli, err := clientv3.New(clientv3.Config{
-	//		Endpoints: etcdEndpoints,
-	//	})
-	//	if err != nil {
-	//		return nil, err
-	//	}
-	// END EXPERIMENT
-
 	// Test connection
 	_, err = myStore.Exists("test")
 	if err != nil {
@@ -91,7 +154,7 @@ func normalize(key string) string {
 }
 
 // s.getKey normalizes key and prepends prefix to it
-func (s *Store) getKey(key string) string {
+func (s *kvStore) getKey(key string) string {
 	// See https://github.com/docker/libkv/blob/master/store/helpers.go#L15
 	normalizedKey := normalize(s.prefix + "/" + key)
 	return normalizedKey
@@ -103,11 +166,11 @@ func (s *Store) getKey(key string) string {
 // prefix is added to all keys (and this is mostly so that tests can
 // run concurrently). Perhaps other things can be added later.
 
-func (s *Store) Exists(key string) (bool, error) {
+func (s *kvStore) Exists(key string) (bool, error) {
 	return s.Store.Exists(s.getKey(key))
 }
 
-func (s *Store) PutObject(key string, value []byte) error {
+func (s *kvStore) PutObject(key string, value []byte) error {
 	key = s.getKey(key)
 	log.Tracef(trace.Inside, "Saving object under key %s: %s", key, string(value))
 	return s.Store.Put(key, value, nil)
@@ -120,7 +183,21 @@ type Atomizable interface {
 	SetPrevKVPair(*libkvStore.KVPair)
 }
 
-func (s *Store) AtomicPut(key string, value Atomizable) error {
+// ErrModified is returned by AtomicPut if the value was
+// modified since it was last read or written.
+var ErrModified = errors.New("value was modified concurrently")
+
+// ErrCompacted is returned by WatchExt if changes after the index to
+// watch from are no longer kept; watches falling that far behind are
+// closed, so that watchers resuming after the last index seen get it.
+// Watchers have to list the current values again, as changes between
+// may have been missed.
+var ErrCompacted = errors.New("changes after index were compacted")
+
+// AtomicPut stores the value, provided it was not modified since it
+// was last read or written (as recorded in its previous KV pair), and
+// records the new KV pair in it. If it was, ErrModified is returned.
+func (s *kvStore) AtomicPut(key string, value Atomizable) error {
 	key = s.getKey(key)
 	b, err := json.Marshal(value)
 	if err != nil {
@@ -128,6 +205,10 @@ func (s *Store) AtomicPut(key string, value Atomizable) error {
 	}
 	prevVal := value.GetPrevKVPair()
 	ok, kvp, err := s.Store.AtomicPut(key, b, prevVal, nil)
+	if err == libkvStore.ErrKeyModified || err == libkvStore.ErrKeyExists {
+		log.Tracef(trace.Inside, "%d: AtomicPut(): Value at key %s modified concurrently", getGID(), key)
+		return ErrModified
+	}
 	if err != nil {
 		return err
 	}
@@ -143,11 +224,61 @@ func (s *Store) AtomicPut(key string, value Atomizable) error {
 	return nil
 }
 
-func (s *Store) Get(key string) (*libkvStore.KVPair, error) {
+// ErrNotTransactional is returned by Commit if the backend does not
+// support transactions, which is the case for etcd v2 API.
+var ErrNotTransactional = errors.New("store does not support transactions")
+
+// StoreOp is a change of a key made by Store.Commit.
+type StoreOp struct {
+	Key string
+	// Value to put, or nil to delete the key.
+	Value []byte
+	// Previous is the KV pair the key must still have, as last read
+	// or written; if nil, the key must not exist.
+	Previous *libkvStore.KVPair
+	// CompareOnly leaves the key as it is, only requiring that
+	// it still has the previous KV pair.
+	CompareOnly bool
+}
+
+// committer is implemented by libkv stores that can change several
+// keys in one transaction.
+type committer interface {
+	commit(ops []StoreOp) (uint64, error)
+}
+
+func (s *kvStore) Transactional() bool {
+	_, ok := s.Store.(committer)
+	return ok
+}
+
+func (s *kvStore) Commit(ops []StoreOp) (uint64, error) {
+	txn, ok := s.Store.(committer)
+	if !ok {
+		return 0, ErrNotTransactional
+	}
+	prefixed := make([]StoreOp, len(ops))
+	for i, op := range ops {
+		prefixed[i] = op
+		prefixed[i].Key = s.getKey(op.Key)
+	}
+	index, err := txn.commit(prefixed)
+	if err == libkvStore.ErrKeyModified || err == libkvStore.ErrKeyExists || err == libkvStore.ErrKeyNotFound {
+		log.Tracef(trace.Inside, "%d: Commit(): Some of %d keys modified concurrently", getGID(), len(ops))
+		return 0, ErrModified
+	}
+	if err != nil {
+		return 0, err
+	}
+	log.Tracef(trace.Inside, "%d: Commit(): Changed %d keys at %d", getGID(), len(ops), index)
+	return index, nil
+}
+
+func (s *kvStore) Get(key string) (*libkvStore.KVPair, error) {
 	return s.Store.Get(s.getKey(key))
 }
 
-func (s *Store) GetBool(key string, defaultValue bool) (bool, error) {
+func (s *kvStore) GetBool(key string, defaultValue bool) (bool, error) {
 	kvp, err := s.Store.Get(s.getKey(key))
 	if err != nil {
 		if err == libkvStore.ErrKeyNotFound {
@@ -158,7 +289,7 @@ func (s *Store) GetBool(key string, defaultValue bool) (bool, error) {
 	return common.ToBool(string(kvp.Value))
 }
 
-func (s *Store) ListObjects(key string) ([]*libkvStore.KVPair, error) {
+func (s *kvStore) ListObjects(key string) ([]*libkvStore.KVPair, error) {
 	kvps, err := s.Store.List(s.getKey(key))
 	if err != nil {
 		return nil, err
@@ -166,7 +297,7 @@ func (s *Store) ListObjects(key string) ([]*libkvStore.KVPair, error) {
 	return kvps, nil
 }
 
-func (s *Store) GetObject(key string) (*libkvStore.KVPair, error) {
+func (s *kvStore) GetObject(key string) (*libkvStore.KVPair, error) {
 	kvp, err := s.Store.Get(s.getKey(key))
 	if err != nil {
 		if err == libkvStore.ErrKeyNotFound {
@@ -177,7 +308,7 @@ func (s *Store) GetObject(key string) (*libkvStore.KVPair, error) {
 	return kvp, nil
 }
 
-func (s *Store) GetString(key string, defaultValue string) (string, error) {
+func (s *kvStore) GetString(key string, defaultValue string) (string, error) {
 	kvp, err := s.Store.Get(s.getKey(key))
 	if err != nil {
 		if err == libkvStore.ErrKeyNotFound {
@@ -188,7 +319,7 @@ func (s *Store) GetString(key string, defaultValue string) (string, error) {
 	return string(kvp.Value), nil
 }
 
-func (s *Store) GetInt(key string, defaultValue int) (int, error) {
+func (s *kvStore) GetInt(key string, defaultValue int) (int, error) {
 	kvp, err := s.Store.Get(s.getKey(key))
 	if err != nil {
 		if err == libkvStore.ErrKeyNotFound {
@@ -205,7 +336,7 @@ func (s *Store) GetInt(key string, defaultValue int) (int, error) {
 // - true if deletion succeede
 // - false and no error if deletion failed because key was not found
 // - false and error if another error occurred
-func (s *Store) Delete(key string) (bool, error) {
+func (s *kvStore) Delete(key string) (bool, error) {
 	err := s.Store.Delete(s.getKey(key))
 	if err == nil {
 		return true, nil
@@ -216,11 +347,35 @@ func (s *Store) Delete(key string) (bool, error) {
 	return false, err
 }
 
+// treeLister is implemented by libkv stores that can list a directory
+// along with the index it was listed at.
+type treeLister interface {
+	listTree(directory string) ([]*libkvStore.KVPair, uint64, error)
+}
+
+// ListTreeExt lists all key-value pairs under the key, and returns the
+// index (revision, with etcd v3 API) they were listed at, to watch for
+// changes after it. As with other Ext methods, the key is not prefixed.
+func (s *kvStore) ListTreeExt(key string) ([]*libkvStore.KVPair, uint64, error) {
+	if lister, ok := s.Store.(treeLister); ok {
+		return lister.listTree(key)
+	}
+	kvp, err := s.Store.GetExt(key, libkvStore.GetOptions{Recursive: true})
+	if err != nil {
+		return nil, 0, err
+	}
+	kvps := make([]*libkvStore.KVPair, 0)
+	for _, node := range kvp.GetResponse().Node.Nodes {
+		kvps = append(kvps, v2Leaves(node)...)
+	}
+	return kvps, kvp.LastIndex, nil
+}
+
 // END WRAPPER METHODS
 
 // ReconnectingWatch wraps libkv Watch method, but attempts to re-establish
-// the watch if it drop.
-func (s *Store) ReconnectingWatch(key string, stopCh <-chan struct{}) (<-chan *libkvStore.KVPair, error) {
+// the watch if it drop, resuming after the last index (revision) seen.
+func (s *kvStore) ReconnectingWatch(key string, stopCh <-chan struct{}) (<-chan *libkvStore.KVPair, error) {
 	outCh := make(chan *libkvStore.KVPair)
 	inCh, err := s.Watch(s.getKey(key), stopCh)
 	if err != nil {
@@ -230,45 +385,139 @@ func (s *Store) ReconnectingWatch(key string, stopCh <-chan struct{}) (<-chan *l
 	return outCh, nil
 }
 
-func (s *Store) reconnectingWatcher(key string, stopCh <-chan struct{}, inCh <-chan *libkvStore.KVPair, outCh chan *libkvStore.KVPair) {
+func (s *kvStore) reconnectingWatcher(key string, stopCh <-chan struct{}, inCh <-chan *libkvStore.KVPair, outCh chan *libkvStore.KVPair) {
 	var err error
+	var resumedCh <-chan *libkvStore.KVPairExt
 	log.Tracef(trace.Private, "Entering ReconnectingWatch goroutine: %d", getGID())
+	lastIndex := uint64(0)
 	channelClosed := false
 	retryDelay := 1 * time.Millisecond
 	for {
+		var kv *libkvStore.KVPair
+		ok := false
 		select {
 		case <-stopCh:
-			log.Info("Stop message received for WatchHosts")
+			log.Infof("Stop message received for watch on %s", key)
 			return
-		case kv, ok := <-inCh:
+		case kv, ok = <-inCh:
+		case kvExt, extOk := <-resumedCh:
+			ok = extOk
 			if ok {
-				channelClosed = false
-				outCh <- kv
+				if kvExt.Dir || kvExt.Action == "delete" {
+					continue
+				}
+				kv = &libkvStore.KVPair{Key: kvExt.Key, Value: []byte(kvExt.Value), LastIndex: kvExt.LastIndex}
+			}
+		}
+		if ok {
+			channelClosed = false
+			if kv.LastIndex > lastIndex {
+				lastIndex = kv.LastIndex
+			}
+			outCh <- kv
+			continue
+		}
+		// Not ok - channel continues to be closed
+
+		if channelClosed {
+			// We got here because we attempted to re-create
+			// a watch but it came back with a closed channel again.
+			// So we should increase the retry, and start over from
+			// the current value, in case the index to resume after
+			// is no longer available.
+			retryDelay *= 2
+			lastIndex = 0
+		} else {
+			channelClosed = true
+			retryDelay = 1 * time.Millisecond
+		}
+		log.Infof("ReconnectingWatch: Lost watch on %s, trying to re-establish after index %d...", key, lastIndex)
+		for {
+			inCh, resumedCh, err = s.resumeWatch(key, lastIndex, stopCh)
+			if err == nil {
 				break
 			}
-			// Not ok - channel continues to be closed
+			if err == ErrCompacted {
+				// Changes may have been missed, so start over
+				// from the current value.
+				log.Warnf("ReconnectingWatch: Changes of %s after index %d were compacted, watching current value", key, lastIndex)
+				lastIndex = 0
+				continue
+			}
+			log.Errorf("ReconnectingWatch: Error reconnecting: %v (%T)", err, err)
+			time.Sleep(retryDelay)
+			retryDelay *= 2
+		}
+	}
+}
 
+// resumeWatch re-establishes the watch on the key, to get values after
+// the index; if it is 0, the current value is watched for, as initially.
+// Only one of the returned channels is not nil.
+func (s *kvStore) resumeWatch(key string, afterIndex uint64, stopCh <-chan struct{}) (<-chan *libkvStore.KVPair, <-chan *libkvStore.KVPairExt, error) {
+	if afterIndex == 0 {
+		ch, err := s.Watch(s.getKey(key), stopCh)
+		return ch, nil, err
+	}
+	ch, err := s.WatchExt(s.getKey(key), libkvStore.WatcherOptions{NoList: true, AfterIndex: afterIndex}, stopCh)
+	return nil, ch, err
+}
+
+// ReconnectingWatchTree watches keys under the key, re-establishing
+// the watch after the last index seen if it drops. If changes after it
+// were compacted, the current values are sent as "get" actions before
+// changes, as they may have been missed.
+func (s *kvStore) ReconnectingWatchTree(key string, stopCh <-chan struct{}) (<-chan *libkvStore.KVPairExt, error) {
+	options := libkvStore.WatcherOptions{Recursive: true, NoList: true}
+	inCh, err := s.WatchExt(s.getKey(key), options, stopCh)
+	if err != nil {
+		return nil, err
+	}
+	outCh := make(chan *libkvStore.KVPairExt)
+	go func() {
+		channelClosed := false
+		retryDelay := 1 * time.Millisecond
+		for {
+			select {
+			case <-stopCh:
+				log.Infof("Stop message received for watch on %s", key)
+				return
+			case kv, ok := <-inCh:
+				if ok {
+					channelClosed = false
+					options.AfterIndex = kv.LastIndex
+					outCh <- kv
+					continue
+				}
+			}
+			// As in reconnectingWatcher, if the watch is lost again
+			// right away, the index may no longer be available.
 			if channelClosed {
-				// We got here because we attempted to re-create
-				// a watch but it came back with a closed channel again.
-				// So we should increase the retry
 				retryDelay *= 2
+				options.AfterIndex = 0
 			} else {
 				channelClosed = true
 				retryDelay = 1 * time.Millisecond
 			}
-			log.Infof("ReconnectingWatch: Lost watch on %s, trying to re-establish...", key)
+			log.Infof("ReconnectingWatchTree: Lost watch on %s, trying to re-establish after index %d...", key, options.AfterIndex)
 			for {
-				inCh, err = s.Watch(s.getKey(key), stopCh)
+				inCh, err = s.WatchExt(s.getKey(key), options, stopCh)
 				if err == nil {
 					break
-				} else {
-					log.Errorf("ReconnectingWatch: Error reconnecting: %v (%T)", err, err)
-					retryDelay *= 2
 				}
+				if err == ErrCompacted {
+					log.Warnf("ReconnectingWatchTree: Changes under %s after index %d were compacted, listing current values", key, options.AfterIndex)
+					options.AfterIndex = 0
+					options.NoList = false
+					continue
+				}
+				log.Errorf("ReconnectingWatchTree: Error reconnecting: %v (%T)", err, err)
+				time.Sleep(retryDelay)
+				retryDelay *= 2
 			}
 		}
-	}
+	}()
+	return outCh, nil
 }
 
 // Locker implements an interface for locking and unlocking.
@@ -279,15 +528,18 @@ func (s *Store) reconnectingWatcher(key string, stopCh <-chan struct{}, inCh <-c
 type Locker interface {
 	Lock() (<-chan struct{}, error)
 	Unlock()
-	GetOwner() uint64
-}
-
-// storeLocker implements Locker interface using the
-// lock form the backend store.
-type storeLocker struct {
-	key   string
-	owner uint64
-	libkvStore.Locker
+	// Token returns the fencing token of the current acquisition
+	// of the lock, which increases with every acquisition, or 0
+	// if the lock is not held.
+	Token() uint64
+	// Fence returns an error if the lock is no longer held with
+	// the current token. As it is checked separately from writes,
+	// writes guarded by the lock are only fenced if they store the
+	// token and are refused when a greater one is stored already
+	// (see saveIPAM).
+	Fence() error
+	// Name returns the name of the lock, which tokens are of.
+	Name() string
 }
 
 // See https://blog.sgmansfield.com/2015/12/goroutine-ids/
@@ -300,63 +552,32 @@ func getGID() uint64 {
 	return n
 }
 
-func (sl *storeLocker) GetOwner() uint64 {
-	return sl.owner
+// lockMaker is implemented by libkv stores that have locks of their
+// own, with fencing tokens.
+type lockMaker interface {
+	newLocker(name string, key string) Locker
 }
 
-// Lock implements Lock method of Locker interface.
-func (sl *storeLocker) Lock() (<-chan struct{}, error) {
-	stopChan := make(chan struct{})
-	ch, err := sl.Locker.Lock(stopChan)
-	if err == nil {
-		sl.owner = getGID()
-		log.Tracef(trace.Inside, "%d: Got lock for %s (owned by %d)", getGID(), sl.key, sl.owner)
-	} else {
-		log.Tracef(trace.Inside, "%d: Error getting lock for %s: %s", getGID(), sl.key, err)
-	}
-	return ch, err
-}
-
-// Unlock implements Unlock method of Locker interface.
-func (sl *storeLocker) Unlock() {
-	prevOwner := sl.owner
-	sl.owner = 0
-	err := sl.Locker.Unlock()
-	if err != nil {
-		sl.owner = prevOwner
-		//		switch err := err.(type) {
-		//		case etcd.Error:
-		//			if err.Code == etcd.ErrorCodeKeyNotFound {
-		//				// If key is not found, then we did not hold the lock to begin with,
-		//				// and unlock was called by a defer...
-		//			}
-		//		default:
-		//			log.Errorf("%d: Error unlocking %s: %s (%T)", sl.key, err, err)
-		//		}
-		log.Errorf("%d: Error unlocking %s: %s (%T)", getGID(), sl.key, err, err)
-
-	} else {
-		log.Tracef(trace.Inside, "%d: Unlocked lock %s (owned by %d)", getGID(), sl.key, prevOwner)
-	}
-}
-
-func (store *Store) NewLocker(name string) (Locker, error) {
-	key := store.getKey("/lock/" + name)
-	l, err := store.Store.NewLock(key, nil)
-	if err != nil {
-		return nil, err
+// NewLocker returns a lock in the store, shared by all processes using
+// the store: a lock of the store itself if it has them (with etcd v3
+// API), otherwise a lock with a lease kept in the store. These are for
+// what must not be done by several processes at once, such as
+// initializing IPAM or migrating data. Changes of IPAM are not made
+// under them, but saved with compare-and-swap instead (see IPAM.update).
+func (store *kvStore) NewLocker(name string) (Locker, error) {
+	if maker, ok := store.Store.(lockMaker); ok {
+		return maker.newLocker(name, store.getKey("/lock/"+name)), nil
 	}
-	return &storeLocker{key: key, Locker: l}, nil
+	return &leaseLocker{store: store.Store,
+		name:   name,
+		key:    store.getKey("/lease/" + name),
+		holder: lockHolder(),
+	}, nil
 }
 
 // mutexLocker implements Locker interface with a sync.Mutex
 type mutexLocker struct {
 	mutex *sync.Mutex
-	owner uint64
-}
-
-func (ml *mutexLocker) GetOwner() uint64 {
-	return ml.owner
 }
 
 // Lock implements Lock method of Locker interface.
@@ -366,16 +587,30 @@ func (ml *mutexLocker) Lock() (<-chan struct{}, error) {
 		ml.mutex = &sync.Mutex{}
 	}
 	ml.mutex.Lock()
-	ml.owner = getGID()
 	return ch, nil
 }
 
 // Unlock implements Unlock method of Locker interface.
 func (ml *mutexLocker) Unlock() {
-	ml.owner = 0
 	ml.mutex.Unlock()
 }
 
+// Token implements Token method of Locker interface. A mutex is
+// only held within the process, so it needs no fencing.
+func (ml *mutexLocker) Token() uint64 {
+	return 0
+}
+
+// Fence implements Fence method of Locker interface.
+func (ml *mutexLocker) Fence() error {
+	return nil
+}
+
+// Name implements Name method of Locker interface.
+func (ml *mutexLocker) Name() string {
+	return ""
+}
+
 func newMutexLocker() *mutexLocker {
 	return &mutexLocker{mutex: &sync.Mutex{}}
 }
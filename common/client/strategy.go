@@ -0,0 +1,214 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/client/idring"
+)
+
+// maxFreedHistory is how many freed addresses a block remembers
+// for the least-recently-freed strategy. Addresses forgotten are
+// treated as never allocated, that is, freed the longest ago.
+const maxFreedHistory = 1024
+
+// addressRand is the source of randomness for the random address
+// selection strategy.
+var addressRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// SeedAddressSelection seeds the source of randomness of the random
+// address selection strategy, making the selection deterministic.
+func SeedAddressSelection(seed int64) {
+	addressRand.Lock()
+	defer addressRand.Unlock()
+	addressRand.Rand = rand.New(rand.NewSource(seed))
+}
+
+func randomUint64n(n uint64) uint64 {
+	addressRand.Lock()
+	defer addressRand.Unlock()
+	return addressRand.Uint64() % n
+}
+
+// insertSortedUint64 inserts i into the sorted slice, keeping it sorted.
+func insertSortedUint64(s []uint64, i uint64) []uint64 {
+	idx := sort.Search(len(s), func(j int) bool { return s[j] >= i })
+	if idx < len(s) && s[idx] == i {
+		return s
+	}
+	s = append(s, 0)
+	copy(s[idx+1:], s[idx:])
+	s[idx] = i
+	return s
+}
+
+// isFree returns true if the ID is not allocated from the block.
+func (b *Block) isFree(id uint64) bool {
+	for _, r := range b.Pool.Ranges {
+		if id >= r.Min && id <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// freeRanges returns the ranges of free IDs of the block, limited to
+// those between min and max.
+func (b *Block) freeRanges(min uint64, max uint64) []idring.Range {
+	ranges := make([]idring.Range, 0, len(b.Pool.Ranges))
+	for _, r := range b.Pool.Ranges {
+		if r.Max < min || r.Min > max {
+			continue
+		}
+		if r.Min < min {
+			r.Min = min
+		}
+		if r.Max > max {
+			r.Max = max
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// excludedIn returns IDs of excluded, which must be sorted, that
+// are between min and max.
+func excludedIn(excluded []uint64, min uint64, max uint64) []uint64 {
+	start := sort.Search(len(excluded), func(i int) bool { return excluded[i] >= min })
+	end := sort.Search(len(excluded), func(i int) bool { return excluded[i] > max })
+	return excluded[start:end]
+}
+
+// freeCount returns the number of free IDs in the ranges that
+// are not in excluded, which must be sorted.
+func freeCount(ranges []idring.Range, excluded []uint64) uint64 {
+	count := uint64(0)
+	for _, r := range ranges {
+		count += r.Max - r.Min + 1 - uint64(len(excludedIn(excluded, r.Min, r.Max)))
+	}
+	return count
+}
+
+// freeCountUpTo returns the number of free IDs in the ranges up to
+// and including max that are not in excluded, which must be sorted.
+func freeCountUpTo(ranges []idring.Range, max uint64, excluded []uint64) uint64 {
+	count := uint64(0)
+	for _, r := range ranges {
+		if r.Min > max {
+			break
+		}
+		rMax := r.Max
+		if rMax > max {
+			rMax = max
+		}
+		count += rMax - r.Min + 1 - uint64(len(excludedIn(excluded, r.Min, rMax)))
+	}
+	return count
+}
+
+// nthFree returns the n-th (from 0) lowest free ID in the ranges
+// that is not in excluded, which must be sorted.
+func nthFree(ranges []idring.Range, n uint64, excluded []uint64) (uint64, bool) {
+	for _, r := range ranges {
+		rExcluded := excludedIn(excluded, r.Min, r.Max)
+		available := r.Max - r.Min + 1 - uint64(len(rExcluded))
+		if n >= available {
+			n -= available
+			continue
+		}
+		id := r.Min + n
+		for _, e := range rExcluded {
+			if e > id {
+				break
+			}
+			id++
+		}
+		return id, true
+	}
+	return 0, false
+}
+
+// selectID selects a free ID of the block between min and max, other
+// than those in excluded, which must be sorted, according to the
+// strategy. It returns false if there is none.
+func (b *Block) selectID(strategy string, min uint64, max uint64, excluded []uint64) (uint64, bool) {
+	ranges := b.freeRanges(min, max)
+	switch strategy {
+	case api.AddressSelectionNextAfterLast:
+		n := freeCountUpTo(ranges, b.LastAllocated, excluded)
+		if n >= freeCount(ranges, excluded) {
+			n = 0
+		}
+		return nthFree(ranges, n, excluded)
+	case api.AddressSelectionRandom:
+		count := freeCount(ranges, excluded)
+		if count == 0 {
+			return 0, false
+		}
+		return nthFree(ranges, randomUint64n(count), excluded)
+	case api.AddressSelectionLeastRecentlyFreed:
+		// Addresses never freed first.
+		excludedAndFreed := append([]uint64{}, excluded...)
+		for _, id := range b.Freed {
+			if b.isFree(id) {
+				excludedAndFreed = insertSortedUint64(excludedAndFreed, id)
+			}
+		}
+		if id, ok := nthFree(ranges, 0, excludedAndFreed); ok {
+			return id, true
+		}
+		for _, id := range b.Freed {
+			if id >= min && id <= max && len(excludedIn(excluded, id, id)) == 0 && b.isFree(id) {
+				return id, true
+			}
+		}
+		return 0, false
+	}
+	return nthFree(ranges, 0, excluded)
+}
+
+// taken records that the ID was allocated.
+func (b *Block) taken(id uint64) {
+	b.LastAllocated = id
+	for i, freed := range b.Freed {
+		if freed == id {
+			b.Freed = append(b.Freed[:i], b.Freed[i+1:]...)
+			break
+		}
+	}
+}
+
+// freed records that the ID was freed.
+func (b *Block) freed(id uint64) {
+	for i, freed := range b.Freed {
+		if freed == id {
+			b.Freed = append(b.Freed[:i], b.Freed[i+1:]...)
+			break
+		}
+	}
+	b.Freed = append(b.Freed, id)
+	if len(b.Freed) > maxFreedHistory {
+		b.Freed = b.Freed[len(b.Freed)-maxFreedHistory:]
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/romana/core/common/api"
+)
+
+func initStrategyIpam(t *testing.T, strategy string) *IPAM {
+	return initIpam(t, fmt.Sprintf(`{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/28","block_mask":29,"address_selection":"%s"}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"}
+  ]}]}]
+}`, strategy))
+}
+
+func TestAddressSelection(t *testing.T) {
+	testCases := []struct {
+		strategy string
+		// Addresses are allocated for names, or, for names
+		// starting with "-", the name is deallocated.
+		ops      []string
+		expected []string
+	}{
+		{
+			strategy: api.AddressSelectionLowestFree,
+			ops:      []string{"a", "b", "c", "-a", "d"},
+			expected: []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.0"},
+		},
+		{
+			strategy: api.AddressSelectionNextAfterLast,
+			ops:      []string{"a", "b", "c", "-a", "d", "e", "f", "g", "h", "i"},
+			expected: []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4",
+				"10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.0"},
+		},
+		{
+			strategy: api.AddressSelectionLeastRecentlyFreed,
+			ops:      []string{"a", "b", "c", "-b", "-a", "d", "e", "f", "g", "h", "i", "j"},
+			expected: []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4",
+				"10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.1", "10.0.0.0"},
+		},
+	}
+	for _, tc := range testCases {
+		ipam = initStrategyIpam(t, tc.strategy)
+		allocated := make([]string, 0)
+		for _, op := range tc.ops {
+			if op[0] == '-' {
+				err := ipam.DeallocateIP(op[1:])
+				if err != nil {
+					t.Fatalf("%s: %s", tc.strategy, err)
+				}
+				continue
+			}
+			ip, err := ipam.AllocateIP(op, "host1", "ten1", "")
+			if err != nil {
+				t.Fatalf("%s: %s", tc.strategy, err)
+			}
+			allocated = append(allocated, ip.String())
+		}
+		if fmt.Sprint(allocated) != fmt.Sprint(tc.expected) {
+			t.Fatalf("%s: expected %v, got %v", tc.strategy, tc.expected, allocated)
+		}
+	}
+}
+
+func TestAddressSelectionRandom(t *testing.T) {
+	allocate := func() []string {
+		SeedAddressSelection(42)
+		ipam = initStrategyIpam(t, api.AddressSelectionRandom)
+		err := ipam.BlackOut("10.0.0.4/31")
+		if err != nil {
+			t.Fatal(err)
+		}
+		allocated := make([]string, 0)
+		seen := make(map[string]bool)
+		for i := 0; i < 6; i++ {
+			ip, err := ipam.AllocateIP(fmt.Sprintf("a%d", i), "host1", "ten1", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[ip.String()] || ip.String() == "10.0.0.4" || ip.String() == "10.0.0.5" {
+				t.Fatalf("Unexpected address %s allocated after %v", ip, allocated)
+			}
+			seen[ip.String()] = true
+			allocated = append(allocated, ip.String())
+		}
+		// The block is exhausted, the next address comes from a new one.
+		ip, err := ipam.AllocateIP("a6", "host1", "ten1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip[len(ip)-1] < 8 {
+			t.Fatalf("Expected address from 10.0.0.8/29, got %s", ip)
+		}
+		return allocated
+	}
+	first := allocate()
+	second := allocate()
+	t.Logf("Allocated %v", first)
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatalf("Expected same addresses with same seed, got %v and %v", first, second)
+	}
+}
+
+func TestAddressSelectionUnknown(t *testing.T) {
+	ipam = initIpam(t, `{"networks":[{"name":"net1","cidr":"10.0.0.0/28","block_mask":29}]}`)
+	err := ipam.UpdateTopology(api.TopologyUpdateRequest{
+		Networks: []api.NetworkDefinition{
+			{Name: "net1", CIDR: "10.0.0.0/28", BlockMask: 29, AddressSelection: "highest-free"},
+		},
+	}, false)
+	if err == nil {
+		t.Fatal("Expected error for unknown address selection strategy")
+	}
+	t.Logf("Got expected error: %s", err)
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	libkvStore "github.com/docker/libkv/store"
+	"github.com/romana/core/common"
+	log "github.com/romana/rlog"
+)
+
+// tlsReloadInterval is how often files of TLS material are checked
+// for changes, at most.
+var tlsReloadInterval = 10 * time.Second
+
+// etcdTLS holds the client certificate and CA bundle used to connect
+// to etcd, reloading them when their files change on disk, so that
+// they can be rotated without restarting.
+type etcdTLS struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mutex    sync.Mutex
+	checked  time.Time
+	modTimes map[string]time.Time
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+}
+
+// etcdStoreConfig returns the libkv config to connect to etcd with,
+// with TLS if the config has any TLS files, and credentials if it has
+// a username.
+func etcdStoreConfig(config *common.Config) (*libkvStore.Config, error) {
+	options := &libkvStore.Config{
+		Username: config.EtcdUsername,
+		Password: config.EtcdPassword,
+	}
+	if config.EtcdCertFile == "" && config.EtcdKeyFile == "" && config.EtcdCAFile == "" {
+		return options, nil
+	}
+	if (config.EtcdCertFile == "") != (config.EtcdKeyFile == "") {
+		return nil, common.NewError("Both certificate and key files are required for etcd client authentication")
+	}
+	t := &etcdTLS{certFile: config.EtcdCertFile,
+		keyFile:  config.EtcdKeyFile,
+		caFile:   config.EtcdCAFile,
+		modTimes: make(map[string]time.Time),
+	}
+	err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	options.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.certFile != "" {
+		options.TLS.GetClientCertificate = t.getClientCertificate
+	}
+	if t.caFile != "" {
+		// Verification against the CA bundle is done in
+		// verifyConnection instead, so that the bundle can
+		// change between connections.
+		options.TLS.InsecureSkipVerify = true
+		options.TLS.VerifyConnection = t.verifyConnection
+	}
+	return options, nil
+}
+
+// load reads the files. Must be called with the mutex held, except
+// before the config is in use.
+func (t *etcdTLS) load() error {
+	if t.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return common.NewError("Error loading etcd client certificate from %s and %s: %s", t.certFile, t.keyFile, err)
+		}
+		t.cert = &cert
+	}
+	if t.caFile != "" {
+		pem, err := ioutil.ReadFile(t.caFile)
+		if err != nil {
+			return common.NewError("Error loading etcd CA bundle: %s", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return common.NewError("No certificates found in etcd CA bundle %s", t.caFile)
+		}
+		t.roots = roots
+	}
+	t.changed()
+	t.checked = time.Now()
+	return nil
+}
+
+// changed records modification times of the files, and returns
+// whether any changed since they were last recorded.
+func (t *etcdTLS) changed() bool {
+	changed := false
+	for _, file := range []string{t.certFile, t.keyFile, t.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			// Files may briefly be missing while rotated.
+			continue
+		}
+		if !info.ModTime().Equal(t.modTimes[file]) {
+			t.modTimes[file] = info.ModTime()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// reload loads the files again if they changed. If they cannot be
+// loaded, for example as they are being rotated, the previous ones
+// are kept.
+func (t *etcdTLS) reload() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if time.Since(t.checked) < tlsReloadInterval {
+		return
+	}
+	t.checked = time.Now()
+	if !t.changed() {
+		return
+	}
+	err := t.load()
+	if err != nil {
+		log.Errorf("Keeping previous etcd TLS material: %s", err)
+		// Try again on the next check.
+		t.modTimes = make(map[string]time.Time)
+		return
+	}
+	log.Infof("Reloaded etcd TLS material")
+}
+
+func (t *etcdTLS) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	t.reload()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.cert, nil
+}
+
+// verifyConnection verifies the certificate of the etcd server against
+// the CA bundle, as crypto/tls would if the bundle were in RootCAs.
+func (t *etcdTLS) verifyConnection(cs tls.ConnectionState) error {
+	t.reload()
+	t.mutex.Lock()
+	roots := t.roots
+	t.mutex.Unlock()
+	if len(cs.PeerCertificates) == 0 {
+		return common.NewError("etcd server %s presented no certificate", cs.ServerName)
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
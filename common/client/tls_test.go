@@ -0,0 +1,165 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/romana/core/common"
+)
+
+// testCert creates a certificate for the name, signed by the parent,
+// or self-signed if parent is nil.
+func testCert(t *testing.T, name string, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	parentCert, parentKey := template, interface{}(key)
+	if parent != nil {
+		parentCert = parent.Leaf
+		parentKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCert writes the certificate and, if keyFile is not empty, its
+// key in PEM, with modification time mtime.
+func writeCert(t *testing.T, cert *tls.Certificate, certFile string, keyFile string, mtime time.Time) {
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, mtime, mtime)
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, mtime, mtime)
+}
+
+func TestEtcdTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedInterval := tlsReloadInterval
+	tlsReloadInterval = 0
+	defer func() { tlsReloadInterval = savedInterval }()
+
+	config := &common.Config{EtcdCertFile: filepath.Join(dir, "client.pem")}
+	_, err = etcdStoreConfig(config)
+	if err == nil {
+		t.Fatal("Expected error for certificate without key")
+	}
+
+	ca := testCert(t, "ca", nil)
+	client1 := testCert(t, "client", ca)
+	server := testCert(t, "etcd", ca)
+	config.EtcdKeyFile = filepath.Join(dir, "client-key.pem")
+	config.EtcdCAFile = filepath.Join(dir, "ca.pem")
+	config.EtcdUsername = "romana"
+	writeCert(t, ca, config.EtcdCAFile, "", time.Now().Add(-time.Minute))
+	writeCert(t, client1, config.EtcdCertFile, config.EtcdKeyFile, time.Now().Add(-time.Minute))
+
+	options, err := etcdStoreConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Username != "romana" || options.TLS == nil {
+		t.Fatalf("Unexpected options %+v", options)
+	}
+	cert, err := options.TLS.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert.Certificate[0]) != string(client1.Certificate[0]) {
+		t.Fatal("Unexpected client certificate")
+	}
+	state := tls.ConnectionState{ServerName: "etcd", PeerCertificates: []*x509.Certificate{server.Leaf}}
+	err = options.TLS.VerifyConnection(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.ServerName = "other"
+	if options.TLS.VerifyConnection(state) == nil {
+		t.Fatal("Expected verification of wrong server name to fail")
+	}
+
+	// Rotate the CA and the client certificate.
+	ca2 := testCert(t, "ca2", nil)
+	client2 := testCert(t, "client", ca2)
+	server2 := testCert(t, "etcd", ca2)
+	writeCert(t, ca2, config.EtcdCAFile, "", time.Now())
+	writeCert(t, client2, config.EtcdCertFile, config.EtcdKeyFile, time.Now())
+
+	cert, err = options.TLS.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert.Certificate[0]) != string(client2.Certificate[0]) {
+		t.Fatal("Expected rotated client certificate")
+	}
+	state = tls.ConnectionState{ServerName: "etcd", PeerCertificates: []*x509.Certificate{server2.Leaf}}
+	err = options.TLS.VerifyConnection(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.PeerCertificates = []*x509.Certificate{server.Leaf}
+	if options.TLS.VerifyConnection(state) == nil {
+		t.Fatal("Expected server certificate of previous CA to be rejected")
+	}
+}
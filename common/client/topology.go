@@ -0,0 +1,208 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/log/trace"
+	log "github.com/romana/rlog"
+)
+
+// allocatedBlock is a block that has addresses allocated from it,
+// along with its owner and the host it belongs to.
+type allocatedBlock struct {
+	block *Block
+	owner string
+	host  string
+}
+
+func (ab allocatedBlock) String() string {
+	return fmt.Sprintf("%s (owner %s, host %s)", ab.block.CIDR, ab.owner, ab.host)
+}
+
+// allocatedBlocks returns all blocks of this group and its subgroups
+// that have addresses allocated from them.
+func (hg *Group) allocatedBlocks() []allocatedBlock {
+	retval := make([]allocatedBlock, 0)
+	if hg.Hosts != nil {
+		blockIDs := make([]int, 0, len(hg.BlockToOwner))
+		for blockID := range hg.BlockToOwner {
+			blockIDs = append(blockIDs, blockID)
+		}
+		sort.Ints(blockIDs)
+		for _, blockID := range blockIDs {
+			retval = append(retval, allocatedBlock{
+				block: hg.Blocks[blockID],
+				owner: hg.BlockToOwner[blockID],
+				host:  hg.BlockToHost[blockID],
+			})
+		}
+		return retval
+	}
+	for _, group := range hg.Groups {
+		retval = append(retval, group.allocatedBlocks()...)
+	}
+	return retval
+}
+
+// adoptBlocks adds the provided blocks, all of which must be within
+// the CIDR of this group, to this group. Gaps between the blocks are
+// left for new blocks to be carved out of (see findBlockSpace).
+func (hg *Group) adoptBlocks(network *Network, blocks []allocatedBlock) error {
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].block.CIDR.StartIPInt < blocks[j].block.CIDR.StartIPInt
+	})
+	for _, ab := range blocks {
+		for _, block := range hg.Blocks {
+			if block.CIDR.StartIPInt <= ab.block.CIDR.EndIPInt && ab.block.CIDR.StartIPInt <= block.CIDR.EndIPInt {
+				return common.NewError("Cannot fit block %s into %s, it overlaps %s", ab.block.CIDR, hg.CIDR, block.CIDR)
+			}
+		}
+		hg.Blocks = append(hg.Blocks, ab.block)
+		blockID := len(hg.Blocks) - 1
+		hg.BlockToOwner[blockID] = ab.owner
+		hg.OwnerToBlocks[ab.owner] = append(hg.OwnerToBlocks[ab.owner], blockID)
+		hg.BlockToHost[blockID] = ab.host
+		log.Tracef(trace.Inside, "Block %s moved to group %s", ab, hg.CIDR)
+	}
+	return nil
+}
+
+// hasAllocations returns true if any addresses are allocated.
+func (ipam *IPAM) hasAllocations() bool {
+	if len(ipam.AddressNameToIP) > 0 {
+		return true
+	}
+	for _, network := range ipam.Networks {
+		if network.Group != nil && len(network.Group.allocatedBlocks()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateAllocations carries hosts and allocated blocks of this IPAM over
+// into the topology of newIPAM. Hosts not explicitly present in the new
+// topology are re-added to it based on assignment rules. An allocated block
+// moves with its host, provided the new group of the host contains it. If
+// any allocated block cannot be moved, an error listing all such blocks is
+// returned.
+func (ipam *IPAM) migrateAllocations(newIPAM *IPAM) error {
+	orphans := make([]string, 0)
+	networkNames := make([]string, 0, len(ipam.Networks))
+	for name := range ipam.Networks {
+		networkNames = append(networkNames, name)
+	}
+	sort.Strings(networkNames)
+
+	for _, name := range networkNames {
+		oldNetwork := ipam.Networks[name]
+		if oldNetwork.Group == nil {
+			continue
+		}
+		blocks := oldNetwork.Group.allocatedBlocks()
+		orphan := func(ab allocatedBlock, reason string, args ...interface{}) {
+			orphans = append(orphans, fmt.Sprintf("%s in network %s: %s", ab, name, fmt.Sprintf(reason, args...)))
+		}
+
+		network, ok := newIPAM.Networks[name]
+		if !ok || network.Group == nil {
+			for _, ab := range blocks {
+				orphan(ab, "network removed from topology")
+			}
+			continue
+		}
+		if network.CIDR.String() != oldNetwork.CIDR.String() || network.BlockMask != oldNetwork.BlockMask {
+			for _, ab := range blocks {
+				orphan(ab, "network CIDR or block mask changed from %s/%d to %s/%d",
+					oldNetwork.CIDR, oldNetwork.BlockMask, network.CIDR, network.BlockMask)
+			}
+			continue
+		}
+		network.BlackedOut = oldNetwork.BlackedOut
+		network.Blackouts = oldNetwork.Blackouts
+		network.Revison = oldNetwork.Revison
+
+		for _, oldHost := range oldNetwork.Group.ListHosts() {
+			host := network.Group.findHostByName(oldHost.Name)
+			if host != nil {
+				// Keep what is not specified in the topology.
+				if host.AgentPort == 0 {
+					host.AgentPort = oldHost.AgentPort
+				}
+				if host.Tags == nil {
+					host.Tags = oldHost.Tags
+				}
+				if host.K8SInfo == nil {
+					host.K8SInfo = oldHost.K8SInfo
+				}
+				host.Cordoned = oldHost.Cordoned
+				continue
+			}
+			host = &Host{}
+			*host = *oldHost
+			host.group = nil
+			added, err := network.Group.addHost(host)
+			if err != nil {
+				return err
+			}
+			if added {
+				log.Infof("Host %s re-parented into group %s of network %s", host.Name, host.group.Name, name)
+			} else {
+				log.Infof("Host %s does not fit into new topology of network %s", host.Name, name)
+			}
+		}
+
+		groupBlocks := make(map[*Group][]allocatedBlock)
+		groups := make([]*Group, 0)
+		for _, ab := range blocks {
+			host := network.Group.findHostByName(ab.host)
+			if host == nil {
+				orphan(ab, "host not in new topology")
+				continue
+			}
+			group := host.group
+			if !group.CIDR.Contains(ab.block.CIDR) {
+				orphan(ab, "not within CIDR %s of new group of host", group.CIDR)
+				continue
+			}
+			blockHostMask := hostMask(network.CIDR.bits() - ab.block.mask())
+			if (ab.block.CIDR.StartIPInt-group.CIDR.StartIPInt)&blockHostMask != 0 {
+				orphan(ab, "not aligned with blocks of new group %s of host", group.CIDR)
+				continue
+			}
+			if _, ok := groupBlocks[group]; !ok {
+				groups = append(groups, group)
+			}
+			groupBlocks[group] = append(groupBlocks[group], ab)
+		}
+		for _, group := range groups {
+			err := group.adoptBlocks(network, groupBlocks[group])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(orphans) > 0 {
+		return common.NewError("Topology update would orphan %d allocated block(s): %s", len(orphans), strings.Join(orphans, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/romana/core/common/log/trace"
+	log "github.com/romana/rlog"
+)
+
+const (
+	// How many times a change of IPAM is attempted
+	// before giving up because of conflicting changes.
+	updateMaxAttempts = 10
+	// Backoff before the second attempt, doubled
+	// on every further one up to updateMaxBackoff.
+	updateInitialBackoff = 10 * time.Millisecond
+	updateMaxBackoff     = time.Second
+)
+
+// updateSleep is used to back off, and can be overridden by tests.
+var updateSleep = time.Sleep
+
+// update changes IPAM with optimistic concurrency: the latest IPAM is
+// loaded, changed by fn, and saved provided no one else saved the parts
+// of it fn changed in the meantime (see saveIPAM). Otherwise, it is
+// retried with backoff.
+// fn returns whether it changed IPAM; if not, nothing is saved. As fn may
+// be called more than once, it must not have effects outside of the
+// IPAM it is given.
+//
+// The locker of IPAM only serializes changes within this process, so
+// that they do not needlessly conflict with one another.
+func (ipam *IPAM) update(fn func(latestIPAM *IPAM) (bool, error)) error {
+	backoff := updateInitialBackoff
+	for attempt := 1; ; attempt++ {
+		saved, err := ipam.tryUpdate(fn)
+		switch {
+		case err == nil:
+			if saved {
+				IPAMWrites.WithLabelValues("saved").Inc()
+				IPAMWriteAttempts.Observe(float64(attempt))
+			}
+			return nil
+		case err != ErrModified:
+			IPAMWrites.WithLabelValues("failed").Inc()
+			return err
+		case attempt >= updateMaxAttempts:
+			IPAMWrites.WithLabelValues("failed").Inc()
+			log.Errorf("Giving up changing IPAM after %d conflicting attempts", attempt)
+			return err
+		}
+		IPAMWrites.WithLabelValues("conflict").Inc()
+		// Jitter keeps conflicting writers from retrying in lockstep.
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		log.Debugf("IPAM was changed concurrently, retrying in %s (attempt %d)", sleep, attempt)
+		IPAMWriteBackoffSeconds.Add(sleep.Seconds())
+		updateSleep(sleep)
+		backoff *= 2
+		if backoff > updateMaxBackoff {
+			backoff = updateMaxBackoff
+		}
+	}
+}
+
+// tryUpdate makes a single attempt of update, and returns
+// whether anything was saved.
+func (ipam *IPAM) tryUpdate(fn func(latestIPAM *IPAM) (bool, error)) (bool, error) {
+	ch, err := ipam.locker.Lock()
+	if err != nil {
+		return false, err
+	}
+	defer ipam.locker.Unlock()
+
+	latestIPAM := &IPAM{}
+	err = ipam.load(latestIPAM, ch)
+	if err != nil {
+		return false, err
+	}
+	changed, err := fn(latestIPAM)
+	if err != nil || !changed {
+		return false, err
+	}
+	err = ipam.save(latestIPAM, ch)
+	if err != nil {
+		return false, err
+	}
+	log.Tracef(trace.Inside, "Saved IPAM at allocation revision %d, topology revision %d", latestIPAM.AllocationRevision, latestIPAM.TopologyRevision)
+	return true, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUpdateRetriesOnConflict(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/16","block_mask":28}],
+  "topologies":[{"networks":["net1"],"map":[
+    {"groups":[{"name":"host1","ip":"192.168.99.10"}]}
+  ]}]
+}`)
+	sleeps := 0
+	updateSleep = func(time.Duration) { sleeps++ }
+	defer func() { updateSleep = time.Sleep }()
+
+	// Fails with a conflict the given number of times, then saves.
+	conflicts := 0
+	saveWithConflicts := func(n int) {
+		conflicts = 0
+		ipam.save = func(latestIPAM *IPAM, ch <-chan struct{}) error {
+			if conflicts < n {
+				conflicts++
+				return ErrModified
+			}
+			return testSaver.save(latestIPAM, ch)
+		}
+	}
+
+	saveWithConflicts(3)
+	calls := 0
+	_, err := ipam.AllocateIP("a1", "host1", "ten1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflicts != 3 || sleeps != 3 {
+		t.Fatalf("Expected 3 conflicts and backoffs, got %d and %d", conflicts, sleeps)
+	}
+	ipam.load(ipam, nil)
+	if ipam.AddressNameToIP["a1"] == nil {
+		t.Fatalf("Expected a1 to be allocated after retries")
+	}
+
+	// Give up after too many conflicts.
+	saveWithConflicts(updateMaxAttempts)
+	err = ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		calls++
+		return true, nil
+	})
+	if err != ErrModified {
+		t.Fatalf("Expected %v, got %v", ErrModified, err)
+	}
+	if calls != updateMaxAttempts {
+		t.Fatalf("Expected %d attempts, got %d", updateMaxAttempts, calls)
+	}
+
+	// Other errors are not retried.
+	saveWithConflicts(0)
+	calls = 0
+	fnErr := errors.New("no luck")
+	err = ipam.update(func(latestIPAM *IPAM) (bool, error) {
+		calls++
+		return false, fnErr
+	})
+	if err != fnErr || calls != 1 {
+		t.Fatalf("Expected %v after 1 attempt, got %v after %d", fnErr, err, calls)
+	}
+}
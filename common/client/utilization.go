@@ -0,0 +1,275 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"sort"
+
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/client/idring"
+)
+
+// size returns the number of addresses in the CIDR.
+func (c CIDR) size() uint64 {
+	return c.EndIPInt - c.StartIPInt + 1
+}
+
+// overlap returns the number of addresses the CIDRs have in common.
+func (c CIDR) overlap(c2 CIDR) uint64 {
+	if c.IsIPv6() != c2.IsIPv6() {
+		return 0
+	}
+	start, end := c.StartIPInt, c.EndIPInt
+	if c2.StartIPInt > start {
+		start = c2.StartIPInt
+	}
+	if c2.EndIPInt < end {
+		end = c2.EndIPInt
+	}
+	if start > end {
+		return 0
+	}
+	return end - start + 1
+}
+
+// blackedOutCount returns the number of addresses of the CIDR
+// that are blacked out in the network.
+func (network *Network) blackedOutCount(cidr CIDR) uint64 {
+	count := uint64(0)
+	for _, blackedOut := range network.BlackedOut {
+		count += cidr.overlap(blackedOut)
+	}
+	return count
+}
+
+// usageCounter accumulates utilization of blocks.
+type usageCounter struct {
+	usage api.IPAMUsage
+	// Addresses in owned blocks, and of those, ones that are
+	// allocated, blacked out or reserved.
+	owned     uint64
+	ownedUsed uint64
+}
+
+func (uc *usageCounter) addBlock(network *Network, block *Block, owned bool, reusable bool) {
+	allocated := uint64(block.allocatedCount())
+	blackedOut := network.blackedOutCount(block.CIDR)
+	uc.usage.Blocks++
+	uc.usage.Allocated += allocated
+	if reusable {
+		uc.usage.Reusable += block.CIDR.size()
+	}
+	if owned {
+		uc.owned += block.CIDR.size()
+		uc.ownedUsed += allocated + blackedOut + network.freeReservedCount(block)
+	}
+}
+
+// freeReservedCount returns the number of free addresses of the block
+// reserved by the network's policy that are not blacked out, as those
+// are counted already.
+func (network *Network) freeReservedCount(block *Block) uint64 {
+	if network.Reserved == nil {
+		return 0
+	}
+	// Addresses reserved first and last are counted by range, as
+	// there may be many of them.
+	edges := []idring.Range{{Min: block.CIDR.StartIPInt, Max: block.CIDR.EndIPInt}}
+	if min, max, ok := network.allocatableIDs(block); ok {
+		edges = edges[:0]
+		if min > block.CIDR.StartIPInt {
+			edges = append(edges, idring.Range{Min: block.CIDR.StartIPInt, Max: min - 1})
+		}
+		if max < block.CIDR.EndIPInt {
+			edges = append(edges, idring.Range{Min: max + 1, Max: block.CIDR.EndIPInt})
+		}
+	}
+	count := uint64(0)
+	for _, edge := range edges {
+		for _, r := range block.freeRanges(edge.Min, edge.Max) {
+			free := CIDR{IPNet: block.CIDR.IPNet, StartIPInt: r.Min, EndIPInt: r.Max}
+			count += free.size() - network.blackedOutCount(free)
+		}
+	}
+	for _, id := range network.reservedIDs(block) {
+		if block.isFree(id) && network.blackedOutBy(block.CIDR.intToIP(id)) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+func (uc *usageCounter) add(uc2 *usageCounter) {
+	uc.usage.Blocks += uc2.usage.Blocks
+	uc.usage.Allocated += uc2.usage.Allocated
+	uc.usage.Reusable += uc2.usage.Reusable
+	uc.usage.FreeBlockSlots += uc2.usage.FreeBlockSlots
+	uc.owned += uc2.owned
+	uc.ownedUsed += uc2.ownedUsed
+}
+
+func (uc *usageCounter) get() api.IPAMUsage {
+	usage := uc.usage
+	if uc.owned > 0 {
+		usage.Fragmentation = float64(uc.owned-uc.ownedUsed) / float64(uc.owned)
+	}
+	return usage
+}
+
+// freeBlockSlots returns the number of reusable blocks of the group
+// holding hosts, and of blocks of the network's block mask that can
+// still be carved out of the gaps between its blocks.
+func (hg *Group) freeBlockSlots(network *Network) int {
+	slots := len(hg.ReusableBlocks)
+	blockHostMask := hostMask(network.CIDR.bits() - network.BlockMask)
+	blockSize := blockHostMask + 1
+	if blockSize == 0 {
+		return slots
+	}
+	blocks := make([]*Block, len(hg.Blocks))
+	copy(blocks, hg.Blocks)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].CIDR.StartIPInt < blocks[j].CIDR.StartIPInt
+	})
+	// countGap counts aligned slots between start and end, inclusive.
+	countGap := func(start uint64, end uint64) {
+		offset := start - hg.CIDR.StartIPInt
+		if offset&blockHostMask != 0 {
+			offset = (offset | blockHostMask) + 1
+		}
+		start = hg.CIDR.StartIPInt + offset
+		if start < hg.CIDR.StartIPInt || start > end || end-start+1 < blockSize {
+			return
+		}
+		slots += int((end - start + 1) / blockSize)
+	}
+	next := hg.CIDR.StartIPInt
+	for _, block := range blocks {
+		if block.CIDR.StartIPInt > next {
+			countGap(next, block.CIDR.StartIPInt-1)
+		}
+		if block.CIDR.EndIPInt >= hg.CIDR.EndIPInt {
+			return slots
+		}
+		if block.CIDR.EndIPInt+1 > next {
+			next = block.CIDR.EndIPInt + 1
+		}
+	}
+	countGap(next, hg.CIDR.EndIPInt)
+	return slots
+}
+
+// utilization returns utilization of this group, adding utilization of
+// it and its subgroups to groups, and of hosts and tenants that have
+// blocks in it to hosts and tenants.
+func (hg *Group) utilization(network *Network, groups *[]api.IPAMUsage, hosts map[string]*usageCounter, tenants map[string]*usageCounter) *usageCounter {
+	uc := &usageCounter{usage: api.IPAMUsage{
+		Name:       hg.Name,
+		Network:    network.Name,
+		CIDR:       hg.CIDR.String(),
+		Total:      hg.CIDR.size(),
+		BlackedOut: network.blackedOutCount(hg.CIDR),
+	}}
+	// Parent groups are listed before their subgroups.
+	groupIdx := len(*groups)
+	*groups = append(*groups, api.IPAMUsage{})
+	if hg.Hosts != nil {
+		reusable := make(map[int]bool)
+		for _, blockID := range hg.ReusableBlocks {
+			reusable[blockID] = true
+		}
+		for blockID, block := range hg.Blocks {
+			owner, owned := hg.BlockToOwner[blockID]
+			uc.addBlock(network, block, owned, reusable[blockID])
+			if !owned {
+				continue
+			}
+			if host, ok := hg.BlockToHost[blockID]; ok {
+				if hosts[host] == nil {
+					hosts[host] = &usageCounter{usage: api.IPAMUsage{Name: host, Network: network.Name}}
+				}
+				hosts[host].addBlock(network, block, true, false)
+				hosts[host].usage.Total += block.CIDR.size()
+				hosts[host].usage.BlackedOut += network.blackedOutCount(block.CIDR)
+			}
+			tenant, _ := parseOwner(owner)
+			if tenants[tenant] == nil {
+				tenants[tenant] = &usageCounter{usage: api.IPAMUsage{Name: tenant, Network: network.Name}}
+			}
+			tenants[tenant].addBlock(network, block, true, false)
+			tenants[tenant].usage.Total += block.CIDR.size()
+			tenants[tenant].usage.BlackedOut += network.blackedOutCount(block.CIDR)
+		}
+		uc.usage.FreeBlockSlots = hg.freeBlockSlots(network)
+	} else {
+		for _, group := range hg.Groups {
+			uc.add(group.utilization(network, groups, hosts, tenants))
+		}
+	}
+	(*groups)[groupIdx] = uc.get()
+	return uc
+}
+
+// Utilization returns utilization of addresses per network, per
+// topology group, and per host and tenant in each network.
+func (ipam *IPAM) Utilization() api.IPAMUtilization {
+	util := api.IPAMUtilization{
+		Networks: make([]api.IPAMUsage, 0),
+		Groups:   make([]api.IPAMUsage, 0),
+		Hosts:    make([]api.IPAMUsage, 0),
+		Tenants:  make([]api.IPAMUsage, 0),
+	}
+	for _, netName := range ipam.sortedNetworkNames() {
+		network := ipam.Networks[netName]
+		netUsage := api.IPAMUsage{
+			Name:       network.Name,
+			CIDR:       network.CIDR.String(),
+			Total:      network.CIDR.size(),
+			BlackedOut: network.blackedOutCount(network.CIDR),
+		}
+		if network.Group == nil {
+			util.Networks = append(util.Networks, netUsage)
+			continue
+		}
+		hosts := make(map[string]*usageCounter)
+		tenants := make(map[string]*usageCounter)
+		groups := make([]api.IPAMUsage, 0)
+		uc := network.Group.utilization(network, &groups, hosts, tenants)
+		uc.usage.Name = netUsage.Name
+		uc.usage.Network = ""
+		uc.usage.CIDR = netUsage.CIDR
+		uc.usage.Total = netUsage.Total
+		uc.usage.BlackedOut = netUsage.BlackedOut
+		util.Networks = append(util.Networks, uc.get())
+		util.Groups = append(util.Groups, groups...)
+		util.Hosts = append(util.Hosts, sortedUsage(hosts)...)
+		util.Tenants = append(util.Tenants, sortedUsage(tenants)...)
+	}
+	return util
+}
+
+func sortedUsage(counters map[string]*usageCounter) []api.IPAMUsage {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	retval := make([]api.IPAMUsage, len(names))
+	for i, name := range names {
+		retval[i] = counters[name].get()
+	}
+	return retval
+}
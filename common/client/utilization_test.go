@@ -0,0 +1,73 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUtilization(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/28","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"}
+  ]}]}]
+}`)
+	for i := 1; i <= 5; i++ {
+		_, err := ipam.AllocateIP(fmt.Sprintf("a%d", i), "host1", "ten1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := ipam.AllocateIP("b1", "host1", "ten2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.DeallocateIP("b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ipam.load(ipam, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util := ipam.Utilization()
+	t.Logf("Utilization: %+v", util)
+	if len(util.Networks) != 1 {
+		t.Fatalf("Expected 1 network, got %d", len(util.Networks))
+	}
+	net1 := util.Networks[0]
+	if net1.Total != 16 || net1.Allocated != 5 || net1.Reusable != 4 {
+		t.Fatalf("Expected 16 total, 5 allocated, 4 reusable addresses, got %d, %d, %d",
+			net1.Total, net1.Allocated, net1.Reusable)
+	}
+	if net1.Blocks != 3 || net1.FreeBlockSlots != 2 {
+		t.Fatalf("Expected 3 blocks and 2 free block slots, got %d and %d",
+			net1.Blocks, net1.FreeBlockSlots)
+	}
+	// Blocks of ten1 have 8 addresses, of which 5 are allocated.
+	if net1.Fragmentation != 0.375 {
+		t.Fatalf("Expected fragmentation of 0.375, got %f", net1.Fragmentation)
+	}
+	if len(util.Hosts) != 1 || util.Hosts[0].Name != "host1" || util.Hosts[0].Allocated != 5 {
+		t.Fatalf("Expected 5 addresses allocated on host1, got %+v", util.Hosts)
+	}
+	if len(util.Tenants) != 1 || util.Tenants[0].Name != "ten1" || util.Tenants[0].Total != 8 {
+		t.Fatalf("Expected 8 addresses in blocks of ten1, got %+v", util.Tenants)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+)
+
+// addressNames returns the map of allocated addresses
+// to the names they were allocated for.
+func (ipam *IPAM) addressNames() map[string]string {
+	names := make(map[string]string, len(ipam.AddressNameToIP)+len(ipam.AddressNameToIPv6))
+	for name, ip := range ipam.AddressNameToIP {
+		names[ip.String()] = name
+	}
+	for name, ip := range ipam.AddressNameToIPv6 {
+		names[ip.String()] = name
+	}
+	return names
+}
+
+// addressInfo describes who holds the IP.
+func (ipam *IPAM) addressInfo(ip net.IP, names map[string]string) api.IPAMAddressInfo {
+	info := api.IPAMAddressInfo{IP: ip, Name: names[ip.String()]}
+	for _, netName := range ipam.sortedNetworkNames() {
+		network := ipam.Networks[netName]
+		if network.Group != nil && info.Host == "" {
+			if host := network.Group.findHostByIP(ip.String()); host != nil {
+				info.Host = host.Name
+				info.HostAddress = true
+			}
+		}
+		if !network.CIDR.IPNet.Contains(ip) {
+			continue
+		}
+		info.Network = network.Name
+		if cidr := network.blackedOutBy(ip); cidr != nil {
+			info.BlackedOutBy = cidr.String()
+		}
+	}
+	group, blockID := ipam.findBlock(ip)
+	if group == nil {
+		return info
+	}
+	block := group.Blocks[blockID]
+	info.Block = block.CIDR.String()
+	info.Allocated = block.isAllocated(ip)
+	if !info.HostAddress {
+		info.Host = group.BlockToHost[blockID]
+	}
+	if owner, ok := group.BlockToOwner[blockID]; ok {
+		info.Tenant, info.Segment = parseOwner(owner)
+	}
+	return info
+}
+
+// Whois describes who holds the address given as query. If query is
+// a CIDR, all allocated addresses in it are described.
+func (ipam *IPAM) Whois(query string) ([]api.IPAMAddressInfo, error) {
+	names := ipam.addressNames()
+	if !strings.Contains(query, "/") {
+		ip := net.ParseIP(query)
+		if ip == nil {
+			return nil, common.NewError400(fmt.Sprintf("Invalid IP address %s", query))
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return []api.IPAMAddressInfo{ipam.addressInfo(ip, names)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(query)
+	if err != nil {
+		return nil, common.NewError400(fmt.Sprintf("Invalid CIDR %s", query))
+	}
+	ips := make([]net.IP, 0)
+	for _, name := range ipam.sortedAddressNames() {
+		if ip := ipam.AddressNameToIP[name]; ipNet.Contains(ip) {
+			ips = append(ips, ip)
+		}
+		if ip, ok := ipam.AddressNameToIPv6[name]; ok && ipNet.Contains(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+	infos := make([]api.IPAMAddressInfo, len(ips))
+	for i, ip := range ips {
+		infos[i] = ipam.addressInfo(ip, names)
+	}
+	return infos, nil
+}
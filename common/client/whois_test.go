@@ -0,0 +1,88 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"testing"
+)
+
+func TestWhois(t *testing.T) {
+	ipam = initIpam(t, `{
+  "networks":[{"name":"net1","cidr":"10.0.0.0/28","block_mask":30}],
+  "topologies":[{"networks":["net1"],"map":[{"groups":[
+    {"name":"host1","ip":"192.168.99.10"}
+  ]}]}]
+}`)
+	_, err := ipam.AllocateIP("pod1", "host1", "ten1", "seg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ipam.AllocateIP("pod2", "host1", "ten1", "seg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.BlackOut("10.0.0.8/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipam.load(ipam, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := ipam.Whois("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := infos[0]
+	t.Logf("10.0.0.1: %+v", info)
+	if info.Name != "pod2" || !info.Allocated || info.Network != "net1" ||
+		info.Block != "10.0.0.0/30" || info.Host != "host1" ||
+		info.Tenant != "ten1" || info.Segment != "seg1" || info.BlackedOutBy != "" {
+		t.Fatalf("Unexpected owner of 10.0.0.1: %+v", info)
+	}
+
+	infos, err = ipam.Whois("10.0.0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = infos[0]
+	if info.Allocated || info.Block != "" || info.BlackedOutBy != "10.0.0.8/30" {
+		t.Fatalf("Expected 10.0.0.9 to be blacked out by 10.0.0.8/30, got %+v", info)
+	}
+
+	infos, err = ipam.Whois("192.168.99.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = infos[0]
+	if info.Host != "host1" || !info.HostAddress {
+		t.Fatalf("Expected 192.168.99.10 to be the address of host1, got %+v", info)
+	}
+
+	infos, err = ipam.Whois("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != "pod1" || infos[1].Name != "pod2" {
+		t.Fatalf("Expected pod1 and pod2 in 10.0.0.0/24, got %+v", infos)
+	}
+
+	_, err = ipam.Whois("10.0.0")
+	if err == nil {
+		t.Fatal("Expected error for invalid IP")
+	}
+}
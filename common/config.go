@@ -21,5 +21,22 @@ type Config struct {
 	EtcdEndpoints       []string
 	EtcdPrefix          string
 	InitialTopologyFile *string
-	Mock                bool
+	// If true, an in-memory store is used, unless StoreBackend
+	// says otherwise.
+	Mock bool
+	// Version of etcd API to use, 2 (default) or 3.
+	EtcdAPIVersion int
+	// Backend of the store: etcd (default), memory or bolt.
+	StoreBackend string
+	// File of the store, for bolt backend.
+	StoreFile string
+	// Client certificate and key, and CA bundle to verify etcd
+	// with. If any are set, etcd is connected to with TLS, and
+	// the files are reloaded when they change.
+	EtcdCertFile string
+	EtcdKeyFile  string
+	EtcdCAFile   string
+	// Credentials for etcd authentication, if enabled.
+	EtcdUsername string
+	EtcdPassword string
 }
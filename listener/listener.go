@@ -80,7 +80,7 @@ func (l *KubeListener) Name() string {
 
 func (l *KubeListener) loadConfig() error {
 	var err error
-	configPrefix := "/kubelistener/config/"
+	configPrefix := client.ListenerConfigPrefix
 
 	l.segmentLabelName, err = l.client.Store.GetString(configPrefix+"segmentLabelName", defaultSegmentLabelName)
 	if err != nil {
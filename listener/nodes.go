@@ -134,7 +134,7 @@ func (l *KubeListener) syncNodes() {
 			}
 		}
 		if !hostInK8S {
-			err = l.client.IPAM.RemoveHost(romanaHost)
+			err = l.client.IPAM.RemoveHost(romanaHost, true)
 			if err == nil {
 				log.Infof("Removed host %s from Romana", romanaHost)
 			} else {
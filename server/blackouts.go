@@ -0,0 +1,74 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/api/errors"
+	"github.com/romana/core/common/client"
+	log "github.com/romana/rlog"
+)
+
+// How often to look for expired blackouts.
+const blackoutExpiryInterval = time.Minute
+
+// liftExpiredBlackouts periodically lifts blackouts that expired.
+func (r *Romanad) liftExpiredBlackouts() {
+	ticker := time.NewTicker(blackoutExpiryInterval)
+	for range ticker.C {
+		_, err := r.client.IPAM.LiftExpiredBlackouts()
+		if err != nil {
+			log.Errorf("Error lifting expired blackouts: %s", err)
+		}
+	}
+}
+
+// listBlackouts returns blacked out CIDRs of all networks.
+func (r *Romanad) listBlackouts(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return r.client.IPAM.ListBlackouts(), nil
+}
+
+// addBlackout blacks out a CIDR.
+func (r *Romanad) addBlackout(input interface{}, ctx common.RestContext) (interface{}, error) {
+	req, ok := input.(*api.IPAMBlackout)
+	if !ok || req.CIDR == "" {
+		return nil, common.NewError400("CIDR required")
+	}
+	if req.Expires != nil && !req.Expires.After(time.Now()) {
+		return nil, common.NewError400("Expiry must be in the future")
+	}
+	blackout := client.Blackout{
+		Reason:  req.Reason,
+		Creator: req.Creator,
+		Expires: req.Expires,
+	}
+	err := r.client.IPAM.AddBlackout(req.CIDR, blackout)
+	return nil, errors.RomanaErrorToHTTPError(err)
+}
+
+// removeBlackout lifts the blackout of the CIDR given
+// as the cidr query parameter.
+func (r *Romanad) removeBlackout(input interface{}, ctx common.RestContext) (interface{}, error) {
+	cidr := ctx.QueryVariables.Get("cidr")
+	if cidr == "" {
+		return nil, common.NewError400("CIDR required")
+	}
+	err := r.client.IPAM.UnBlackOut(cidr)
+	return nil, errors.RomanaErrorToHTTPError(err)
+}
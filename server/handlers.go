@@ -16,6 +16,7 @@
 package server
 
 import (
+	"net"
 	"strings"
 
 	"github.com/romana/core/common"
@@ -33,6 +34,24 @@ func (r *Romanad) deallocateIP(input interface{}, ctx common.RestContext) (inter
 	return nil, errors.RomanaErrorToHTTPError(err)
 }
 
+// whois describes who holds the address, or the allocated
+// addresses in the CIDR, given as the ip query parameter.
+func (r *Romanad) whois(input interface{}, ctx common.RestContext) (interface{}, error) {
+	query := ctx.QueryVariables.Get("ip")
+	if query == "" {
+		return nil, common.NewError400("IP or CIDR required")
+	}
+	infos, err := r.client.IPAM.Whois(query)
+	if err != nil {
+		return nil, errors.RomanaErrorToHTTPError(err)
+	}
+	return infos, nil
+}
+
+// allocateIP allocates an address, or a dual-stack pair in networks
+// that have both. The address is returned by itself, unless the request
+// asks for the dual-stack response, which has the IPv6 address of the
+// pair too.
 func (r *Romanad) allocateIP(input interface{}, ctx common.RestContext) (interface{}, error) {
 	req := input.(*api.IPAMAddressRequest)
 	if req.Name == "" {
@@ -41,8 +60,50 @@ func (r *Romanad) allocateIP(input interface{}, ctx common.RestContext) (interfa
 	if req.Host == "" {
 		return nil, common.NewError400("Host required")
 	}
-	retval, err := r.client.IPAM.AllocateIP(req.Name, req.Host, req.Tenant, req.Segment)
-	return retval, errors.RomanaErrorToHTTPError(err)
+	var ip, ipv6 net.IP
+	var err error
+	if req.IP != nil {
+		ip = req.IP
+		err = r.client.IPAM.AllocateSpecificIP(req.Name, req.IP, req.Host, req.Tenant, req.Segment)
+	} else {
+		ip, ipv6, err = r.client.IPAM.AllocateDualStackIP(req.Name, req.Host, req.Tenant, req.Segment)
+	}
+	if err != nil {
+		return nil, errors.RomanaErrorToHTTPError(err)
+	}
+	if ip == nil {
+		// Only an IPv6 address was allocated.
+		ip, ipv6 = ipv6, nil
+	}
+	if !req.DualStack {
+		return ip, nil
+	}
+	return api.IPAMAddressResponse{Name: req.Name, IP: ip, IPv6: ipv6}, nil
+}
+
+// allocateIPs allocates addresses for all the names requested
+// in a single save.
+func (r *Romanad) allocateIPs(input interface{}, ctx common.RestContext) (interface{}, error) {
+	req := input.(*api.IPAMBatchAddressRequest)
+	if req.Host == "" {
+		return nil, common.NewError400("Host required")
+	}
+	addresses, err := r.client.IPAM.AllocateIPs(req.Names, req.Host, req.Tenant, req.Segment)
+	if err != nil {
+		return nil, errors.RomanaErrorToHTTPError(err)
+	}
+	return api.IPAMBatchAddressResponse{Addresses: addresses}, nil
+}
+
+// releaseIPs releases addresses requested by name or by selector
+// in a single save.
+func (r *Romanad) releaseIPs(input interface{}, ctx common.RestContext) (interface{}, error) {
+	req := input.(*api.IPAMBatchReleaseRequest)
+	addresses, err := r.client.IPAM.ReleaseIPs(*req)
+	if err != nil {
+		return nil, errors.RomanaErrorToHTTPError(err)
+	}
+	return api.IPAMBatchAddressResponse{Addresses: addresses}, nil
 }
 
 // listHosts returns all hosts.
@@ -63,21 +124,116 @@ func (r *Romanad) listNetworks(input interface{}, ctx common.RestContext) (inter
 	resp := make([]api.IPAMNetworkResponse, 0)
 	for _, network := range r.client.IPAM.Networks {
 		n := api.IPAMNetworkResponse{
-			CIDR:     api.IPNet{IPNet: *network.CIDR.IPNet},
-			Name:     network.Name,
-			Revision: network.Revison,
+			CIDR:             api.IPNet{IPNet: *network.CIDR.IPNet},
+			Name:             network.Name,
+			Revision:         network.Revison,
+			AddressSelection: network.AddressSelection,
+			BlockMask:        network.BlockMask,
+			TenantBlockMasks: network.TenantBlockMasks,
+			MinBlockMask:     network.MinBlockMask,
+			Reserved:         network.Reserved,
 		}
 		resp = append(resp, n)
 	}
 	return resp, nil
 }
 
-// updateTopology serves to update topology information in the Romana service
+// updateTopology replaces the topology. If query parameter "dry_run"
+// is true, nothing is changed, and the resulting topology and its
+// differences from the current one are returned instead.
 func (r *Romanad) updateTopology(input interface{}, ctx common.RestContext) (interface{}, error) {
 	topoReq := input.(*api.TopologyUpdateRequest)
+	dryRun := false
+	if dryRunStr := ctx.QueryVariables.Get("dry_run"); dryRunStr != "" {
+		var err error
+		dryRun, err = common.ToBool(dryRunStr)
+		if err != nil {
+			return nil, common.NewError400(err.Error())
+		}
+	}
+	if dryRun {
+		plan, err := r.client.IPAM.PlanTopology(*topoReq)
+		if err != nil {
+			return nil, errors.RomanaErrorToHTTPError(err)
+		}
+		return plan, nil
+	}
 	return nil, r.client.IPAM.UpdateTopology(*topoReq, true)
 }
 
+// getSnapshot returns a snapshot of the entire IPAM state.
+func (r *Romanad) getSnapshot(input interface{}, ctx common.RestContext) (interface{}, error) {
+	snapshot, err := r.client.IPAM.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// restoreSnapshot replaces IPAM state with the provided snapshot.
+// If any addresses are currently allocated, query parameter "confirm"
+// must be set to true.
+func (r *Romanad) restoreSnapshot(input interface{}, ctx common.RestContext) (interface{}, error) {
+	snapshot, ok := input.(*api.IPAMSnapshot)
+	if !ok {
+		return nil, common.NewError400("Snapshot required")
+	}
+	confirm := false
+	if confirmStr := ctx.QueryVariables.Get("confirm"); confirmStr != "" {
+		var err error
+		confirm, err = common.ToBool(confirmStr)
+		if err != nil {
+			return nil, common.NewError400(err.Error())
+		}
+	}
+	err := r.client.IPAM.Restore(*snapshot, confirm)
+	return nil, errors.RomanaErrorToHTTPError(err)
+}
+
+// checkIPAM verifies consistency of IPAM state.
+func (r *Romanad) checkIPAM(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return r.client.IPAM.Check(false)
+}
+
+// repairIPAM verifies consistency of IPAM state, and repairs
+// the violations that can be safely repaired.
+func (r *Romanad) repairIPAM(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return r.client.IPAM.Check(true)
+}
+
+// migrate runs migrations pending for data in the store, or, with
+// query parameter "dry_run", only shows what they would change.
+func (r *Romanad) migrate(input interface{}, ctx common.RestContext) (interface{}, error) {
+	dryRun := false
+	if dryRunStr := ctx.QueryVariables.Get("dry_run"); dryRunStr != "" {
+		var err error
+		dryRun, err = common.ToBool(dryRunStr)
+		if err != nil {
+			return nil, common.NewError400(err.Error())
+		}
+	}
+	return r.client.Migrate(dryRun)
+}
+
+// listQuotas returns quotas of tenants and segments, with their usage.
+func (r *Romanad) listQuotas(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return r.client.IPAM.ListQuotas(), nil
+}
+
+// setQuota sets quota of a tenant or of a segment. A quota with
+// no limits removes it.
+func (r *Romanad) setQuota(input interface{}, ctx common.RestContext) (interface{}, error) {
+	quota, ok := input.(*api.IPAMQuota)
+	if !ok {
+		return nil, common.NewError400("Quota required")
+	}
+	err := r.client.IPAM.SetQuota(quota.Tenant, quota.Segment, client.Quota{
+		MaxIPs:    quota.MaxIPs,
+		MaxBlocks: quota.MaxBlocks,
+	})
+	return nil, errors.RomanaErrorToHTTPError(err)
+}
+
 // getPolicy is a handler for the /policy/{name} URL that
 // returns the policy.
 func (r *Romanad) getPolicy(input interface{}, ctx common.RestContext) (interface{}, error) {
@@ -0,0 +1,76 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/client"
+)
+
+func TestAllocateIPResponse(t *testing.T) {
+	c, err := client.NewClient(&common.Config{EtcdPrefix: "/romana", Mock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Store.Close()
+	req := api.TopologyUpdateRequest{}
+	err = json.Unmarshal([]byte(`{
+  "networks":[{"name":"net4","cidr":"10.0.0.0/16","block_mask":29},
+    {"name":"net6","cidr":"2001:db8::/64","block_mask":125}],
+  "topologies":[{"networks":["net4","net6"],"map":[
+    {"groups":[{"name":"host1","ip":"192.168.99.10","ipv6":"2001:db8:1::10"}]}
+  ]}]
+}`), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.IPAM.UpdateTopology(req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Romanad{client: c}
+
+	// Just the address, as before dual-stack networks.
+	resp, err := r.allocateIP(&api.IPAMAddressRequest{Name: "a1", Host: "host1", Tenant: "ten1"}, common.RestContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(resp)
+	if string(b) != `"10.0.0.0"` {
+		t.Fatalf("Expected the address, got %s", b)
+	}
+	resp, err = r.allocateIP(&api.IPAMAddressRequest{Name: "a2", Host: "host1", Tenant: "ten1", IP: net.ParseIP("10.0.0.5")}, common.RestContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = json.Marshal(resp)
+	if string(b) != `"10.0.0.5"` {
+		t.Fatalf("Expected the address, got %s", b)
+	}
+
+	resp, err = r.allocateIP(&api.IPAMAddressRequest{Name: "a3", Host: "host1", Tenant: "ten1", DualStack: true}, common.RestContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = json.Marshal(resp)
+	if string(b) != `{"id":"a3","ip":"10.0.0.1","ipv6":"2001:db8::1"}` {
+		t.Fatalf("Expected the dual-stack pair, got %s", b)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/api/errors"
+)
+
+// cordonHost stops new blocks from being assigned to the host.
+func (r *Romanad) cordonHost(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := r.client.IPAM.CordonHost(ctx.PathVariables["name"], true)
+	return nil, errors.RomanaErrorToHTTPError(err)
+}
+
+// uncordonHost allows new blocks to be assigned to the host again.
+func (r *Romanad) uncordonHost(input interface{}, ctx common.RestContext) (interface{}, error) {
+	err := r.client.IPAM.CordonHost(ctx.PathVariables["name"], false)
+	return nil, errors.RomanaErrorToHTTPError(err)
+}
+
+// drainHost cordons the host and reports addresses that
+// must be moved off it.
+func (r *Romanad) drainHost(input interface{}, ctx common.RestContext) (interface{}, error) {
+	resp, err := r.client.IPAM.DrainHost(ctx.PathVariables["name"])
+	if err != nil {
+		return nil, errors.RomanaErrorToHTTPError(err)
+	}
+	return resp, nil
+}
+
+// removeHost removes the host. If the host has allocated addresses,
+// the force query parameter must be true to release them.
+func (r *Romanad) removeHost(input interface{}, ctx common.RestContext) (interface{}, error) {
+	force := false
+	if forceStr := ctx.QueryVariables.Get("force"); forceStr != "" {
+		var err error
+		force, err = common.ToBool(forceStr)
+		if err != nil {
+			return nil, common.NewError400(err.Error())
+		}
+	}
+	err := r.client.IPAM.RemoveHost(api.Host{Name: ctx.PathVariables["name"]}, force)
+	return nil, errors.RomanaErrorToHTTPError(err)
+}
+
+// updateHost replaces attributes of the host with those given.
+func (r *Romanad) updateHost(input interface{}, ctx common.RestContext) (interface{}, error) {
+	host, err := r.client.IPAM.UpdateHost(ctx.PathVariables["name"], *input.(*api.Host), true)
+	if err != nil {
+		return nil, errors.RomanaErrorToHTTPError(err)
+	}
+	return host, nil
+}
+
+// patchHost updates the attributes of the host that are given.
+func (r *Romanad) patchHost(input interface{}, ctx common.RestContext) (interface{}, error) {
+	host, err := r.client.IPAM.UpdateHost(ctx.PathVariables["name"], *input.(*api.Host), false)
+	if err != nil {
+		return nil, errors.RomanaErrorToHTTPError(err)
+	}
+	return host, nil
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+	"github.com/romana/core/common/api/errors"
+	log "github.com/romana/rlog"
+)
+
+const (
+	// How often to look for stale leases.
+	leaseGCInterval = time.Minute
+	// How many of the most recently released leases to report.
+	leaseGCReportSize = 100
+	// How many addresses to release at most in one run, so that
+	// a renewal gone wrong cannot release all of them at once.
+	leaseGCMaxReleases = 100
+)
+
+// leaseGCReport keeps track of addresses recently released
+// because their leases were not renewed.
+type leaseGCReport struct {
+	sync.Mutex
+	lastRun  time.Time
+	released []api.IPAMAddressLease
+}
+
+func (r *leaseGCReport) add(released []api.IPAMAddressLease) {
+	r.Lock()
+	defer r.Unlock()
+	r.lastRun = time.Now()
+	r.released = append(r.released, released...)
+	if len(r.released) > leaseGCReportSize {
+		r.released = r.released[len(r.released)-leaseGCReportSize:]
+	}
+}
+
+func (r *leaseGCReport) get() api.IPAMLeaseGCResponse {
+	r.Lock()
+	defer r.Unlock()
+	released := make([]api.IPAMAddressLease, len(r.released))
+	copy(released, r.released)
+	return api.IPAMLeaseGCResponse{LastRun: r.lastRun, Released: released}
+}
+
+// releaseStaleLeases releases addresses whose leases were not renewed
+// within LeaseGracePeriod, up to leaseGCMaxReleases of them.
+func (r *Romanad) releaseStaleLeases() error {
+	NumLeaseGCRuns.Inc()
+	released, err := r.client.IPAM.ReleaseStaleLeases(r.LeaseGracePeriod, leaseGCMaxReleases)
+	if err != nil {
+		NumLeaseGCErrors.Inc()
+		return err
+	}
+	NumLeasesReleased.Add(float64(len(released)))
+	r.leaseGCReport.add(released)
+	return nil
+}
+
+// leaseGC periodically releases stale leases.
+func (r *Romanad) leaseGC() {
+	log.Infof("Releasing addresses whose leases are not renewed for %s", r.LeaseGracePeriod)
+	ticker := time.NewTicker(leaseGCInterval)
+	for range ticker.C {
+		err := r.releaseStaleLeases()
+		if err != nil {
+			log.Errorf("Error releasing stale leases: %s", err)
+		}
+	}
+}
+
+// listLeases returns leases of all allocated addresses.
+func (r *Romanad) listLeases(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return r.client.IPAM.ListLeases()
+}
+
+// renewLeases renews leases of addresses reported to be in use
+// on a host.
+func (r *Romanad) renewLeases(input interface{}, ctx common.RestContext) (interface{}, error) {
+	req := input.(*api.IPAMLeaseRenewRequest)
+	if req.Host == "" {
+		return nil, common.NewError400("Host required")
+	}
+	err := r.client.IPAM.RenewLeases(map[string][]string{req.Host: req.OwnerRefs})
+	return nil, errors.RomanaErrorToHTTPError(err)
+}
+
+// getLeaseGC reports addresses recently released because their
+// leases were not renewed.
+func (r *Romanad) getLeaseGC(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return r.leaseGCReport.get(), nil
+}
+
+// runLeaseGC releases stale leases immediately.
+func (r *Romanad) runLeaseGC(input interface{}, ctx common.RestContext) (interface{}, error) {
+	if r.LeaseGracePeriod <= 0 {
+		return nil, common.NewError400("Releasing of stale leases is disabled")
+	}
+	err := r.releaseStaleLeases()
+	if err != nil {
+		return nil, err
+	}
+	return r.leaseGCReport.get(), nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/romana/core/common/client"
+	log "github.com/romana/rlog"
+)
+
+var (
+	NumLeaseGCRuns = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "romana_ipam_lease_gc_runs_total",
+			Help: "Number of times stale address leases were looked for.",
+		},
+	)
+	NumLeasesReleased = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "romana_ipam_leases_released_total",
+			Help: "Number of addresses released because their leases were not renewed.",
+		},
+	)
+	NumLeaseGCErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "romana_ipam_lease_gc_errors_total",
+			Help: "Number of failed attempts to release stale address leases.",
+		},
+	)
+	IPAMAddresses = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "romana_ipam_addresses",
+			Help: "Number of addresses of a network, group, host or tenant by state (total, allocated, reusable, blacked_out).",
+		},
+		[]string{"scope", "network", "name", "state"},
+	)
+	IPAMFreeBlockSlots = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "romana_ipam_free_block_slots",
+			Help: "Number of blocks of a network or group that can still be given out.",
+		},
+		[]string{"scope", "network", "name"},
+	)
+	IPAMFragmentation = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "romana_ipam_fragmentation_ratio",
+			Help: "Share of addresses in owned blocks that are neither allocated nor blacked out.",
+		},
+		[]string{"scope", "network", "name"},
+	)
+	IPAMAllocationRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "romana_ipam_allocation_rate_per_hour",
+			Help: "Recent rate of allocation of addresses in a network.",
+		},
+		[]string{"network"},
+	)
+	IPAMExhaustionSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "romana_ipam_exhaustion_forecast_seconds",
+			Help: "Time until a network runs out of addresses at the recent allocation rate; absent if allocation is not growing.",
+		},
+		[]string{"network"},
+	)
+)
+
+// MetricStart starts publishing romanad metrics on the provided port.
+func MetricStart(port int) error {
+	if port <= 0 {
+		return nil
+	}
+
+	registry := prometheus.NewRegistry()
+	err := client.MetricsRegister(registry)
+	if err != nil {
+		return err
+	}
+	for _, c := range []prometheus.Collector{NumLeaseGCRuns, NumLeasesReleased, NumLeaseGCErrors,
+		IPAMAddresses, IPAMFreeBlockSlots, IPAMFragmentation, IPAMAllocationRate, IPAMExhaustionSeconds} {
+		err := registry.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorHandling: promhttp.HTTPErrorOnError})
+
+	go func() {
+		http.Handle("/", handler)
+		log.Errorf("Metrics publishing stopped due to %s", http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	}()
+
+	return nil
+}
@@ -16,14 +16,23 @@
 package server
 
 import (
+	"time"
+
 	"github.com/romana/core/common"
 	"github.com/romana/core/common/api"
 	"github.com/romana/core/common/client"
 )
 
 type Romanad struct {
-	Addr   string
-	client *client.Client
+	Addr string
+	// LeaseGracePeriod is how long an address lease may go without
+	// being renewed before the address is released. Zero disables
+	// releasing of stale addresses.
+	LeaseGracePeriod time.Duration
+
+	client             *client.Client
+	leaseGCReport      leaseGCReport
+	utilizationHistory utilizationHistory
 }
 
 func (r *Romanad) GetAddress() string {
@@ -40,6 +49,11 @@ func (r *Romanad) Initialize(clientConfig common.Config) error {
 	if err != nil {
 		return err
 	}
+	if r.LeaseGracePeriod > 0 {
+		go r.leaseGC()
+	}
+	go r.sampleUtilization()
+	go r.liftExpiredBlackouts()
 	return nil
 }
 
@@ -102,6 +116,23 @@ func (r *Romanad) Routes() common.Routes {
 			Pattern: "/address",
 			Handler: r.deallocateIP,
 		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/address",
+			Handler: r.whois,
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     "/address/batch",
+			Handler:     r.allocateIPs,
+			MakeMessage: func() interface{} { return &api.IPAMBatchAddressRequest{} },
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     "/address/batch/release",
+			Handler:     r.releaseIPs,
+			MakeMessage: func() interface{} { return &api.IPAMBatchReleaseRequest{} },
+		},
 		common.Route{
 			Method:  "GET",
 			Pattern: "/networks",
@@ -125,6 +156,117 @@ func (r *Romanad) Routes() common.Routes {
 			Handler:     r.addHost,
 			MakeMessage: func() interface{} { return &api.Host{} },
 		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: "/hosts/{name}",
+			Handler: r.removeHost,
+		},
+		common.Route{
+			Method:      "PUT",
+			Pattern:     "/hosts/{name}",
+			Handler:     r.updateHost,
+			MakeMessage: func() interface{} { return &api.Host{} },
+		},
+		common.Route{
+			Method:      "PATCH",
+			Pattern:     "/hosts/{name}",
+			Handler:     r.patchHost,
+			MakeMessage: func() interface{} { return &api.Host{} },
+		},
+		common.Route{
+			Method:  "POST",
+			Pattern: "/hosts/{name}/cordon",
+			Handler: r.cordonHost,
+		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: "/hosts/{name}/cordon",
+			Handler: r.uncordonHost,
+		},
+		common.Route{
+			Method:  "POST",
+			Pattern: "/hosts/{name}/drain",
+			Handler: r.drainHost,
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/blackouts",
+			Handler: r.listBlackouts,
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     "/blackouts",
+			Handler:     r.addBlackout,
+			MakeMessage: func() interface{} { return &api.IPAMBlackout{} },
+		},
+		common.Route{
+			Method:  "DELETE",
+			Pattern: "/blackouts",
+			Handler: r.removeBlackout,
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/ipam/snapshot",
+			Handler: r.getSnapshot,
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     "/ipam/snapshot",
+			Handler:     r.restoreSnapshot,
+			MakeMessage: func() interface{} { return &api.IPAMSnapshot{} },
+		},
+		common.Route{
+			Method:  "POST",
+			Pattern: "/migrations",
+			Handler: r.migrate,
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/ipam/check",
+			Handler: r.checkIPAM,
+		},
+		common.Route{
+			Method:  "POST",
+			Pattern: "/ipam/check",
+			Handler: r.repairIPAM,
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/quotas",
+			Handler: r.listQuotas,
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     "/quotas",
+			Handler:     r.setQuota,
+			MakeMessage: func() interface{} { return &api.IPAMQuota{} },
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/utilization",
+			Handler: r.getUtilization,
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/leases",
+			Handler: r.listLeases,
+		},
+		common.Route{
+			Method:      "POST",
+			Pattern:     "/leases",
+			Handler:     r.renewLeases,
+			MakeMessage: func() interface{} { return &api.IPAMLeaseRenewRequest{} },
+		},
+		common.Route{
+			Method:  "GET",
+			Pattern: "/leases/gc",
+			Handler: r.getLeaseGC,
+		},
+		common.Route{
+			Method:  "POST",
+			Pattern: "/leases/gc",
+			Handler: r.runLeaseGC,
+		},
 	}
 	return routes
 }
@@ -0,0 +1,154 @@
+// Copyright (c) 2017 Pani Networks
+// All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/romana/core/common"
+	"github.com/romana/core/common/api"
+)
+
+const (
+	// How often to sample utilization.
+	utilizationSampleInterval = time.Minute
+	// Allocation rate is computed over samples from this period.
+	utilizationForecastWindow = time.Hour
+)
+
+// utilizationSample is the number of allocated addresses
+// per network at some point in time.
+type utilizationSample struct {
+	time      time.Time
+	allocated map[string]uint64
+}
+
+// utilizationHistory keeps recent utilization samples
+// to forecast exhaustion of networks.
+type utilizationHistory struct {
+	sync.Mutex
+	samples []utilizationSample
+}
+
+// add records the utilization, and forgets samples
+// that are out of utilizationForecastWindow.
+func (h *utilizationHistory) add(now time.Time, util api.IPAMUtilization) {
+	h.Lock()
+	defer h.Unlock()
+	sample := utilizationSample{time: now, allocated: make(map[string]uint64)}
+	for _, usage := range util.Networks {
+		sample.allocated[usage.Name] = usage.Allocated
+	}
+	h.samples = append(h.samples, sample)
+	for len(h.samples) > 0 && now.Sub(h.samples[0].time) > utilizationForecastWindow {
+		h.samples = h.samples[1:]
+	}
+}
+
+// forecast sets allocation rate of each network of util based on the
+// oldest sample available for it, and, if allocation is growing, when
+// the network is expected to be exhausted.
+func (h *utilizationHistory) forecast(now time.Time, util *api.IPAMUtilization) {
+	h.Lock()
+	defer h.Unlock()
+	for i := range util.Networks {
+		usage := &util.Networks[i]
+		for _, sample := range h.samples {
+			allocated, ok := sample.allocated[usage.Name]
+			elapsed := now.Sub(sample.time).Hours()
+			if !ok || elapsed <= 0 {
+				continue
+			}
+			usage.AllocationRate = (float64(usage.Allocated) - float64(allocated)) / elapsed
+			break
+		}
+		if usage.AllocationRate <= 0 || usage.Allocated+usage.BlackedOut >= usage.Total {
+			continue
+		}
+		free := float64(usage.Total - usage.Allocated - usage.BlackedOut)
+		remaining := free / usage.AllocationRate * float64(time.Hour)
+		if remaining >= math.MaxInt64 {
+			continue
+		}
+		exhaustion := now.Add(time.Duration(remaining))
+		usage.ExhaustionForecast = &exhaustion
+	}
+}
+
+// utilization returns current utilization along with
+// the exhaustion forecast.
+func (r *Romanad) utilization() api.IPAMUtilization {
+	util := r.client.IPAM.Utilization()
+	r.utilizationHistory.forecast(time.Now(), &util)
+	return util
+}
+
+// sampleUtilization periodically records utilization
+// and publishes it as metrics.
+func (r *Romanad) sampleUtilization() {
+	ticker := time.NewTicker(utilizationSampleInterval)
+	for {
+		now := time.Now()
+		util := r.client.IPAM.Utilization()
+		r.utilizationHistory.add(now, util)
+		r.utilizationHistory.forecast(now, &util)
+		updateUtilizationMetrics(now, util)
+		<-ticker.C
+	}
+}
+
+// updateUtilizationMetrics sets utilization gauges.
+func updateUtilizationMetrics(now time.Time, util api.IPAMUtilization) {
+	IPAMAddresses.Reset()
+	IPAMFreeBlockSlots.Reset()
+	IPAMFragmentation.Reset()
+	IPAMAllocationRate.Reset()
+	IPAMExhaustionSeconds.Reset()
+	set := func(scope string, network string, name string, usage api.IPAMUsage) {
+		IPAMAddresses.WithLabelValues(scope, network, name, "total").Set(float64(usage.Total))
+		IPAMAddresses.WithLabelValues(scope, network, name, "allocated").Set(float64(usage.Allocated))
+		IPAMAddresses.WithLabelValues(scope, network, name, "reusable").Set(float64(usage.Reusable))
+		IPAMAddresses.WithLabelValues(scope, network, name, "blacked_out").Set(float64(usage.BlackedOut))
+		IPAMFragmentation.WithLabelValues(scope, network, name).Set(usage.Fragmentation)
+	}
+	for _, usage := range util.Networks {
+		set("network", usage.Name, usage.Name, usage)
+		IPAMFreeBlockSlots.WithLabelValues("network", usage.Name, usage.Name).Set(float64(usage.FreeBlockSlots))
+		IPAMAllocationRate.WithLabelValues(usage.Name).Set(usage.AllocationRate)
+		if usage.ExhaustionForecast != nil {
+			IPAMExhaustionSeconds.WithLabelValues(usage.Name).Set(usage.ExhaustionForecast.Sub(now).Seconds())
+		}
+	}
+	for _, usage := range util.Groups {
+		// Group names are optional, so groups are told apart by CIDR.
+		set("group", usage.Network, usage.CIDR, usage)
+		IPAMFreeBlockSlots.WithLabelValues("group", usage.Network, usage.CIDR).Set(float64(usage.FreeBlockSlots))
+	}
+	for _, usage := range util.Hosts {
+		set("host", usage.Network, usage.Name, usage)
+	}
+	for _, usage := range util.Tenants {
+		set("tenant", usage.Network, usage.Name, usage)
+	}
+}
+
+// getUtilization reports utilization of addresses per network,
+// group, host and tenant.
+func (r *Romanad) getUtilization(input interface{}, ctx common.RestContext) (interface{}, error) {
+	return r.utilization(), nil
+}
@@ -34,6 +34,8 @@ func main() {
 	var err error
 	endpointsStr := flag.String("etcd-endpoints", client.DefaultEtcdEndpoints, "Comma-separated list of etcd endpoints.")
 	prefix := flag.String("etcd-prefix", client.DefaultEtcdPrefix, "Prefix to use for etcd data.")
+	storeBackend := flag.String("store", client.StoreEtcd, "Store backend to use: etcd, memory or bolt.")
+	storeFile := flag.String("store-file", "", "File of the bolt store.")
 	flag.Parse()
 	if endpointsStr == nil {
 		log.Errorf("No etcd endpoints specified")
@@ -46,7 +48,9 @@ func main() {
 		pr = "/" + pr
 	}
 	config := common.Config{EtcdEndpoints: endpoints,
-		EtcdPrefix: pr,
+		EtcdPrefix:   pr,
+		StoreBackend: *storeBackend,
+		StoreFile:    *storeFile,
 	}
 	cl, err := client.NewClient(&config)
 	if err != nil {